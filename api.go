@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var errOutsideUploadDir = errors.New("path is outside the upload directory")
+
+// resolveUploadPath maps a client-supplied slash-separated path onto the
+// upload directory. It returns the cleaned relative name and the filesystem
+// path, and refuses anything that would escape the upload directory, follow
+// a symlink out of it, or reach into the state directory.
+func resolveUploadPath(uploadDir, name string) (rel, full string, err error) {
+	rel = strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(name, "\\", "/")), "/")
+	if rel == "" {
+		return "", uploadDir, nil
+	}
+	if first := strings.SplitN(rel, "/", 2)[0]; isStateDirName(first) {
+		return "", "", errOutsideUploadDir
+	}
+	full = filepath.Join(uploadDir, filepath.FromSlash(rel))
+
+	// Resolve symlinks on whatever part of the path already exists and make
+	// sure the result still lives under the upload directory.
+	root, err := filepath.EvalSymlinks(uploadDir)
+	if err != nil {
+		return "", "", err
+	}
+	existing := full
+	for {
+		real, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			if real != root && !strings.HasPrefix(real, root+string(filepath.Separator)) {
+				return "", "", errOutsideUploadDir
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return "", "", err
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+	return rel, full, nil
+}
+
+// writeJSON sends v as a JSON response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// serveDownload streams a stored file to the client as an attachment. Range
+// and conditional requests are handled by http.ServeContent.
+func serveDownload(w http.ResponseWriter, r *http.Request, store storage, name string) {
+	info, err := store.stat(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to open file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f, err := store.open(name)
+	if err != nil {
+		http.Error(w, "Failed to open file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	base := path.Base(name)
+	w.Header().Set("Content-Disposition", contentDisposition(base))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, base, info.ModTime, f)
+}
+
+// contentDisposition builds an attachment header that survives non-ASCII
+// file names.
+func contentDisposition(name string) string {
+	return disposition("attachment", name)
+}
+
+// disposition builds a Content-Disposition header of the given kind,
+// attachment or inline.
+func disposition(kind, name string) string {
+	ascii := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+	return kind + `; filename="` + ascii + `"; filename*=UTF-8''` + url.PathEscape(name)
+}
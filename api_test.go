@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveUploadPathRefusesStateDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(stateDir(dir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		".nostromo",
+		".nostromo/share.key",
+		"/.NOSTROMO/ssh_host_ed25519_key",
+		".Nostromo/share.key",
+		".NoStRoMo",
+		"docs/../.nostromo/quota.json",
+		`.NOSTROMO\share.key`,
+		".nostromo./share.key",
+		".nostromo /share.key",
+	} {
+		if _, _, err := resolveUploadPath(dir, name); err != errOutsideUploadDir {
+			t.Errorf("resolveUploadPath(%q) = %v", name, err)
+		}
+	}
+
+	for name, want := range map[string]string{
+		"docs/.nostromo":  "docs/.nostromo",
+		".nostromo-notes": ".nostromo-notes",
+		"a/b.txt":         "a/b.txt",
+	} {
+		rel, full, err := resolveUploadPath(dir, name)
+		if err != nil || rel != want || full != filepath.Join(dir, filepath.FromSlash(want)) {
+			t.Errorf("resolveUploadPath(%q) = %q, %q, %v", name, rel, full, err)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// archiveEntry is a stored file and the name it gets inside an archive.
+type archiveEntry struct {
+	file storedFile
+	name string
+}
+
+// handleArchive serves GET /api/archive?path=...&format=zip|tar.gz|tar.zst.
+// Each path may be a file or a folder and the parameter can be repeated;
+// with none the whole upload directory is archived. The archive is written
+// straight to the response as the files are read, so nothing is built on
+// disk first. Symlinks inside folders are left out, as they are everywhere
+// else in storage.
+func handleArchive(store storage, uploadDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "zip"
+		}
+		contentType := map[string]string{
+			"zip":     "application/zip",
+			"tar.gz":  "application/gzip",
+			"tar.zst": "application/zstd",
+		}[format]
+		if contentType == "" {
+			http.Error(w, "Unknown archive format "+format+": use zip, tar.gz or tar.zst", http.StatusBadRequest)
+			return
+		}
+
+		paths := r.URL.Query()["path"]
+		if len(paths) == 0 {
+			paths = []string{""}
+		}
+		var names []string
+		for _, p := range paths {
+			name, _, err := resolveUploadPath(uploadDir, p)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			names = append(names, name)
+		}
+		entries, err := archiveEntries(store, names)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				http.Error(w, "File not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Failed to list files: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		filename := "nostromo"
+		if len(names) == 1 && names[0] != "" {
+			filename = path.Base(names[0])
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", contentDisposition(filename+"."+format))
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		var werr error
+		switch format {
+		case "zip":
+			werr = writeZip(w, store, entries)
+		case "tar.gz":
+			gz := gzip.NewWriter(w)
+			if werr = writeTar(gz, store, entries); werr == nil {
+				werr = gz.Close()
+			}
+		case "tar.zst":
+			zw := newZstdWriter(w)
+			if werr = writeTar(zw, store, entries); werr == nil {
+				werr = zw.Close()
+			}
+		}
+		if werr != nil {
+			// The status has already been sent. Abort the connection so the
+			// client sees a failed download rather than a short archive.
+			log.Printf("Archive download for %s failed: %v", clientIP(r), werr)
+			panic(http.ErrAbortHandler)
+		}
+		log.Printf("Sent %s archive of %d files to %s", format, len(entries), clientIP(r))
+	}
+}
+
+// archiveEntries expands the selected names into the files to archive,
+// named relative to the folder that holds all of the selection.
+func archiveEntries(store storage, names []string) ([]archiveEntry, error) {
+	var base []string
+	seen := map[string]bool{}
+	var entries []archiveEntry
+	for i, name := range names {
+		var files []storedFile
+		f := storedFile{Name: name, IsDir: true}
+		if name != "" {
+			var err error
+			if f, err = store.stat(name); err != nil {
+				return nil, err
+			}
+		}
+		if f.IsDir {
+			prefix := name
+			if prefix != "" {
+				prefix += "/"
+			}
+			var err error
+			if files, err = store.list(prefix); err != nil {
+				return nil, err
+			}
+		} else {
+			files = []storedFile{f}
+		}
+		for _, file := range files {
+			if !seen[file.Name] {
+				seen[file.Name] = true
+				entries = append(entries, archiveEntry{file: file})
+			}
+		}
+
+		parent := strings.Split(path.Dir(name), "/")
+		if name == "" || path.Dir(name) == "." {
+			parent = nil
+		}
+		if i == 0 {
+			base = parent
+			continue
+		}
+		n := 0
+		for n < len(base) && n < len(parent) && base[n] == parent[n] {
+			n++
+		}
+		base = base[:n]
+	}
+
+	prefix := strings.Join(base, "/")
+	for i := range entries {
+		entries[i].name = entries[i].file.Name
+		if prefix != "" {
+			entries[i].name = strings.TrimPrefix(entries[i].name, prefix+"/")
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries, nil
+}
+
+// writeZip streams entries as a ZIP archive. archive/zip switches to ZIP64
+// records for files and archives past the 4GB limits.
+func writeZip(w io.Writer, store storage, entries []archiveEntry) error {
+	zw := zip.NewWriter(w)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate, Modified: e.file.ModTime}
+		hdr.SetMode(0644)
+		dst, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if err := copyStored(dst, store, e.file.Name, -1); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// writeTar streams entries as a tar archive. archive/tar uses PAX headers
+// for long names and files too large for the classic format.
+func writeTar(w io.Writer, store storage, entries []archiveEntry) error {
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     e.name,
+			Size:     e.file.Size,
+			Mode:     0644,
+			ModTime:  e.file.ModTime,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if err := copyStored(tw, store, e.file.Name, e.file.Size); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// copyStored copies the stored file name to dst: all of it, or exactly size
+// bytes when size is not negative, as tar needs to match its header.
+func copyStored(dst io.Writer, store storage, name string, size int64) error {
+	f, err := store.open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if size < 0 {
+		_, err = io.Copy(dst, f)
+	} else {
+		_, err = io.CopyN(dst, f, size)
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// auditEntry is one line of the audit log.
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Event  string    `json:"event"`
+	Path   string    `json:"path,omitempty"`
+	Client string    `json:"client,omitempty"`
+	Size   int64     `json:"size,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// auditLog appends a JSON line per event to a file, so what happened to
+// each upload can be reviewed later.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newAuditLog(path string) (*auditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return &auditLog{path: path}, nil
+}
+
+// record appends e to the log. Failures are logged rather than returned: the
+// audit trail must never be the reason an upload fails.
+func (a *auditLog) record(e auditEntry) {
+	if a == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := appendJSONLine(a.path, e); err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+	}
+}
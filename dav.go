@@ -0,0 +1,535 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// davPrefix is where the upload directory is mounted for WebDAV clients.
+const davPrefix = "/dav/"
+
+const (
+	davDefaultLockTimeout = time.Hour
+	davMaxLockTimeout     = 24 * time.Hour
+)
+
+// davLock is a write lock taken by a WebDAV client. Locks are kept in
+// memory only; clients refresh them and a restart simply drops them.
+type davLock struct {
+	token   string
+	name    string
+	deep    bool
+	owner   string
+	timeout time.Duration
+	expires time.Time
+}
+
+// davLocks tracks active locks by token.
+type davLocks struct {
+	mu    sync.Mutex
+	locks map[string]*davLock
+}
+
+// covers reports whether a write to name is affected by l. With deep set the
+// write also reaches everything below name, as DELETE and MOVE do.
+func (l *davLock) covers(name string, deep bool) bool {
+	if l.name == name || l.name == "" && l.deep {
+		return true
+	}
+	if l.deep && strings.HasPrefix(name, l.name+"/") {
+		return true
+	}
+	return deep && (name == "" || strings.HasPrefix(l.name, name+"/"))
+}
+
+// conflict returns a lock that blocks a write to name unless its token was
+// submitted in the If header.
+func (ls *davLocks) conflict(name string, deep bool, ifHeader string, now time.Time) *davLock {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for token, l := range ls.locks {
+		if now.After(l.expires) {
+			delete(ls.locks, token)
+			continue
+		}
+		if l.covers(name, deep) && !strings.Contains(ifHeader, l.token) {
+			return l
+		}
+	}
+	return nil
+}
+
+func (ls *davLocks) create(l *davLock, now time.Time) (*davLock, error) {
+	if c := ls.conflict(l.name, l.deep, "", now); c != nil {
+		return nil, errDAVLocked
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	l.token = "opaquelocktoken:" + randomID(16)
+	l.expires = now.Add(l.timeout)
+	ls.locks[l.token] = l
+	return l, nil
+}
+
+// refresh extends the lock on name whose token appears in ifHeader.
+func (ls *davLocks) refresh(name, ifHeader string, timeout time.Duration, now time.Time) *davLock {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for _, l := range ls.locks {
+		if strings.Contains(ifHeader, l.token) && l.covers(name, false) && now.Before(l.expires) {
+			l.timeout = timeout
+			l.expires = now.Add(timeout)
+			c := *l
+			return &c
+		}
+	}
+	return nil
+}
+
+func (ls *davLocks) release(token string) bool {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if _, ok := ls.locks[token]; !ok {
+		return false
+	}
+	delete(ls.locks, token)
+	return true
+}
+
+var errDAVLocked = errors.New("resource is locked")
+
+// davServer serves the upload directory to WebDAV clients. Uploads go
+// through the uploader, so type rules, scanning, quotas, hooks and the audit
+// log apply exactly as they do for POST /upload.
+type davServer struct {
+	u     *uploader
+	j     *janitor
+	locks *davLocks
+}
+
+// handleDAV serves /dav/ with the WebDAV methods desktop file managers use:
+// OPTIONS, PROPFIND, GET, HEAD, PUT, DELETE, MKCOL, MOVE, COPY, LOCK and
+// UNLOCK. Like the rest of the server there is no login; clients are told
+// apart by address.
+func handleDAV(u *uploader, j *janitor) http.HandlerFunc {
+	d := &davServer{u: u, j: j, locks: &davLocks{locks: make(map[string]*davLock)}}
+	return d.serve
+}
+
+func (d *davServer) serve(w http.ResponseWriter, r *http.Request) {
+	name, err := d.resolve(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("DAV", "1, 2")
+		w.Header().Set("MS-Author-Via", "DAV")
+		w.Header().Set("Allow", "OPTIONS, PROPFIND, GET, HEAD, PUT, DELETE, MKCOL, MOVE, COPY, LOCK, UNLOCK")
+		w.WriteHeader(http.StatusOK)
+	case "PROPFIND":
+		d.propfind(w, r, name)
+	case http.MethodGet, http.MethodHead:
+		d.get(w, r, name)
+	case http.MethodPut:
+		d.put(w, r, name)
+	case http.MethodDelete:
+		d.delete(w, r, name)
+	case "MKCOL":
+		d.mkcol(w, r, name)
+	case "MOVE", "COPY":
+		d.moveOrCopy(w, r, name)
+	case "LOCK":
+		d.lock(w, r, name)
+	case "UNLOCK":
+		token := strings.Trim(r.Header.Get("Lock-Token"), "<> ")
+		if !d.locks.release(token) {
+			http.Error(w, "No such lock", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// resolve maps a request path under /dav/ onto a storage name, with the
+// same confinement rules as the rest of the API.
+func (d *davServer) resolve(p string) (string, error) {
+	if p == strings.TrimSuffix(davPrefix, "/") {
+		return "", nil
+	}
+	if !strings.HasPrefix(p, davPrefix) {
+		return "", errOutsideUploadDir
+	}
+	rel, _, err := resolveUploadPath(d.u.uploadDir, strings.TrimPrefix(p, davPrefix))
+	return rel, err
+}
+
+// href is the escaped URL of name, with a trailing slash for directories.
+func davHref(name string, dir bool) string {
+	p := davPrefix + name
+	if dir && name != "" {
+		p += "/"
+	}
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// locked refuses a write to name that is blocked by another client's lock.
+func (d *davServer) locked(w http.ResponseWriter, r *http.Request, name string, deep bool) bool {
+	if d.locks.conflict(name, deep, r.Header.Get("If"), time.Now()) == nil {
+		return false
+	}
+	http.Error(w, "Locked", http.StatusLocked)
+	return true
+}
+
+// parentExists reports whether the directory that would hold name exists.
+func (d *davServer) parentExists(name string) bool {
+	parent := path.Dir(name)
+	if parent == "." {
+		return true
+	}
+	info, err := d.u.store.stat(parent)
+	return err == nil && info.IsDir
+}
+
+func (d *davServer) get(w http.ResponseWriter, r *http.Request, name string) {
+	info, err := d.u.store.stat(name)
+	if err != nil {
+		davError(w, err)
+		return
+	}
+	if info.IsDir {
+		http.Error(w, "Use PROPFIND to list a collection", http.StatusMethodNotAllowed)
+		return
+	}
+	serveDownload(w, r, d.u.store, name)
+}
+
+func (d *davServer) put(w http.ResponseWriter, r *http.Request, name string) {
+	if name == "" {
+		http.Error(w, "Cannot replace the root collection", http.StatusMethodNotAllowed)
+		return
+	}
+	if d.locked(w, r, name, false) {
+		return
+	}
+	if !d.parentExists(name) {
+		http.Error(w, "Parent collection does not exist", http.StatusConflict)
+		return
+	}
+	info, err := d.u.store.stat(name)
+	existed := err == nil
+	if existed && info.IsDir {
+		http.Error(w, "A collection exists at this path", http.StatusMethodNotAllowed)
+		return
+	}
+
+	meta := requestMeta(r, "webdav")
+	meta.OriginalName = path.Base(name)
+	ev, err := d.u.save(clientIP(r), name, r.Body, r.ContentLength, saveOptions{types: d.u.types, meta: meta})
+	if err != nil {
+		d.u.reject(w, r, name, err)
+		return
+	}
+	d.u.finish(w, ev)
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (d *davServer) mkcol(w http.ResponseWriter, r *http.Request, name string) {
+	if r.ContentLength > 0 {
+		http.Error(w, "MKCOL bodies are not supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	if d.locked(w, r, name, false) {
+		return
+	}
+	err := d.u.files.mkdir(clientIP(r), name, false)
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusCreated)
+	case err == errExists:
+		http.Error(w, "Already exists", http.StatusMethodNotAllowed)
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, errNotFolder):
+		http.Error(w, "Parent collection does not exist", http.StatusConflict)
+	default:
+		davError(w, err)
+	}
+}
+
+func (d *davServer) delete(w http.ResponseWriter, r *http.Request, name string) {
+	if name == "" {
+		http.Error(w, "Cannot delete the root collection", http.StatusForbidden)
+		return
+	}
+	if d.locked(w, r, name, true) {
+		return
+	}
+	info, err := d.u.store.stat(name)
+	if err != nil {
+		davError(w, err)
+		return
+	}
+	if _, err := d.u.files.remove(clientIP(r), info); err != nil {
+		davError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *davServer) moveOrCopy(w http.ResponseWriter, r *http.Request, name string) {
+	move := r.Method == "MOVE"
+	dest, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || dest.Path == "" {
+		http.Error(w, "Missing or invalid Destination header", http.StatusBadRequest)
+		return
+	}
+	if dest.Host != "" && dest.Host != r.Host {
+		http.Error(w, "Destination is on another server", http.StatusBadGateway)
+		return
+	}
+	to, err := d.resolve(dest.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if name == "" || to == "" || to == name || strings.HasPrefix(to, name+"/") {
+		http.Error(w, "Cannot "+strings.ToLower(r.Method)+" a collection into itself", http.StatusForbidden)
+		return
+	}
+	if (move && d.locked(w, r, name, true)) || d.locked(w, r, to, true) {
+		return
+	}
+
+	src, err := d.u.store.stat(name)
+	if err != nil {
+		davError(w, err)
+		return
+	}
+	if !d.parentExists(to) {
+		http.Error(w, "Parent collection does not exist", http.StatusConflict)
+		return
+	}
+	// A replaced destination needs the same permission as deleting it, and
+	// goes to the trash like a deleted file would.
+	existed := storageExists(d.u.store, to)
+	replace := r.Header.Get("Overwrite") != "F"
+	if move {
+		if err := d.u.files.move(clientIP(r), src, to, replace); err != nil {
+			davError(w, err)
+			return
+		}
+	} else {
+		if err := d.u.files.clear(clientIP(r), to, replace); err != nil {
+			davError(w, err)
+			return
+		}
+		deep := src.IsDir && r.Header.Get("Depth") != "0"
+		if err := d.copyTree(w, r, src, to, deep); err != nil {
+			d.u.reject(w, r, to, err)
+			return
+		}
+		log.Printf("WebDAV copy of %s to %s by %s", name, to, clientIP(r))
+	}
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// copyTree copies a file, or a directory and (when deep) its contents, to
+// to. Copied files are saved like any other upload, so they count against
+// the quota of the client making the copy.
+func (d *davServer) copyTree(w http.ResponseWriter, r *http.Request, f storedFile, to string, deep bool) error {
+	if !f.IsDir {
+		obj, err := d.u.store.open(f.Name)
+		if err != nil {
+			return err
+		}
+		defer obj.Close()
+		meta := requestMeta(r, "webdav")
+		meta.OriginalName = path.Base(f.Name)
+		ev, err := d.u.save(clientIP(r), to, obj, f.Size, saveOptions{types: d.u.types, meta: meta})
+		if err != nil {
+			return err
+		}
+		d.u.finish(w, ev)
+		return nil
+	}
+	if err := d.u.store.mkdir(to); err != nil {
+		return err
+	}
+	if !deep {
+		return nil
+	}
+	children, err := d.u.store.readDir(f.Name)
+	if err != nil {
+		return err
+	}
+	for _, c := range children {
+		if err := d.copyTree(w, r, c, to+"/"+path.Base(c.Name), true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// propfind lists name and, at Depth 1, its children. Every live property
+// is always returned; clients ignore the ones they did not ask for.
+func (d *davServer) propfind(w http.ResponseWriter, r *http.Request, name string) {
+	depth := r.Header.Get("Depth")
+	if depth == "infinity" || depth == "" {
+		http.Error(w, "Depth infinity is not supported", http.StatusForbidden)
+		return
+	}
+	info, err := d.u.store.stat(name)
+	if err != nil {
+		davError(w, err)
+		return
+	}
+	files := []storedFile{info}
+	if info.IsDir && depth == "1" {
+		children, err := d.u.store.readDir(name)
+		if err != nil {
+			http.Error(w, "Failed to list: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		files = append(files, children...)
+	}
+
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n" + `<D:multistatus xmlns:D="DAV:">`)
+	for _, f := range files {
+		b.WriteString("<D:response><D:href>" + html.EscapeString(davHref(f.Name, f.IsDir)) + "</D:href>")
+		b.WriteString("<D:propstat><D:prop>")
+		display := path.Base(f.Name)
+		if f.Name == "" {
+			display = "/"
+		}
+		b.WriteString("<D:displayname>" + html.EscapeString(display) + "</D:displayname>")
+		if f.IsDir {
+			b.WriteString("<D:resourcetype><D:collection/></D:resourcetype>")
+		} else {
+			b.WriteString("<D:resourcetype/>")
+			b.WriteString("<D:getcontentlength>" + strconv.FormatInt(f.Size, 10) + "</D:getcontentlength>")
+			ctype := mime.TypeByExtension(path.Ext(f.Name))
+			if ctype == "" {
+				ctype = "application/octet-stream"
+			}
+			b.WriteString("<D:getcontenttype>" + html.EscapeString(ctype) + "</D:getcontenttype>")
+			b.WriteString(fmt.Sprintf(`<D:getetag>"%x-%x"</D:getetag>`, f.ModTime.UnixNano(), f.Size))
+		}
+		if !f.ModTime.IsZero() {
+			b.WriteString("<D:getlastmodified>" + f.ModTime.UTC().Format(http.TimeFormat) + "</D:getlastmodified>")
+		}
+		b.WriteString("<D:supportedlock><D:lockentry><D:lockscope><D:exclusive/></D:lockscope>" +
+			"<D:locktype><D:write/></D:locktype></D:lockentry></D:supportedlock>")
+		b.WriteString("</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>")
+	}
+	b.WriteString("</D:multistatus>\n")
+
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, b.String())
+}
+
+// lock takes or refreshes an exclusive write lock. Only exclusive locks are
+// offered; a request for a shared lock gets an exclusive one, which RFC 4918
+// clients handle.
+func (d *davServer) lock(w http.ResponseWriter, r *http.Request, name string) {
+	timeout := davDefaultLockTimeout
+	if t := r.Header.Get("Timeout"); strings.HasPrefix(t, "Second-") {
+		if n, err := strconv.Atoi(strings.SplitN(strings.TrimPrefix(t, "Second-"), ",", 2)[0]); err == nil && n > 0 {
+			timeout = time.Duration(n) * time.Second
+		}
+	}
+	if timeout > davMaxLockTimeout {
+		timeout = davMaxLockTimeout
+	}
+
+	var req struct {
+		Owner struct {
+			Inner string `xml:",innerxml"`
+		} `xml:"owner"`
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return
+	}
+
+	var l *davLock
+	if len(strings.TrimSpace(string(body))) == 0 {
+		// An empty body refreshes a lock named in the If header.
+		if l = d.locks.refresh(name, r.Header.Get("If"), timeout, time.Now()); l == nil {
+			http.Error(w, "No lock to refresh", http.StatusPreconditionFailed)
+			return
+		}
+	} else {
+		if err := xml.Unmarshal(body, &req); err != nil {
+			http.Error(w, "Invalid lockinfo: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		l, err = d.locks.create(&davLock{
+			name:    name,
+			deep:    r.Header.Get("Depth") != "0",
+			owner:   req.Owner.Inner,
+			timeout: timeout,
+		}, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusLocked)
+			return
+		}
+		w.Header().Set("Lock-Token", "<"+l.token+">")
+	}
+
+	depth := "infinity"
+	if !l.deep {
+		depth = "0"
+	}
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<D:prop xmlns:D="DAV:"><D:lockdiscovery><D:activelock>
+<D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope>
+<D:depth>%s</D:depth><D:owner>%s</D:owner><D:timeout>Second-%d</D:timeout>
+<D:locktoken><D:href>%s</D:href></D:locktoken>
+<D:lockroot><D:href>%s</D:href></D:lockroot>
+</D:activelock></D:lockdiscovery></D:prop>
+`, depth, l.owner, int(l.timeout.Seconds()), l.token, html.EscapeString(davHref(name, false)))
+}
+
+// davError reports a storage lookup failure.
+func davError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case err == errExists:
+		http.Error(w, "Destination exists", http.StatusPreconditionFailed)
+	case errors.Is(err, fs.ErrPermission):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// dedupStorage is local storage that keeps each distinct file content once,
+// as a blob under .nostromo/blobs named by its SHA-256. The names in the
+// upload directory are hard links to the blobs, so they look and behave like
+// ordinary files. A blob is deleted once no name refers to it any more.
+//
+// Blobs are made read-only, as writing to one name through the filesystem
+// would change every file sharing its content. Files stored through the
+// server are always replaced rather than written in place.
+type dedupStorage struct {
+	*localStorage
+	blobDir string
+
+	mu   sync.Mutex
+	path string
+	// refs maps each deduplicated name to the hex digest of its blob.
+	refs   map[string]string
+	counts map[string]int
+}
+
+// hashedImporter is implemented by backends that store content by digest.
+// importHashed is importFile for a file whose SHA-256 is already known, and
+// reports whether the content was already held.
+type hashedImporter interface {
+	importHashed(name, localPath string, sum []byte) (bool, error)
+}
+
+// newDedupStorage opens a deduplicated store rooted at uploadDir. Names
+// that were deleted or replaced behind the server's back are dropped from
+// the index, and blobs nothing refers to are removed.
+func newDedupStorage(uploadDir string) (*dedupStorage, error) {
+	d := &dedupStorage{
+		localStorage: &localStorage{root: uploadDir},
+		blobDir:      filepath.Join(stateDir(uploadDir), "blobs"),
+		path:         filepath.Join(stateDir(uploadDir), "blobs.json"),
+		refs:         map[string]string{},
+		counts:       map[string]int{},
+	}
+	if err := loadJSON(d.path, &d.refs); err != nil {
+		return nil, fmt.Errorf("loading blob index: %w", err)
+	}
+	if err := os.MkdirAll(d.blobDir, 0755); err != nil {
+		return nil, err
+	}
+
+	changed := false
+	for name, sum := range d.refs {
+		info, err := os.Lstat(d.localPath(name))
+		blob, berr := os.Stat(d.blobPath(sum))
+		if err != nil || berr != nil || !os.SameFile(info, blob) {
+			delete(d.refs, name)
+			changed = true
+			continue
+		}
+		d.counts[sum]++
+	}
+	err := filepath.WalkDir(d.blobDir, func(p string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() {
+			return err
+		}
+		if d.counts[e.Name()] == 0 {
+			log.Printf("Removing unreferenced blob %s", e.Name())
+			return os.Remove(p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		if err := saveJSON(d.path, d.refs); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *dedupStorage) blobPath(sum string) string {
+	return filepath.Join(d.blobDir, sum[:2], sum)
+}
+
+// blob describes the blob with the given hex digest, if it is held.
+func (d *dedupStorage) blob(sum string) (fs.FileInfo, bool) {
+	if len(sum) != sha256.Size*2 {
+		return nil, false
+	}
+	if _, err := hex.DecodeString(sum); err != nil {
+		return nil, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.counts[sum] == 0 {
+		return nil, false
+	}
+	info, err := os.Stat(d.blobPath(sum))
+	return info, err == nil
+}
+
+// blobOf returns the hex digest of the blob name is linked to, if it is
+// one of the deduplicated names.
+func (d *dedupStorage) blobOf(name string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sum, ok := d.refs[name]
+	return sum, ok
+}
+
+// openBlob opens the blob with the given digest, if it is held.
+func (d *dedupStorage) openBlob(sum []byte) (*os.File, int64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	hexSum := hex.EncodeToString(sum)
+	if d.counts[hexSum] == 0 {
+		return nil, 0, false
+	}
+	f, err := os.Open(d.blobPath(hexSum))
+	if err != nil {
+		return nil, 0, false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, false
+	}
+	return f, info.Size(), true
+}
+
+func (d *dedupStorage) create(name string, r io.Reader) error {
+	incoming := filepath.Join(stateDir(d.root), "incoming")
+	if err := os.MkdirAll(incoming, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(incoming, "create-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	digest := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, digest), r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	_, err = d.importHashed(name, tmp.Name(), digest.Sum(nil))
+	return err
+}
+
+func (d *dedupStorage) importFile(name, localPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	digest := sha256.New()
+	_, err = io.Copy(digest, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	_, err = d.importHashed(name, localPath, digest.Sum(nil))
+	return err
+}
+
+// importHashed makes localPath the blob for sum, unless that blob already
+// exists, and links name to it. localPath is consumed either way.
+func (d *dedupStorage) importHashed(name, localPath string, sum []byte) (bool, error) {
+	hexSum := hex.EncodeToString(sum)
+	blob := d.blobPath(hexSum)
+	dest := d.localPath(name)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return false, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, err := os.Stat(blob)
+	deduped := err == nil
+	if deduped {
+		os.Remove(localPath)
+	} else {
+		if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+			return false, err
+		}
+		if err := os.Chmod(localPath, 0444); err != nil {
+			return false, err
+		}
+		if err := os.Rename(localPath, blob); err != nil {
+			return false, err
+		}
+	}
+
+	if err := d.link(blob, dest); err != nil {
+		if d.counts[hexSum] == 0 {
+			os.Remove(blob)
+		}
+		return false, err
+	}
+	d.counts[hexSum]++
+	if old, ok := d.refs[name]; ok {
+		d.unref(old)
+	}
+	d.refs[name] = hexSum
+	return deduped, saveJSON(d.path, d.refs)
+}
+
+// link points dest at blob, replacing whatever dest was. The link is made
+// beside the blob and renamed into place so dest is never missing.
+func (d *dedupStorage) link(blob, dest string) error {
+	// Renaming one link over another to the same file does nothing, so a
+	// name that already points at the blob is left alone.
+	if b, err := os.Stat(blob); err == nil {
+		if cur, err := os.Lstat(dest); err == nil && os.SameFile(b, cur) {
+			return nil
+		}
+	}
+	tmp := filepath.Join(filepath.Dir(blob), "link-"+randomID(8))
+	if err := os.Link(blob, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// unref drops one reference to the blob sum, removing it when it was the
+// last. The caller holds d.mu.
+func (d *dedupStorage) unref(sum string) {
+	d.counts[sum]--
+	if d.counts[sum] > 0 {
+		return
+	}
+	delete(d.counts, sum)
+	if err := os.Remove(d.blobPath(sum)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Failed to remove blob %s: %v", sum, err)
+	}
+}
+
+func (d *dedupStorage) remove(name string) error {
+	if err := d.localStorage.remove(name); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sum, ok := d.refs[name]
+	if !ok {
+		return nil
+	}
+	delete(d.refs, name)
+	d.unref(sum)
+	return saveJSON(d.path, d.refs)
+}
+
+func (d *dedupStorage) rename(from, to string) error {
+	if err := d.localStorage.rename(from, to); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// A file renamed over another replaces it.
+	if sum, ok := d.refs[to]; ok {
+		delete(d.refs, to)
+		d.unref(sum)
+	}
+	moved := map[string]string{}
+	for name, sum := range d.refs {
+		if dest, ok := movedPath(name, from, to); ok {
+			moved[dest] = sum
+			delete(d.refs, name)
+		}
+	}
+	for name, sum := range moved {
+		d.refs[name] = sum
+	}
+	return saveJSON(d.path, d.refs)
+}
+
+// handleBlobs serves GET /api/blobs/{sha256}, which tells a client whether
+// the server already holds some content. If it does, the client can PUT
+// the file with its digest and an empty body instead of sending the bytes.
+func handleBlobs(d *dedupStorage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		sum := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/api/blobs/"))
+		info, ok := d.blob(sum)
+		if !ok {
+			http.Error(w, "Content not held", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"sha256": sum, "size": info.Size()})
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dropBox is an upload-only entry point with its own unguessable URL. Files
+// sent to it land in Dir, relative to the upload directory, and the sender
+// never gets to see anything else.
+type dropBox struct {
+	Slug         string      `json:"slug"`
+	Label        string      `json:"label,omitempty"`
+	Dir          string      `json:"dir"`
+	Created      time.Time   `json:"created"`
+	Expires      *time.Time  `json:"expires,omitempty"`
+	MaxFileSize  int64       `json:"max_file_size,omitempty"`
+	MaxFiles     int         `json:"max_files,omitempty"`
+	AllowedTypes []string    `json:"allowed_types,omitempty"`
+	Types        *typePolicy `json:"types,omitempty"`
+	Extract      bool        `json:"extract,omitempty"`
+	Files        int         `json:"files"`
+}
+
+func (b *dropBox) expired(now time.Time) bool {
+	return b.Expires != nil && !now.Before(*b.Expires)
+}
+
+func (b *dropBox) checkSize(size int64) error {
+	if b.MaxFileSize > 0 && size > b.MaxFileSize {
+		return &uploadError{http.StatusRequestEntityTooLarge, "FILE_TOO_LARGE",
+			fmt.Sprintf("this drop box accepts files up to %d bytes", b.MaxFileSize)}
+	}
+	return nil
+}
+
+// policy returns the file type rules for this box. Its own rules apply on
+// top of the server-wide ones, so a box can only narrow what the server
+// accepts: the server's deny lists always hold, and a file has to be on
+// both allow lists. AllowedTypes is a shorthand that adds extensions
+// (".pdf") and MIME types ("image/*") to the box's allow lists.
+func (b *dropBox) policy(global typePolicy) typePolicy {
+	if b.Types == nil && len(b.AllowedTypes) == 0 {
+		return global
+	}
+	var p typePolicy
+	if b.Types != nil {
+		p = *b.Types
+	}
+	p.outer = &global
+	for _, t := range b.AllowedTypes {
+		if strings.HasPrefix(t, ".") {
+			p.AllowExt = append(p.AllowExt[:len(p.AllowExt):len(p.AllowExt)], t)
+		} else {
+			p.AllowType = append(p.AllowType[:len(p.AllowType):len(p.AllowType)], t)
+		}
+	}
+	return p
+}
+
+// dropBoxStore holds the configured drop boxes, keyed by slug.
+type dropBoxStore struct {
+	mu    sync.Mutex
+	path  string
+	boxes map[string]*dropBox
+}
+
+func loadDropBoxStore(path string) (*dropBoxStore, error) {
+	s := &dropBoxStore{path: path, boxes: make(map[string]*dropBox)}
+	if err := loadJSON(path, &s.boxes); err != nil {
+		return nil, fmt.Errorf("loading drop boxes: %w", err)
+	}
+	return s, nil
+}
+
+// get returns a copy of the box with the given slug.
+func (s *dropBoxStore) get(slug string) (*dropBox, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.boxes[slug]
+	if !ok {
+		return nil, false
+	}
+	c := *b
+	return &c, true
+}
+
+func (s *dropBoxStore) add(b *dropBox) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.boxes[b.Slug] = b
+	if err := saveJSON(s.path, s.boxes); err != nil {
+		delete(s.boxes, b.Slug)
+		return err
+	}
+	return nil
+}
+
+func (s *dropBoxStore) remove(slug string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.boxes[slug]; !ok {
+		return false, nil
+	}
+	delete(s.boxes, slug)
+	return true, saveJSON(s.path, s.boxes)
+}
+
+func (s *dropBoxStore) list() []*dropBox {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []*dropBox{}
+	for _, b := range s.boxes {
+		c := *b
+		out = append(out, &c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out
+}
+
+// claim takes one of the box's file slots for an upload about to start.
+func (s *dropBoxStore) claim(slug string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.boxes[slug]
+	if !ok {
+		return &uploadError{http.StatusNotFound, "NO_SUCH_DROP_BOX", "drop box not found"}
+	}
+	if b.expired(time.Now()) {
+		return &uploadError{http.StatusGone, "DROP_BOX_EXPIRED", "this drop box has expired"}
+	}
+	if b.MaxFiles > 0 && b.Files >= b.MaxFiles {
+		return &uploadError{http.StatusForbidden, "DROP_BOX_FULL",
+			fmt.Sprintf("this drop box accepts at most %d files", b.MaxFiles)}
+	}
+	b.Files++
+	return saveJSON(s.path, s.boxes)
+}
+
+// unclaim gives back a slot taken by an upload that did not complete.
+func (s *dropBoxStore) unclaim(slug string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.boxes[slug]; ok && b.Files > 0 {
+		b.Files--
+		if err := saveJSON(s.path, s.boxes); err != nil {
+			log.Printf("Failed to update drop box %s: %v", slug, err)
+		}
+	}
+}
+
+// handleDropBoxes serves the drop box management API:
+//
+//	GET    /api/dropboxes         list drop boxes
+//	POST   /api/dropboxes         create one: {"label", "dir", "expires_in", "max_file_size", "max_files", "allowed_types", "types", "extract"}
+//	DELETE /api/dropboxes/{slug}  remove a drop box (uploaded files are kept)
+func handleDropBoxes(boxes *dropBoxStore, uploadDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/dropboxes"), "/")
+
+		switch {
+		case r.Method == http.MethodGet && slug == "":
+			writeJSON(w, http.StatusOK, boxes.list())
+
+		case r.Method == http.MethodPost && slug == "":
+			var req struct {
+				Label        string      `json:"label"`
+				Dir          string      `json:"dir"`
+				ExpiresIn    string      `json:"expires_in"`
+				MaxFileSize  string      `json:"max_file_size"`
+				MaxFiles     int         `json:"max_files"`
+				AllowedTypes []string    `json:"allowed_types"`
+				Types        *typePolicy `json:"types"`
+				Extract      bool        `json:"extract"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			b := &dropBox{
+				Slug:         randomID(16),
+				Label:        req.Label,
+				Created:      time.Now().UTC(),
+				MaxFiles:     req.MaxFiles,
+				AllowedTypes: req.AllowedTypes,
+				Types:        req.Types,
+				Extract:      req.Extract,
+			}
+			if req.ExpiresIn != "" {
+				ttl, err := parseTTL(req.ExpiresIn)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				t := time.Now().Add(ttl).UTC().Truncate(time.Second)
+				b.Expires = &t
+			}
+			if req.MaxFileSize != "" {
+				n, err := parseByteSize(req.MaxFileSize)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				b.MaxFileSize = n
+			}
+			if req.Dir == "" {
+				req.Dir = "dropbox-" + b.Slug[:8]
+			}
+			// The directory itself is created by the first upload.
+			rel, _, err := resolveUploadPath(uploadDir, req.Dir)
+			if err != nil || rel == "" {
+				http.Error(w, "Invalid drop box directory", http.StatusBadRequest)
+				return
+			}
+			b.Dir = rel
+
+			if err := boxes.add(b); err != nil {
+				http.Error(w, "Failed to create drop box: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Printf("Created drop box %s -> %s", b.Slug, b.Dir)
+			writeJSON(w, http.StatusCreated, b)
+
+		case r.Method == http.MethodDelete && slug != "":
+			ok, err := boxes.remove(slug)
+			if err != nil {
+				http.Error(w, "Failed to remove drop box: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, "Drop box not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("Removed drop box %s", slug)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleDropBox serves a drop box to the outside world:
+//
+//	GET  /drop/{slug}         the upload page, scoped to the box
+//	POST /drop/{slug}/upload  the box's upload endpoint
+func handleDropBox(boxes *dropBoxStore, u *uploader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(r.URL.Path, "/drop/")
+		slug, action := rest, ""
+		if i := strings.Index(rest, "/"); i >= 0 {
+			slug, action = rest[:i], rest[i+1:]
+		}
+
+		box, ok := boxes.get(slug)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if box.expired(time.Now()) {
+			http.Error(w, "This drop box has expired", http.StatusGone)
+			return
+		}
+
+		switch action {
+		case "":
+			label := box.Label
+			if label == "" {
+				label = "SECURE DROP"
+			}
+			renderUI(w, uiConfig{
+				UploadURL: "/drop/" + box.Slug + "/upload",
+				DropBox:   strings.ToUpper(label),
+			})
+		case "upload":
+			u.receive(w, r, box)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestDropBoxCannotWidenTypes(t *testing.T) {
+	global := typePolicy{DenyExt: []string{".exe"}, AllowExt: []string{".txt", ".exe", ".pdf"}}
+	text := []byte("plain text\n")
+	for name, box := range map[string]*dropBox{
+		"empty types":         {Types: &typePolicy{}},
+		"allowed_types .exe":  {AllowedTypes: []string{".exe"}},
+		"types allowing .exe": {Types: &typePolicy{AllowExt: []string{".exe"}}},
+	} {
+		if err := box.policy(global).check("tool.exe", text); err == nil {
+			t.Errorf("%s: box accepts a globally denied extension", name)
+		}
+	}
+
+	// Allow lists intersect: the box can leave things out, not add them.
+	box := &dropBox{AllowedTypes: []string{".txt", ".csv"}}
+	p := box.policy(global)
+	if err := p.check("notes.txt", text); err != nil {
+		t.Errorf("allowed by both: %v", err)
+	}
+	for _, name := range []string{"data.csv", "report.pdf"} {
+		if err := p.check(name, text); err == nil {
+			t.Errorf("%s accepted outside one of the allow lists", name)
+		}
+	}
+
+	// A box's own deny list applies on top of the server's.
+	box = &dropBox{Types: &typePolicy{DenyExt: []string{".pdf"}}}
+	if err := box.policy(global).check("report.pdf", []byte("%PDF-1.7\n")); err == nil {
+		t.Error("box deny list ignored")
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// End-to-end encrypted uploads are sealed in the browser with WebCrypto
+// before they are sent, under a random key that only travels in the
+// fragment of the download link, which browsers never send to the server.
+// The server stores them like any other file and cannot read them. A
+// sealed file is laid out as:
+//
+//	magic      "NSTRME2E"
+//	version    1 byte
+//	chunk      1 byte: log2 of the chunk size, 16 for 64 KB
+//	meta size  4 bytes, big-endian
+//	meta       the JSON-encoded e2eInfo, sealed with AES-256-GCM under the
+//	           nonce 01 00 ... 00 with the first 10 header bytes as
+//	           additional data
+//	chunks     the content in chunks of the chunk size, the last one
+//	           shorter, each sealed with AES-256-GCM under chunkNonce
+//
+// The chunk nonces are the same as for encryption at rest: the chunk index,
+// with the last byte set for the final chunk, so chunks cannot be dropped
+// or reordered. They never collide with the metadata nonce. An empty file
+// has one empty chunk.
+const (
+	e2eMagic      = "NSTRME2E"
+	e2eVersion    = 1
+	e2eHeaderSize = 14
+	e2eMaxMeta    = 64 << 10
+)
+
+// e2eInfo describes the original file inside a sealed upload.
+type e2eInfo struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+}
+
+// parseE2EKey reads the key of a sealed upload, given either on its own or
+// as the whole download link.
+func parseE2EKey(s string) ([]byte, error) {
+	if i := strings.Index(s, "key="); i >= 0 {
+		s = s[i+4:]
+	}
+	if i := strings.IndexByte(s, '&'); i >= 0 {
+		s = s[:i]
+	}
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("key must be 32 bytes in unpadded base64url, as in the download link")
+	}
+	return key, nil
+}
+
+// e2eDecrypt reads a sealed upload from r and writes the original file to
+// w. The whole file is authenticated, chunk by chunk, so anything written
+// to w before an error is genuine but incomplete.
+func e2eDecrypt(r io.Reader, w io.Writer, key []byte) (e2eInfo, error) {
+	var info e2eInfo
+	aead, err := newGCM(key)
+	if err != nil {
+		return info, err
+	}
+	br := bufio.NewReader(r)
+	header := make([]byte, e2eHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:8]) != e2eMagic {
+		return info, errors.New("not an end-to-end encrypted upload")
+	}
+	if header[8] != e2eVersion {
+		return info, fmt.Errorf("unsupported version %d", header[8])
+	}
+	if header[9] < 12 || header[9] > 24 {
+		return info, fmt.Errorf("unsupported chunk size 2^%d", header[9])
+	}
+	chunkSize := 1 << header[9]
+	metaSize := binary.BigEndian.Uint32(header[10:])
+	if metaSize > e2eMaxMeta {
+		return info, errors.New("metadata too large")
+	}
+	sealedMeta := make([]byte, metaSize)
+	if _, err := io.ReadFull(br, sealedMeta); err != nil {
+		return info, errors.New("file is truncated")
+	}
+	metaNonce := make([]byte, aead.NonceSize())
+	metaNonce[0] = 1
+	meta, err := aead.Open(nil, metaNonce, sealedMeta, header[:10])
+	if err != nil {
+		return info, errDecrypt
+	}
+	if err := json.Unmarshal(meta, &info); err != nil {
+		return info, fmt.Errorf("bad metadata: %w", err)
+	}
+
+	if err := e2eChunks(br, w, aead, chunkSize, info.Size); err != nil {
+		return info, err
+	}
+	return info, nil
+}
+
+// e2eChunks decrypts the chunks of a sealed upload, checking they add up
+// to size.
+func e2eChunks(br *bufio.Reader, w io.Writer, aead cipher.AEAD, chunkSize int, size int64) error {
+	sealed := make([]byte, chunkSize+aead.Overhead())
+	var plain []byte
+	var total int64
+	for i := int64(0); ; i++ {
+		n, err := io.ReadFull(br, sealed)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return errors.New("file is truncated")
+		}
+		final := err == io.ErrUnexpectedEOF
+		if !final {
+			if _, err := br.Peek(1); err == io.EOF {
+				final = true
+			}
+		}
+		plain, err = aead.Open(plain[:0], chunkNonce(i, final), sealed[:n], nil)
+		if err != nil {
+			return errDecrypt
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+		total += int64(len(plain))
+		if final {
+			break
+		}
+	}
+	if total != size {
+		return fmt.Errorf("content is %d bytes but should be %d", total, size)
+	}
+	return nil
+}
+
+// runE2EDecrypt decrypts the sealed upload in the file src for the decrypt
+// subcommand, writing the original to out or standard output. keys, when
+// given, first remove encryption at rest, so files can be read straight
+// from an encrypted upload directory.
+func runE2EDecrypt(src, out, keyText string, keys *keyring) {
+	key, err := parseE2EKey(keyText)
+	if err != nil {
+		log.Fatal(err)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if keys != nil {
+		plain, _, err := decryptObject(f, keys)
+		if err != nil {
+			log.Fatalf("%s: %v", src, err)
+		}
+		defer plain.Close()
+		r = plain
+	}
+
+	dest := os.Stdout
+	if out != "" && out != "-" {
+		if dest, err = os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	info, err := e2eDecrypt(r, dest, key)
+	if cerr := dest.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		if dest != os.Stdout {
+			os.Remove(out)
+		}
+		log.Fatalf("%s: %v", src, err)
+	}
+	fmt.Fprintf(os.Stderr, "DECRYPTED %s (%d bytes, originally %q)\n", src, info.Size, info.Name)
+}
+
+// handleE2EPage serves /e2e, the page that downloads a sealed upload and
+// decrypts it in the browser. The file and key are read from the fragment.
+func handleE2EPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	io.WriteString(w, e2ePage)
+}
+
+const e2ePage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1.0">
+<title>NOSTROMO SEALED TRANSMISSION</title>
+<style>
+body { background: #000; color: #5cdb5c; font-family: 'Share Tech Mono', monospace; padding: 40px; text-shadow: 0 0 4px rgba(92, 219, 92, 0.5); }
+main { border: 1px solid #93e293; background: #001100; padding: 30px; max-width: 600px; margin: 0 auto; }
+p { word-break: break-all; }
+button { background: rgba(0, 30, 0, 0.6); color: #93e293; border: 1px solid #93e293; font-family: inherit; font-size: 16px; padding: 10px 20px; margin-top: 10px; cursor: pointer; }
+button[disabled] { opacity: 0.4; cursor: default; }
+.progress { height: 15px; border: 1px solid #93e293; background: rgba(0, 30, 0, 0.6); margin-top: 15px; }
+.bar { height: 100%; width: 0; background: linear-gradient(to right, #5cdb5c, #98fb98); }
+.error { color: #ff6b6b; }
+</style>
+</head>
+<body>
+<main>
+<p>&gt;_ MU/TH/UR 6000: SEALED TRANSMISSION</p>
+<p>&gt;_ DECRYPTION TAKES PLACE IN THIS TERMINAL. THE KEY NEVER LEAVES IT.</p>
+<p id="record">&gt;_ LOCATING RECORD...</p>
+<button id="save" disabled>DECRYPT AND SAVE</button>
+<div class="progress"><div class="bar" id="bar"></div></div>
+<p id="status"></p>
+</main>
+<script>
+(function () {
+    const CHUNK_OVERHEAD = 16;
+    const params = new URLSearchParams(location.hash.slice(1));
+    const file = params.get('file');
+    const keyText = params.get('key');
+    const record = document.getElementById('record');
+    const status = document.getElementById('status');
+    const bar = document.getElementById('bar');
+    const save = document.getElementById('save');
+    const url = file ? '/dav/' + file.split('/').map(encodeURIComponent).join('/') : '';
+    let key = null;
+    let info = null;
+    let dataStart = 0;
+    let chunkSize = 0;
+
+    function fail(message) {
+        status.textContent = '>_ ' + message;
+        status.className = 'error';
+    }
+
+    function fromBase64url(text) {
+        const bin = atob(text.replace(/-/g, '+').replace(/_/g, '/'));
+        return Uint8Array.from(bin, c => c.charCodeAt(0));
+    }
+
+    function nonce(index, final) {
+        const n = new Uint8Array(12);
+        new DataView(n.buffer).setBigUint64(3, BigInt(index));
+        n[11] = final ? 1 : 0;
+        return n;
+    }
+
+    function formatBytes(bytes) {
+        const units = ['BYTES', 'KB', 'MB', 'GB', 'TB'];
+        let i = 0;
+        while (bytes >= 1024 && i < units.length - 1) {
+            bytes /= 1024;
+            i++;
+        }
+        return (i ? bytes.toFixed(2) : bytes) + ' ' + units[i];
+    }
+
+    // Read the header and metadata with a range request, so the name and
+    // size can be shown before anything is downloaded
+    async function locate() {
+        if (!file || !keyText) {
+            throw new Error('LINK IS INCOMPLETE: FILE OR KEY MISSING');
+        }
+        if (!window.isSecureContext || !crypto.subtle) {
+            throw new Error('THIS TERMINAL CANNOT DECRYPT OVER AN INSECURE CONNECTION. USE HTTPS.');
+        }
+        const raw = fromBase64url(keyText);
+        if (raw.length !== 32) {
+            throw new Error('KEY IN LINK IS DAMAGED');
+        }
+        key = await crypto.subtle.importKey('raw', raw, 'AES-GCM', false, ['decrypt']);
+        const response = await fetch(url, { headers: { Range: 'bytes=0-65549' } });
+        if (!response.ok) {
+            throw new Error(response.status === 404 ? 'RECORD NOT FOUND' : 'RETRIEVAL FAILED: ' + response.status);
+        }
+        const head = new Uint8Array(await response.arrayBuffer());
+        if (head.length < 14 || new TextDecoder().decode(head.subarray(0, 8)) !== 'NSTRME2E' || head[8] !== 1) {
+            throw new Error('RECORD IS NOT A SEALED TRANSMISSION');
+        }
+        chunkSize = 1 << head[9];
+        const metaSize = new DataView(head.buffer).getUint32(10);
+        dataStart = 14 + metaSize;
+        if (head.length < dataStart) {
+            throw new Error('RECORD IS DAMAGED');
+        }
+        const metaNonce = new Uint8Array(12);
+        metaNonce[0] = 1;
+        let meta;
+        try {
+            meta = await crypto.subtle.decrypt({ name: 'AES-GCM', iv: metaNonce, additionalData: head.subarray(0, 10) }, key, head.subarray(14, dataStart));
+        } catch (e) {
+            throw new Error('KEY DOES NOT MATCH THIS RECORD');
+        }
+        info = JSON.parse(new TextDecoder().decode(meta));
+        record.textContent = '>_ RECORD: ' + info.name + ' (' + formatBytes(info.size) + ')';
+        save.disabled = false;
+    }
+
+    // Where the plaintext goes: straight to disk where the browser can
+    // write files, otherwise into a blob offered as a download at the end
+    async function openOutput() {
+        if (window.showSaveFilePicker) {
+            try {
+                const handle = await showSaveFilePicker({ suggestedName: info.name });
+                const writable = await handle.createWritable();
+                return { write: data => writable.write(data), close: () => writable.close(), abort: () => writable.abort() };
+            } catch (e) {
+                if (e.name === 'AbortError') {
+                    return null;
+                }
+            }
+        }
+        const parts = [];
+        return {
+            write: data => { parts.push(data); },
+            close: () => {
+                const link = document.createElement('a');
+                link.href = URL.createObjectURL(new Blob(parts, { type: info.type || 'application/octet-stream' }));
+                link.download = info.name;
+                document.body.appendChild(link);
+                link.click();
+                link.remove();
+                setTimeout(() => URL.revokeObjectURL(link.href), 60000);
+            },
+            abort: () => { parts.length = 0; }
+        };
+    }
+
+    // Stream the chunks, decrypting each as soon as it has arrived. A
+    // chunk is only known to be the last once the stream ends after it.
+    async function decrypt() {
+        const out = await openOutput();
+        if (!out) {
+            return;
+        }
+        save.disabled = true;
+        status.className = '';
+        status.textContent = '>_ DECRYPTING...';
+        const sealedSize = chunkSize + CHUNK_OVERHEAD;
+        try {
+            const response = await fetch(url, { headers: { Range: 'bytes=' + dataStart + '-' } });
+            if (response.status !== 206 && response.status !== 200) {
+                throw new Error('RETRIEVAL FAILED: ' + response.status);
+            }
+            const reader = response.body.getReader();
+            // If the server ignored the range, the header is skipped here
+            let skip = response.status === 200 ? dataStart : 0;
+            let buffer = new Uint8Array(0);
+            let index = 0;
+            let done = false;
+            let written = 0;
+            while (true) {
+                while (!done && buffer.length <= sealedSize) {
+                    const next = await reader.read();
+                    if (next.done) {
+                        done = true;
+                        break;
+                    }
+                    let value = next.value;
+                    if (skip > 0) {
+                        const n = Math.min(skip, value.length);
+                        value = value.subarray(n);
+                        skip -= n;
+                    }
+                    const joined = new Uint8Array(buffer.length + value.length);
+                    joined.set(buffer);
+                    joined.set(value, buffer.length);
+                    buffer = joined;
+                }
+                const final = done && buffer.length <= sealedSize;
+                const sealed = buffer.subarray(0, Math.min(sealedSize, buffer.length));
+                let plain;
+                try {
+                    plain = await crypto.subtle.decrypt({ name: 'AES-GCM', iv: nonce(index, final) }, key, sealed);
+                } catch (e) {
+                    throw new Error('RECORD IS DAMAGED OR TRUNCATED');
+                }
+                await out.write(new Uint8Array(plain));
+                written += plain.byteLength;
+                buffer = buffer.slice(sealed.length);
+                index++;
+                bar.style.width = (info.size ? Math.min(100, written / info.size * 100) : 100) + '%';
+                if (final) {
+                    break;
+                }
+            }
+            if (written !== info.size) {
+                throw new Error('RECORD IS INCOMPLETE');
+            }
+            await out.close();
+            status.textContent = '>_ TRANSMISSION DECRYPTED: ' + info.name;
+        } catch (e) {
+            await out.abort();
+            fail(e.message);
+            save.disabled = false;
+        }
+    }
+
+    save.addEventListener('click', decrypt);
+    locate().catch(e => {
+        record.textContent = '>_ RECORD UNAVAILABLE';
+        fail(e.message);
+    });
+})();
+</script>
+</body>
+</html>`
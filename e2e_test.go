@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// e2eVector was sealed by the upload page's e2eEncrypt, with the key
+// 00 01 ... 1f, from a file named log.txt.
+const (
+	e2eVectorKey     = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8"
+	e2eVectorContent = "Nostromo to Antarctica traffic control.\n"
+	e2eVector        = "4e5354524d453245011000000040990eec5ec9cace3d68686aa412b5f0bfee4ded5a05d80e" +
+		"30743d299b6552a800809d99a7028e8cbcb1a778f1743d30f5557f16fd6aa0459b180570660acc" +
+		"ac535bb9cc88369b5d712e5a3e19adc84e9667fc683d07d374f0016165bf4f53533d55f81383" +
+		"4740aa36a7946b1675620fd2a5b0fb88b2ed64df"
+)
+
+func e2eTestKey() []byte {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return key
+}
+
+// e2eSeal seals content the way the upload page does, in chunks of
+// 2^chunkLog bytes. It returns the header and sealed metadata, and the
+// sealed chunks.
+func e2eSeal(t *testing.T, key []byte, info e2eInfo, content []byte, chunkLog uint8) ([]byte, [][]byte) {
+	t.Helper()
+	aead, err := newGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, e2eHeaderSize)
+	copy(header, e2eMagic)
+	header[8] = e2eVersion
+	header[9] = chunkLog
+	meta, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaNonce := make([]byte, aead.NonceSize())
+	metaNonce[0] = 1
+	sealedMeta := aead.Seal(nil, metaNonce, meta, header[:10])
+	binary.BigEndian.PutUint32(header[10:], uint32(len(sealedMeta)))
+
+	size := 1 << chunkLog
+	n := (len(content) + size - 1) / size
+	if n == 0 {
+		n = 1
+	}
+	var chunks [][]byte
+	for i := 0; i < n; i++ {
+		end := (i + 1) * size
+		if end > len(content) {
+			end = len(content)
+		}
+		chunks = append(chunks, aead.Seal(nil, chunkNonce(int64(i), i == n-1), content[i*size:end], nil))
+	}
+	return append(header, sealedMeta...), chunks
+}
+
+func e2eJoin(head []byte, chunks [][]byte) []byte {
+	return bytes.Join(append([][]byte{head}, chunks...), nil)
+}
+
+func TestE2EDecryptPageVector(t *testing.T) {
+	sealed, err := hex.DecodeString(e2eVector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := parseE2EKey(e2eVectorKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	info, err := e2eDecrypt(bytes.NewReader(sealed), &out, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := e2eInfo{Name: "log.txt", Type: "text/plain", Size: int64(len(e2eVectorContent))}
+	if info != want || out.String() != e2eVectorContent {
+		t.Fatalf("decrypted %+v %q", info, out.String())
+	}
+
+	// Sealing the same file under the same key here gives the same bytes,
+	// so the format below matches the page's.
+	head, chunks := e2eSeal(t, key, want, []byte(e2eVectorContent), 16)
+	if !bytes.Equal(e2eJoin(head, chunks), sealed) {
+		t.Fatal("e2eSeal does not match the upload page")
+	}
+}
+
+func TestE2EDecryptRejectsTampering(t *testing.T) {
+	key := e2eTestKey()
+	content := bytes.Repeat([]byte("0123456789abcdef"), 3*4096/16)
+	info := e2eInfo{Name: "a.bin", Size: int64(len(content))}
+	head, chunks := e2eSeal(t, key, info, content, 12)
+	if len(chunks) != 3 {
+		t.Fatalf("%d chunks", len(chunks))
+	}
+
+	var out bytes.Buffer
+	if _, err := e2eDecrypt(bytes.NewReader(e2eJoin(head, chunks)), &out, key); err != nil || !bytes.Equal(out.Bytes(), content) {
+		t.Fatalf("intact file: %v", err)
+	}
+
+	for name, sealed := range map[string][]byte{
+		"cut after a chunk":  e2eJoin(head, chunks[:2]),
+		"cut after the meta": head,
+		"cut inside a chunk": e2eJoin(head, chunks)[:len(head)+len(chunks[0])+100],
+		"chunks reordered":   e2eJoin(head, [][]byte{chunks[1], chunks[0], chunks[2]}),
+		"chunk repeated":     e2eJoin(head, [][]byte{chunks[0], chunks[0], chunks[1], chunks[2]}),
+	} {
+		if _, err := e2eDecrypt(bytes.NewReader(sealed), &bytes.Buffer{}, key); err == nil {
+			t.Errorf("%s: decrypted", name)
+		}
+	}
+
+	wrong := e2eTestKey()
+	wrong[0] ^= 1
+	if _, err := e2eDecrypt(bytes.NewReader(e2eJoin(head, chunks)), &bytes.Buffer{}, wrong); err != errDecrypt {
+		t.Errorf("wrong key: %v", err)
+	}
+}
+
+func TestE2EDecryptEmptyFile(t *testing.T) {
+	key := e2eTestKey()
+	head, chunks := e2eSeal(t, key, e2eInfo{Name: "empty"}, nil, 16)
+	if len(chunks) != 1 {
+		t.Fatalf("%d chunks", len(chunks))
+	}
+	var out bytes.Buffer
+	info, err := e2eDecrypt(bytes.NewReader(e2eJoin(head, chunks)), &out, key)
+	if err != nil || info.Name != "empty" || out.Len() != 0 {
+		t.Fatalf("empty file: %+v, %d bytes, %v", info, out.Len(), err)
+	}
+	// Without its one empty chunk it is truncated.
+	if _, err := e2eDecrypt(bytes.NewReader(head), &out, key); err == nil {
+		t.Error("empty file without its chunk decrypted")
+	}
+}
+
+func TestParseE2EKey(t *testing.T) {
+	want := e2eTestKey()
+	for _, s := range []string{
+		e2eVectorKey,
+		" " + e2eVectorKey + "\n",
+		"https://example.com/e2e#file=2021222324252627.nenc&key=" + e2eVectorKey,
+		"https://example.com/e2e#key=" + e2eVectorKey + "&file=2021222324252627.nenc",
+	} {
+		key, err := parseE2EKey(s)
+		if err != nil || !bytes.Equal(key, want) {
+			t.Errorf("parseE2EKey(%q) = %x, %v", s, key, err)
+		}
+	}
+	for _, s := range []string{
+		"",
+		e2eVectorKey[:20],
+		e2eVectorKey + "AA",
+		strings.Replace(e2eVectorKey, "A", "+", 1),
+		"https://example.com/e2e#file=2021222324252627.nenc",
+	} {
+		if _, err := parseE2EKey(s); err == nil {
+			t.Errorf("parseE2EKey(%q) accepted", s)
+		}
+	}
+}
@@ -0,0 +1,676 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Encrypted files start with a header holding the file's own data key,
+// wrapped by the master key, followed by the content in chunks sealed with
+// AES-256-GCM:
+//
+//	magic      "NSTRMENC"
+//	version    1 byte
+//	kdf        1 byte: 0 for a key file, 1 for a passphrase (PBKDF2-SHA256)
+//	iterations 4 bytes, big-endian, for the passphrase
+//	salt       16 bytes, for the passphrase
+//	nonce      12 bytes
+//	data key   48 bytes: the 32-byte key sealed with the master key, with
+//	           the header up to here as additional data
+//
+// Each chunk holds encChunkSize bytes of content, less in the last one,
+// plus a 16-byte tag. A chunk's nonce is its index, with the last byte set
+// only for the final chunk, so chunks cannot be reordered and a truncated
+// file fails to decrypt. An empty file is a single empty chunk.
+const (
+	encMagic         = "NSTRMENC"
+	encVersion       = 1
+	encHeaderSize    = 90
+	encChunkSize     = 64 << 10
+	encTagSize       = 16
+	kdfKeyFile       = 0
+	kdfPassphrase    = 1
+	pbkdf2Iterations = 600_000
+)
+
+var errDecrypt = errors.New("cannot decrypt: wrong key, or the file is damaged")
+
+// keyring holds the master key: the key from a key file, or the passphrase
+// along with the keys derived from it for each salt seen.
+type keyring struct {
+	fileKey    []byte
+	passphrase string
+
+	// salt and iterations are used to derive the key new files are
+	// wrapped with, from the passphrase.
+	salt       [16]byte
+	iterations uint32
+
+	mu      sync.Mutex
+	derived map[string]cipher.AEAD
+}
+
+// loadKeyring reads the master key from a key file or a passphrase file.
+// A key file holds 32 bytes, raw or as 64 hex digits.
+func loadKeyring(keyFile, passphraseFile string) (*keyring, error) {
+	k := &keyring{derived: map[string]cipher.AEAD{}, iterations: pbkdf2Iterations}
+	switch {
+	case keyFile != "" && passphraseFile != "":
+		return nil, fmt.Errorf("give either --encrypt-key-file or --encrypt-passphrase-file, not both")
+	case keyFile != "":
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading key file: %w", err)
+		}
+		if key, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil && len(key) == 32 {
+			k.fileKey = key
+		} else if len(data) == 32 {
+			k.fileKey = data
+		} else {
+			return nil, fmt.Errorf("key file %s must hold 32 bytes, raw or as 64 hex digits", keyFile)
+		}
+	case passphraseFile != "":
+		data, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading passphrase file: %w", err)
+		}
+		k.passphrase = strings.TrimRight(string(data), "\r\n")
+		if k.passphrase == "" {
+			return nil, fmt.Errorf("passphrase file %s is empty", passphraseFile)
+		}
+		if _, err := rand.Read(k.salt[:]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+	return k, nil
+}
+
+// master returns the AEAD that wraps data keys for the given header
+// parameters.
+func (k *keyring) master(kdf byte, iterations uint32, salt []byte) (cipher.AEAD, error) {
+	var key []byte
+	switch kdf {
+	case kdfKeyFile:
+		if k.fileKey == nil {
+			return nil, fmt.Errorf("file was encrypted with a key file, not a passphrase")
+		}
+		key = k.fileKey
+	case kdfPassphrase:
+		if k.passphrase == "" {
+			return nil, fmt.Errorf("file was encrypted with a passphrase, not a key file")
+		}
+		id := fmt.Sprintf("%x/%d", salt, iterations)
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if aead, ok := k.derived[id]; ok {
+			return aead, nil
+		}
+		key = pbkdf2SHA256([]byte(k.passphrase), salt, int(iterations), 32)
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		k.derived[id] = aead
+		return aead, nil
+	default:
+		return nil, fmt.Errorf("unknown key type %d", kdf)
+	}
+	return newGCM(key)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal makes a header with a new data key and returns it with the AEAD for
+// the file's chunks.
+func (k *keyring) seal() ([]byte, cipher.AEAD, error) {
+	h := make([]byte, 42, encHeaderSize)
+	copy(h, encMagic)
+	h[8] = encVersion
+	if k.fileKey == nil {
+		h[9] = kdfPassphrase
+		binary.BigEndian.PutUint32(h[10:], k.iterations)
+		copy(h[14:30], k.salt[:])
+	}
+	if _, err := rand.Read(h[30:42]); err != nil {
+		return nil, nil, err
+	}
+	master, err := k.master(h[9], k.iterations, h[14:30])
+	if err != nil {
+		return nil, nil, err
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	h = master.Seal(h, h[30:42], dataKey, h[:42])
+	aead, err := newGCM(dataKey)
+	return h, aead, err
+}
+
+// open unwraps the data key in header and returns the AEAD for the file's
+// chunks.
+func (k *keyring) open(h []byte) (cipher.AEAD, error) {
+	if len(h) != encHeaderSize || string(h[:8]) != encMagic {
+		return nil, errDecrypt
+	}
+	if h[8] != encVersion {
+		return nil, fmt.Errorf("unsupported encryption version %d", h[8])
+	}
+	master, err := k.master(h[9], binary.BigEndian.Uint32(h[10:]), h[14:30])
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := master.Open(nil, h[30:42], h[42:], h[:42])
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return newGCM(dataKey)
+}
+
+// chunkNonce is the nonce of chunk i of a file.
+func chunkNonce(i int64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:], uint64(i))
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// plaintextSize works out the size of an encrypted file's content from its
+// stored size, and how many chunks it has.
+func plaintextSize(stored int64) (size, chunks int64, ok bool) {
+	body := stored - encHeaderSize
+	if body < encTagSize {
+		return 0, 0, false
+	}
+	chunks = (body + encChunkSize + encTagSize - 1) / (encChunkSize + encTagSize)
+	return body - chunks*encTagSize, chunks, true
+}
+
+// encryptReader reads plaintext from src and produces the encrypted file.
+type encryptReader struct {
+	src    *bufio.Reader
+	aead   cipher.AEAD
+	out    []byte
+	plain  []byte
+	sealed []byte
+	index  int64
+	done   bool
+}
+
+func newEncryptReader(src io.Reader, keys *keyring) (*encryptReader, error) {
+	header, aead, err := keys.seal()
+	if err != nil {
+		return nil, err
+	}
+	return &encryptReader{
+		src:   bufio.NewReaderSize(src, encChunkSize),
+		aead:  aead,
+		out:   header,
+		plain: make([]byte, encChunkSize),
+	}, nil
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(e.src, e.plain)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		// A full chunk is only the last one if nothing follows it.
+		final := n < encChunkSize
+		if !final {
+			if _, err := e.src.Peek(1); err == io.EOF {
+				final = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+		e.sealed = e.aead.Seal(e.sealed[:0], chunkNonce(e.index, final), e.plain[:n], nil)
+		e.out = e.sealed
+		e.index++
+		e.done = final
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// decryptReader gives seekable access to the content of an encrypted file,
+// decrypting a chunk at a time.
+type decryptReader struct {
+	obj    storageObject
+	aead   cipher.AEAD
+	size   int64
+	chunks int64
+
+	pos    int64
+	objPos int64
+	loaded int64
+	sealed []byte
+	plain  []byte
+}
+
+// decryptObject returns the content of obj, decrypting it if it is an
+// encrypted file. Files stored before encryption was turned on are
+// returned as they are.
+func decryptObject(obj storageObject, keys *keyring) (storageObject, bool, error) {
+	header := make([]byte, encHeaderSize)
+	n, err := io.ReadFull(obj, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, false, err
+	}
+	end, serr := obj.Seek(0, io.SeekEnd)
+	if serr != nil {
+		return nil, false, serr
+	}
+	size, chunks, ok := plaintextSize(end)
+	if n < encHeaderSize || string(header[:8]) != encMagic || !ok {
+		_, err := obj.Seek(0, io.SeekStart)
+		return obj, false, err
+	}
+	aead, err := keys.open(header)
+	if err != nil {
+		return nil, true, err
+	}
+	d := &decryptReader{obj: obj, aead: aead, size: size, chunks: chunks, objPos: end, loaded: -1}
+	// Reads of empty content never load its one chunk, which would let
+	// any file cut down to a header and a tag pass for an empty one.
+	if size == 0 {
+		if err := d.load(0); err != nil {
+			return nil, true, err
+		}
+	}
+	return d, true, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+	i := d.pos / encChunkSize
+	if i != d.loaded {
+		if err := d.load(i); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain[d.pos-i*encChunkSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+// load reads and decrypts chunk i.
+func (d *decryptReader) load(i int64) error {
+	off := encHeaderSize + i*(encChunkSize+encTagSize)
+	if d.objPos != off {
+		if _, err := d.obj.Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	n := int64(encChunkSize + encTagSize)
+	if i == d.chunks-1 {
+		n = d.size - i*encChunkSize + encTagSize
+	}
+	if int64(cap(d.sealed)) < n {
+		d.sealed = make([]byte, encChunkSize+encTagSize)
+	}
+	d.sealed = d.sealed[:n]
+	if _, err := io.ReadFull(d.obj, d.sealed); err != nil {
+		d.objPos = -1
+		return err
+	}
+	d.objPos = off + n
+	plain, err := d.aead.Open(d.plain[:0], chunkNonce(i, i == d.chunks-1), d.sealed, nil)
+	if err != nil {
+		d.loaded = -1
+		return errDecrypt
+	}
+	d.plain, d.loaded = plain, i
+	return nil
+}
+
+func (d *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of file")
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.obj.Close()
+}
+
+// encryptionState is kept in .nostromo/encryption.json. Check is the header
+// of an empty file, which only the right master key can open, so a wrong
+// key or passphrase is caught at startup rather than on the first download.
+type encryptionState struct {
+	Check []byte `json:"check"`
+}
+
+// encryptedStorage encrypts every file written to the storage it wraps and
+// decrypts files as they are read, so the rest of the server only ever sees
+// plaintext. Sizes reported are those of the content.
+type encryptedStorage struct {
+	storage
+	keys *keyring
+
+	mu sync.Mutex
+	// sizes caches what was learnt from each file's header, keyed by name
+	// and checked against the stored size and time.
+	sizes map[string]encryptedSize
+}
+
+type encryptedSize struct {
+	stored  int64
+	modTime time.Time
+	plain   int64
+}
+
+// newEncryptedStorage wraps inner with encryption under the master key in
+// keys. keys is nil when no key was given, which is only allowed if no
+// files were ever encrypted in uploadDir.
+func newEncryptedStorage(inner storage, uploadDir string, keys *keyring) (storage, error) {
+	statePath := filepath.Join(stateDir(uploadDir), "encryption.json")
+	var state encryptionState
+	if err := loadJSON(statePath, &state); err != nil {
+		return nil, fmt.Errorf("loading encryption settings: %w", err)
+	}
+	if keys == nil {
+		if state.Check != nil {
+			return nil, fmt.Errorf("files in %s are encrypted: give --encrypt-key-file or --encrypt-passphrase-file", uploadDir)
+		}
+		return inner, nil
+	}
+
+	if state.Check != nil {
+		if _, err := keys.open(state.Check); err != nil {
+			return nil, fmt.Errorf("checking the encryption key: %w", err)
+		}
+		// New files use the same salt, so the key is derived only once.
+		if state.Check[9] == kdfPassphrase {
+			copy(keys.salt[:], state.Check[14:30])
+			keys.iterations = binary.BigEndian.Uint32(state.Check[10:])
+		}
+	} else {
+		check, _, err := keys.seal()
+		if err != nil {
+			return nil, err
+		}
+		state.Check = check
+		if err := saveJSON(statePath, state); err != nil {
+			return nil, err
+		}
+	}
+	return &encryptedStorage{storage: inner, keys: keys, sizes: map[string]encryptedSize{}}, nil
+}
+
+// storageEncrypted reports whether files in s are encrypted at rest. What
+// the server keeps about them outside the storage, such as thumbnails and
+// the search index, is not, so features that copy content there are off.
+func storageEncrypted(s storage) bool {
+	_, ok := s.(*encryptedStorage)
+	return ok
+}
+
+func (e *encryptedStorage) create(name string, r io.Reader) error {
+	enc, err := newEncryptReader(r, e.keys)
+	if err != nil {
+		return err
+	}
+	return e.storage.create(name, enc)
+}
+
+// importFile encrypts a finished upload into storage. The plaintext is
+// removed once it is stored.
+func (e *encryptedStorage) importFile(name, localPath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(localPath)
+	defer f.Close()
+	return e.create(name, f)
+}
+
+func (e *encryptedStorage) open(name string) (storageObject, error) {
+	obj, err := e.storage.open(name)
+	if err != nil {
+		return nil, err
+	}
+	plain, _, err := decryptObject(obj, e.keys)
+	if err != nil {
+		obj.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return plain, nil
+}
+
+// describe replaces the stored size of f with the size of its content.
+func (e *encryptedStorage) describe(f storedFile) storedFile {
+	if f.IsDir {
+		return f
+	}
+	e.mu.Lock()
+	s, ok := e.sizes[f.Name]
+	e.mu.Unlock()
+	if ok && s.stored == f.Size && s.modTime.Equal(f.ModTime) {
+		f.Size = s.plain
+		return f
+	}
+
+	s = encryptedSize{stored: f.Size, modTime: f.ModTime, plain: f.Size}
+	if obj, err := e.storage.open(f.Name); err == nil {
+		header := make([]byte, len(encMagic))
+		_, err := io.ReadFull(obj, header)
+		obj.Close()
+		if size, _, ok := plaintextSize(f.Size); err == nil && ok && string(header) == encMagic {
+			s.plain = size
+		}
+	}
+	e.mu.Lock()
+	e.sizes[f.Name] = s
+	e.mu.Unlock()
+	f.Size = s.plain
+	return f
+}
+
+func (e *encryptedStorage) stat(name string) (storedFile, error) {
+	f, err := e.storage.stat(name)
+	if err != nil {
+		return f, err
+	}
+	return e.describe(f), nil
+}
+
+func (e *encryptedStorage) list(prefix string) ([]storedFile, error) {
+	files, err := e.storage.list(prefix)
+	for i := range files {
+		files[i] = e.describe(files[i])
+	}
+	return files, err
+}
+
+func (e *encryptedStorage) readDir(dir string) ([]storedFile, error) {
+	files, err := e.storage.readDir(dir)
+	for i := range files {
+		files[i] = e.describe(files[i])
+	}
+	return files, err
+}
+
+func (e *encryptedStorage) remove(name string) error {
+	e.mu.Lock()
+	delete(e.sizes, name)
+	e.mu.Unlock()
+	return e.storage.remove(name)
+}
+
+func (e *encryptedStorage) rename(from, to string) error {
+	e.mu.Lock()
+	for name := range e.sizes {
+		if _, ok := movedPath(name, from, to); ok {
+			delete(e.sizes, name)
+		}
+	}
+	delete(e.sizes, to)
+	e.mu.Unlock()
+	return e.storage.rename(from, to)
+}
+
+// runDecryptCommand implements "nostromo decrypt", which recovers files
+// without the server: a single file to standard output or --out, or a
+// whole upload directory into the directory --out.
+func runDecryptCommand(args []string) {
+	flags := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	keyFile := flags.String("encrypt-key-file", "", "Key file the files were encrypted with")
+	passphraseFile := flags.String("encrypt-passphrase-file", "", "File holding the passphrase the files were encrypted with")
+	out := flags.String("out", "", "Where to write the plaintext: a file, or a directory when decrypting a directory (default: standard output)")
+	e2eKey := flags.String("e2e-key", "", "Key of an end-to-end encrypted upload, or its whole download link")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: nostromo decrypt --encrypt-key-file FILE | --encrypt-passphrase-file FILE [--out PATH] FILE|DIR")
+		fmt.Fprintln(flags.Output(), "       nostromo decrypt --e2e-key KEY|LINK [--encrypt-key-file FILE | --encrypt-passphrase-file FILE] [--out PATH] FILE")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	keys, err := loadKeyring(*keyFile, *passphraseFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *e2eKey != "" {
+		runE2EDecrypt(flags.Arg(0), *out, *e2eKey, keys)
+		return
+	}
+	if keys == nil {
+		log.Fatal("give --encrypt-key-file or --encrypt-passphrase-file")
+	}
+
+	src := flags.Arg(0)
+	info, err := os.Stat(src)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !info.IsDir() {
+		if *out == "" || *out == "-" {
+			if _, err := decryptFile(src, os.Stdout, keys); err != nil {
+				log.Fatalf("%s: %v", src, err)
+			}
+			return
+		}
+		if _, err := decryptTo(src, *out, keys); err != nil {
+			log.Fatalf("%s: %v", src, err)
+		}
+		return
+	}
+
+	if *out == "" {
+		log.Fatal("decrypting a directory needs --out")
+	}
+	failed := 0
+	err = filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == stateDirName {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		encrypted, err := decryptTo(p, filepath.Join(*out, rel), keys)
+		switch {
+		case err != nil:
+			fmt.Printf("FAILED    %s: %v\n", filepath.ToSlash(rel), err)
+			failed++
+		case encrypted:
+			fmt.Printf("DECRYPTED %s\n", filepath.ToSlash(rel))
+		default:
+			fmt.Printf("COPIED    %s (not encrypted)\n", filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if failed > 0 {
+		log.Fatalf("%d file(s) could not be decrypted", failed)
+	}
+}
+
+// decryptTo decrypts the file src into a new file dest, which is removed
+// again if decryption fails.
+func decryptTo(src, dest string, keys *keyring) (bool, error) {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return false, err
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return false, err
+	}
+	encrypted, err := decryptFile(src, f, keys)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dest)
+	}
+	return encrypted, err
+}
+
+// decryptFile writes the content of src to w, decrypting it if it is an
+// encrypted file, and reports whether it was.
+func decryptFile(src string, w io.Writer, keys *keyring) (bool, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	plain, encrypted, err := decryptObject(f, keys)
+	if err != nil {
+		f.Close()
+		return encrypted, err
+	}
+	defer plain.Close()
+	_, err = io.Copy(w, plain)
+	return encrypted, err
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// memObject is a stored file held in memory.
+type memObject struct{ *bytes.Reader }
+
+func (memObject) Close() error { return nil }
+
+func testKeyring(b byte) *keyring {
+	return &keyring{fileKey: bytes.Repeat([]byte{b}, 32), derived: map[string]cipher.AEAD{}}
+}
+
+func encryptBytes(t *testing.T, keys *keyring, data []byte) []byte {
+	t.Helper()
+	e, err := newEncryptReader(bytes.NewReader(data), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := io.ReadAll(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func decryptBytes(keys *keyring, stored []byte) ([]byte, error) {
+	obj, encrypted, err := decryptObject(memObject{bytes.NewReader(stored)}, keys)
+	if err != nil {
+		return nil, err
+	}
+	if !encrypted {
+		return nil, errors.New("not recognised as encrypted")
+	}
+	return io.ReadAll(obj)
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	keys := testKeyring(1)
+	for _, tc := range []struct {
+		size   int
+		chunks int64
+	}{
+		{0, 1},
+		{1, 1},
+		{encChunkSize - 1, 1},
+		{encChunkSize, 1},
+		{encChunkSize + 1, 2},
+		{3*encChunkSize + 1000, 4},
+	} {
+		data := randomBytes(tc.size)
+		stored := encryptBytes(t, keys, data)
+		size, chunks, ok := plaintextSize(int64(len(stored)))
+		if !ok || size != int64(tc.size) || chunks != tc.chunks {
+			t.Errorf("%d bytes: plaintextSize(%d) = %d, %d, %v, want %d, %d", tc.size, len(stored), size, chunks, ok, tc.size, tc.chunks)
+		}
+		got, err := decryptBytes(keys, stored)
+		if err != nil {
+			t.Errorf("%d bytes: %v", tc.size, err)
+			continue
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: decrypted content differs", tc.size)
+		}
+	}
+	if _, _, ok := plaintextSize(encHeaderSize + encTagSize - 1); ok {
+		t.Error("plaintextSize accepted a file too short to hold a chunk")
+	}
+}
+
+func TestDecryptSeek(t *testing.T) {
+	keys := testKeyring(1)
+	data := randomBytes(3*encChunkSize + 1000)
+	obj, _, err := decryptObject(memObject{bytes.NewReader(encryptBytes(t, keys, data))}, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		offset int64
+		whence int
+		n      int
+		want   int64
+	}{
+		{encChunkSize - 10, io.SeekStart, 20, encChunkSize - 10},
+		{2*encChunkSize - 1, io.SeekStart, encChunkSize + 2, 2*encChunkSize - 1},
+		{-encChunkSize - 5, io.SeekCurrent, 10, 2*encChunkSize - 4},
+		{-500, io.SeekEnd, 500, int64(len(data)) - 500},
+		{0, io.SeekStart, 3, 0},
+	} {
+		pos, err := obj.Seek(tc.offset, tc.whence)
+		if err != nil || pos != tc.want {
+			t.Fatalf("Seek(%d, %d) = %d, %v, want %d", tc.offset, tc.whence, pos, err, tc.want)
+		}
+		buf := make([]byte, tc.n)
+		if _, err := io.ReadFull(obj, buf); err != nil {
+			t.Fatalf("reading %d bytes at %d: %v", tc.n, pos, err)
+		}
+		if !bytes.Equal(buf, data[pos:pos+int64(tc.n)]) {
+			t.Errorf("%d bytes at %d differ", tc.n, pos)
+		}
+	}
+	if n, err := obj.Read(make([]byte, 1)); n != 1 || err != nil {
+		t.Errorf("reading on after a seek: %d, %v", n, err)
+	}
+}
+
+func TestDecryptRefusesTampering(t *testing.T) {
+	keys := testKeyring(1)
+	const sealedChunk = encChunkSize + encTagSize
+	stored := encryptBytes(t, keys, randomBytes(3*encChunkSize+1000))
+	whole := encryptBytes(t, keys, randomBytes(2*encChunkSize))
+
+	swapped := append([]byte{}, stored...)
+	copy(swapped[encHeaderSize:], stored[encHeaderSize+sealedChunk:encHeaderSize+2*sealedChunk])
+	copy(swapped[encHeaderSize+sealedChunk:], stored[encHeaderSize:encHeaderSize+sealedChunk])
+
+	flipped := append([]byte{}, stored...)
+	flipped[len(flipped)-100] ^= 1
+
+	for name, bad := range map[string][]byte{
+		"truncated at a chunk boundary":     stored[:encHeaderSize+2*sealedChunk],
+		"last full chunk dropped":           whole[:encHeaderSize+sealedChunk],
+		"cut down to an empty chunk's size": stored[:encHeaderSize+encTagSize],
+		"chunks swapped":                    swapped,
+		"byte flipped in the last chunk":    flipped,
+		"truncated inside the last chunk":   stored[:len(stored)-10],
+	} {
+		if _, err := decryptBytes(keys, bad); !errors.Is(err, errDecrypt) {
+			t.Errorf("%s: %v, want errDecrypt", name, err)
+		}
+	}
+
+	for name, other := range map[string][]byte{"full file": stored, "empty file": encryptBytes(t, keys, nil)} {
+		if _, err := decryptBytes(testKeyring(2), other); !errors.Is(err, errDecrypt) {
+			t.Errorf("%s with the wrong key: %v, want errDecrypt", name, err)
+		}
+	}
+}
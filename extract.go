@@ -0,0 +1,440 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// extractLimits bound what one archive may unpack to, so a small upload
+// cannot expand into something that fills the disk. Zero means unlimited.
+type extractLimits struct {
+	MaxBytes int64
+	MaxFiles int
+}
+
+// extractor unpacks uploaded archives into a new folder. Every entry is
+// stored through the uploader, so it meets the same type rules, scanning
+// and quotas as a file uploaded on its own.
+type extractor struct {
+	u      *uploader
+	j      *janitor
+	limits extractLimits
+}
+
+// extractManifest describes an unpacked archive to the client.
+type extractManifest struct {
+	Archive   string          `json:"archive"`
+	Directory string          `json:"directory"`
+	Files     []extractedFile `json:"files"`
+	Skipped   []skippedEntry  `json:"skipped,omitempty"`
+}
+
+type extractedFile struct {
+	Path         string `json:"path"`
+	Size         int64  `json:"size"`
+	SHA256       string `json:"sha256"`
+	Deduplicated bool   `json:"deduplicated,omitempty"`
+}
+
+// skippedEntry is an archive entry that was deliberately not unpacked,
+// such as a symlink.
+type skippedEntry struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+var errNotArchive = &uploadError{http.StatusUnsupportedMediaType, "NOT_AN_ARCHIVE", "only zip, tar, tar.gz and tar.zst archives can be extracted"}
+
+// archiveFormat names the kind of archive that starts with head, or returns
+// "" if it is not one that can be extracted. Compressed streams are assumed
+// to hold a tar archive.
+func archiveFormat(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return "zip"
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return "tar.gz"
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return "tar.zst"
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return "tar"
+	}
+	return ""
+}
+
+// isArchive reports whether content starts with an archive that can be
+// extracted, without consuming it.
+func isArchive(content *bufio.Reader) bool {
+	head, _ := content.Peek(sniffLen)
+	return archiveFormat(head) != ""
+}
+
+// archiveStem is the name of an archive without its archive extension,
+// which is what the folder it unpacks into is called.
+func archiveStem(name string) string {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".tar.gz", ".tar.zst", ".tgz", ".tzst", ".tar", ".zip"} {
+		if strings.HasSuffix(lower, ext) && len(name) > len(ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+	if ext := path.Ext(name); ext != "" && len(name) > len(ext) {
+		return strings.TrimSuffix(name, ext)
+	}
+	return name + "-extracted"
+}
+
+// entryName turns the name of an archive entry into a path inside the
+// target folder, refusing anything that would climb out of it.
+func entryName(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return "", &uploadError{http.StatusUnprocessableEntity, "UNSAFE_ARCHIVE", fmt.Sprintf("entry %q has an absolute path", name)}
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", &uploadError{http.StatusUnprocessableEntity, "UNSAFE_ARCHIVE", fmt.Sprintf("entry %q points outside the archive", name)}
+		}
+		// Files under a state directory would be hidden from listings,
+		// quotas and the janitor.
+		if strings.EqualFold(part, stateDirName) {
+			return "", &uploadError{http.StatusUnprocessableEntity, "UNSAFE_ARCHIVE", fmt.Sprintf("entry %q uses the reserved name %s", name, stateDirName)}
+		}
+	}
+	clean := path.Clean(name)
+	if clean == "." {
+		return "", nil
+	}
+	return clean, nil
+}
+
+// extract unpacks the archive in body, which was uploaded as name, into a
+// new folder beside it named after the archive. The archive itself is not
+// kept. Nothing is left behind unless every entry is stored; symlinks and
+// special files are skipped and listed in the manifest. For a drop box,
+// each file takes one of the box's slots and must fit its size limit. The
+// returned events are for the caller to announce once it has replied.
+func (x *extractor) extract(client, name string, body io.Reader, size int64, types typePolicy, meta fileMeta, box *dropBox) (*extractManifest, []uploadEvent, error) {
+	content := bufio.NewReaderSize(body, sniffLen)
+	head, err := content.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return nil, nil, &uploadError{http.StatusBadRequest, "READ_FAILED", err.Error()}
+	}
+	format := archiveFormat(head)
+	if format == "" {
+		return nil, nil, errNotArchive
+	}
+
+	// Spool the archive to disk: zip needs random access, and it should be
+	// complete before anything is unpacked. It is held to what is left of
+	// the client's quota, as everything in it will count against that.
+	res, err := x.u.quota.reserve(client, "", size)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.cancel()
+	var src io.Reader = content
+	if size < 0 {
+		src = res.reader(src)
+	}
+	if res.limit >= 0 {
+		src = io.LimitReader(src, res.limit+1)
+	}
+	incoming := filepath.Join(stateDir(x.u.uploadDir), "incoming")
+	if err := os.MkdirAll(incoming, 0755); err != nil {
+		return nil, nil, err
+	}
+	spool, err := os.CreateTemp(incoming, "archive-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	written, err := io.Copy(spool, src)
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.limit >= 0 && written > res.limit {
+		return nil, nil, &uploadError{http.StatusInsufficientStorage, "QUOTA_EXCEEDED",
+			fmt.Sprintf("upload exceeds the %d bytes of quota remaining", res.limit)}
+	}
+	res.cancel()
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	// Claim the target folder under the same lock create-only uploads use,
+	// so two archives with the same name cannot unpack into one folder.
+	parent := path.Dir(name)
+	if parent == "." {
+		parent = ""
+	}
+	if err := x.mkdirAll("", parent); err != nil {
+		return nil, nil, err
+	}
+	x.u.placeMu.Lock()
+	dir := uniqueName(x.u.store, path.Join(parent, archiveStem(path.Base(name))))
+	err = x.u.store.mkdir(dir)
+	x.u.placeMu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m := &extractManifest{Archive: name, Directory: dir, Files: []extractedFile{}}
+	var events []uploadEvent
+	var total int64
+	entries, claimed := 0, 0
+	put := func(hdrName string, mode fs.FileMode, r io.Reader, declared int64) error {
+		entries++
+		if x.limits.MaxFiles > 0 && entries > x.limits.MaxFiles {
+			return &uploadError{http.StatusRequestEntityTooLarge, "EXTRACT_LIMIT",
+				fmt.Sprintf("archive has more than %d entries", x.limits.MaxFiles)}
+		}
+		rel, err := entryName(hdrName)
+		if err != nil || rel == "" {
+			return err
+		}
+		switch {
+		case mode.IsDir():
+			return x.mkdirAll(dir, rel)
+		case mode&fs.ModeSymlink != 0:
+			m.Skipped = append(m.Skipped, skippedEntry{hdrName, "links are not extracted"})
+			return nil
+		case !mode.IsRegular():
+			m.Skipped = append(m.Skipped, skippedEntry{hdrName, "special files are not extracted"})
+			return nil
+		}
+
+		if box != nil {
+			if err := box.checkSize(declared); err != nil {
+				return &uploadError{http.StatusRequestEntityTooLarge, "FILE_TOO_LARGE", rel + ": " + err.(*uploadError).msg}
+			}
+			if box.MaxFileSize > 0 {
+				r = io.LimitReader(r, box.MaxFileSize+1)
+			}
+			if err := x.u.dropBoxes.claim(box.Slug); err != nil {
+				return err
+			}
+			claimed++
+		}
+
+		remaining := int64(-1)
+		if x.limits.MaxBytes > 0 {
+			remaining = x.limits.MaxBytes - total
+			if declared > remaining {
+				return errExtractTooLarge(x.limits.MaxBytes)
+			}
+			r = io.LimitReader(r, remaining+1)
+		}
+		if err := x.mkdirAll(dir, path.Dir(rel)); err != nil {
+			return err
+		}
+		target := path.Join(dir, rel)
+		entryMeta := meta
+		entryMeta.OriginalName = path.Base(name) + "/" + hdrName
+		ev, err := x.u.save(client, target, archiveReader{r}, declared, saveOptions{types: types, createOnly: true, meta: entryMeta})
+		if err == errExists {
+			return &uploadError{http.StatusUnprocessableEntity, "UNSAFE_ARCHIVE", fmt.Sprintf("entry %q appears more than once", hdrName)}
+		}
+		if ue, ok := err.(*uploadError); ok {
+			return &uploadError{ue.status, ue.code, rel + ": " + ue.msg}
+		}
+		if err != nil {
+			return err
+		}
+		events = append(events, ev)
+		m.Files = append(m.Files, extractedFile{Path: ev.Path, Size: ev.Size, SHA256: ev.SHA256, Deduplicated: ev.Deduplicated})
+		total += ev.Size
+		if remaining >= 0 && ev.Size > remaining {
+			return errExtractTooLarge(x.limits.MaxBytes)
+		}
+		if box != nil {
+			if err := box.checkSize(ev.Size); err != nil {
+				return &uploadError{http.StatusRequestEntityTooLarge, "FILE_TOO_LARGE", rel + ": " + err.(*uploadError).msg}
+			}
+		}
+		return nil
+	}
+
+	if format == "zip" {
+		err = x.walkZip(spool, written, put)
+	} else {
+		err = walkTar(spool, format, put)
+	}
+	if err != nil {
+		if rerr := x.j.removeTree(storedFile{Name: dir, IsDir: true}); rerr != nil {
+			log.Printf("Failed to clean up %s after a failed extraction: %v", dir, rerr)
+		}
+		for ; claimed > 0; claimed-- {
+			x.u.dropBoxes.unclaim(box.Slug)
+		}
+		return nil, nil, err
+	}
+	return m, events, nil
+}
+
+// store unpacks an uploaded archive for the client of r and replies with
+// the manifest, or with the reason it was refused. meta and ttl apply to
+// every extracted file.
+func (x *extractor) store(w http.ResponseWriter, r *http.Request, name string, body io.Reader, size int64, types typePolicy, meta fileMeta, box *dropBox, ttl time.Duration) {
+	client := clientIP(r)
+	m, events, err := x.extract(client, name, body, size, types, meta, box)
+	if err != nil {
+		x.u.reject(w, r, name, err)
+		return
+	}
+	if ttl > 0 {
+		for _, f := range m.Files {
+			if err := x.u.retention.setExpiry(f.Path, time.Now().Add(ttl)); err != nil {
+				log.Printf("Failed to record retention for %s: %v", f.Path, err)
+			}
+		}
+	}
+	writeJSON(w, http.StatusCreated, m)
+	for _, ev := range events {
+		if box != nil {
+			ev.DropBox = box.Slug
+		}
+		x.u.announce(ev)
+	}
+	log.Printf("Extracted %s (%d files) into %s for %s", name, len(m.Files), m.Directory, client)
+	x.u.audit.record(auditEntry{Event: "extracted", Path: name, Client: client,
+		Detail: fmt.Sprintf("%d files -> %s", len(m.Files), m.Directory)})
+}
+
+func errExtractTooLarge(max int64) error {
+	return &uploadError{http.StatusRequestEntityTooLarge, "EXTRACT_LIMIT",
+		fmt.Sprintf("archive unpacks to more than %d bytes", max)}
+}
+
+// mkdirAll creates rel and its parents inside dir. An empty or "." rel
+// creates nothing.
+func (x *extractor) mkdirAll(dir, rel string) error {
+	if rel == "" || rel == "." {
+		return nil
+	}
+	for _, part := range strings.Split(rel, "/") {
+		dir = path.Join(dir, part)
+		f, err := x.u.store.stat(dir)
+		if err == nil {
+			if !f.IsDir {
+				return &uploadError{http.StatusConflict, "INVALID_NAME", dir + " is a file"}
+			}
+			continue
+		}
+		if err := x.u.store.mkdir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkZip calls put for each entry of a zip archive. The declared sizes
+// are checked against the limits before anything is unpacked.
+func (x *extractor) walkZip(f *os.File, size int64, put func(string, fs.FileMode, io.Reader, int64) error) error {
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return invalidArchive(err)
+	}
+	if x.limits.MaxFiles > 0 && len(zr.File) > x.limits.MaxFiles {
+		return &uploadError{http.StatusRequestEntityTooLarge, "EXTRACT_LIMIT",
+			fmt.Sprintf("archive has more than %d entries", x.limits.MaxFiles)}
+	}
+	var declared uint64
+	for _, zf := range zr.File {
+		declared += zf.UncompressedSize64
+	}
+	if x.limits.MaxBytes > 0 && declared > uint64(x.limits.MaxBytes) {
+		return errExtractTooLarge(x.limits.MaxBytes)
+	}
+
+	for _, zf := range zr.File {
+		mode := zf.Mode()
+		if !mode.IsRegular() {
+			if err := put(zf.Name, mode, nil, 0); err != nil {
+				return err
+			}
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return invalidArchive(err)
+		}
+		err = put(zf.Name, mode, rc, int64(zf.UncompressedSize64))
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkTar calls put for each entry of a tar archive, decompressing it first
+// if format says it is compressed.
+func walkTar(f *os.File, format string, put func(string, fs.FileMode, io.Reader, int64) error) error {
+	var r io.Reader = f
+	switch format {
+	case "tar.gz":
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return invalidArchive(err)
+		}
+		defer gz.Close()
+		r = gz
+	case "tar.zst":
+		r = newZstdReader(f)
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return invalidArchive(err)
+		}
+		mode := hdr.FileInfo().Mode()
+		if hdr.Typeflag == tar.TypeLink {
+			mode = fs.ModeSymlink
+		}
+		if err := put(hdr.Name, mode, tr, hdr.Size); err != nil {
+			return err
+		}
+	}
+}
+
+func invalidArchive(err error) error {
+	return &uploadError{http.StatusUnprocessableEntity, "INVALID_ARCHIVE", err.Error()}
+}
+
+// archiveReader reports a failure to read an entry as a damaged archive
+// rather than a server error.
+type archiveReader struct {
+	r io.Reader
+}
+
+func (a archiveReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if err != nil && err != io.EOF {
+		var ue *uploadError
+		if !errors.As(err, &ue) {
+			err = invalidArchive(err)
+		}
+	}
+	return n, err
+}
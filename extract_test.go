@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestEntryName(t *testing.T) {
+	cases := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"report.pdf", "report.pdf", true},
+		{"docs/./q3/report.pdf", "docs/q3/report.pdf", true},
+		{`docs\q3\report.pdf`, "docs/q3/report.pdf", true},
+		{"docs/", "docs", true},
+		{"./", "", true},
+		{"/etc/passwd", "", false},
+		{"C:/Windows/win.ini", "", false},
+		{"../outside.txt", "", false},
+		{"docs/../../outside.txt", "", false},
+		{".nostromo/quota.json", "", false},
+		{"docs/.nostromo/shares.json", "", false},
+		{"docs/.NOSTROMO/shares.json", "", false},
+		{"docs/.nostromo-notes.txt", "docs/.nostromo-notes.txt", true},
+	}
+	for _, c := range cases {
+		got, err := entryName(c.in)
+		if c.ok && (err != nil || got != c.want) {
+			t.Errorf("entryName(%q) = %q, %v; want %q", c.in, got, err, c.want)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("entryName(%q) = %q; want an error", c.in, got)
+		}
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Who may delete, rename, replace and create folders, whether through
+// /api/files, WebDAV, SFTP or by uploading over a file. There are no
+// accounts, so "owner" means the client address a file was uploaded from,
+// the same identity quotas use.
+const (
+	fileOpsOwner = "owner"
+	fileOpsAny   = "any"
+	fileOpsOff   = "off"
+)
+
+// fileManager serves /api/files/{path}: GET describes a file or folder
+// along with its metadata, DELETE removes it, PATCH renames or moves it or
+// changes its tags and notes, and POST creates a folder. WebDAV, SFTP and
+// uploads go through it too whenever they delete, move or replace a file.
+type fileManager struct {
+	u    *uploader
+	j    *janitor
+	mode string
+
+	// trash is the folder, relative to the upload directory, that deleted
+	// files are moved into. Empty means deletes are permanent.
+	trash string
+}
+
+// notPermitted is the error for a change the client may not make.
+type notPermitted struct {
+	msg string
+}
+
+func (e *notPermitted) Error() string { return e.msg }
+
+// Is makes a notPermitted match fs.ErrPermission, so WebDAV and SFTP report
+// it the way they report any other permission error.
+func (e *notPermitted) Is(target error) bool { return target == fs.ErrPermission }
+
+func handleFiles(m *fileManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, _, err := resolveUploadPath(m.u.uploadDir, strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/files"), "/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		// Describing files stays available with file management off, as
+		// it only reads.
+		if r.Method == http.MethodGet {
+			m.describe(w, name)
+			return
+		}
+		if m.mode == fileOpsOff {
+			http.Error(w, "File management is disabled on this server", http.StatusForbidden)
+			return
+		}
+		if name == "" {
+			http.Error(w, "Cannot change the upload directory itself", http.StatusForbidden)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodDelete:
+			m.delete(w, r, name)
+		case http.MethodPatch:
+			m.rename(w, r, name)
+		case http.MethodPost:
+			m.create(w, r, name)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// allowed reports whether client may change f. In owner mode that is only
+// files it uploaded itself, and folders holding nothing else.
+func (m *fileManager) allowed(client string, f storedFile) (bool, error) {
+	if m.mode == fileOpsAny {
+		return true, nil
+	}
+	files := []storedFile{f}
+	if f.IsDir {
+		var err error
+		if files, err = m.u.store.list(f.Name + "/"); err != nil {
+			return false, err
+		}
+	}
+	for _, file := range files {
+		if owner, ok := m.u.quota.owner(file.Name); !ok || owner != client {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// permit checks that client may change f. Deleting, moving and replacing a
+// file all count as changing it.
+func (m *fileManager) permit(client string, f storedFile) error {
+	if m.mode == fileOpsOff {
+		return &notPermitted{"File management is disabled on this server"}
+	}
+	ok, err := m.allowed(client, f)
+	if err != nil {
+		return fmt.Errorf("checking permissions: %w", err)
+	}
+	if !ok {
+		return &notPermitted{"Only the client that uploaded " + f.Name + " may change it"}
+	}
+	return nil
+}
+
+// lookup stats name and checks that the client may change it, reporting
+// any problem to the client.
+func (m *fileManager) lookup(w http.ResponseWriter, r *http.Request, name string) (storedFile, bool) {
+	f, err := m.u.store.stat(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return f, false
+		}
+		http.Error(w, "Failed to look up file: "+err.Error(), http.StatusInternalServerError)
+		return f, false
+	}
+	if err := m.permit(clientIP(r), f); err != nil {
+		fileOpError(w, err)
+		return f, false
+	}
+	return f, true
+}
+
+// fileOpError reports a failed change to an HTTP client.
+func fileOpError(w http.ResponseWriter, err error) {
+	var np *notPermitted
+	switch {
+	case errors.As(err, &np):
+		http.Error(w, np.msg, http.StatusForbidden)
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "File not found", http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// inTrash reports whether name is the trash folder or lies inside it.
+func (m *fileManager) inTrash(name string) bool {
+	return m.trash != "" && (name == m.trash || strings.HasPrefix(name, m.trash+"/"))
+}
+
+func (m *fileManager) delete(w http.ResponseWriter, r *http.Request, name string) {
+	f, ok := m.lookup(w, r, name)
+	if !ok {
+		return
+	}
+	dest, err := m.discard(clientIP(r), f)
+	if err != nil {
+		http.Error(w, "Failed to delete: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if dest == "" {
+		writeJSON(w, http.StatusOK, map[string]string{"path": name})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"path": name, "trash": dest})
+}
+
+// remove deletes f on behalf of client, if it may, and returns where in the
+// trash f was kept, if anywhere.
+func (m *fileManager) remove(client string, f storedFile) (string, error) {
+	if err := m.permit(client, f); err != nil {
+		return "", err
+	}
+	return m.discard(client, f)
+}
+
+// discard moves f into the trash, or deletes it if there is no trash.
+// Deleting something that is already in the trash, or the trash itself, is
+// permanent. The caller has checked the client may do this.
+func (m *fileManager) discard(client string, f storedFile) (string, error) {
+	if m.trash == "" || m.inTrash(f.Name) {
+		if err := m.j.removeTree(f); err != nil {
+			return "", err
+		}
+		log.Printf("Deleted %s for %s", f.Name, client)
+		m.u.audit.record(auditEntry{Event: "deleted", Path: f.Name, Client: client})
+		return "", nil
+	}
+
+	dest := uniqueName(m.u.store, path.Join(m.trash, f.Name))
+	if err := m.u.store.rename(f.Name, dest); err != nil {
+		return "", fmt.Errorf("moving to the trash: %w", err)
+	}
+	m.trashed(client, f.Name, dest)
+	return dest, nil
+}
+
+// trashed brings the records of a file just moved into the trash from name
+// to dest up to date.
+func (m *fileManager) trashed(client, name, dest string) {
+	m.j.rename(name, dest)
+	// Share links would otherwise follow it into the trash and still
+	// serve it.
+	m.j.unshare(dest)
+	log.Printf("Moved %s to the trash as %s for %s", name, dest, client)
+	m.u.audit.record(auditEntry{Event: "trashed", Path: name, Client: client, Detail: "-> " + dest})
+}
+
+// clear makes way for something new at name on behalf of client. Whatever
+// is there already is refused with errExists unless replace is set, and
+// otherwise needs the same permission as deleting it and goes the same way.
+func (m *fileManager) clear(client, name string, replace bool) error {
+	existing, err := m.u.store.stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !replace {
+		return errExists
+	}
+	if err := m.permit(client, existing); err != nil {
+		return err
+	}
+	_, err = m.discard(client, existing)
+	return err
+}
+
+// move renames f to to on behalf of client, replacing anything at to only
+// if replace is set.
+func (m *fileManager) move(client string, f storedFile, to string, replace bool) error {
+	if err := m.permit(client, f); err != nil {
+		return err
+	}
+	if err := m.clear(client, to, replace); err != nil {
+		return err
+	}
+	if err := m.u.store.rename(f.Name, to); err != nil {
+		return err
+	}
+	m.j.rename(f.Name, to)
+	log.Printf("Moved %s to %s for %s", f.Name, to, client)
+	m.u.audit.record(auditEntry{Event: "moved", Path: f.Name, Client: client, Detail: "-> " + to})
+	return nil
+}
+
+// replacing checks whether client may store a new file over name. It
+// reports whether the current file will be kept in the trash when that
+// happens, which keep does.
+func (m *fileManager) replacing(client, name string) (bool, error) {
+	if m == nil {
+		return false, nil
+	}
+	f, err := m.u.store.stat(name)
+	if err != nil || f.IsDir {
+		return false, nil
+	}
+	if err := m.permit(client, f); err != nil {
+		return false, err
+	}
+	return m.trash != "" && !m.inTrash(name), nil
+}
+
+// keep moves the file at name into the trash ahead of a new one being
+// stored there, once replacing has allowed it. The move is only finished
+// by calling done once the new file is in place. If it could not be
+// stored, done(false) puts the old version back instead.
+func (m *fileManager) keep(client, name string) (done func(stored bool), err error) {
+	if _, err := m.u.store.stat(name); errors.Is(err, fs.ErrNotExist) {
+		return func(bool) {}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	dest := uniqueName(m.u.store, path.Join(m.trash, name))
+	if err := m.u.store.rename(name, dest); err != nil {
+		return nil, fmt.Errorf("moving to the trash: %w", err)
+	}
+	return func(stored bool) {
+		if !stored {
+			err := m.u.store.rename(dest, name)
+			if err == nil {
+				return
+			}
+			log.Printf("Failed to put %s back from the trash: %v", name, err)
+		}
+		m.trashed(client, name, dest)
+	}, nil
+}
+
+// fileInfo is how /api/files describes a file or folder.
+type fileInfo struct {
+	Path     string     `json:"path"`
+	IsDir    bool       `json:"is_dir,omitempty"`
+	Size     int64      `json:"size"`
+	Modified time.Time  `json:"modified"`
+	Metadata *fileMeta  `json:"metadata,omitempty"`
+	Entries  []fileInfo `json:"entries,omitempty"`
+}
+
+func (m *fileManager) info(f storedFile) fileInfo {
+	fi := fileInfo{Path: f.Name, IsDir: f.IsDir, Size: f.Size, Modified: f.ModTime}
+	if meta, ok := m.u.meta.get(f.Name); ok && !f.IsDir {
+		fi.Metadata = &meta
+	}
+	return fi
+}
+
+// describe reports a file and its metadata, or a folder and what is
+// directly inside it.
+func (m *fileManager) describe(w http.ResponseWriter, name string) {
+	f := storedFile{Name: name, IsDir: true}
+	if name != "" {
+		var err error
+		if f, err = m.u.store.stat(name); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				http.Error(w, "File not found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Failed to look up file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	fi := m.info(f)
+	if f.IsDir {
+		children, err := m.u.store.readDir(name)
+		if err != nil {
+			http.Error(w, "Failed to list folder: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fi.Entries = []fileInfo{}
+		for _, c := range children {
+			fi.Entries = append(fi.Entries, m.info(c))
+		}
+	}
+	writeJSON(w, http.StatusOK, fi)
+}
+
+// rename handles PATCH, which moves a file when "to" is given and replaces
+// its tags or notes when those are.
+func (m *fileManager) rename(w http.ResponseWriter, r *http.Request, name string) {
+	var req struct {
+		To    string    `json:"to"`
+		Tags  *[]string `json:"tags"`
+		Notes *string   `json:"notes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Tags != nil || req.Notes != nil {
+		if !m.annotate(w, r, name, req.Tags, req.Notes) {
+			return
+		}
+		if req.To == "" {
+			meta, _ := m.u.meta.get(name)
+			writeJSON(w, http.StatusOK, map[string]interface{}{"path": name, "metadata": meta})
+			return
+		}
+	}
+	to, _, err := resolveUploadPath(m.u.uploadDir, req.To)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if to == "" || to == name || strings.HasPrefix(to, name+"/") {
+		http.Error(w, "Cannot move "+name+" to "+req.To, http.StatusBadRequest)
+		return
+	}
+	f, ok := m.lookup(w, r, name)
+	if !ok {
+		return
+	}
+	if err := m.move(clientIP(r), f, to, false); err != nil {
+		if err == errExists {
+			http.Error(w, to+" already exists", http.StatusConflict)
+			return
+		}
+		fileOpError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"path": to})
+}
+
+// annotate replaces the tags or notes of the file name, reporting any
+// problem to the client.
+func (m *fileManager) annotate(w http.ResponseWriter, r *http.Request, name string, tags *[]string, notes *string) bool {
+	var clean []string
+	if tags != nil {
+		var err error
+		if clean, err = cleanTags(*tags); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return false
+		}
+		if clean == nil {
+			clean = []string{}
+		}
+	}
+	if notes != nil {
+		if err := checkNotes(*notes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return false
+		}
+	}
+	f, ok := m.lookup(w, r, name)
+	if !ok {
+		return false
+	}
+	if f.IsDir {
+		http.Error(w, "Folders have no tags or notes", http.StatusBadRequest)
+		return false
+	}
+	if _, err := m.u.meta.annotate(name, clean, notes); err != nil {
+		http.Error(w, "Failed to save metadata: "+err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	m.u.index.refresh(name)
+	log.Printf("Updated tags and notes of %s for %s", name, clientIP(r))
+	return true
+}
+
+// mkdir creates the folder name along with any missing parents.
+func (m *fileManager) create(w http.ResponseWriter, r *http.Request, name string) {
+	err := m.mkdir(clientIP(r), name, true)
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusCreated, map[string]string{"path": name})
+	case err == errExists:
+		http.Error(w, name+" already exists", http.StatusConflict)
+	case errors.Is(err, errNotFolder):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		fileOpError(w, err)
+	}
+}
+
+// errNotFolder is returned for a folder whose path runs through a file.
+var errNotFolder = errors.New("not a folder")
+
+// mkdir creates the folder name on behalf of client, along with any missing
+// folders above it if parents is set. Otherwise the folder above it has to
+// exist. Like every other change, it is refused with file management off.
+func (m *fileManager) mkdir(client, name string, parents bool) error {
+	if m.mode == fileOpsOff {
+		return &notPermitted{"File management is disabled on this server"}
+	}
+	if name == "" {
+		return errExists
+	}
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		dir := strings.Join(parts[:i+1], "/")
+		f, err := m.u.store.stat(dir)
+		switch {
+		case err == nil && i == len(parts)-1:
+			return errExists
+		case err == nil && !f.IsDir:
+			return fmt.Errorf("%s is a file: %w", dir, errNotFolder)
+		case err == nil:
+			continue
+		case !errors.Is(err, fs.ErrNotExist):
+			return err
+		case i < len(parts)-1 && !parents:
+			return fmt.Errorf("%s: %w", dir, fs.ErrNotExist)
+		}
+		if err := m.u.store.mkdir(dir); err != nil {
+			return fmt.Errorf("creating %s: %w", dir, err)
+		}
+	}
+	log.Printf("Created folder %s for %s", name, client)
+	return nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestFileManager returns a file manager over a fresh upload directory,
+// wired to an uploader the way the server sets it up.
+func newTestFileManager(t *testing.T, mode, trash string) *fileManager {
+	t.Helper()
+	dir := t.TempDir()
+	state := stateDir(dir)
+	store := &localStorage{root: dir}
+	quota, err := loadQuotaStore(filepath.Join(state, "quota.json"), quotaLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	retention, err := loadRetentionStore(filepath.Join(state, "retention.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := loadMetaStore(filepath.Join(state, "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares, err := loadShareStore(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &janitor{files: store, store: retention, quota: quota, meta: meta, shares: shares}
+	u := &uploader{uploadDir: dir, store: store, quota: quota, retention: retention, meta: meta}
+	u.files = &fileManager{u: u, j: j, mode: mode, trash: trash}
+	return u.files
+}
+
+func saveAs(m *fileManager, client, name, content string) error {
+	_, err := m.u.save(client, name, strings.NewReader(content), int64(len(content)), saveOptions{})
+	return err
+}
+
+func readStored(t *testing.T, m *fileManager, name string) string {
+	t.Helper()
+	f, err := m.u.store.open(name)
+	if err != nil {
+		t.Fatalf("open %s: %v", name, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestReplaceFollowsFileOps(t *testing.T) {
+	for _, c := range []struct {
+		mode            string
+		owner, stranger bool
+	}{
+		{fileOpsOwner, true, false},
+		{fileOpsAny, true, true},
+		{fileOpsOff, false, false},
+	} {
+		m := newTestFileManager(t, c.mode, "")
+		if err := saveAs(m, "10.0.0.1", "a.txt", "one"); err != nil {
+			t.Fatal(err)
+		}
+		for client, want := range map[string]bool{"10.0.0.2": c.stranger, "10.0.0.1": c.owner} {
+			err := saveAs(m, client, "a.txt", "from "+client)
+			if want && err != nil {
+				t.Errorf("%s: %s could not replace the file: %v", c.mode, client, err)
+			}
+			if !want {
+				if ue, ok := err.(*uploadError); !ok || ue.code != "NOT_PERMITTED" {
+					t.Errorf("%s: %s replacing the file: %v", c.mode, client, err)
+				}
+			}
+		}
+	}
+
+	// A new name is not a replacement, whatever the mode.
+	m := newTestFileManager(t, fileOpsOff, "")
+	if err := saveAs(m, "10.0.0.1", "new.txt", "data"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplaceKeepsOldVersionInTrash(t *testing.T) {
+	m := newTestFileManager(t, fileOpsOwner, ".trash")
+	if err := saveAs(m, "10.0.0.1", "docs/a.txt", "one"); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveAs(m, "10.0.0.1", "docs/a.txt", "two!"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readStored(t, m, "docs/a.txt"); got != "two!" {
+		t.Errorf("docs/a.txt = %q", got)
+	}
+	if got := readStored(t, m, ".trash/docs/a.txt"); got != "one" {
+		t.Errorf("trashed copy = %q", got)
+	}
+	// Both versions are still the uploader's, and both count.
+	if owner, _ := m.u.quota.owner(".trash/docs/a.txt"); owner != "10.0.0.1" {
+		t.Errorf("trashed copy owned by %q", owner)
+	}
+	if used, files := m.u.quota.usage("10.0.0.1"); used != 7 || files != 2 {
+		t.Errorf("usage = %d bytes in %d files, want 7 in 2", used, files)
+	}
+}
+
+// brokenStore refuses to store anything new.
+type brokenStore struct{ *localStorage }
+
+func (s brokenStore) create(string, io.Reader) error { return errors.New("disk full") }
+
+func (s brokenStore) importFile(string, string) error { return errors.New("disk full") }
+
+func TestFailedReplaceKeepsOldVersion(t *testing.T) {
+	m := newTestFileManager(t, fileOpsOwner, ".trash")
+	if err := saveAs(m, "10.0.0.1", "a.txt", "one"); err != nil {
+		t.Fatal(err)
+	}
+	m.u.store = brokenStore{m.u.store.(*localStorage)}
+	if err := saveAs(m, "10.0.0.1", "a.txt", "two"); err == nil {
+		t.Fatal("replace succeeded with storage failing")
+	}
+	if got := readStored(t, m, "a.txt"); got != "one" {
+		t.Errorf("a.txt = %q after a failed replace", got)
+	}
+	if storageExists(m.u.store, ".trash/a.txt") {
+		t.Error("old version left in the trash")
+	}
+	if owner, _ := m.u.quota.owner("a.txt"); owner != "10.0.0.1" {
+		t.Errorf("a.txt owned by %q after a failed replace", owner)
+	}
+}
+
+func TestMoveAndRemoveFollowFileOps(t *testing.T) {
+	m := newTestFileManager(t, fileOpsOwner, ".trash")
+	for name, client := range map[string]string{"a.txt": "10.0.0.1", "b.txt": "10.0.0.2"} {
+		if err := saveAs(m, client, name, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, _ := m.u.store.stat("a.txt")
+
+	if _, err := m.remove("10.0.0.2", a); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("stranger removing a.txt: %v", err)
+	}
+	if err := m.move("10.0.0.2", a, "c.txt", false); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("stranger moving a.txt: %v", err)
+	}
+	// Moving over someone else's file needs their permission too.
+	if err := m.move("10.0.0.1", a, "b.txt", true); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("moving a.txt over b.txt: %v", err)
+	}
+	if err := m.move("10.0.0.1", a, "b.txt", false); err != errExists {
+		t.Errorf("moving a.txt onto b.txt without replace: %v", err)
+	}
+	if got := readStored(t, m, "b.txt"); got != "b.txt" {
+		t.Errorf("b.txt = %q after refused moves", got)
+	}
+
+	dest, err := m.remove("10.0.0.1", a)
+	if err != nil || dest != ".trash/a.txt" {
+		t.Fatalf("owner removing a.txt: %q, %v", dest, err)
+	}
+	if storageExists(m.u.store, "a.txt") {
+		t.Error("a.txt still there after removal")
+	}
+	trashed, _ := m.u.store.stat(dest)
+	if dest, err := m.remove("10.0.0.1", trashed); err != nil || dest != "" {
+		t.Errorf("removing from the trash: %q, %v", dest, err)
+	}
+	if storageExists(m.u.store, ".trash/a.txt") {
+		t.Error("file removed from the trash is still there")
+	}
+}
+
+func TestShareLinksFollowRenamesAndDeletes(t *testing.T) {
+	for _, trash := range []string{"", ".trash"} {
+		m := newTestFileManager(t, fileOpsAny, trash)
+		if err := saveAs(m, "10.0.0.1", "docs/a.txt", "one"); err != nil {
+			t.Fatal(err)
+		}
+		shares := m.j.shares
+		sh, err := shares.create("docs/a.txt", time.Hour, 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		token := shares.sign(sh)
+
+		docs, _ := m.u.store.stat("docs")
+		if err := m.move("10.0.0.1", docs, "papers", false); err != nil {
+			t.Fatal(err)
+		}
+		if name, err := shares.redeem(token, "", "10.0.0.2", true, false); err != nil || name != "papers/a.txt" {
+			t.Fatalf("link after the rename: %q, %v", name, err)
+		}
+
+		a, _ := m.u.store.stat("papers/a.txt")
+		if _, err := m.remove("10.0.0.1", a); err != nil {
+			t.Fatal(err)
+		}
+		if err := saveAs(m, "10.0.0.2", "papers/a.txt", "someone else's"); err != nil {
+			t.Fatal(err)
+		}
+		if name, err := shares.redeem(token, "", "10.0.0.2", true, false); err != errShareRevoked {
+			t.Errorf("trash %q: link after the delete: %q, %v", trash, name, err)
+		}
+	}
+}
+
+func TestMkdirFollowsFileOps(t *testing.T) {
+	off := newTestFileManager(t, fileOpsOff, "")
+	if err := off.mkdir("10.0.0.1", "docs", false); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("mkdir with file management off: %v", err)
+	}
+	dav := handleDAV(off.u, off.j)
+	w := httptest.NewRecorder()
+	dav(w, httptest.NewRequest("MKCOL", "/dav/docs", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("MKCOL with file management off: %d", w.Code)
+	}
+	if storageExists(off.u.store, "docs") {
+		t.Error("folder created with file management off")
+	}
+
+	m := newTestFileManager(t, fileOpsAny, "")
+	if err := m.mkdir("10.0.0.1", "a/b", false); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("mkdir without its parent: %v", err)
+	}
+	if err := m.mkdir("10.0.0.1", "a/b", true); err != nil {
+		t.Fatalf("mkdir with parents: %v", err)
+	}
+	if err := m.mkdir("10.0.0.1", "a", false); err != errExists {
+		t.Errorf("mkdir of an existing folder: %v", err)
+	}
+	if err := saveAs(m, "10.0.0.1", "f.txt", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.mkdir("10.0.0.1", "f.txt/c", true); !errors.Is(err, errNotFolder) {
+		t.Errorf("mkdir under a file: %v", err)
+	}
+}
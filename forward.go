@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// forwardJob is a stored upload waiting to be pushed to the remote instance.
+type forwardJob struct {
+	Path        string    `json:"path"`
+	SHA256      string    `json:"sha256"`
+	Size        int64     `json:"size"`
+	Queued      time.Time `json:"queued"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+const (
+	// forwardMaxBackoff caps the delay between attempts for a failing job.
+	forwardMaxBackoff = 10 * time.Minute
+
+	// forwardMaxAttempts is how often a transfer is tried before it is given
+	// up, which with the backoff above is about fifteen hours.
+	forwardMaxAttempts = 100
+)
+
+// forwardRefused is a failure that retrying cannot fix, such as the remote
+// refusing the file or not being able to confirm what it stored.
+type forwardRefused struct {
+	msg string
+}
+
+func (e *forwardRefused) Error() string {
+	return e.msg
+}
+
+// forwarder relays completed uploads to another Nostromo instance through
+// its upload API. The queue is kept on disk so nothing is lost across
+// restarts, and each transfer is only considered done once the remote
+// reports the same SHA-256 the local side sent.
+type forwarder struct {
+	mu        sync.Mutex
+	uploadURL string
+	// dropBox is set when the target is a drop box, which only takes
+	// multipart uploads and stores each file under its base name.
+	dropBox   bool
+	store     storage
+	queuePath string
+	jobs      []*forwardJob
+	wake      chan struct{}
+	client    *http.Client
+	audit     *auditLog
+
+	// deleteAfter removes the local copy once the remote has confirmed it;
+	// forget then drops the quota and retention bookkeeping for it.
+	deleteAfter bool
+	forget      func(name string)
+}
+
+// newForwarder prepares a forwarder for target, which is either the base URL
+// of a Nostromo instance or a drop box URL on one.
+func newForwarder(target, uploadDir string, store storage) (*forwarder, error) {
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		return nil, fmt.Errorf("forward target %q must be an http:// or https:// URL", target)
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("forward target %q: %w", target, err)
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	f := &forwarder{
+		uploadURL: strings.TrimSuffix(target, "/") + "/upload",
+		dropBox:   len(parts) >= 2 && parts[len(parts)-2] == "drop",
+		store:     store,
+		queuePath: filepath.Join(stateDir(uploadDir), "forward-queue.json"),
+		wake:      make(chan struct{}, 1),
+		client:    &http.Client{},
+	}
+	if err := loadJSON(f.queuePath, &f.jobs); err != nil {
+		return nil, fmt.Errorf("loading forward queue: %w", err)
+	}
+	return f, nil
+}
+
+// enqueue adds a stored upload to the queue and nudges the worker.
+func (f *forwarder) enqueue(ev uploadEvent) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	f.jobs = append(f.jobs, &forwardJob{
+		Path:   ev.Path,
+		SHA256: ev.SHA256,
+		Size:   ev.Size,
+		Queued: time.Now().UTC(),
+	})
+	if err := saveJSON(f.queuePath, f.jobs); err != nil {
+		log.Printf("Failed to save forward queue: %v", err)
+	}
+	f.mu.Unlock()
+
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the first job that is due, or how long to wait for one.
+func (f *forwarder) next(now time.Time) (*forwardJob, time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	wait := time.Duration(-1)
+	for _, j := range f.jobs {
+		if !now.Before(j.NextAttempt) {
+			c := *j
+			return &c, 0
+		}
+		if d := j.NextAttempt.Sub(now); wait < 0 || d < wait {
+			wait = d
+		}
+	}
+	return nil, wait
+}
+
+// finish updates the queue after an attempt at job. A failed job is given
+// up, and finish reports true, if the failure is permanent or the job has
+// run out of attempts.
+func (f *forwarder) finish(job *forwardJob, err error) (gaveUp bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var refused *forwardRefused
+	for i, j := range f.jobs {
+		if j.Path != job.Path || !j.Queued.Equal(job.Queued) {
+			continue
+		}
+		if err != nil && (errors.As(err, &refused) || j.Attempts+1 >= forwardMaxAttempts) {
+			gaveUp = true
+		}
+		if err == nil || gaveUp {
+			f.jobs = append(f.jobs[:i], f.jobs[i+1:]...)
+		} else {
+			j.Attempts++
+			j.LastError = err.Error()
+			backoff := forwardMaxBackoff
+			if j.Attempts < 10 {
+				if d := time.Second << uint(j.Attempts); d < backoff {
+					backoff = d
+				}
+			}
+			j.NextAttempt = time.Now().Add(backoff)
+		}
+		break
+	}
+	if err := saveJSON(f.queuePath, f.jobs); err != nil {
+		log.Printf("Failed to save forward queue: %v", err)
+	}
+	return gaveUp
+}
+
+// run works through the queue until the process exits.
+func (f *forwarder) run() {
+	for {
+		job, wait := f.next(time.Now())
+		if job == nil {
+			var timer <-chan time.Time
+			if wait >= 0 {
+				timer = time.After(wait)
+			}
+			select {
+			case <-f.wake:
+			case <-timer:
+			}
+			continue
+		}
+
+		err := f.send(job)
+		if errors.Is(err, fs.ErrNotExist) {
+			// The file was deleted before it could be sent; nothing to retry.
+			log.Printf("Dropped %s from the forward queue: file no longer exists", job.Path)
+			f.finish(job, nil)
+			continue
+		}
+		gaveUp := f.finish(job, err)
+		if gaveUp {
+			log.Printf("Gave up forwarding %s after %d attempts: %v", job.Path, job.Attempts+1, err)
+			f.audit.record(auditEntry{Event: "forward_failed", Path: job.Path, Size: job.Size, Detail: err.Error()})
+			continue
+		}
+		if err != nil {
+			log.Printf("Forwarding %s failed (attempt %d): %v", job.Path, job.Attempts+1, err)
+			continue
+		}
+
+		log.Printf("Forwarded %s (%d bytes) to %s", job.Path, job.Size, f.uploadURL)
+		f.audit.record(auditEntry{Event: "forwarded", Path: job.Path, Size: job.Size, Detail: f.uploadURL})
+		if f.deleteAfter {
+			if err := f.store.remove(job.Path); err != nil {
+				log.Printf("Failed to remove forwarded file %s: %v", job.Path, err)
+			} else if f.forget != nil {
+				f.forget(job.Path)
+			}
+		}
+	}
+}
+
+// send streams one file to the remote and checks the digest the remote
+// reports against what was sent. A Nostromo instance gets a PUT to the
+// file's own path, so files in different folders stay apart; a drop box
+// gets a multipart form, as that is all it takes.
+func (f *forwarder) send(job *forwardJob) error {
+	file, err := f.store.open(job.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	digest := sha256.New()
+	content := io.TeeReader(file, digest)
+	var req *http.Request
+	if f.dropBox {
+		pr, pw := io.Pipe()
+		mw := multipart.NewWriter(pw)
+		go func() {
+			part, err := mw.CreateFormFile("file", path.Base(job.Path))
+			if err == nil {
+				_, err = io.Copy(part, content)
+			}
+			if err == nil {
+				err = mw.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		if req, err = http.NewRequest(http.MethodPost, f.uploadURL, pr); err != nil {
+			pr.Close()
+			return err
+		}
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+	} else {
+		segments := strings.Split(job.Path, "/")
+		for i, s := range segments {
+			segments[i] = url.PathEscape(s)
+		}
+		if req, err = http.NewRequest(http.MethodPut, f.uploadURL+"/"+strings.Join(segments, "/"), content); err != nil {
+			return err
+		}
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	switch {
+	case resp.StatusCode == http.StatusOK, resp.StatusCode == http.StatusCreated:
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests,
+		resp.StatusCode == http.StatusNotImplemented:
+		return &forwardRefused{fmt.Sprintf("remote refused the file: %s: %s", resp.Status, strings.TrimSpace(string(body)))}
+	default:
+		return fmt.Errorf("remote replied %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	// Sending again cannot help if the remote stores something other
+	// than what it was sent, or does not say what it stored.
+	sent := hex.EncodeToString(digest.Sum(nil))
+	if sent != job.SHA256 {
+		log.Printf("Forwarded %s changed since upload (sha256 %s, now %s)", job.Path, job.SHA256, sent)
+	}
+	if stripped := resp.Header.Get("X-Nostromo-Stripped"); stripped != "" {
+		return &forwardRefused{"remote removed metadata (" + stripped + "), so the copy cannot be verified"}
+	}
+	got := resp.Header.Get("X-Nostromo-SHA256")
+	if got == "" {
+		return &forwardRefused{"remote did not report a checksum; is it a Nostromo server?"}
+	}
+	if got != sent {
+		return fmt.Errorf("checksum mismatch: sent %s, remote stored %s", sent, got)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestForwarder returns a forwarder for target whose local files are
+// written from files.
+func newTestForwarder(t *testing.T, target string, files map[string]string) *forwarder {
+	t.Helper()
+	dir := t.TempDir()
+	store := &localStorage{root: dir}
+	for name, content := range files {
+		if err := store.create(name, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := newForwarder(target, dir, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func forwardJobFor(name, content string) *forwardJob {
+	sum := sha256.Sum256([]byte(content))
+	return &forwardJob{Path: name, SHA256: hex.EncodeToString(sum[:]), Size: int64(len(content))}
+}
+
+// fakeRemote stores PUT bodies by path and reports their digest the way a
+// Nostromo instance does.
+type fakeRemote struct {
+	mu    sync.Mutex
+	files map[string]string
+}
+
+func (fr *fakeRemote) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if r.Method != http.MethodPut || !strings.HasPrefix(r.URL.Path, "/upload/") {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	fr.files[strings.TrimPrefix(r.URL.Path, "/upload/")] = string(body)
+	sum := sha256.Sum256(body)
+	w.Header().Set("X-Nostromo-SHA256", hex.EncodeToString(sum[:]))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func TestForwardKeepsFolders(t *testing.T) {
+	remote := &fakeRemote{files: map[string]string{}}
+	srv := httptest.NewServer(remote)
+	defer srv.Close()
+
+	files := map[string]string{"a/report one.pdf": "first", "b/report one.pdf": "second"}
+	f := newTestForwarder(t, srv.URL, files)
+	if f.dropBox {
+		t.Fatal("instance URL taken for a drop box")
+	}
+	for name, content := range files {
+		if err := f.send(forwardJobFor(name, content)); err != nil {
+			t.Fatalf("send %s: %v", name, err)
+		}
+	}
+	for name, content := range files {
+		if remote.files[name] != content {
+			t.Errorf("remote %s = %q, want %q", name, remote.files[name], content)
+		}
+	}
+}
+
+func TestForwardDropBoxTarget(t *testing.T) {
+	for target, want := range map[string]bool{
+		"http://10.0.0.5:8080":                false,
+		"http://10.0.0.5:8080/drop/Xy12ab":    true,
+		"http://10.0.0.5:8080/drop/Xy12ab/":   true,
+		"https://proxy.example/nostromo/":     false,
+		"https://proxy.example/n/drop/Xy12ab": true,
+	} {
+		f, err := newForwarder(target, t.TempDir(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.dropBox != want {
+			t.Errorf("%s: dropBox = %v", target, f.dropBox)
+		}
+	}
+}
+
+func TestForwardUnverifiableRemoteIsPermanent(t *testing.T) {
+	cases := map[string]http.HandlerFunc{
+		"no checksum": func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			w.WriteHeader(http.StatusCreated)
+		},
+		"stripped": func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			w.Header().Set("X-Nostromo-SHA256", strings.Repeat("0", 64))
+			w.Header().Set("X-Nostromo-Stripped", "EXIF")
+			w.WriteHeader(http.StatusCreated)
+		},
+		"refused": func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "TYPE_NOT_ALLOWED: .exe files are not accepted", http.StatusUnsupportedMediaType)
+		},
+		"no PUT": func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Unsupported method", http.StatusNotImplemented)
+		},
+	}
+	for name, handler := range cases {
+		srv := httptest.NewServer(handler)
+		f := newTestForwarder(t, srv.URL, map[string]string{"x.txt": "data"})
+		job := forwardJobFor("x.txt", "data")
+		f.jobs = []*forwardJob{job}
+		err := f.send(job)
+		if err == nil {
+			t.Errorf("%s: send succeeded", name)
+		} else if !f.finish(job, err) {
+			t.Errorf("%s: %v was retried", name, err)
+		}
+		if len(f.jobs) != 0 {
+			t.Errorf("%s: job still queued", name)
+		}
+		srv.Close()
+	}
+}
+
+func TestForwardGivesUpAfterMaxAttempts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	f := newTestForwarder(t, srv.URL, map[string]string{"x.txt": "data"})
+	job := forwardJobFor("x.txt", "data")
+	f.jobs = []*forwardJob{job}
+
+	for i := 1; i < forwardMaxAttempts; i++ {
+		if f.finish(job, f.send(job)) {
+			t.Fatalf("gave up after %d attempts", i)
+		}
+	}
+	if !f.finish(job, f.send(job)) {
+		t.Fatalf("still retrying after %d attempts", forwardMaxAttempts)
+	}
+	if len(f.jobs) != 0 {
+		t.Fatal("job still queued")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// uploadEvent describes a file that has just been stored. It is the payload
+// of webhooks and the source of the environment given to hook commands.
+type uploadEvent struct {
+	Event   string    `json:"event"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256"`
+	Client  string    `json:"client"`
+	DropBox string    `json:"drop_box,omitempty"`
+	Time    time.Time `json:"time"`
+
+	// Deduplicated is set when --dedup found the content already stored.
+	Deduplicated bool `json:"deduplicated,omitempty"`
+	// Stripped lists the kinds of image metadata --strip-metadata removed.
+	Stripped []string `json:"stripped,omitempty"`
+}
+
+// hookOutputLimit caps how much of a hook command's output is kept.
+const hookOutputLimit = 64 << 10
+
+// hookWaitDelay is how long a hook command's output is still read after it
+// exits or times out. A process it left running in the background can hold
+// the output open indefinitely.
+const hookWaitDelay = 5 * time.Second
+
+// hookRunner runs the configured post-upload actions. Hooks run in the
+// background after the file is in place; a failing hook is logged and
+// audited but never touches the stored file.
+type hookRunner struct {
+	uploadDir string
+	store     storage
+	audit     *auditLog
+
+	command        string
+	commandTimeout time.Duration
+
+	webhookURL     string
+	webhookSecret  []byte
+	webhookRetries int
+	deadLetterPath string
+	client         *http.Client
+
+	deadLetterMu sync.Mutex
+}
+
+// fire starts every configured action for ev.
+func (h *hookRunner) fire(ev uploadEvent) {
+	if h == nil {
+		return
+	}
+	if h.command != "" {
+		go h.runCommand(ev)
+	}
+	if h.webhookURL != "" {
+		go h.sendWebhook(ev)
+	}
+}
+
+// limitedBuffer keeps the first max bytes written to it and discards the
+// rest, so a chatty hook cannot exhaust memory.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + "\n[output truncated]"
+	}
+	return b.buf.String()
+}
+
+// runCommand executes the hook command through the system shell with the
+// upload described in NOSTROMO_* environment variables.
+func (h *hookRunner) runCommand(ev uploadEvent) {
+	ctx := context.Background()
+	if h.commandTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.commandTimeout)
+		defer cancel()
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", h.command)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", h.command)
+	}
+	// NOSTROMO_FILE is only set when the upload exists on local disk.
+	full := ""
+	if lp, ok := h.store.(localPather); ok {
+		full = lp.localPath(ev.Path)
+		if abs, err := filepath.Abs(full); err == nil {
+			full = abs
+		}
+	}
+	cmd.Env = append(os.Environ(),
+		"NOSTROMO_FILE="+full,
+		"NOSTROMO_PATH="+ev.Path,
+		"NOSTROMO_SIZE="+strconv.FormatInt(ev.Size, 10),
+		"NOSTROMO_SHA256="+ev.SHA256,
+		"NOSTROMO_CLIENT="+ev.Client,
+		"NOSTROMO_DROPBOX="+ev.DropBox,
+		"NOSTROMO_TIME="+ev.Time.Format(time.RFC3339),
+	)
+	cmd.Dir = h.uploadDir
+	out := &limitedBuffer{max: hookOutputLimit}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.WaitDelay = hookWaitDelay
+	hookProcessGroup(cmd)
+
+	start := time.Now()
+	err := cmd.Run()
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		err = fmt.Errorf("timed out after %s", h.commandTimeout)
+	case errors.Is(err, exec.ErrWaitDelay):
+		err = errors.New("exited, but something it started kept its output open")
+	}
+	output := out.String()
+	if err != nil {
+		log.Printf("Upload hook failed for %s: %v\n%s", ev.Path, err, output)
+		h.audit.record(auditEntry{Event: "hook_failed", Path: ev.Path, Detail: "command: " + err.Error() + ": " + tail(output, 2048)})
+		return
+	}
+	log.Printf("Upload hook ran for %s in %s", ev.Path, time.Since(start).Round(time.Millisecond))
+	h.audit.record(auditEntry{Event: "hook", Path: ev.Path, Detail: "command: ok: " + tail(output, 2048)})
+}
+
+// tail returns at most the last n bytes of s.
+func tail(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return "..." + s[len(s)-n:]
+}
+
+// sendWebhook POSTs ev as JSON, retrying with exponential backoff. The body
+// is signed with HMAC-SHA256 in the X-Nostromo-Signature header. Events that
+// cannot be delivered are appended to the dead-letter log.
+func (h *hookRunner) sendWebhook(ev uploadEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("Failed to encode webhook for %s: %v", ev.Path, err)
+		return
+	}
+	mac := hmac.New(sha256.New, h.webhookSecret)
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	backoff := time.Second
+	attempts := h.webhookRetries + 1
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = h.postWebhook(body, signature)
+		if err == nil {
+			h.audit.record(auditEntry{Event: "hook", Path: ev.Path, Detail: "webhook delivered to " + h.webhookURL})
+			return
+		}
+		log.Printf("Webhook for %s failed (attempt %d/%d): %v", ev.Path, attempt, attempts, err)
+		if attempt < attempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	h.audit.record(auditEntry{Event: "hook_failed", Path: ev.Path, Detail: "webhook: " + err.Error()})
+	h.deadLetterMu.Lock()
+	defer h.deadLetterMu.Unlock()
+	letter := struct {
+		Time     time.Time       `json:"time"`
+		URL      string          `json:"url"`
+		Attempts int             `json:"attempts"`
+		Error    string          `json:"error"`
+		Payload  json.RawMessage `json:"payload"`
+	}{time.Now().UTC(), h.webhookURL, attempts, err.Error(), body}
+	if err := appendJSONLine(h.deadLetterPath, letter); err != nil {
+		log.Printf("Failed to write webhook dead letter: %v", err)
+	}
+}
+
+func (h *hookRunner) postWebhook(body []byte, signature string) error {
+	req, err := http.NewRequest(http.MethodPost, h.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Nostromo-Event", "upload")
+	req.Header.Set("X-Nostromo-Signature", signature)
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("server replied %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// hookProcessGroup leaves cmd as it is where there are no process groups.
+// A timeout then kills the hook itself, and hookWaitDelay stops anything it
+// started from holding up its worker.
+func hookProcessGroup(cmd *exec.Cmd) {}
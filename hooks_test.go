@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHookTimeoutKillsWhatItStarted(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs /bin/sh")
+	}
+	dir := t.TempDir()
+	audit, _ := newAuditLog(filepath.Join(dir, "audit.log"))
+	// The backgrounded sleep keeps the output open after the shell is
+	// killed, which used to hold runCommand until it exited.
+	h := &hookRunner{uploadDir: dir, audit: audit, command: "sleep 30 & sleep 30", commandTimeout: 200 * time.Millisecond}
+
+	start := time.Now()
+	h.runCommand(uploadEvent{Path: "a.txt"})
+	if d := time.Since(start); d > hookWaitDelay {
+		t.Fatalf("hook held its worker for %s", d)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "audit.log"))
+	if !strings.Contains(string(data), "timed out") {
+		t.Errorf("audit log: %s", data)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits on the tags and notes a client may attach to a file.
+const (
+	maxTags     = 32
+	maxTagLen   = 64
+	maxNotesLen = 4096
+)
+
+// fileMeta is what is known about how a stored file arrived, plus the tags
+// and notes people have added to it since.
+type fileMeta struct {
+	// Uploader is the user the client authenticated as: the SFTP login, or
+	// the basic auth user name when a proxy in front of the server asks for
+	// one. There are no accounts otherwise, so it is often empty.
+	Uploader     string    `json:"uploader,omitempty"`
+	ClientIP     string    `json:"client_ip"`
+	UserAgent    string    `json:"user_agent,omitempty"`
+	Via          string    `json:"via"`
+	DropBox      string    `json:"drop_box,omitempty"`
+	OriginalName string    `json:"original_name,omitempty"`
+	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256"`
+	Uploaded     time.Time `json:"uploaded"`
+	Tags         []string  `json:"tags,omitempty"`
+	Notes        string    `json:"notes,omitempty"`
+	// Language is the syntax hint given with a pasted snippet.
+	Language string `json:"language,omitempty"`
+}
+
+// requestMeta describes the client behind an HTTP upload.
+func requestMeta(r *http.Request, via string) fileMeta {
+	m := fileMeta{UserAgent: r.UserAgent(), Via: via}
+	if user, _, ok := r.BasicAuth(); ok {
+		m.Uploader = user
+	}
+	return m
+}
+
+// annotateFromForm sets the tags, given as a comma-separated list, and
+// notes a client sent along with an upload.
+func annotateFromForm(m *fileMeta, tags, notes string) error {
+	var err error
+	if m.Tags, err = cleanTags(strings.Split(tags, ",")); err != nil {
+		return &uploadError{http.StatusBadRequest, "INVALID_METADATA", err.Error()}
+	}
+	if err := checkNotes(notes); err != nil {
+		return &uploadError{http.StatusBadRequest, "INVALID_METADATA", err.Error()}
+	}
+	m.Notes = notes
+	return nil
+}
+
+// cleanTags trims tags, drops empty and repeated ones, and enforces the
+// limits.
+func cleanTags(tags []string) ([]string, error) {
+	var out []string
+	seen := map[string]bool{}
+	for _, t := range tags {
+		t = strings.TrimSpace(t)
+		if t == "" || seen[t] {
+			continue
+		}
+		if len(t) > maxTagLen {
+			return nil, fmt.Errorf("tag %q is longer than %d characters", t, maxTagLen)
+		}
+		seen[t] = true
+		out = append(out, t)
+	}
+	if len(out) > maxTags {
+		return nil, fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	return out, nil
+}
+
+func checkNotes(notes string) error {
+	if len(notes) > maxNotesLen {
+		return fmt.Errorf("notes are longer than %d characters", maxNotesLen)
+	}
+	return nil
+}
+
+// metaStore keeps the metadata of stored files, keyed by their path in the
+// upload directory.
+type metaStore struct {
+	mu    sync.Mutex
+	path  string
+	files map[string]fileMeta
+}
+
+func loadMetaStore(path string) (*metaStore, error) {
+	s := &metaStore{path: path, files: make(map[string]fileMeta)}
+	if err := loadJSON(path, &s.files); err != nil {
+		return nil, fmt.Errorf("loading file metadata: %w", err)
+	}
+	return s, nil
+}
+
+func (s *metaStore) get(name string) (fileMeta, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.files[name]
+	return m, ok
+}
+
+// set records m for name, replacing what was known about an earlier file
+// stored under the same name.
+func (s *metaStore) set(name string, m fileMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = m
+	return saveJSON(s.path, s.files)
+}
+
+// annotate replaces the tags or notes of name, where given, and returns the
+// result. Files stored before metadata was kept get an entry of their own.
+func (s *metaStore) annotate(name string, tags []string, notes *string) (fileMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.files[name]
+	if tags != nil {
+		m.Tags = tags
+	}
+	if notes != nil {
+		m.Notes = *notes
+	}
+	s.files[name] = m
+	return m, saveJSON(s.path, s.files)
+}
+
+func (s *metaStore) forget(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[name]; !ok {
+		return nil
+	}
+	delete(s.files, name)
+	return saveJSON(s.path, s.files)
+}
+
+// move carries metadata over when a file or directory is renamed.
+func (s *metaStore) move(from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	moved := map[string]string{}
+	for name := range s.files {
+		if dest, ok := movedPath(name, from, to); ok {
+			moved[name] = dest
+		}
+	}
+	if len(moved) == 0 {
+		return nil
+	}
+	entries := map[string]fileMeta{}
+	for name, dest := range moved {
+		entries[dest] = s.files[name]
+		delete(s.files, name)
+	}
+	for dest, m := range entries {
+		s.files[dest] = m
+	}
+	return saveJSON(s.path, s.files)
+}
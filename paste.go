@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Snippets of text pasted into the interface or sent to /api/paste are
+// stored as ordinary files in pasteDir, under a random id, so quotas,
+// retention, search and the file browser all treat them like any upload.
+const (
+	pasteDir     = "pastes"
+	maxPasteSize = 1 << 20
+)
+
+// pasteLanguages maps the language hints a snippet may carry to the
+// extension it is stored with, which is what the preview highlights by.
+// Markup that browsers would render, such as HTML and SVG, is stored as
+// plain text so that downloading it never runs anything.
+var pasteLanguages = map[string]string{
+	"text":       "txt",
+	"log":        "log",
+	"shell":      "sh",
+	"bash":       "sh",
+	"sh":         "sh",
+	"powershell": "ps1",
+	"go":         "go",
+	"python":     "py",
+	"javascript": "js",
+	"typescript": "ts",
+	"json":       "json",
+	"yaml":       "yaml",
+	"toml":       "toml",
+	"ini":        "ini",
+	"sql":        "sql",
+	"diff":       "diff",
+	"markdown":   "md",
+	"c":          "c",
+	"cpp":        "cpp",
+	"csharp":     "cs",
+	"java":       "java",
+	"kotlin":     "kt",
+	"rust":       "rs",
+	"ruby":       "rb",
+	"php":        "php",
+	"perl":       "pl",
+	"lua":        "lua",
+	"css":        "css",
+	"html":       "txt",
+	"xml":        "txt",
+	"svg":        "txt",
+}
+
+// pasteInfo is what the API reports about a stored snippet.
+type pasteInfo struct {
+	ID       string     `json:"id"`
+	Path     string     `json:"path"`
+	Language string     `json:"language,omitempty"`
+	Size     int64      `json:"size"`
+	URL      string     `json:"url"`
+	RawURL   string     `json:"raw_url"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+// pasteRequest is a snippet as sent to /api/paste, either as JSON or as a
+// raw body with the other fields in the query string.
+type pasteRequest struct {
+	Content  string `json:"content"`
+	Language string `json:"language"`
+	TTL      string `json:"ttl"`
+	Tags     string `json:"tags"`
+}
+
+// readPasteRequest decodes a snippet from a JSON body, or takes the body as
+// the snippet itself, which is what "curl --data-binary @file" sends.
+func readPasteRequest(w http.ResponseWriter, r *http.Request) (pasteRequest, error) {
+	var req pasteRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		// JSON escaping can double the size of the text it carries.
+		body := http.MaxBytesReader(w, r.Body, 2*maxPasteSize+4096)
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			return req, &uploadError{http.StatusBadRequest, "INVALID_PASTE", "invalid request: " + err.Error()}
+		}
+	} else {
+		q := r.URL.Query()
+		req.Language, req.TTL, req.Tags = q.Get("language"), q.Get("ttl"), q.Get("tags")
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxPasteSize+1))
+		if err != nil {
+			return req, &uploadError{http.StatusBadRequest, "READ_FAILED", err.Error()}
+		}
+		req.Content = string(body)
+	}
+
+	switch {
+	case req.Content == "":
+		return req, &uploadError{http.StatusBadRequest, "INVALID_PASTE", "snippet is empty"}
+	case len(req.Content) > maxPasteSize:
+		return req, &uploadError{http.StatusRequestEntityTooLarge, "PASTE_TOO_LARGE", "snippets are limited to 1 MB; upload larger text as a file"}
+	case !utf8.ValidString(req.Content):
+		return req, &uploadError{http.StatusBadRequest, "INVALID_PASTE", "snippets must be UTF-8 text"}
+	}
+	return req, nil
+}
+
+// handlePaste serves POST /api/paste, which stores a snippet of text under
+// a generated name and answers with the short URL it can be read at:
+//
+//	{"content", "language", "ttl", "tags"}
+func (u *uploader) handlePaste(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req, err := readPasteRequest(w, r)
+	if err != nil {
+		u.reject(w, r, pasteDir, err)
+		return
+	}
+
+	lang := strings.ToLower(strings.TrimSpace(req.Language))
+	ext := "txt"
+	if lang != "" {
+		var ok bool
+		if ext, ok = pasteLanguages[lang]; !ok {
+			u.reject(w, r, pasteDir, &uploadError{http.StatusBadRequest, "INVALID_LANGUAGE", "unknown language " + lang})
+			return
+		}
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		if ttl, err = parseTTL(req.TTL); err != nil {
+			u.reject(w, r, pasteDir, &uploadError{http.StatusBadRequest, "INVALID_TTL", err.Error()})
+			return
+		}
+	}
+	meta := requestMeta(r, "paste")
+	meta.Language = lang
+	if err := annotateFromForm(&meta, req.Tags, ""); err != nil {
+		u.reject(w, r, pasteDir, err)
+		return
+	}
+
+	id := randomID(6)
+	name := path.Join(pasteDir, id+"."+ext)
+	ev, err := u.save(clientIP(r), name, strings.NewReader(req.Content), int64(len(req.Content)), saveOptions{types: u.types, createOnly: true, meta: meta})
+	if err != nil {
+		u.reject(w, r, name, err)
+		return
+	}
+	info := pasteInfo{ID: id, Path: name, Language: lang, Size: ev.Size}
+	if ttl > 0 {
+		expires := time.Now().Add(ttl).UTC()
+		if err := u.retention.setExpiry(name, expires); err != nil {
+			log.Printf("Failed to record retention for %s: %v", name, err)
+		}
+		info.Expires = &expires
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	info.URL = scheme + "://" + r.Host + "/p/" + id
+	info.RawURL = info.URL + "/raw"
+	u.finish(w, ev)
+	writeJSON(w, http.StatusCreated, info)
+}
+
+var errPasteNotFound = errors.New("snippet not found")
+
+// findPaste returns the stored name of the snippet with the given id.
+func (u *uploader) findPaste(id string) (string, error) {
+	if id == "" || len(id) > 16 || strings.Trim(id, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+		return "", errPasteNotFound
+	}
+	entries, err := u.store.readDir(pasteDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", errPasteNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		base := path.Base(e.Name)
+		if !e.IsDir && strings.TrimSuffix(base, path.Ext(base)) == id {
+			return e.Name, nil
+		}
+	}
+	return "", errPasteNotFound
+}
+
+// wantsRaw reports whether a client reading a snippet should get the bare
+// text rather than a page: anything that does not ask for HTML, like curl.
+func wantsRaw(r *http.Request) bool {
+	return !strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// handlePasteView serves /p/{id}, a snippet shown on a page of its own, and
+// /p/{id}/raw, the text alone. Clients that do not ask for HTML get the
+// text at either address.
+func (u *uploader) handlePasteView(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/p/")
+	raw := strings.HasSuffix(id, "/raw")
+	id = strings.TrimSuffix(id, "/raw")
+
+	name, err := u.findPaste(id)
+	if err == errPasteNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to find snippet: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The janitor may not have run since the snippet expired.
+	expires, hasExpiry := u.retention.expiry(name)
+	if hasExpiry && !time.Now().Before(expires) {
+		http.Error(w, "snippet has expired", http.StatusGone)
+		return
+	}
+	if raw || wantsRaw(r) {
+		servePreview(w, r, u.store, name)
+		return
+	}
+
+	f, err := u.store.open(name)
+	if err != nil {
+		http.Error(w, "Failed to open snippet: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	text, err := io.ReadAll(io.LimitReader(f, maxPasteSize))
+	if err != nil {
+		http.Error(w, "Failed to read snippet: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page := pastePageData{
+		ID:    id,
+		Path:  name,
+		Size:  int64(len(text)),
+		Lines: strings.Split(strings.TrimSuffix(strings.ToValidUTF8(string(text), "\uFFFD"), "\n"), "\n"),
+	}
+	if m, ok := u.meta.get(name); ok {
+		page.Language = m.Language
+		page.Created = m.Uploaded
+	}
+	if hasExpiry {
+		page.Expires = expires
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if err := pasteTemplate.Execute(w, page); err != nil {
+		log.Printf("Failed to render snippet %s: %v", id, err)
+	}
+}
+
+// pastePageData is what the snippet page shows.
+type pastePageData struct {
+	ID       string
+	Path     string
+	Language string
+	Size     int64
+	Created  time.Time
+	Expires  time.Time
+	Lines    []string
+}
+
+var pasteTemplate = template.Must(template.New("paste").Parse(pastePage))
+
+const pastePage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<meta name="viewport" content="width=device-width, initial-scale=1.0">
+<title>NOSTROMO SNIPPET {{.ID}}</title>
+<style>
+body { background: #000; color: #5cdb5c; font-family: 'Share Tech Mono', monospace; padding: 30px; margin: 0; }
+.header { border-bottom: 1px solid #93e293; padding-bottom: 12px; margin-bottom: 16px; }
+.header a { color: #93e293; margin-right: 16px; }
+.meta { opacity: 0.8; font-size: 14px; margin: 6px 0 10px; }
+pre { background: #001100; border: 1px solid #93e293; padding: 12px 0; overflow-x: auto; margin: 0; counter-reset: line; }
+pre span { display: block; padding: 0 12px; white-space: pre; }
+pre span::before { counter-increment: line; content: counter(line); display: inline-block; width: 4em; margin-right: 12px; text-align: right; opacity: 0.5; }
+</style>
+</head>
+<body>
+<div class="header">
+<div>&gt;_ MU/TH/UR 6000: TEXT TRANSMISSION {{.ID}}</div>
+<div class="meta">{{if .Language}}LANGUAGE: {{.Language}} | {{end}}{{.Size}} BYTES{{if not .Created.IsZero}} | RECEIVED {{.Created.Format "2006-01-02 15:04 MST"}}{{end}}{{if not .Expires.IsZero}} | EXPIRES {{.Expires.Format "2006-01-02 15:04 MST"}}{{end}}</div>
+<a href="/p/{{.ID}}/raw">RAW</a><a href="/dav/{{.Path}}" download>DOWNLOAD</a>
+</div>
+<pre>{{range .Lines}}<span>{{.}}</span>{{end}}</pre>
+</body>
+</html>`
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"strings"
+)
+
+// pdfText pulls the readable text out of a PDF, up to limit bytes of it. It
+// reads the text-showing operators of uncompressed and Flate-compressed
+// content streams, which covers PDFs written with standard font encodings;
+// text drawn with embedded glyph mappings comes out as nothing rather than
+// as garbage. It is meant for search, not faithful reproduction.
+func pdfText(data []byte, limit int) string {
+	var out strings.Builder
+	for len(data) > 0 && out.Len() < limit {
+		i := bytes.Index(data, []byte("stream"))
+		if i < 0 {
+			break
+		}
+		// Skip "endstream", and find where the stream data starts.
+		if i >= 3 && string(data[i-3:i]) == "end" {
+			data = data[i+6:]
+			continue
+		}
+		from := i - 1024
+		if from < 0 {
+			from = 0
+		}
+		dict := data[from:i]
+		if j := bytes.LastIndex(dict, []byte("obj")); j >= 0 {
+			dict = dict[j:]
+		}
+		start := i + 6
+		if start < len(data) && data[start] == '\r' {
+			start++
+		}
+		if start < len(data) && data[start] == '\n' {
+			start++
+		}
+		end := bytes.Index(data[start:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		body := data[start : start+end]
+		data = data[start+end+9:]
+
+		// Only content streams hold text. Images and fonts are skipped by
+		// their dictionaries; anything left that is not Flate or plain is
+		// encoded in a way not worth decoding for search.
+		if bytes.Contains(dict, []byte("/Subtype")) || bytes.Contains(dict, []byte("/Type/XObject")) ||
+			bytes.Contains(dict, []byte("/Length1")) || bytes.Contains(dict, []byte("/Type /XObject")) {
+			continue
+		}
+		if bytes.Contains(dict, []byte("/Filter")) {
+			if !bytes.Contains(dict, []byte("/FlateDecode")) || bytes.Count(dict, []byte("Decode")) > 1 {
+				continue
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(body))
+			if err != nil {
+				continue
+			}
+			inflated, _ := io.ReadAll(io.LimitReader(zr, int64(limit)*4))
+			zr.Close()
+			body = inflated
+		}
+		pdfContentText(body, &out)
+	}
+	s := out.String()
+	if len(s) > limit {
+		s = s[:limit]
+	}
+	return s
+}
+
+// pdfContentText appends the strings shown by the text operators in a
+// content stream to out.
+func pdfContentText(content []byte, out *strings.Builder) {
+	var pending []string
+	inArray := false
+	flush := func(sep string) {
+		for _, s := range pending {
+			out.WriteString(s)
+		}
+		if len(pending) > 0 {
+			out.WriteString(sep)
+		}
+		pending = pending[:0]
+	}
+
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case c == '(':
+			s, n := pdfLiteral(content[i:])
+			pending = append(pending, s)
+			i += n
+		case c == '<' && i+1 < len(content) && content[i+1] != '<':
+			end := bytes.IndexByte(content[i:], '>')
+			if end < 0 {
+				return
+			}
+			pending = append(pending, pdfHex(content[i+1:i+end]))
+			i += end + 1
+		case c == '[':
+			inArray = true
+			i++
+		case c == ']':
+			inArray = false
+			i++
+		case c == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+			// A large negative kerning inside a TJ array is a word gap.
+			start := i
+			for i < len(content) && (content[i] == '-' || content[i] == '.' || (content[i] >= '0' && content[i] <= '9')) {
+				i++
+			}
+			if inArray && c == '-' && i-start >= 4 {
+				pending = append(pending, " ")
+			}
+		case c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c == '\'' || c == '"' || c == '*':
+			start := i
+			for i < len(content) && (content[i] >= 'A' && content[i] <= 'Z' || content[i] >= 'a' && content[i] <= 'z' || content[i] == '*' || content[i] == '\'' || content[i] == '"') {
+				i++
+			}
+			switch string(content[start:i]) {
+			case "Tj", "TJ":
+				flush(" ")
+			case "'", "\"":
+				out.WriteString("\n")
+				flush(" ")
+			case "Td", "TD", "T*", "Tm":
+				out.WriteString(" ")
+			case "ET":
+				out.WriteString("\n")
+			default:
+				if !inArray {
+					pending = pending[:0]
+				}
+			}
+		default:
+			i++
+		}
+	}
+}
+
+// pdfLiteral decodes the literal string at the start of b, which begins
+// with "(", and returns it with the number of bytes it took.
+func pdfLiteral(b []byte) (string, int) {
+	var s []byte
+	depth := 0
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch c {
+		case '(':
+			if depth > 0 {
+				s = append(s, c)
+			}
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return printable(s), i + 1
+			}
+			s = append(s, c)
+		case '\\':
+			i++
+			if i >= len(b) {
+				return printable(s), i
+			}
+			switch e := b[i]; e {
+			case 'n':
+				s = append(s, '\n')
+			case 'r', 't', 'b', 'f':
+				s = append(s, ' ')
+			case '\r', '\n':
+				// A line continuation.
+			default:
+				if e >= '0' && e <= '7' {
+					v := 0
+					for k := 0; k < 3 && i < len(b) && b[i] >= '0' && b[i] <= '7'; k++ {
+						v = v*8 + int(b[i]-'0')
+						i++
+					}
+					i--
+					s = append(s, byte(v))
+				} else {
+					s = append(s, e)
+				}
+			}
+		default:
+			s = append(s, c)
+		}
+	}
+	return printable(s), len(b)
+}
+
+// pdfHex decodes a hex string, keeping it only if it is readable text.
+func pdfHex(h []byte) string {
+	var b []byte
+	var hi byte
+	odd := false
+	for _, c := range h {
+		var v byte
+		switch {
+		case c >= '0' && c <= '9':
+			v = c - '0'
+		case c >= 'a' && c <= 'f':
+			v = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			v = c - 'A' + 10
+		default:
+			continue
+		}
+		if odd {
+			b = append(b, hi<<4|v)
+		} else {
+			hi = v
+		}
+		odd = !odd
+	}
+	if odd {
+		b = append(b, hi<<4)
+	}
+	for _, c := range b {
+		if c < 0x20 && c != '\n' && c != '\t' {
+			return ""
+		}
+	}
+	return printable(b)
+}
+
+// printable turns PDF string bytes into text. Bytes are taken as Latin-1,
+// which PDFDocEncoding and WinAnsiEncoding agree with for letters, and
+// control characters become spaces.
+func printable(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		if c < 0x20 || c == 0x7f {
+			sb.WriteByte(' ')
+			continue
+		}
+		sb.WriteRune(rune(c))
+	}
+	return sb.String()
+}
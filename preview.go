@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// previewTypes are the media types the browser is trusted to show inline,
+// by extension. Other files are previewed as plain text if they look like
+// text, and not at all otherwise. HTML and SVG are deliberately missing, so
+// they can only ever be shown as their source.
+var previewTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".pdf":  "application/pdf",
+	".mp3":  "audio/mpeg",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".ogv":  "video/ogg",
+	".mov":  "video/quicktime",
+}
+
+// textSniffLen is how much of a file is checked to decide whether it can
+// be previewed as text.
+const textSniffLen = 8 << 10
+
+// previewHeaders locks down a preview response so that whatever a file
+// contains, it cannot run script with the server's origin. The sandbox
+// gives the document a unique origin of its own; PDFs are left out of it
+// because browsers refuse to run their PDF viewers in a sandbox, but PDF
+// scripts never run in the page's origin anyway.
+func previewHeaders(w http.ResponseWriter, contentType string) {
+	csp := "default-src 'none'; img-src 'self'; media-src 'self'; style-src 'unsafe-inline'; frame-ancestors 'self'"
+	if contentType != "application/pdf" {
+		csp += "; sandbox"
+	}
+	w.Header().Set("Content-Security-Policy", csp)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cross-Origin-Resource-Policy", "same-origin")
+}
+
+// previewType works out the type a stored file is previewed as, from its
+// extension or, for text, its first bytes. It returns "" for files that
+// have no preview.
+func previewType(name string, f io.ReadSeeker) (string, error) {
+	if t, ok := previewTypes[strings.ToLower(path.Ext(name))]; ok {
+		return t, nil
+	}
+	head := make([]byte, textSniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	head = head[:n]
+	if bytes.IndexByte(head, 0) >= 0 {
+		return "", nil
+	}
+	// The sniffed prefix may end partway through a character.
+	for i := 0; i < utf8.UTFMax && len(head) > 0 && !utf8.Valid(head); i++ {
+		head = head[:len(head)-1]
+	}
+	if !utf8.Valid(head) {
+		return "", nil
+	}
+	return "text/plain; charset=utf-8", nil
+}
+
+// servePreview sends a stored file to be shown inline, with a type from
+// previewTypes or as plain text, and never as anything the browser would
+// run. Range requests are supported so media can seek and long text can be
+// read in part.
+func servePreview(w http.ResponseWriter, r *http.Request, store storage, name string) {
+	info, err := store.stat(name)
+	if err != nil || info.IsDir {
+		if err == nil || errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to open file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f, err := store.open(name)
+	if err != nil {
+		http.Error(w, "Failed to open file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	contentType, err := previewType(name, f)
+	if err != nil {
+		http.Error(w, "Failed to read file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if contentType == "" {
+		http.Error(w, "No preview for this type of file", http.StatusUnsupportedMediaType)
+		return
+	}
+	base := path.Base(name)
+	previewHeaders(w, contentType)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", disposition("inline", base))
+	http.ServeContent(w, r, base, info.ModTime, f)
+}
+
+// handlePreview serves GET /api/preview/{path}, a stored file as the
+// preview modal shows it.
+func handlePreview(store storage, uploadDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name, _, err := resolveUploadPath(uploadDir, strings.TrimPrefix(r.URL.Path, "/api/preview/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		servePreview(w, r, store, name)
+	}
+}
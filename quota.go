@@ -0,0 +1,381 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// byteSize is a flag value that accepts plain byte counts as well as sizes
+// with a unit suffix such as 512KB, 20MB or 2GB.
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	n, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(n)
+	return nil
+}
+
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+		{"B", 1},
+	}
+	scale := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			scale = u.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxInt64/scale {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return n * scale, nil
+}
+
+// uploadError is an upload failure reported to the client with a specific
+// status and a short code, so the UI console can show why it was refused.
+type uploadError struct {
+	status int
+	code   string
+	msg    string
+}
+
+func (e *uploadError) Error() string {
+	return e.code + ": " + e.msg
+}
+
+// writeUploadError sends err to the client, using the status and code of an
+// uploadError when there is one.
+func writeUploadError(w http.ResponseWriter, err error) {
+	if ue, ok := err.(*uploadError); ok {
+		http.Error(w, ue.Error(), ue.status)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// clientIP returns the address uploads are accounted against. There is no
+// authentication, so the remote IP is the only notion of a user we have.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// quotaLimits holds the configured limits. A zero value means unlimited.
+type quotaLimits struct {
+	TotalBytes     int64
+	PerClientBytes int64
+	MaxFileSize    int64
+	MaxFiles       int
+	PerClientFiles int
+}
+
+type quotaEntry struct {
+	Owner string `json:"owner"`
+	Size  int64  `json:"size"`
+}
+
+// quotaStore tracks how much each client has stored. Usage is keyed by the
+// stored file name and persisted to disk so it survives restarts.
+type quotaStore struct {
+	mu      sync.Mutex
+	path    string
+	limits  quotaLimits
+	files   map[string]quotaEntry
+	pending map[string]int64
+}
+
+func loadQuotaStore(path string, limits quotaLimits) (*quotaStore, error) {
+	q := &quotaStore{
+		path:    path,
+		limits:  limits,
+		files:   make(map[string]quotaEntry),
+		pending: make(map[string]int64),
+	}
+	if err := loadJSON(path, &q.files); err != nil {
+		return nil, fmt.Errorf("loading quota usage: %w", err)
+	}
+	return q, nil
+}
+
+// usage returns the stored bytes and file count for owner, or for everyone
+// when owner is empty. Callers must hold q.mu.
+func (q *quotaStore) usage(owner string) (bytes int64, files int) {
+	for _, e := range q.files {
+		if owner == "" || e.Owner == owner {
+			bytes += e.Size
+			files++
+		}
+	}
+	for o, n := range q.pending {
+		if owner == "" || o == owner {
+			bytes += n
+		}
+	}
+	return bytes, files
+}
+
+// counts returns the stored bytes and file count for everyone and for owner,
+// leaving out a file under name, which is about to be replaced. Callers must
+// hold q.mu.
+func (q *quotaStore) counts(owner, name string) (totalBytes int64, totalFiles int, ownerBytes int64, ownerFiles int) {
+	totalBytes, totalFiles = q.usage("")
+	ownerBytes, ownerFiles = q.usage(owner)
+	if e, ok := q.files[name]; ok {
+		totalBytes -= e.Size
+		totalFiles--
+		if e.Owner == owner {
+			ownerBytes -= e.Size
+			ownerFiles--
+		}
+	}
+	return totalBytes, totalFiles, ownerBytes, ownerFiles
+}
+
+// room returns how many more bytes owner may send for a file under name of
+// which held bytes are already accounted for, or -1 if nothing limits it.
+// Callers must hold q.mu.
+func (q *quotaStore) room(owner, name string, held int64) int64 {
+	l := q.limits
+	totalBytes, _, ownerBytes, _ := q.counts(owner, name)
+	limit := int64(-1)
+	remaining := func(max, used int64) {
+		if max <= 0 {
+			return
+		}
+		left := max - used
+		if left < 0 {
+			left = 0
+		}
+		if limit < 0 || left < limit {
+			limit = left
+		}
+	}
+	remaining(l.TotalBytes, totalBytes)
+	remaining(l.PerClientBytes, ownerBytes)
+	remaining(l.MaxFileSize, held)
+	return limit
+}
+
+// reserve checks an upload of size bytes from owner against the limits and
+// holds that space until commit or cancel is called. A negative size means
+// the length is unknown: nothing is held up front, the returned
+// reservation's limit is the most the client may still send, and the body
+// should be read through reader so space is held as it arrives.
+func (q *quotaStore) reserve(owner, name string, size int64) (*quotaReservation, error) {
+	return q.hold(owner, name, name, size)
+}
+
+// reserveAlongside is reserve for an upload over a file that is kept, in
+// the trash, rather than replaced, so its space is not given back.
+func (q *quotaStore) reserveAlongside(owner, name string, size int64) (*quotaReservation, error) {
+	return q.hold(owner, name, "", size)
+}
+
+// hold reserves space for name, giving back what the file replaced uses.
+func (q *quotaStore) hold(owner, name, replaced string, size int64) (*quotaReservation, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l := q.limits
+	if l.MaxFileSize > 0 && size > l.MaxFileSize {
+		return nil, &uploadError{http.StatusRequestEntityTooLarge, "FILE_TOO_LARGE",
+			fmt.Sprintf("%d bytes exceeds the per-file limit of %d bytes", size, l.MaxFileSize)}
+	}
+
+	// Space held by a file being overwritten is given back first.
+	_, totalFiles, _, ownerFiles := q.counts(owner, replaced)
+	if l.MaxFiles > 0 && totalFiles >= l.MaxFiles {
+		return nil, &uploadError{http.StatusInsufficientStorage, "QUOTA_EXCEEDED",
+			fmt.Sprintf("server file limit of %d reached", l.MaxFiles)}
+	}
+	if l.PerClientFiles > 0 && ownerFiles >= l.PerClientFiles {
+		return nil, &uploadError{http.StatusInsufficientStorage, "QUOTA_EXCEEDED",
+			fmt.Sprintf("file limit of %d for %s reached", l.PerClientFiles, owner)}
+	}
+
+	limit := q.room(owner, replaced, 0)
+	if limit >= 0 && size > limit {
+		return nil, &uploadError{http.StatusInsufficientStorage, "QUOTA_EXCEEDED",
+			fmt.Sprintf("%d bytes requested but only %d bytes of quota remain", size, limit)}
+	}
+	if limit == 0 {
+		return nil, &uploadError{http.StatusInsufficientStorage, "QUOTA_EXCEEDED", "no quota remaining"}
+	}
+
+	held := size
+	if held < 0 {
+		held = 0
+	}
+	q.pending[owner] += held
+	return &quotaReservation{q: q, owner: owner, name: name, replaced: replaced, held: held, limit: limit}, nil
+}
+
+// release forgets the usage recorded for name, for example after the file
+// has been deleted.
+func (q *quotaStore) release(name string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.files[name]; !ok {
+		return nil
+	}
+	delete(q.files, name)
+	return saveJSON(q.path, q.files)
+}
+
+// owner returns the client that stored name, if it is known.
+func (q *quotaStore) owner(name string) (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.files[name]
+	return e.Owner, ok
+}
+
+// move carries the usage recorded for from, or for everything under it if
+// it is a directory, over to its new name.
+func (q *quotaStore) move(from, to string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	moved := map[string]string{}
+	for name := range q.files {
+		if dest, ok := movedPath(name, from, to); ok {
+			moved[name] = dest
+		}
+	}
+	if len(moved) == 0 {
+		return nil
+	}
+	for name, dest := range moved {
+		e := q.files[name]
+		delete(q.files, name)
+		q.files[dest] = e
+	}
+	return saveJSON(q.path, q.files)
+}
+
+// quotaReservation is space held for an upload that is still in progress.
+type quotaReservation struct {
+	q     *quotaStore
+	owner string
+	name  string
+	// replaced is the file whose space the upload takes over: name, or
+	// nothing if that file is kept.
+	replaced string
+	held     int64
+	limit    int64
+	done     bool
+}
+
+// quotaStep is how far ahead of what it has received an upload of unknown
+// length holds space, so the store is not consulted for every read.
+const quotaStep = 1 << 20
+
+// grow holds up to n more bytes, as far as the limits allow, for an upload
+// of unknown length.
+func (r *quotaReservation) grow(n int64) {
+	q := r.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if r.done {
+		return
+	}
+	if limit := q.room(r.owner, r.replaced, r.held); limit >= 0 && n > limit {
+		n = limit
+	}
+	r.held += n
+	q.pending[r.owner] += n
+}
+
+// reader returns body wrapped so that space is held for what is read from
+// it, failing once the limits are reached. Concurrent uploads then only see
+// what this one has actually received, rather than all of its allowance.
+func (r *quotaReservation) reader(body io.Reader) io.Reader {
+	return &quotaReader{r: body, res: r}
+}
+
+type quotaReader struct {
+	r    io.Reader
+	res  *quotaReservation
+	read int64
+}
+
+func (qr *quotaReader) Read(p []byte) (int, error) {
+	n, err := qr.r.Read(p)
+	qr.read += int64(n)
+	if qr.read > qr.res.held {
+		need := qr.read - qr.res.held
+		if need < quotaStep {
+			need = quotaStep
+		}
+		qr.res.grow(need)
+		if qr.read > qr.res.held {
+			return 0, &uploadError{http.StatusInsufficientStorage, "QUOTA_EXCEEDED",
+				fmt.Sprintf("upload exceeds the %d bytes of quota remaining", qr.res.held)}
+		}
+	}
+	return n, err
+}
+
+// commit records the final size of the stored file against the owner.
+func (r *quotaReservation) commit(size int64) error {
+	q := r.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	r.finish()
+	q.files[r.name] = quotaEntry{Owner: r.owner, Size: size}
+	return saveJSON(q.path, q.files)
+}
+
+// rename records the upload under name instead, when it had to be stored
+// under another name than the one it was reserved for.
+func (r *quotaReservation) rename(name string) {
+	r.q.mu.Lock()
+	defer r.q.mu.Unlock()
+	r.name = name
+}
+
+// cancel gives back the held space without recording anything. It is safe
+// to call after commit.
+func (r *quotaReservation) cancel() {
+	r.q.mu.Lock()
+	defer r.q.mu.Unlock()
+	r.finish()
+}
+
+func (r *quotaReservation) finish() {
+	if r.done {
+		return
+	}
+	r.done = true
+	r.q.pending[r.owner] -= r.held
+	if r.q.pending[r.owner] <= 0 {
+		delete(r.q.pending, r.owner)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseByteSize(t *testing.T) {
+	cases := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"512", 512, true},
+		{"512KB", 512 << 10, true},
+		{"20 mb", 20 << 20, true},
+		{"2G", 2 << 30, true},
+		{"1TB", 1 << 40, true},
+		{"0", 0, true},
+		{"-1", 0, false},
+		{"lots", 0, false},
+		{"9223372036854775807", 9223372036854775807, true},
+		{"8388608TB", 0, false},
+		{"9223372036854775807K", 0, false},
+	}
+	for _, c := range cases {
+		got, err := parseByteSize(c.in)
+		if c.ok && (err != nil || got != c.want) {
+			t.Errorf("parseByteSize(%q) = %d, %v; want %d", c.in, got, err, c.want)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("parseByteSize(%q) = %d; want an error", c.in, got)
+		}
+	}
+}
+
+func newTestQuota(t *testing.T, limits quotaLimits) *quotaStore {
+	t.Helper()
+	q, err := loadQuotaStore(filepath.Join(t.TempDir(), "quota.json"), limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func quotaCode(err error) string {
+	var ue *uploadError
+	if errors.As(err, &ue) {
+		return ue.code
+	}
+	return ""
+}
+
+func TestReserveUnknownLengthHoldsOnlyWhatIsRead(t *testing.T) {
+	q := newTestQuota(t, quotaLimits{TotalBytes: 10 << 20})
+
+	streaming, err := q.reserve("10.0.0.1", "stream.bin", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer streaming.cancel()
+	if streaming.limit != 10<<20 {
+		t.Fatalf("limit = %d, want %d", streaming.limit, 10<<20)
+	}
+	n, err := io.Copy(io.Discard, streaming.reader(bytes.NewReader(make([]byte, 2<<20))))
+	if err != nil || n != 2<<20 {
+		t.Fatalf("read %d bytes, %v", n, err)
+	}
+
+	// Another client may use what the stream has not received yet.
+	other, err := q.reserve("10.0.0.2", "other.bin", 8<<20)
+	if err != nil {
+		t.Fatalf("concurrent upload refused while the stream holds %d bytes: %v", streaming.held, err)
+	}
+	other.cancel()
+	if _, err := q.reserve("10.0.0.2", "other.bin", 8<<20+1); quotaCode(err) != "QUOTA_EXCEEDED" {
+		t.Fatalf("reserving past the limit: %v", err)
+	}
+
+	streaming.cancel()
+	if len(q.pending) != 0 {
+		t.Fatalf("pending = %v after cancel, want nothing held", q.pending)
+	}
+}
+
+func TestReserveUnknownLengthStopsAtLimit(t *testing.T) {
+	q := newTestQuota(t, quotaLimits{PerClientBytes: 3 << 20})
+	res, err := q.reserve("10.0.0.1", "big.bin", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.cancel()
+	_, err = io.Copy(io.Discard, res.reader(bytes.NewReader(make([]byte, 4<<20))))
+	if quotaCode(err) != "QUOTA_EXCEEDED" {
+		t.Fatalf("reading past the limit: %v", err)
+	}
+	if res.held != 3<<20 {
+		t.Fatalf("held = %d, want the %d bytes allowed", res.held, 3<<20)
+	}
+}
+
+func TestReserveMaxFileSize(t *testing.T) {
+	q := newTestQuota(t, quotaLimits{MaxFileSize: 1000})
+	res, err := q.reserve("10.0.0.1", "exact.bin", 1000)
+	if err != nil {
+		t.Fatalf("file exactly at the limit refused: %v", err)
+	}
+	res.cancel()
+	if _, err := q.reserve("10.0.0.1", "over.bin", 1001); quotaCode(err) != "FILE_TOO_LARGE" {
+		t.Fatalf("file over the limit: %v", err)
+	}
+}
+
+func TestReserveCreditsOverwrite(t *testing.T) {
+	q := newTestQuota(t, quotaLimits{TotalBytes: 8 << 20, MaxFiles: 1})
+	res, err := q.reserve("10.0.0.1", "report.pdf", 5<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := res.commit(5 << 20); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replacing the file frees its space and its slot.
+	res, err = q.reserve("10.0.0.1", "report.pdf", 6<<20)
+	if err != nil {
+		t.Fatalf("overwrite refused: %v", err)
+	}
+	res.cancel()
+	if _, err := q.reserve("10.0.0.1", "other.pdf", 1); quotaCode(err) != "QUOTA_EXCEEDED" {
+		t.Fatalf("second file past MaxFiles: %v", err)
+	}
+}
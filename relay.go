@@ -0,0 +1,438 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Relays hand a file from one client to another without storing it: the
+// sender's request body is copied straight into the receiver's response, so
+// the sender can only go as fast as the receiver reads. Nothing is written
+// to the upload directory, which also means relayed files are not scanned,
+// checked against file type rules or counted against quotas.
+const (
+	maxRelays = 64
+	// maxClientRelays keeps one client from holding every code.
+	maxClientRelays = 4
+	relayCodeLen    = 8
+	relayCopySize   = 64 << 10
+	// maxRelayRequest bounds the JSON body that opens a relay.
+	maxRelayRequest = 4096
+)
+
+var (
+	errRelayNotFound = errors.New("no relay is waiting with that code")
+	errRelayToken    = errors.New("only the client that opened a relay can send on it")
+	errRelayBusy     = errors.New("relay is already in use")
+	errRelaysFull    = errors.New("too many relays open")
+	errClientRelays  = errors.New("too many relays open from this address")
+)
+
+// relayInfo is what the API reports about an open relay.
+type relayInfo struct {
+	Code    string    `json:"code"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+	// Token is only given to the sender, which sends it back with the file.
+	Token string `json:"token,omitempty"`
+}
+
+// relayReceiver is a waiting download, handed to the sender to write into.
+// The sender reports on done how the copy ended.
+type relayReceiver struct {
+	w    http.ResponseWriter
+	done chan error
+}
+
+// relaySlot is a relay waiting for its sender and receiver to meet.
+type relaySlot struct {
+	info     relayInfo
+	token    string
+	from     string
+	sending  bool
+	claimed  bool
+	receiver chan *relayReceiver
+}
+
+// relayHub pairs senders and receivers by one-time code. Codes are only
+// held in memory, and are given up once the transfer starts or the relay
+// times out.
+type relayHub struct {
+	mu      sync.Mutex
+	slots   map[string]*relaySlot
+	timeout time.Duration
+}
+
+func newRelayHub(timeout time.Duration) *relayHub {
+	return &relayHub{slots: make(map[string]*relaySlot), timeout: timeout}
+}
+
+// open reserves a code for a file about to be sent by client.
+func (h *relayHub) open(name string, size int64, client string) (*relaySlot, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.slots) >= maxRelays {
+		return nil, errRelaysFull
+	}
+	held := 0
+	for _, slot := range h.slots {
+		if slot.from == client {
+			held++
+		}
+	}
+	if held >= maxClientRelays {
+		return nil, errClientRelays
+	}
+	code := sessionCode(relayCodeLen)
+	for h.slots[code] != nil {
+		code = sessionCode(relayCodeLen)
+	}
+	slot := &relaySlot{
+		info:     relayInfo{Code: code, Name: name, Size: size, Expires: time.Now().Add(h.timeout).UTC()},
+		token:    randomID(18),
+		from:     client,
+		receiver: make(chan *relayReceiver),
+	}
+	h.slots[code] = slot
+	time.AfterFunc(h.timeout, func() {
+		if h.remove(slot) {
+			log.Printf("Relay %s of %s from %s expired", code, name, client)
+		}
+	})
+	return slot, nil
+}
+
+// remove gives up a relay's code, reporting whether it was still held.
+func (h *relayHub) remove(slot *relaySlot) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.slots[slot.info.Code] != slot {
+		return false
+	}
+	delete(h.slots, slot.info.Code)
+	return true
+}
+
+// get returns the relay with the given code.
+func (h *relayHub) get(code string) (*relaySlot, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	slot, ok := h.slots[strings.ToUpper(code)]
+	if !ok {
+		return nil, errRelayNotFound
+	}
+	return slot, nil
+}
+
+// attach marks one side of a relay as present: the sender, which must hold
+// the relay's token, or the receiver. Each side can only attach once at a
+// time.
+func (h *relayHub) attach(code, token string, sender bool) (*relaySlot, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	slot, ok := h.slots[strings.ToUpper(code)]
+	if !ok {
+		return nil, errRelayNotFound
+	}
+	if sender && subtle.ConstantTimeCompare([]byte(token), []byte(slot.token)) != 1 {
+		return nil, errRelayToken
+	}
+	side := &slot.claimed
+	if sender {
+		side = &slot.sending
+	}
+	if *side {
+		return nil, errRelayBusy
+	}
+	*side = true
+	return slot, nil
+}
+
+// detach lets another sender or receiver take the place of one that left
+// before the transfer began.
+func (h *relayHub) detach(slot *relaySlot, sender bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if sender {
+		slot.sending = false
+	} else {
+		slot.claimed = false
+	}
+}
+
+// relayError reports a relay error with a fitting status.
+func relayError(w http.ResponseWriter, err error) {
+	switch err {
+	case errRelayNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errRelayToken:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errRelayBusy:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errClientRelays:
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	default:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	}
+}
+
+// relayURL is where the receiver of a relay downloads it.
+func relayURL(r *http.Request, code string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/r/" + code
+}
+
+// handleRelay serves the relay API:
+//
+//	POST /api/relay         open a relay: {"name", "size"}
+//	GET  /api/relay/{code}  describe a waiting relay
+//	PUT  /api/relay/{code}  send the file, with X-Nostromo-Relay-Token
+func (h *relayHub) handleRelay(w http.ResponseWriter, r *http.Request) {
+	code := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/relay"), "/")
+	switch {
+	case code == "" && r.Method == http.MethodPost:
+		var req struct {
+			Name string `json:"name"`
+			Size int64  `json:"size"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRelayRequest)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		name, err := sanitizeFilename(req.Name)
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		slot, err := h.open(name, req.Size, clientIP(r))
+		if err != nil {
+			relayError(w, err)
+			return
+		}
+		info := slot.info
+		info.URL = relayURL(r, info.Code)
+		info.Token = slot.token
+		log.Printf("Relay %s opened for %s from %s", info.Code, name, slot.from)
+		writeJSON(w, http.StatusCreated, info)
+
+	case code != "" && r.Method == http.MethodGet:
+		slot, err := h.get(code)
+		if err != nil {
+			relayError(w, err)
+			return
+		}
+		info := slot.info
+		info.URL = relayURL(r, info.Code)
+		writeJSON(w, http.StatusOK, info)
+
+	case code != "" && r.Method == http.MethodPut:
+		h.send(w, r, code)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// send waits for the receiver of a relay and copies the request body to
+// it. The response only comes once the receiver has everything, or the
+// relay times out.
+func (h *relayHub) send(w http.ResponseWriter, r *http.Request, code string) {
+	slot, err := h.attach(code, r.Header.Get("X-Nostromo-Relay-Token"), true)
+	if err != nil {
+		relayError(w, err)
+		return
+	}
+	timer := time.NewTimer(time.Until(slot.info.Expires))
+	defer timer.Stop()
+	var rc *relayReceiver
+	select {
+	case rc = <-slot.receiver:
+	case <-timer.C:
+		http.Error(w, "RELAY_TIMEOUT: no receiver arrived in time", http.StatusRequestTimeout)
+		return
+	case <-r.Context().Done():
+		h.detach(slot, true)
+		return
+	}
+	h.remove(slot)
+
+	log.Printf("Relay %s: sending %s from %s", slot.info.Code, slot.info.Name, slot.from)
+	rw := rc.w
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("Content-Disposition", contentDisposition(slot.info.Name))
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	if r.ContentLength >= 0 {
+		rw.Header().Set("Content-Length", fmt.Sprint(r.ContentLength))
+	}
+	rw.WriteHeader(http.StatusOK)
+	n, err := io.CopyBuffer(rw, r.Body, make([]byte, relayCopySize))
+	if err == nil && r.ContentLength >= 0 && n != r.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	rc.done <- err
+	if err != nil {
+		log.Printf("Relay %s failed after %d bytes: %v", slot.info.Code, n, err)
+		http.Error(w, "RELAY_FAILED: transfer broke off: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	log.Printf("Relay %s: delivered %s (%d bytes)", slot.info.Code, slot.info.Name, n)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"code": slot.info.Code, "size": n})
+}
+
+// handleRelayReceive serves GET /r/{code}, which downloads a relayed file
+// as its sender sends it. It waits for the sender if need be, and each code
+// can only be received once.
+func (h *relayHub) handleRelayReceive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	slot, err := h.attach(strings.TrimPrefix(r.URL.Path, "/r/"), "", false)
+	if err != nil {
+		relayError(w, err)
+		return
+	}
+	rc := &relayReceiver{w: w, done: make(chan error, 1)}
+	timer := time.NewTimer(time.Until(slot.info.Expires))
+	defer timer.Stop()
+	select {
+	case slot.receiver <- rc:
+	case <-timer.C:
+		http.Error(w, "RELAY_TIMEOUT: the sender never started", http.StatusRequestTimeout)
+		return
+	case <-r.Context().Done():
+		h.detach(slot, false)
+		return
+	}
+	// A transfer that broke off must not look complete, so the connection
+	// is dropped rather than the response ended.
+	if err := <-rc.done; err != nil {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// runRelayCommand implements the "relay" subcommand, which sends a file
+// through a running server's relay, or receives one.
+func runRelayCommand(args []string) {
+	usage := "Usage: nostromo relay send [--server URL] FILE\n       nostromo relay receive [--server URL] [--out PATH] CODE|LINK"
+	if len(args) == 0 || (args[0] != "send" && args[0] != "receive") {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	flags := flag.NewFlagSet("relay "+args[0], flag.ExitOnError)
+	server := flags.String("server", "http://localhost:8080", "Address of the running server, with user:password@ if a proxy asks for one")
+	out := flags.String("out", "", "Where to save a received file (default: its own name in the current directory, - for standard output)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args[1:])
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	base := strings.TrimSuffix(*server, "/")
+	if args[0] == "send" {
+		relaySend(base, flags.Arg(0))
+	} else {
+		relayReceive(base, flags.Arg(0), *out)
+	}
+}
+
+// relaySend opens a relay for file and sends it once the receiver arrives.
+func relaySend(base, file string) {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := &http.Client{}
+	var relay relayInfo
+	body, _ := json.Marshal(map[string]interface{}{"name": path.Base(file), "size": info.Size()})
+	if err := apiRequest(client, http.MethodPost, base+"/api/relay", body, &relay); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("RELAY CODE %s\n%s\n", relay.Code, relay.URL)
+	fmt.Printf("Waiting for the receiver until %s\n", relay.Expires.Local().Format("15:04:05"))
+
+	req, err := http.NewRequest(http.MethodPut, base+"/api/relay/"+url.PathEscape(relay.Code), f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("X-Nostromo-Relay-Token", relay.Token)
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("relay failed: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	fmt.Printf("DELIVERED %s (%d bytes)\n", relay.Name, info.Size())
+}
+
+// relayReceive downloads the relay given by code, or by its whole link.
+func relayReceive(base, code, out string) {
+	if i := strings.LastIndex(code, "/r/"); i >= 0 {
+		code = code[i+3:]
+	}
+	resp, err := http.Get(base + "/r/" + url.PathEscape(code))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		log.Fatalf("server replied %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	dest := os.Stdout
+	if out != "-" {
+		if out == "" {
+			_, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+			if out, err = sanitizeFilename(params["filename"]); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if dest, err = os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	n, err := io.Copy(dest, resp.Body)
+	if cerr := dest.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		if dest != os.Stdout {
+			os.Remove(out)
+		}
+		log.Fatalf("transfer broke off after %d bytes: %v", n, err)
+	}
+	if dest != os.Stdout {
+		fmt.Fprintf(os.Stderr, "RECEIVED %s (%d bytes)\n", out, n)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRelayLimitsPerClient(t *testing.T) {
+	h := newRelayHub(time.Minute)
+	var first *relaySlot
+	for i := 0; i < maxClientRelays; i++ {
+		slot, err := h.open("a.bin", 1, "10.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = slot
+		}
+	}
+	if _, err := h.open("a.bin", 1, "10.0.0.1"); err != errClientRelays {
+		t.Fatalf("relay over the per-client cap: %v", err)
+	}
+	if _, err := h.open("a.bin", 1, "10.0.0.2"); err != nil {
+		t.Fatalf("another client: %v", err)
+	}
+
+	// A relay that is given up makes room again.
+	h.remove(first)
+	if _, err := h.open("a.bin", 1, "10.0.0.1"); err != nil {
+		t.Fatalf("after one lapsed: %v", err)
+	}
+}
+
+func TestRelayOpenBodyLimit(t *testing.T) {
+	h := newRelayHub(time.Minute)
+	body := `{"name": "a.bin", "size": 1, "pad": "` + strings.Repeat("x", maxRelayRequest) + `"}`
+	r := httptest.NewRequest(http.MethodPost, "/api/relay", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.handleRelay(w, r)
+	if w.Code != http.StatusBadRequest || len(h.slots) != 0 {
+		t.Fatalf("oversized request: %d, %d relays", w.Code, len(h.slots))
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/api/relay", strings.NewReader(`{"name": "a.bin", "size": 1}`))
+	w = httptest.NewRecorder()
+	h.handleRelay(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("open: %d %s", w.Code, w.Body)
+	}
+}
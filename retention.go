@@ -0,0 +1,369 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// retentionPolicy decides how long uploads are kept. Zero values disable the
+// corresponding rule.
+type retentionPolicy struct {
+	MaxAge   time.Duration
+	MaxTotal int64
+}
+
+// parseTTL parses a retention period. It accepts anything time.ParseDuration
+// does, plus whole days such as "7d".
+func parseTTL(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("invalid ttl %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid ttl %q", s)
+	}
+	return d, nil
+}
+
+// retentionStore remembers expiry times requested for individual uploads.
+type retentionStore struct {
+	mu      sync.Mutex
+	path    string
+	expires map[string]time.Time
+}
+
+func loadRetentionStore(path string) (*retentionStore, error) {
+	s := &retentionStore{path: path, expires: make(map[string]time.Time)}
+	if err := loadJSON(path, &s.expires); err != nil {
+		return nil, fmt.Errorf("loading retention data: %w", err)
+	}
+	return s, nil
+}
+
+func (s *retentionStore) setExpiry(name string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expires[name] = t
+	return saveJSON(s.path, s.expires)
+}
+
+func (s *retentionStore) forget(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.expires[name]; !ok {
+		return nil
+	}
+	delete(s.expires, name)
+	return saveJSON(s.path, s.expires)
+}
+
+// move carries expiry times over when a file or directory is renamed.
+func (s *retentionStore) move(from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	moved := map[string]string{}
+	for name := range s.expires {
+		if dest, ok := movedPath(name, from, to); ok {
+			moved[name] = dest
+		}
+	}
+	if len(moved) == 0 {
+		return nil
+	}
+	for name, dest := range moved {
+		t := s.expires[name]
+		delete(s.expires, name)
+		s.expires[dest] = t
+	}
+	return saveJSON(s.path, s.expires)
+}
+
+func (s *retentionStore) expiry(name string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.expires[name]
+	return t, ok
+}
+
+// janitorAction is a file the janitor removed, or would remove in a dry run.
+type janitorAction struct {
+	File   storedFile
+	Reason string
+}
+
+// janitor deletes uploads that have outlived the retention policy.
+type janitor struct {
+	files  storage
+	policy retentionPolicy
+	store  *retentionStore
+	quota  *quotaStore
+	meta   *metaStore
+	index  *searchIndex
+	thumbs *thumbCache
+	shares *shareStore
+}
+
+// uploaded returns when f was uploaded. That is recorded in its metadata,
+// since with --dedup the modification time is that of the first upload of
+// the same content; files stored without metadata fall back to it.
+func (j *janitor) uploaded(f storedFile) time.Time {
+	if j.meta != nil {
+		if m, ok := j.meta.get(f.Name); ok && !m.Uploaded.IsZero() {
+			return m.Uploaded
+		}
+	}
+	return f.ModTime
+}
+
+// content returns what holds the bytes of f: with --dedup its blob, which
+// other names may share, and otherwise the file itself.
+func (j *janitor) content(f storedFile) string {
+	if d, ok := j.files.(*dedupStorage); ok {
+		if sum, ok := d.blobOf(f.Name); ok {
+			return "blob:" + sum
+		}
+	}
+	return f.Name
+}
+
+// sweep works out which files are due for removal: first anything past its
+// expiry or older than the maximum age, then the oldest remaining files until
+// the total fits under the size cap. Unless dryRun is set the files are
+// deleted.
+func (j *janitor) sweep(now time.Time, dryRun bool) ([]janitorAction, error) {
+	files, err := j.files.list("")
+	if err != nil {
+		return nil, err
+	}
+
+	var actions []janitorAction
+	var kept []storedFile
+	var total int64
+	// names counts the kept files sharing each content, which takes up
+	// space only once.
+	names := map[string]int{}
+	for _, f := range files {
+		if t, ok := j.store.expiry(f.Name); ok && !now.Before(t) {
+			actions = append(actions, janitorAction{f, "ttl expired " + t.Format(time.RFC3339)})
+			continue
+		}
+		if j.policy.MaxAge > 0 && now.Sub(j.uploaded(f)) > j.policy.MaxAge {
+			actions = append(actions, janitorAction{f, "older than " + j.policy.MaxAge.String()})
+			continue
+		}
+		kept = append(kept, f)
+		c := j.content(f)
+		if names[c] == 0 {
+			total += f.Size
+		}
+		names[c]++
+	}
+
+	if j.policy.MaxTotal > 0 && total > j.policy.MaxTotal {
+		uploaded := make(map[string]time.Time, len(kept))
+		for _, f := range kept {
+			uploaded[f.Name] = j.uploaded(f)
+		}
+		sort.Slice(kept, func(a, b int) bool { return uploaded[kept[a].Name].Before(uploaded[kept[b].Name]) })
+		for _, f := range kept {
+			if total <= j.policy.MaxTotal {
+				break
+			}
+			actions = append(actions, janitorAction{f, "evicted to stay under " + strconv.FormatInt(j.policy.MaxTotal, 10) + " bytes"})
+			// Content still held under another name frees nothing yet.
+			c := j.content(f)
+			if names[c]--; names[c] == 0 {
+				total -= f.Size
+			}
+		}
+	}
+
+	if dryRun {
+		return actions, nil
+	}
+	done := actions[:0]
+	for _, a := range actions {
+		if err := j.files.remove(a.File.Name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Janitor failed to remove %s: %v", a.File.Name, err)
+			continue
+		}
+		j.forget(a.File.Name)
+		done = append(done, a)
+	}
+	return done, nil
+}
+
+// forget drops the bookkeeping kept for a file that no longer exists.
+func (j *janitor) forget(name string) {
+	if err := j.store.forget(name); err != nil {
+		log.Printf("Failed to update retention data for %s: %v", name, err)
+	}
+	if j.quota != nil {
+		if err := j.quota.release(name); err != nil {
+			log.Printf("Failed to update quota usage for %s: %v", name, err)
+		}
+	}
+	if j.meta != nil {
+		if err := j.meta.forget(name); err != nil {
+			log.Printf("Failed to update metadata for %s: %v", name, err)
+		}
+	}
+	j.index.remove(name)
+	if err := j.thumbs.forget(name); err != nil {
+		log.Printf("Failed to update thumbnails for %s: %v", name, err)
+	}
+	j.unshare(name)
+}
+
+// unshare revokes the share links to a file, or to anything in a
+// directory, that is gone from where it was shared.
+func (j *janitor) unshare(name string) {
+	if j.shares == nil {
+		return
+	}
+	if err := j.shares.forget(name); err != nil {
+		log.Printf("Failed to revoke share links to %s: %v", name, err)
+	}
+}
+
+// rename moves the bookkeeping for a file or directory that was renamed.
+func (j *janitor) rename(from, to string) {
+	if err := j.store.move(from, to); err != nil {
+		log.Printf("Failed to update retention data for %s: %v", to, err)
+	}
+	if j.quota != nil {
+		if err := j.quota.move(from, to); err != nil {
+			log.Printf("Failed to update quota usage for %s: %v", to, err)
+		}
+	}
+	if j.meta != nil {
+		if err := j.meta.move(from, to); err != nil {
+			log.Printf("Failed to update metadata for %s: %v", to, err)
+		}
+	}
+	j.index.move(from, to)
+	if err := j.thumbs.move(from, to); err != nil {
+		log.Printf("Failed to update thumbnails for %s: %v", to, err)
+	}
+	if j.shares != nil {
+		if err := j.shares.move(from, to); err != nil {
+			log.Printf("Failed to update share links for %s: %v", to, err)
+		}
+	}
+}
+
+// removeTree deletes a file, or a directory and everything in it, dropping
+// the quota, retention and metadata bookkeeping for each file.
+func (j *janitor) removeTree(f storedFile) error {
+	if f.IsDir {
+		children, err := j.files.readDir(f.Name)
+		if err != nil {
+			return err
+		}
+		for _, c := range children {
+			if err := j.removeTree(c); err != nil {
+				return err
+			}
+		}
+	}
+	if err := j.files.remove(f.Name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if !f.IsDir {
+		j.forget(f.Name)
+	}
+	return nil
+}
+
+// run sweeps the upload directory every interval, logging what it removes.
+func (j *janitor) run(interval time.Duration) {
+	for {
+		actions, err := j.sweep(time.Now(), false)
+		if err != nil {
+			log.Printf("Janitor sweep failed: %v", err)
+		}
+		for _, a := range actions {
+			log.Printf("Janitor removed %s (%d bytes): %s", a.File.Name, a.File.Size, a.Reason)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// runJanitorCommand implements the "janitor" subcommand, which performs a
+// single sweep from the command line. With --dry-run it only reports.
+func runJanitorCommand(args []string) {
+	flags := flag.NewFlagSet("janitor", flag.ExitOnError)
+	uploadDir := flags.String("dir", ".", "Upload directory to clean")
+	maxAge := flags.Duration("max-age", 0, "Remove files older than this, e.g. 72h (0 = keep forever)")
+	var maxTotal byteSize
+	flags.Var(&maxTotal, "max-total", "Evict the oldest files once the directory exceeds this size (0 = unlimited)")
+	dryRun := flags.Bool("dry-run", false, "Report what would be removed without deleting anything")
+	storageCfg := addStorageFlags(flags)
+	flags.Parse(args)
+
+	files, err := storageCfg.open(*uploadDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := loadRetentionStore(filepath.Join(stateDir(*uploadDir), "retention.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	quota, err := loadQuotaStore(filepath.Join(stateDir(*uploadDir), "quota.json"), quotaLimits{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	meta, err := loadMetaStore(filepath.Join(stateDir(*uploadDir), "metadata.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var thumbs *thumbCache
+	if !storageEncrypted(files) {
+		if thumbs, err = loadThumbCache(filepath.Join(stateDir(*uploadDir), "thumbs"), files); err != nil {
+			log.Fatal(err)
+		}
+	}
+	shares, err := loadShareStore(stateDir(*uploadDir))
+	if err != nil {
+		log.Fatal(err)
+	}
+	j := &janitor{
+		files:  files,
+		policy: retentionPolicy{MaxAge: *maxAge, MaxTotal: int64(maxTotal)},
+		store:  store,
+		quota:  quota,
+		meta:   meta,
+		thumbs: thumbs,
+		shares: shares,
+	}
+	actions, err := j.sweep(time.Now(), *dryRun)
+	if err != nil {
+		log.Fatalf("Janitor sweep failed: %v", err)
+	}
+
+	verb := "REMOVED"
+	if *dryRun {
+		verb = "WOULD REMOVE"
+	}
+	var freed int64
+	for _, a := range actions {
+		fmt.Printf("%s %s (%d bytes): %s\n", verb, a.File.Name, a.File.Size, a.Reason)
+		freed += a.File.Size
+	}
+	fmt.Printf("%d file(s), %d bytes\n", len(actions), freed)
+}
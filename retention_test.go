@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newDedupUploader returns an uploader and janitor sharing a deduplicated
+// store over a fresh upload directory.
+func newDedupUploader(t *testing.T, policy retentionPolicy) (*uploader, *janitor) {
+	t.Helper()
+	dir := t.TempDir()
+	state := stateDir(dir)
+	store, err := newDedupStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quota, err := loadQuotaStore(filepath.Join(state, "quota.json"), quotaLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	retention, err := loadRetentionStore(filepath.Join(state, "retention.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := loadMetaStore(filepath.Join(state, "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &uploader{uploadDir: dir, store: store, quota: quota, retention: retention, meta: meta}
+	return u, &janitor{files: store, policy: policy, store: retention, quota: quota, meta: meta}
+}
+
+func sweepNames(t *testing.T, j *janitor) []string {
+	t.Helper()
+	actions, err := j.sweep(time.Now(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, a := range actions {
+		names = append(names, a.File.Name)
+	}
+	return names
+}
+
+func TestSweepAgesDedupedFilesFromUpload(t *testing.T) {
+	u, j := newDedupUploader(t, retentionPolicy{MaxAge: time.Hour})
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if _, err := u.save("10.0.0.1", name, strings.NewReader("same"), 4, saveOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Both names are links to one blob, which carries the first upload's
+	// time; make that look long past.
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(u.uploadDir, "a.txt"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if names := sweepNames(t, j); len(names) != 0 {
+		t.Errorf("fresh uploads swept: %v", names)
+	}
+}
+
+func TestSweepCountsSharedContentOnce(t *testing.T) {
+	u, j := newDedupUploader(t, retentionPolicy{MaxTotal: 150})
+	for _, f := range []struct{ name, content string }{
+		{"a.txt", strings.Repeat("x", 100)},
+		{"b.txt", strings.Repeat("x", 100)},
+		{"c.txt", strings.Repeat("y", 50)},
+	} {
+		if _, err := u.save("10.0.0.1", f.name, strings.NewReader(f.content), int64(len(f.content)), saveOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if names := sweepNames(t, j); len(names) != 0 {
+		t.Errorf("evicted %v with 150 bytes on disk", names)
+	}
+
+	// Going over, evicting one of the shared names frees nothing, so the
+	// next oldest goes as well.
+	j.policy.MaxTotal = 149
+	if names := sweepNames(t, j); len(names) != 2 || names[0] != "a.txt" || names[1] != "b.txt" {
+		t.Errorf("evicted %v, want [a.txt b.txt]", names)
+	}
+}
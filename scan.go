@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// scanner checks a completed upload for malware. It returns the name of the
+// signature that matched, or "" if the content is clean.
+type scanner interface {
+	scan(r io.Reader) (string, error)
+}
+
+// clamdScanner streams content to a ClamAV daemon using the INSTREAM
+// command.
+type clamdScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// clamdChunkSize is the size of each INSTREAM chunk. It must stay below
+// clamd's StreamMaxLength, which defaults to 25MB.
+const clamdChunkSize = 64 << 10
+
+// newClamdScanner parses a clamd address: "tcp://host:port", "unix:///path",
+// a bare "host:port" or a bare socket path.
+func newClamdScanner(addr string, timeout time.Duration) (*clamdScanner, error) {
+	c := &clamdScanner{timeout: timeout}
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		c.network, c.address = "unix", strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "tcp://"):
+		c.network, c.address = "tcp", strings.TrimPrefix(addr, "tcp://")
+	case strings.HasPrefix(addr, "/"):
+		c.network, c.address = "unix", addr
+	default:
+		c.network, c.address = "tcp", addr
+	}
+	if c.address == "" {
+		return nil, fmt.Errorf("invalid clamd address %q", addr)
+	}
+	return c, nil
+}
+
+func (c *clamdScanner) scan(r io.Reader) (string, error) {
+	conn, err := net.DialTimeout(c.network, c.address, c.timeout)
+	if err != nil {
+		return "", fmt.Errorf("connecting to clamd: %w", err)
+	}
+	defer conn.Close()
+	if c.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	// The "z" prefix asks for NUL-terminated commands and replies.
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return "", fmt.Errorf("sending to clamd: %w", err)
+	}
+	buf := make([]byte, clamdChunkSize)
+	var size [4]byte
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			if _, err := conn.Write(size[:]); err != nil {
+				return "", fmt.Errorf("sending to clamd: %w", err)
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return "", fmt.Errorf("sending to clamd: %w", err)
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return "", rerr
+		}
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	if _, err := conn.Write(size[:]); err != nil {
+		return "", fmt.Errorf("sending to clamd: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && len(reply) == 0 {
+		return "", fmt.Errorf("reading clamd reply: %w", err)
+	}
+	return parseClamdReply(string(bytes.TrimRight(reply, "\x00\n")))
+}
+
+// parseClamdReply interprets "stream: OK", "stream: <name> FOUND" and
+// "... ERROR" replies.
+func parseClamdReply(reply string) (string, error) {
+	result := strings.TrimSpace(reply)
+	if i := strings.Index(result, ": "); i >= 0 {
+		result = result[i+2:]
+	}
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", strings.TrimSuffix(result, " ERROR"))
+	}
+}
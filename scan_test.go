@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd answers INSTREAM requests like clamd, reporting a signature for
+// any stream containing "EICAR". It records the chunk sizes it was sent.
+func fakeClamd(t *testing.T) (addr string, chunks chan []int) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	chunks = make(chan []int, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				cmd, err := r.ReadString(0)
+				if err != nil || cmd != "zINSTREAM\x00" {
+					io.WriteString(conn, "UNKNOWN COMMAND\x00")
+					return
+				}
+				var stream bytes.Buffer
+				var sizes []int
+				for {
+					var size [4]byte
+					if _, err := io.ReadFull(r, size[:]); err != nil {
+						return
+					}
+					n := binary.BigEndian.Uint32(size[:])
+					if n == 0 {
+						break
+					}
+					sizes = append(sizes, int(n))
+					if _, err := io.CopyN(&stream, r, int64(n)); err != nil {
+						return
+					}
+				}
+				chunks <- sizes
+				if bytes.Contains(stream.Bytes(), []byte("EICAR")) {
+					io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+				} else {
+					io.WriteString(conn, "stream: OK\x00")
+				}
+			}(conn)
+		}
+	}()
+	return ln.Addr().String(), chunks
+}
+
+func TestClamdScanner(t *testing.T) {
+	addr, chunks := fakeClamd(t)
+	c, err := newClamdScanner("tcp://"+addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clean := bytes.Repeat([]byte("a"), clamdChunkSize*2+10)
+	sig, err := c.scan(bytes.NewReader(clean))
+	if err != nil || sig != "" {
+		t.Fatalf("clean stream: %q, %v", sig, err)
+	}
+	sizes := <-chunks
+	total := 0
+	for _, n := range sizes {
+		if n > clamdChunkSize {
+			t.Errorf("chunk of %d bytes is larger than %d", n, clamdChunkSize)
+		}
+		total += n
+	}
+	if total != len(clean) {
+		t.Errorf("clamd received %d bytes, want %d", total, len(clean))
+	}
+
+	sig, err = c.scan(strings.NewReader("X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*"))
+	if err != nil || sig != "Eicar-Test-Signature" {
+		t.Fatalf("infected stream: %q, %v", sig, err)
+	}
+}
+
+func TestClamdUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	c, _ := newClamdScanner(addr, time.Second)
+	if _, err := c.scan(strings.NewReader("data")); err == nil {
+		t.Fatal("scan succeeded with clamd down")
+	}
+}
+
+func TestParseClamdReply(t *testing.T) {
+	if sig, err := parseClamdReply("stream: OK"); sig != "" || err != nil {
+		t.Errorf("OK reply: %q, %v", sig, err)
+	}
+	if sig, err := parseClamdReply("stream: Win.Test.EICAR_HDB-1 FOUND"); sig != "Win.Test.EICAR_HDB-1" || err != nil {
+		t.Errorf("FOUND reply: %q, %v", sig, err)
+	}
+	if _, err := parseClamdReply("INSTREAM size limit exceeded. ERROR"); err == nil {
+		t.Error("ERROR reply was not an error")
+	}
+}
+
+func TestScanFileQuarantinesEachUpload(t *testing.T) {
+	addr, _ := fakeClamd(t)
+	c, _ := newClamdScanner(addr, 5*time.Second)
+	u := &uploader{scanner: c, quarantineDir: filepath.Join(t.TempDir(), "quarantine")}
+
+	// Two rejected uploads of the same name in the same second must both
+	// be kept.
+	tmp := t.TempDir()
+	for i := 0; i < 2; i++ {
+		name := filepath.Join(tmp, "upload")
+		if err := os.WriteFile(name, []byte("EICAR"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := u.scanFile("10.0.0.1", name, "invoice.pdf")
+		if ue, ok := err.(*uploadError); !ok || ue.code != "MALWARE_DETECTED" {
+			t.Fatalf("scanFile: %v", err)
+		}
+	}
+	entries, err := os.ReadDir(u.quarantineDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("quarantine holds %d files, want 2", len(entries))
+	}
+}
+
+func TestMoveFileAcrossFilesystems(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(src, []byte("EICAR evidence"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// /dev/shm is a separate tmpfs on most Linux systems, where a plain
+	// rename fails with EXDEV.
+	other, err := os.MkdirTemp("/dev/shm", "quarantine-")
+	if err != nil {
+		t.Skip("no second filesystem to move to")
+	}
+	defer os.RemoveAll(other)
+
+	dst := filepath.Join(other, "evidence")
+	if err := moveFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(dst); err != nil || string(data) != "EICAR evidence" {
+		t.Fatalf("moved file: %q, %v", data, err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("source still there: %v", err)
+	}
+	if entries, _ := os.ReadDir(other); len(entries) != 1 {
+		t.Errorf("quarantine holds %d entries, want only the file", len(entries))
+	}
+}
+
+func TestScanFileAuditsOnlyWhatWasQuarantined(t *testing.T) {
+	addr, _ := fakeClamd(t)
+	c, _ := newClamdScanner(addr, 5*time.Second)
+	dir := t.TempDir()
+	audit, _ := newAuditLog(filepath.Join(dir, "audit.log"))
+	// The quarantine directory cannot be created under a file.
+	blocker := filepath.Join(dir, "blocker")
+	os.WriteFile(blocker, nil, 0644)
+	u := &uploader{scanner: c, quarantineDir: filepath.Join(blocker, "quarantine"), audit: audit}
+
+	name := filepath.Join(dir, "upload")
+	os.WriteFile(name, []byte("EICAR"), 0644)
+	if err := u.scanFile("10.0.0.1", name, "invoice.pdf"); err == nil {
+		t.Fatal("infected upload accepted")
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "audit.log"))
+	if strings.Contains(string(data), "quarantined") {
+		t.Errorf("audit log claims a quarantine that failed: %s", data)
+	}
+}
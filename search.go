@@ -0,0 +1,537 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Where a term was found in a document, as bits of searchDoc.Terms.
+const (
+	fieldName uint8 = 1 << iota
+	fieldTag
+	fieldNotes
+	fieldText
+)
+
+// fieldWeights ranks a match in a file's name above one in its tags, notes
+// or contents.
+var fieldWeights = []struct {
+	field  uint8
+	label  string
+	weight int
+}{
+	{fieldName, "name", 8},
+	{fieldTag, "tags", 4},
+	{fieldNotes, "notes", 2},
+	{fieldText, "content", 1},
+}
+
+const (
+	// maxIndexedText is how much of a text file, or of the text drawn from
+	// a PDF, is indexed.
+	maxIndexedText = 4 << 20
+	// maxIndexedPDF is the largest PDF whose text is extracted.
+	maxIndexedPDF = 64 << 20
+	// maxDocTerms caps the distinct content terms kept per file.
+	maxDocTerms = 20000
+	excerptLen  = 240
+)
+
+// searchDoc is what the index holds about one stored file.
+type searchDoc struct {
+	Name     string           `json:"name"`
+	Size     int64            `json:"size"`
+	Modified time.Time        `json:"modified"`
+	Tags     []string         `json:"tags,omitempty"`
+	Notes    string           `json:"notes,omitempty"`
+	Excerpt  string           `json:"excerpt,omitempty"`
+	Terms    map[string]uint8 `json:"terms"`
+}
+
+// searchIndex finds stored files by name, tags, notes and, with content
+// indexing on, the text of plain text, Markdown and PDF files. It is kept
+// in memory, updated as files come and go, and saved to disk in the
+// background so it survives restarts. At startup it is brought up to date
+// with storage, which rebuilds it entirely if the saved copy is missing.
+type searchIndex struct {
+	store   storage
+	meta    *metaStore
+	content bool
+
+	mu       sync.Mutex
+	path     string
+	docs     map[string]*searchDoc
+	postings map[string]map[string]bool
+	saving   *time.Timer
+}
+
+// loadSearchIndex opens the index saved at path and starts bringing it up
+// to date in the background.
+func loadSearchIndex(path string, store storage, meta *metaStore, content bool) (*searchIndex, error) {
+	x := &searchIndex{
+		store:    store,
+		meta:     meta,
+		content:  content,
+		path:     path,
+		docs:     map[string]*searchDoc{},
+		postings: map[string]map[string]bool{},
+	}
+	if err := loadJSON(path, &x.docs); err != nil {
+		return nil, fmt.Errorf("loading search index: %w", err)
+	}
+	for _, d := range x.docs {
+		// Contents indexed while --index-content was on are dropped once
+		// it is off, so the index no longer holds any of the text.
+		if !content && d.dropContent() {
+			x.saveLater()
+		}
+		x.post(d)
+	}
+	go x.sync()
+	return x, nil
+}
+
+// sync indexes stored files that are new or changed since the index was
+// saved, and drops files that have gone.
+func (x *searchIndex) sync() {
+	start := time.Now()
+	files, err := x.store.list("")
+	if err != nil {
+		log.Printf("Failed to update search index: %v", err)
+		return
+	}
+	present := map[string]bool{}
+	var stale []string
+	x.mu.Lock()
+	for _, f := range files {
+		present[f.Name] = true
+		if d, ok := x.docs[f.Name]; !ok || d.Size != f.Size || !d.Modified.Equal(f.ModTime) {
+			stale = append(stale, f.Name)
+		}
+	}
+	removed := 0
+	for name := range x.docs {
+		if !present[name] {
+			x.unpost(name)
+			delete(x.docs, name)
+			removed++
+		}
+	}
+	x.mu.Unlock()
+
+	for _, name := range stale {
+		x.add(name)
+	}
+	x.mu.Lock()
+	if len(stale) > 0 || removed > 0 || x.saving != nil {
+		x.saveLocked()
+	}
+	x.mu.Unlock()
+	if len(stale) > 0 || removed > 0 {
+		log.Printf("Search index updated in %v: %d files indexed, %d dropped",
+			time.Since(start).Round(time.Millisecond), len(stale), removed)
+	}
+}
+
+// tokenize splits s into lower-case words.
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// add indexes the stored file name, replacing anything already indexed
+// under that name.
+func (x *searchIndex) add(name string) {
+	if x == nil {
+		return
+	}
+	f, err := x.store.stat(name)
+	if err != nil || f.IsDir {
+		return
+	}
+	d := &searchDoc{Name: name, Size: f.Size, Modified: f.ModTime, Terms: map[string]uint8{}}
+	if x.content {
+		text, err := x.extractText(name)
+		if err != nil {
+			log.Printf("Failed to index the contents of %s: %v", name, err)
+		}
+		terms := 0
+		for _, t := range tokenize(text) {
+			if len(t) < 2 {
+				continue
+			}
+			if _, ok := d.Terms[t]; !ok {
+				if terms == maxDocTerms {
+					break
+				}
+				terms++
+			}
+			d.Terms[t] |= fieldText
+		}
+		d.Excerpt = excerpt(text)
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	// The file may have been removed or moved while it was being read.
+	if !storageExists(x.store, name) {
+		return
+	}
+	x.setMeta(d)
+	x.unpost(name)
+	x.docs[name] = d
+	x.post(d)
+	x.saveLater()
+}
+
+// excerpt is the start of text with runs of whitespace collapsed.
+func excerpt(text string) string {
+	if len(text) > excerptLen*8 {
+		text = text[:excerptLen*8]
+	}
+	s := strings.Join(strings.Fields(text), " ")
+	if r := []rune(s); len(r) > excerptLen {
+		s = string(r[:excerptLen]) + "…"
+	}
+	return s
+}
+
+// dropContent removes the terms and excerpt taken from the contents of the
+// file, reporting whether there were any.
+func (d *searchDoc) dropContent() bool {
+	dropped := d.Excerpt != ""
+	d.Excerpt = ""
+	for t, fields := range d.Terms {
+		if fields&fieldText == 0 {
+			continue
+		}
+		dropped = true
+		if fields &^= fieldText; fields == 0 {
+			delete(d.Terms, t)
+		} else {
+			d.Terms[t] = fields
+		}
+	}
+	return dropped
+}
+
+// setMeta refreshes the name, tag and notes terms of d from its current
+// name and metadata. The caller holds x.mu.
+func (x *searchIndex) setMeta(d *searchDoc) {
+	for t, fields := range d.Terms {
+		if fields &^= fieldName | fieldTag | fieldNotes; fields == 0 {
+			delete(d.Terms, t)
+		} else {
+			d.Terms[t] = fields
+		}
+	}
+	for _, t := range tokenize(d.Name) {
+		d.Terms[t] |= fieldName
+	}
+	d.Tags, d.Notes = nil, ""
+	if m, ok := x.meta.get(d.Name); ok {
+		d.Tags, d.Notes = m.Tags, m.Notes
+	}
+	for _, tag := range d.Tags {
+		d.Terms[strings.ToLower(tag)] |= fieldTag
+		for _, t := range tokenize(tag) {
+			d.Terms[t] |= fieldTag
+		}
+	}
+	for _, t := range tokenize(d.Notes) {
+		d.Terms[t] |= fieldNotes
+	}
+}
+
+// extractText returns the indexable text of a stored file: all of a plain
+// text or Markdown file or a pasted snippet, the text drawn from a PDF, and
+// nothing otherwise.
+func (x *searchIndex) extractText(name string) (string, error) {
+	ext := strings.ToLower(path.Ext(name))
+	isPDF := ext == ".pdf"
+	switch {
+	case ext == ".txt", ext == ".text", ext == ".md", ext == ".markdown", isPDF:
+	case path.Dir(name) == pasteDir:
+	default:
+		return "", nil
+	}
+	obj, err := x.store.open(name)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+	if !isPDF {
+		b, err := io.ReadAll(io.LimitReader(obj, maxIndexedText))
+		return string(b), err
+	}
+	b, err := io.ReadAll(io.LimitReader(obj, maxIndexedPDF+1))
+	if err != nil || len(b) > maxIndexedPDF {
+		return "", err
+	}
+	return pdfText(b, maxIndexedText), nil
+}
+
+// refresh picks up changed tags or notes for name.
+func (x *searchIndex) refresh(name string) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	d, ok := x.docs[name]
+	if !ok {
+		return
+	}
+	x.unpost(name)
+	x.setMeta(d)
+	x.post(d)
+	x.saveLater()
+}
+
+// remove drops name from the index.
+func (x *searchIndex) remove(name string) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.docs[name]; !ok {
+		return
+	}
+	x.unpost(name)
+	delete(x.docs, name)
+	x.saveLater()
+}
+
+// move re-indexes a file, or everything under a directory, under its new
+// name. Contents are not read again.
+func (x *searchIndex) move(from, to string) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var moved []*searchDoc
+	for name, d := range x.docs {
+		if dest, ok := movedPath(name, from, to); ok {
+			x.unpost(name)
+			delete(x.docs, name)
+			d.Name = dest
+			moved = append(moved, d)
+		}
+	}
+	for _, d := range moved {
+		x.unpost(d.Name)
+		x.setMeta(d)
+		x.docs[d.Name] = d
+		x.post(d)
+	}
+	if len(moved) > 0 {
+		x.saveLater()
+	}
+}
+
+// post adds the terms of d to the postings. The caller holds x.mu.
+func (x *searchIndex) post(d *searchDoc) {
+	for t := range d.Terms {
+		names := x.postings[t]
+		if names == nil {
+			names = map[string]bool{}
+			x.postings[t] = names
+		}
+		names[d.Name] = true
+	}
+}
+
+// unpost removes the terms of the document called name from the postings.
+// The caller holds x.mu.
+func (x *searchIndex) unpost(name string) {
+	d, ok := x.docs[name]
+	if !ok {
+		return
+	}
+	for t := range d.Terms {
+		delete(x.postings[t], name)
+		if len(x.postings[t]) == 0 {
+			delete(x.postings, t)
+		}
+	}
+}
+
+// saveLater writes the index to disk shortly, so a burst of uploads is
+// saved once. The caller holds x.mu.
+func (x *searchIndex) saveLater() {
+	if x.saving != nil {
+		return
+	}
+	x.saving = time.AfterFunc(2*time.Second, func() {
+		x.mu.Lock()
+		defer x.mu.Unlock()
+		x.saveLocked()
+	})
+}
+
+func (x *searchIndex) saveLocked() {
+	if x.saving != nil {
+		x.saving.Stop()
+		x.saving = nil
+	}
+	if err := saveJSON(x.path, x.docs); err != nil {
+		log.Printf("Failed to save search index: %v", err)
+	}
+}
+
+// searchResult is one file matching a search.
+type searchResult struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Tags     []string  `json:"tags,omitempty"`
+	Notes    string    `json:"notes,omitempty"`
+	Excerpt  string    `json:"excerpt,omitempty"`
+	Matched  []string  `json:"matched"`
+	Score    int       `json:"score"`
+}
+
+// search returns the files matching every word of query, best first. Each
+// word also matches longer terms it is the start of. A non-empty tag
+// narrows the results to files carrying that tag.
+func (x *searchIndex) search(query, tag string, limit int) ([]searchResult, int) {
+	words := tokenize(query)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	var candidates map[string]int
+	matched := map[string]uint8{}
+	for _, w := range words {
+		scores := map[string]int{}
+		for term, names := range x.postings {
+			if !strings.HasPrefix(term, w) {
+				continue
+			}
+			for name := range names {
+				fields := x.docs[name].Terms[term]
+				matched[name] |= fields
+				score := 0
+				for _, f := range fieldWeights {
+					if fields&f.field != 0 && f.weight > score {
+						score = f.weight
+					}
+				}
+				if term != w {
+					score = (score + 1) / 2
+				}
+				if score > scores[name] {
+					scores[name] = score
+				}
+			}
+		}
+		if candidates == nil {
+			candidates = scores
+			continue
+		}
+		for name, s := range candidates {
+			if extra, ok := scores[name]; ok {
+				candidates[name] = s + extra
+			} else {
+				delete(candidates, name)
+			}
+		}
+	}
+	if len(words) == 0 {
+		// With only a tag to go on, every file is a candidate.
+		candidates = map[string]int{}
+		for name := range x.docs {
+			candidates[name] = 0
+		}
+	}
+
+	var results []searchResult
+	for name, score := range candidates {
+		d := x.docs[name]
+		if tag != "" && !hasTag(d.Tags, tag) {
+			continue
+		}
+		r := searchResult{
+			Path:     d.Name,
+			Size:     d.Size,
+			Modified: d.Modified,
+			Tags:     d.Tags,
+			Notes:    d.Notes,
+			Matched:  []string{},
+			Score:    score,
+		}
+		for _, f := range fieldWeights {
+			if matched[name]&f.field != 0 {
+				r.Matched = append(r.Matched, f.label)
+			}
+		}
+		if matched[name]&fieldText != 0 {
+			r.Excerpt = d.Excerpt
+		}
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Path < results[j].Path
+	})
+	total := len(results)
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, total
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleSearch serves GET /api/search?q=...&tag=...&limit=...
+func handleSearch(x *searchIndex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query().Get("q")
+		tag := strings.TrimSpace(r.URL.Query().Get("tag"))
+		if len(tokenize(q)) == 0 && tag == "" {
+			http.Error(w, "Give a query with q or a tag with tag", http.StatusBadRequest)
+			return
+		}
+		limit := 50
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, "Invalid limit "+v, http.StatusBadRequest)
+				return
+			}
+			limit = n
+			if limit > 500 {
+				limit = 500
+			}
+		}
+		results, total := x.search(q, tag, limit)
+		if results == nil {
+			results = []searchResult{}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"query": q, "tag": tag, "total": total, "results": results})
+	}
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits on what connected tabs can hold, so abandoned tabs or a noisy
+// sender cannot pile up unbounded state.
+const (
+	maxSessions = 256
+	// maxClientSessions keeps one client from holding every stream, while
+	// leaving room for several tabs behind one address.
+	maxClientSessions = 16
+	maxPendingOffers  = 16
+	sessionPing       = 25 * time.Second
+	maxOfferWait      = time.Minute
+	// settledOffers is how long an answered offer can still be looked up.
+	settledOffers = 10 * time.Minute
+	// sessionReconnect is how long the code of a tab whose stream dropped
+	// is held for it to reconnect.
+	sessionReconnect = time.Minute
+)
+
+// sessionCodeAlphabet leaves out letters and digits that are easily
+// confused, since codes are read off one screen and typed on another.
+const sessionCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+// Offer states. An offer is pending until the tab answers it, or the tab
+// goes away.
+const (
+	offerPending      = "pending"
+	offerAccepted     = "accepted"
+	offerDeclined     = "declined"
+	offerDisconnected = "disconnected"
+)
+
+var (
+	errSessionNotFound = errors.New("no tab is connected with that code")
+	errOfferNotFound   = errors.New("transfer offer not found")
+	errSessionsFull    = errors.New("too many tabs connected")
+	errClientSessions  = errors.New("too many tabs connected from this address")
+	errTooManyOffers   = errors.New("too many transfers waiting for that tab")
+	errSessionToken    = errors.New("only the tab an offer was made to can answer it")
+)
+
+// sessionEvent is a server-sent event for one tab.
+type sessionEvent struct {
+	Name string
+	Data interface{}
+}
+
+// session is an open UI tab, reachable through the code it shows for as
+// long as its event stream stays connected.
+type session struct {
+	Code      string
+	Client    string
+	UserAgent string
+	Connected time.Time
+
+	// token is only ever told to the tab itself, and proves an answer to
+	// an offer, or a reconnect, comes from it rather than from someone who
+	// read the code.
+	token  string
+	events chan sessionEvent
+	offers map[string]*transferOffer
+}
+
+// sessionInfo is what the API reports about a connected tab. The code is
+// left out: it is read off the tab's screen, and the listing is public.
+type sessionInfo struct {
+	Client    string    `json:"client"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Connected time.Time `json:"connected"`
+}
+
+// transferOffer is a stored file offered to a tab.
+type transferOffer struct {
+	ID      string    `json:"id"`
+	Code    string    `json:"code"`
+	Path    string    `json:"path"`
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	From    string    `json:"from"`
+	Created time.Time `json:"created"`
+	State   string    `json:"state"`
+
+	// done is closed once the offer is no longer pending.
+	done chan struct{}
+}
+
+// sessionRegistry tracks the open tabs and the files offered to them.
+// Nothing is persisted: a tab that reloads gets a new code.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	// released holds the codes of tabs whose stream ended recently, for
+	// sessionReconnect, so they can be handed back on proof of the token.
+	released map[string]releasedCode
+	store    storage
+	audit    *auditLog
+}
+
+// releasedCode is a code held for the tab that had it.
+type releasedCode struct {
+	token string
+	until time.Time
+}
+
+func newSessionRegistry(store storage, audit *auditLog) *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[string]*session), released: make(map[string]releasedCode), store: store, audit: audit}
+}
+
+// sessionCode returns a random code of n characters from
+// sessionCodeAlphabet.
+func sessionCode(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	for i := range b {
+		b[i] = sessionCodeAlphabet[int(b[i])%len(sessionCodeAlphabet)]
+	}
+	return string(b)
+}
+
+// open registers a tab. A tab whose stream dropped asks for its old code
+// back with the token it was given, and gets it if that was the code's
+// token within the last sessionReconnect.
+func (s *sessionRegistry) open(previous, token, client, userAgent string) (*session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.sessions) >= maxSessions {
+		return nil, errSessionsFull
+	}
+	held := 0
+	for _, sess := range s.sessions {
+		if sess.Client == client {
+			held++
+		}
+	}
+	if held >= maxClientSessions {
+		return nil, errClientSessions
+	}
+	now := time.Now()
+	for c, r := range s.released {
+		if now.After(r.until) {
+			delete(s.released, c)
+		}
+	}
+	code := previous
+	if r, ok := s.released[code]; !ok || subtle.ConstantTimeCompare([]byte(token), []byte(r.token)) != 1 {
+		for {
+			code = sessionCode(6)
+			_, taken := s.sessions[code]
+			_, held := s.released[code]
+			if !taken && !held {
+				break
+			}
+		}
+	}
+	delete(s.released, code)
+	sess := &session{
+		Code:      code,
+		Client:    client,
+		UserAgent: userAgent,
+		Connected: time.Now().UTC(),
+		token:     randomID(18),
+		events:    make(chan sessionEvent, maxPendingOffers),
+		offers:    make(map[string]*transferOffer),
+	}
+	s.sessions[code] = sess
+	return sess, nil
+}
+
+// close removes a tab whose stream ended. Offers it never answered are
+// settled as disconnected, so senders stop waiting.
+func (s *sessionRegistry) close(sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions[sess.Code] == sess {
+		delete(s.sessions, sess.Code)
+		s.released[sess.Code] = releasedCode{sess.token, time.Now().Add(sessionReconnect)}
+	}
+	for _, o := range sess.offers {
+		if o.State == offerPending {
+			o.State = offerDisconnected
+			close(o.done)
+		}
+	}
+}
+
+// list returns the connected tabs, longest connected first.
+func (s *sessionRegistry) list() []sessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	infos := []sessionInfo{}
+	for _, sess := range s.sessions {
+		infos = append(infos, sessionInfo{sess.Client, sess.UserAgent, sess.Connected})
+	}
+	sort.Slice(infos, func(a, b int) bool { return infos[a].Connected.Before(infos[b].Connected) })
+	return infos
+}
+
+// offer sends the stored file name to the tab with the given code.
+func (s *sessionRegistry) offer(code, name, from string) (transferOffer, error) {
+	info, err := s.store.stat(name)
+	if err != nil || info.IsDir {
+		return transferOffer{}, errNotStored
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[strings.ToUpper(code)]
+	if !ok {
+		return transferOffer{}, errSessionNotFound
+	}
+	pending := 0
+	for id, o := range sess.offers {
+		switch {
+		case o.State == offerPending:
+			pending++
+		case time.Since(o.Created) > settledOffers:
+			delete(sess.offers, id)
+		}
+	}
+	if pending >= maxPendingOffers {
+		return transferOffer{}, errTooManyOffers
+	}
+	o := &transferOffer{
+		ID:      randomID(9),
+		Code:    sess.Code,
+		Path:    name,
+		Name:    path.Base(name),
+		Size:    info.Size,
+		From:    from,
+		Created: time.Now().UTC(),
+		State:   offerPending,
+		done:    make(chan struct{}),
+	}
+	select {
+	case sess.events <- sessionEvent{"offer", *o}:
+	default:
+		return transferOffer{}, errTooManyOffers
+	}
+	sess.offers[o.ID] = o
+	s.audit.record(auditEntry{Event: "offered", Path: name, Client: from, Size: info.Size, Detail: "to " + sess.Code})
+	return *o, nil
+}
+
+// find returns a tab's offer as it stands, with the channel that is closed
+// once it is settled.
+func (s *sessionRegistry) find(code, id string) (transferOffer, <-chan struct{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[strings.ToUpper(code)]
+	if !ok {
+		return transferOffer{}, nil, errSessionNotFound
+	}
+	o, ok := sess.offers[id]
+	if !ok {
+		return transferOffer{}, nil, errOfferNotFound
+	}
+	return *o, o.done, nil
+}
+
+// answer records the tab's decision on an offer. token must be the one the
+// tab was given when it connected.
+func (s *sessionRegistry) answer(code, id, token string, accept bool) (transferOffer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[strings.ToUpper(code)]
+	if !ok {
+		return transferOffer{}, errSessionNotFound
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(sess.token)) != 1 {
+		return transferOffer{}, errSessionToken
+	}
+	o, ok := sess.offers[id]
+	if !ok {
+		return transferOffer{}, errOfferNotFound
+	}
+	if o.State == offerPending {
+		o.State = offerDeclined
+		if accept {
+			o.State = offerAccepted
+		}
+		close(o.done)
+		s.audit.record(auditEntry{Event: o.State, Path: o.Path, Client: sess.Client, Detail: "by " + sess.Code})
+	}
+	return *o, nil
+}
+
+// writeEvent sends one server-sent event.
+func writeEvent(w io.Writer, name, id string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, b)
+	return err
+}
+
+// handleEvents serves GET /api/sessions/events, the event stream that keeps
+// a tab registered. The first event gives the tab its code and the token it
+// answers offers with; offers follow as they are made. The code and token
+// are sent as the event id, so a browser reconnecting after a dropped
+// connection asks for the code back in Last-Event-ID, with the proof that
+// it is the same tab.
+func (s *sessionRegistry) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	previous, token, _ := strings.Cut(r.Header.Get("Last-Event-ID"), ".")
+	sess, err := s.open(previous, token, clientIP(r), r.UserAgent())
+	if err == errClientSessions {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer s.close(sess)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	hello := struct {
+		Code  string `json:"code"`
+		Token string `json:"token"`
+	}{sess.Code, sess.token}
+	if err := writeEvent(w, "session", sess.Code+"."+sess.token, hello); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	// Comments keep proxies from closing a quiet stream.
+	ping := time.NewTicker(sessionPing)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev := <-sess.events:
+			if err := writeEvent(w, ev.Name, "", ev.Data); err != nil {
+				return
+			}
+		case <-ping.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// handleSessions serves the session API:
+//
+//	GET  /api/sessions                      list connected tabs, without their codes
+//	GET  /api/sessions/events               a tab's event stream
+//	POST /api/sessions/{code}/offers        offer a stored file: {"path"}
+//	GET  /api/sessions/{code}/offers/{id}   an offer's state; ?wait=30s blocks until it is answered
+//	POST /api/sessions/{code}/offers/{id}   the tab's answer: {"accept"}, with X-Nostromo-Session-Token
+func (s *sessionRegistry) handleSessions(uploadDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/sessions"), "/")
+		parts := strings.Split(rest, "/")
+		switch {
+		case rest == "" && r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, s.list())
+
+		case rest == "events":
+			s.handleEvents(w, r)
+
+		case len(parts) == 2 && parts[1] == "offers" && r.Method == http.MethodPost:
+			var req struct {
+				Path string `json:"path"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			name, _, err := resolveUploadPath(uploadDir, req.Path)
+			if err != nil || name == "" {
+				http.Error(w, "invalid path", http.StatusBadRequest)
+				return
+			}
+			o, err := s.offer(parts[0], name, clientIP(r))
+			switch err {
+			case nil:
+			case errNotStored:
+				http.Error(w, "File not found", http.StatusNotFound)
+				return
+			case errSessionNotFound:
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			default:
+				http.Error(w, err.Error(), http.StatusTooManyRequests)
+				return
+			}
+			log.Printf("Offered %s to tab %s for %s", name, o.Code, o.From)
+			writeJSON(w, http.StatusCreated, o)
+
+		case len(parts) == 3 && parts[1] == "offers" && r.Method == http.MethodGet:
+			o, done, err := s.find(parts[0], parts[2])
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if v := r.URL.Query().Get("wait"); v != "" && o.State == offerPending {
+				wait, err := time.ParseDuration(v)
+				if err != nil || wait < 0 {
+					http.Error(w, "invalid wait", http.StatusBadRequest)
+					return
+				}
+				if wait > maxOfferWait {
+					wait = maxOfferWait
+				}
+				timer := time.NewTimer(wait)
+				select {
+				case <-done:
+				case <-timer.C:
+				case <-r.Context().Done():
+				}
+				timer.Stop()
+				// A tab that closed has taken its offers with it, but the
+				// state they were left in is still worth reporting.
+				if latest, _, err := s.find(parts[0], parts[2]); err == nil {
+					o = latest
+				} else {
+					o.State = offerDisconnected
+				}
+			}
+			writeJSON(w, http.StatusOK, o)
+
+		case len(parts) == 3 && parts[1] == "offers" && r.Method == http.MethodPost:
+			var req struct {
+				Accept bool `json:"accept"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			o, err := s.answer(parts[0], parts[2], r.Header.Get("X-Nostromo-Session-Token"), req.Accept)
+			if err == errSessionToken {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			log.Printf("Tab %s %s %s", o.Code, o.State, o.Path)
+			writeJSON(w, http.StatusOK, o)
+
+		default:
+			http.Error(w, "Not found", http.StatusNotFound)
+		}
+	}
+}
+
+// runPushCommand implements the "push" subcommand, which offers a file to a
+// browser tab through a running server. A local file is uploaded first; with
+// --stored the argument is a file already on the server. It waits for the
+// tab to answer and exits non-zero unless the file was accepted.
+func runPushCommand(args []string) {
+	flags := flag.NewFlagSet("push", flag.ExitOnError)
+	server := flags.String("server", "http://localhost:8080", "Address of the running server, with user:password@ if a proxy asks for one")
+	to := flags.String("to", "", "Code shown by the browser tab to send to")
+	stored := flags.Bool("stored", false, "Offer a file already in the upload directory, given by its path there")
+	dir := flags.String("dir", "pushed", "Directory in the upload directory that pushed files are stored in")
+	ttl := flags.String("ttl", "24h", "How long a pushed file is kept (empty = the retention policy)")
+	wait := flags.Duration("wait", 5*time.Minute, "How long to wait for the tab to answer (0 = do not wait)")
+	list := flags.Bool("list", false, "List the connected tabs")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: nostromo push --to CODE [--server URL] FILE")
+		fmt.Fprintln(flags.Output(), "       nostromo push --list [--server URL]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	base := strings.TrimSuffix(*server, "/")
+	client := &http.Client{}
+
+	if *list {
+		var tabs []sessionInfo
+		if err := apiRequest(client, http.MethodGet, base+"/api/sessions", nil, &tabs); err != nil {
+			log.Fatal(err)
+		}
+		for _, t := range tabs {
+			fmt.Printf("%-15s  since %s  %s\n", t.Client, t.Connected.Local().Format("15:04:05"), t.UserAgent)
+		}
+		fmt.Printf("%d tab(s) connected\n", len(tabs))
+		return
+	}
+	if *to == "" || flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	name := flags.Arg(0)
+	if !*stored {
+		var err error
+		if name, err = pushUpload(client, base, *dir, *ttl, name); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("UPLOADED %s\n", name)
+	}
+
+	var o transferOffer
+	body, _ := json.Marshal(map[string]string{"path": name})
+	if err := apiRequest(client, http.MethodPost, base+"/api/sessions/"+url.PathEscape(*to)+"/offers", body, &o); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("OFFERED %s (%d bytes) to %s\n", o.Path, o.Size, o.Code)
+	if *wait <= 0 {
+		return
+	}
+
+	offerURL := base + "/api/sessions/" + url.PathEscape(o.Code) + "/offers/" + url.PathEscape(o.ID)
+	deadline := time.Now().Add(*wait)
+	for o.State == offerPending && time.Now().Before(deadline) {
+		step := time.Until(deadline)
+		if step > maxOfferWait {
+			step = maxOfferWait
+		}
+		if err := apiRequest(client, http.MethodGet, offerURL+"?wait="+step.Round(time.Second).String(), nil, &o); err != nil {
+			log.Fatal(err)
+		}
+	}
+	switch o.State {
+	case offerAccepted:
+		fmt.Printf("ACCEPTED by %s\n", o.Code)
+	case offerDeclined:
+		log.Fatalf("DECLINED by %s", o.Code)
+	case offerPending:
+		log.Fatalf("no answer from %s after %s", o.Code, *wait)
+	default:
+		log.Fatalf("%s closed before answering", o.Code)
+	}
+}
+
+// pushUpload stores a local file on the server with PUT /upload, returning
+// the path it was stored under.
+func pushUpload(client *http.Client, base, dir, ttl, file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	target := base + "/upload/" + (&url.URL{Path: path.Join(dir, path.Base(file))}).EscapedPath()
+	if ttl != "" {
+		target += "?ttl=" + url.QueryEscape(ttl)
+	}
+	req, err := http.NewRequest(http.MethodPut, target, f)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = info.Size()
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("upload refused: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp.Header.Get("X-Nostromo-Stored"), nil
+}
+
+// apiRequest makes an API call for the push and relay subcommands, decoding
+// the JSON reply into out.
+func apiRequest(client *http.Client, method, target string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("server replied %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSessionReconnectNeedsToken(t *testing.T) {
+	s := newSessionRegistry(nil, nil)
+	first, err := s.open("", "", "10.0.0.1", "tab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.close(first)
+
+	// Someone who only read the code does not get it.
+	for _, token := range []string{"", "guess", first.token[1:]} {
+		sess, err := s.open(first.Code, token, "10.0.0.2", "other")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sess.Code == first.Code {
+			t.Fatalf("code handed to a reconnect with token %q", token)
+		}
+		s.close(sess)
+	}
+
+	again, err := s.open(first.Code, first.token, "10.0.0.1", "tab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Code != first.Code || again.token == first.token {
+		t.Fatalf("reconnect got %s with the old token %v", again.Code, again.token == first.token)
+	}
+	// The code is taken again, so the old token no longer reclaims it.
+	other, _ := s.open(first.Code, first.token, "10.0.0.1", "tab")
+	if other.Code == first.Code {
+		t.Fatal("code handed out twice")
+	}
+}
+
+func TestSessionListHidesCodes(t *testing.T) {
+	s := newSessionRegistry(nil, nil)
+	sess, err := s.open("", "", "10.0.0.1", "tab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(s.list())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), sess.Code) || strings.Contains(string(b), sess.token) {
+		t.Fatalf("listing reveals the tab: %s", b)
+	}
+	if !strings.Contains(string(b), `"client":"10.0.0.1"`) {
+		t.Fatalf("listing %s", b)
+	}
+}
+
+func TestSessionsPerClientAreCapped(t *testing.T) {
+	s := newSessionRegistry(nil, nil)
+	var held []*session
+	for i := 0; i < maxClientSessions; i++ {
+		sess, err := s.open("", "", "10.0.0.1", "tab")
+		if err != nil {
+			t.Fatal(err)
+		}
+		held = append(held, sess)
+	}
+	if _, err := s.open("", "", "10.0.0.1", "tab"); err != errClientSessions {
+		t.Fatalf("one tab too many: %v", err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/sessions/events", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	s.handleEvents(w, r)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("event stream over the cap: %d", w.Code)
+	}
+
+	// Other clients are not held back, and a closed tab frees its place.
+	if _, err := s.open("", "", "10.0.0.2", "tab"); err != nil {
+		t.Fatalf("another client: %v", err)
+	}
+	s.close(held[0])
+	if _, err := s.open("", "", "10.0.0.1", "tab"); err != nil {
+		t.Fatalf("after closing a tab: %v", err)
+	}
+}
@@ -0,0 +1,684 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SFTP version 3 packet types (draft-ietf-secsh-filexfer-02), which is what
+// OpenSSH and most clients speak.
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpLstat    = 7
+	sftpFstat    = 8
+	sftpSetstat  = 9
+	sftpFsetstat = 10
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRmdir    = 15
+	sftpRealpath = 16
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpReadlink = 19
+	sftpSymlink  = 20
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+	sftpExtended = 200
+)
+
+const (
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpFailure          = 4
+	sftpBadMessage       = 5
+	sftpOpUnsupported    = 8
+)
+
+const (
+	sftpFlagRead   = 0x01
+	sftpFlagWrite  = 0x02
+	sftpFlagCreate = 0x08
+	sftpFlagTrunc  = 0x10
+	sftpFlagExcl   = 0x20
+
+	sftpAttrSize        = 0x01
+	sftpAttrPermissions = 0x04
+	sftpAttrTimes       = 0x08
+
+	sftpMaxPacket   = 256 << 10
+	sftpMaxRead     = 64 << 10
+	sftpReaddirSize = 100
+
+	// sftpMaxGap is how far past the end of a file being written a write
+	// may start when there is no quota to bound it. Clients keep several
+	// writes in flight, so some slack is needed for ones that arrive early.
+	sftpMaxGap = 64 << 20
+)
+
+// sftpOpenFile is an open file or directory.
+type sftpOpenFile struct {
+	name string
+
+	// obj is set for files opened for reading.
+	obj storageObject
+
+	// tmp collects a file being written; it is stored through the uploader
+	// when the client closes it. limit is the most it may grow to under
+	// the client's quota, or -1. failed records the first write that was
+	// refused, after which the file is discarded rather than stored.
+	tmp        *os.File
+	limit      int64
+	createOnly bool
+	failed     error
+
+	// dir is set for directories; entries not yet returned by READDIR.
+	dir     bool
+	entries []storedFile
+}
+
+// sftpServer serves one SFTP session. Paths are rooted at the upload
+// directory, and writes go through the uploader so they get the same
+// checks, quotas, hooks and audit entries as HTTP uploads.
+type sftpServer struct {
+	u      *uploader
+	j      *janitor
+	client string
+	user   string
+	rw     io.ReadWriter
+
+	handles    map[string]*sftpOpenFile
+	nextHandle int
+}
+
+// sftpSubsystem returns the function the SSH server runs for each SFTP
+// channel.
+func sftpSubsystem(u *uploader, j *janitor) func(c *sshConn, ch *sshChannel) {
+	return func(c *sshConn, ch *sshChannel) {
+		s := &sftpServer{u: u, j: j, client: c.clientAddr(), user: c.user, rw: ch, handles: make(map[string]*sftpOpenFile)}
+		if err := s.serve(); err != nil && err != io.EOF {
+			log.Printf("SFTP session for %s from %s ended: %v", c.user, s.client, err)
+		}
+		s.closeAll()
+	}
+}
+
+func (s *sftpServer) serve() error {
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(s.rw, header[:]); err != nil {
+			return err
+		}
+		length := uint32(header[0])<<24 | uint32(header[1])<<16 | uint32(header[2])<<8 | uint32(header[3])
+		if length == 0 || length > sftpMaxPacket {
+			return fmt.Errorf("sftp: invalid packet length %d", length)
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(s.rw, packet); err != nil {
+			return err
+		}
+		if err := s.handle(packet); err != nil {
+			return err
+		}
+	}
+}
+
+// send writes one SFTP packet.
+func (s *sftpServer) send(payload []byte) error {
+	_, err := s.rw.Write(sshPutString(nil, payload))
+	return err
+}
+
+func (s *sftpServer) status(id uint32, code uint32, msg string) error {
+	p := sshPutUint32([]byte{sftpStatus}, id)
+	p = sshPutUint32(p, code)
+	p = sshPutString(p, []byte(msg))
+	return s.send(sshPutString(p, nil))
+}
+
+// fail reports err as an SFTP status, keeping the message of upload errors
+// so clients can show why a file was refused.
+func (s *sftpServer) fail(id uint32, err error) error {
+	var ue *uploadError
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return s.status(id, sftpNoSuchFile, "No such file")
+	case errors.Is(err, errOutsideUploadDir), errors.Is(err, fs.ErrPermission):
+		return s.status(id, sftpPermissionDenied, "Permission denied")
+	case errors.As(err, &ue):
+		return s.status(id, sftpFailure, ue.Error())
+	}
+	return s.status(id, sftpFailure, err.Error())
+}
+
+// resolve maps a client path onto a storage name. Paths are taken relative
+// to "/", which is the upload directory.
+func (s *sftpServer) resolve(p string) (string, error) {
+	rel, _, err := resolveUploadPath(s.u.uploadDir, strings.TrimPrefix(path.Join("/", p), "/"))
+	return rel, err
+}
+
+// sftpAttrsOf encodes a file's attributes.
+func sftpAttrsOf(f storedFile) []byte {
+	mode := uint32(0100644)
+	if f.IsDir {
+		mode = 040755
+	}
+	p := sshPutUint32(nil, sftpAttrSize|sftpAttrPermissions|sftpAttrTimes)
+	p = sshPutUint64(p, uint64(f.Size))
+	p = sshPutUint32(p, mode)
+	p = sshPutUint32(p, uint32(f.ModTime.Unix()))
+	return sshPutUint32(p, uint32(f.ModTime.Unix()))
+}
+
+// sftpLongName formats an entry like "ls -l", which v3 clients display.
+func sftpLongName(f storedFile) string {
+	mode := "-rw-r--r--"
+	if f.IsDir {
+		mode = "drwxr-xr-x"
+	}
+	stamp := f.ModTime.Format("Jan _2 15:04")
+	if time.Since(f.ModTime) > 180*24*time.Hour {
+		stamp = f.ModTime.Format("Jan _2  2006")
+	}
+	return fmt.Sprintf("%s    1 nostromo nostromo %8d %s %s", mode, f.Size, stamp, path.Base(f.Name))
+}
+
+func (s *sftpServer) lookup(id uint32, handle string) (*sftpOpenFile, error) {
+	h := s.handles[handle]
+	if h == nil {
+		return nil, s.status(id, sftpFailure, "Invalid handle")
+	}
+	return h, nil
+}
+
+func (s *sftpServer) handle(packet []byte) error {
+	kind := packet[0]
+	r := &sshReader{b: packet[1:]}
+
+	if kind == sftpInit {
+		p := sshPutUint32([]byte{sftpVersion}, 3)
+		p = sshPutString(p, []byte("posix-rename@openssh.com"))
+		p = sshPutString(p, []byte("1"))
+		return s.send(p)
+	}
+
+	id := r.uint32()
+	if r.err != nil {
+		return r.err
+	}
+
+	switch kind {
+	case sftpRealpath:
+		name, err := s.resolve(r.string())
+		if err != nil {
+			return s.fail(id, err)
+		}
+		p := sshPutUint32([]byte{sftpName}, id)
+		p = sshPutUint32(p, 1)
+		p = sshPutString(p, []byte("/"+name))
+		p = sshPutString(p, []byte("/"+name))
+		return s.send(sshPutUint32(p, 0))
+
+	case sftpStat, sftpLstat:
+		name, err := s.resolve(r.string())
+		if err != nil {
+			return s.fail(id, err)
+		}
+		info, err := s.u.store.stat(name)
+		if err != nil {
+			return s.fail(id, err)
+		}
+		return s.send(append(sshPutUint32([]byte{sftpAttrs}, id), sftpAttrsOf(info)...))
+
+	case sftpFstat:
+		h, err := s.lookup(id, r.string())
+		if h == nil {
+			return err
+		}
+		var info storedFile
+		if h.tmp != nil {
+			fi, err := h.tmp.Stat()
+			if err != nil {
+				return s.fail(id, err)
+			}
+			info = storedFile{Name: h.name, Size: fi.Size(), ModTime: fi.ModTime()}
+		} else if info, err = s.u.store.stat(h.name); err != nil {
+			return s.fail(id, err)
+		}
+		return s.send(append(sshPutUint32([]byte{sftpAttrs}, id), sftpAttrsOf(info)...))
+
+	case sftpSetstat, sftpFsetstat:
+		// Permissions and times are the server's business; accept and
+		// ignore them so "put -p" does not fail.
+		return s.status(id, sftpOK, "")
+
+	case sftpOpen:
+		name, err := s.resolve(r.string())
+		flags := r.uint32()
+		if r.err != nil {
+			return r.err
+		}
+		if err != nil {
+			return s.fail(id, err)
+		}
+		h, err := s.open(name, flags)
+		if err != nil {
+			return s.fail(id, err)
+		}
+		return s.sendHandle(id, h)
+
+	case sftpOpendir:
+		name, err := s.resolve(r.string())
+		if err != nil {
+			return s.fail(id, err)
+		}
+		info, err := s.u.store.stat(name)
+		if err != nil {
+			return s.fail(id, err)
+		}
+		if !info.IsDir {
+			return s.status(id, sftpFailure, "Not a directory")
+		}
+		entries, err := s.u.store.readDir(name)
+		if err != nil {
+			return s.fail(id, err)
+		}
+		return s.sendHandle(id, &sftpOpenFile{name: name, dir: true, entries: entries})
+
+	case sftpReaddir:
+		h, err := s.lookup(id, r.string())
+		if h == nil {
+			return err
+		}
+		if !h.dir {
+			return s.status(id, sftpFailure, "Not a directory")
+		}
+		if len(h.entries) == 0 {
+			return s.status(id, sftpEOF, "")
+		}
+		batch := h.entries
+		if len(batch) > sftpReaddirSize {
+			batch = batch[:sftpReaddirSize]
+		}
+		h.entries = h.entries[len(batch):]
+		p := sshPutUint32([]byte{sftpName}, id)
+		p = sshPutUint32(p, uint32(len(batch)))
+		for _, f := range batch {
+			p = sshPutString(p, []byte(path.Base(f.Name)))
+			p = sshPutString(p, []byte(sftpLongName(f)))
+			p = append(p, sftpAttrsOf(f)...)
+		}
+		return s.send(p)
+
+	case sftpRead:
+		h, err := s.lookup(id, r.string())
+		if h == nil {
+			return err
+		}
+		offset := r.uint64()
+		n := r.uint32()
+		if r.err != nil {
+			return r.err
+		}
+		if h.obj == nil {
+			return s.status(id, sftpFailure, "File not open for reading")
+		}
+		if n > sftpMaxRead {
+			n = sftpMaxRead
+		}
+		if _, err := h.obj.Seek(int64(offset), io.SeekStart); err != nil {
+			return s.fail(id, err)
+		}
+		buf := make([]byte, n)
+		got, err := io.ReadFull(h.obj, buf)
+		if got == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			return s.status(id, sftpEOF, "")
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return s.fail(id, err)
+		}
+		return s.send(sshPutString(sshPutUint32([]byte{sftpData}, id), buf[:got]))
+
+	case sftpWrite:
+		h, err := s.lookup(id, r.string())
+		if h == nil {
+			return err
+		}
+		offset := r.uint64()
+		data := r.bytes()
+		if r.err != nil {
+			return r.err
+		}
+		if h.tmp == nil {
+			return s.status(id, sftpFailure, "File not open for writing")
+		}
+		if h.failed != nil {
+			return s.fail(id, h.failed)
+		}
+		// The temporary file is copied in full when it is stored, so a
+		// write far past its end would make a sparse file count for
+		// everything up to the offset.
+		end := int64(offset) + int64(len(data))
+		if int64(offset) < 0 || end < 0 {
+			return s.status(id, sftpFailure, "Invalid offset")
+		}
+		if h.limit >= 0 && end > h.limit {
+			h.failed = &uploadError{http.StatusInsufficientStorage, "QUOTA_EXCEEDED",
+				fmt.Sprintf("upload exceeds the %d bytes of quota remaining", h.limit)}
+			return s.fail(id, h.failed)
+		}
+		if h.limit < 0 {
+			info, err := h.tmp.Stat()
+			if err != nil {
+				return s.fail(id, err)
+			}
+			if int64(offset) > info.Size()+sftpMaxGap {
+				return s.status(id, sftpFailure, "Write offset is past the end of the file")
+			}
+		}
+		if _, err := h.tmp.WriteAt(data, int64(offset)); err != nil {
+			h.failed = err
+			return s.fail(id, err)
+		}
+		return s.status(id, sftpOK, "")
+
+	case sftpClose:
+		handle := r.string()
+		h, err := s.lookup(id, handle)
+		if h == nil {
+			return err
+		}
+		delete(s.handles, handle)
+		if err := s.closeFile(h); err != nil {
+			return s.fail(id, err)
+		}
+		return s.status(id, sftpOK, "")
+
+	case sftpRemove:
+		name, err := s.resolve(r.string())
+		if err != nil {
+			return s.fail(id, err)
+		}
+		info, err := s.u.store.stat(name)
+		if err != nil {
+			return s.fail(id, err)
+		}
+		if info.IsDir {
+			return s.status(id, sftpFailure, "Is a directory")
+		}
+		if _, err := s.u.files.remove(s.client, info); err != nil {
+			return s.fail(id, err)
+		}
+		return s.status(id, sftpOK, "")
+
+	case sftpMkdir:
+		name, err := s.resolve(r.string())
+		if err != nil {
+			return s.fail(id, err)
+		}
+		switch err := s.u.files.mkdir(s.client, name, false); {
+		case err == errExists:
+			return s.status(id, sftpFailure, "File exists")
+		case err != nil:
+			return s.fail(id, err)
+		}
+		return s.status(id, sftpOK, "")
+
+	case sftpRmdir:
+		name, err := s.resolve(r.string())
+		if err != nil {
+			return s.fail(id, err)
+		}
+		info, err := s.u.store.stat(name)
+		if err != nil {
+			return s.fail(id, err)
+		}
+		if !info.IsDir || name == "" {
+			return s.status(id, sftpFailure, "Not a directory")
+		}
+		if entries, err := s.u.store.readDir(name); err != nil || len(entries) > 0 {
+			return s.status(id, sftpFailure, "Directory not empty")
+		}
+		if err := s.u.files.permit(s.client, info); err != nil {
+			return s.fail(id, err)
+		}
+		if err := s.u.store.remove(name); err != nil {
+			return s.fail(id, err)
+		}
+		return s.status(id, sftpOK, "")
+
+	case sftpRename:
+		return s.rename(id, r.string(), r.string(), false)
+
+	case sftpExtended:
+		if r.string() == "posix-rename@openssh.com" {
+			return s.rename(id, r.string(), r.string(), true)
+		}
+		return s.status(id, sftpOpUnsupported, "Unsupported extension")
+
+	case sftpReadlink, sftpSymlink:
+		return s.status(id, sftpOpUnsupported, "Symbolic links are not supported")
+	}
+	return s.status(id, sftpOpUnsupported, "Unsupported request")
+}
+
+func (s *sftpServer) sendHandle(id uint32, h *sftpOpenFile) error {
+	s.nextHandle++
+	handle := strconv.Itoa(s.nextHandle)
+	s.handles[handle] = h
+	return s.send(sshPutString(sshPutUint32([]byte{sftpHandle}, id), []byte(handle)))
+}
+
+// open prepares a file for reading or writing. Writes are collected in a
+// temporary file; an existing file opened without TRUNC is copied there
+// first so the client can resume or patch it.
+func (s *sftpServer) open(name string, flags uint32) (*sftpOpenFile, error) {
+	if flags&sftpFlagWrite == 0 {
+		obj, err := s.u.store.open(name)
+		if err != nil {
+			return nil, err
+		}
+		return &sftpOpenFile{name: name, obj: obj}, nil
+	}
+
+	if name == "" {
+		return nil, fs.ErrPermission
+	}
+	if _, err := sanitizeFilename(path.Base(name)); err != nil {
+		return nil, err
+	}
+	info, err := s.u.store.stat(name)
+	exists := err == nil
+	switch {
+	case exists && info.IsDir:
+		return nil, errors.New("is a directory")
+	case exists && flags&sftpFlagCreate != 0 && flags&sftpFlagExcl != 0:
+		return nil, errExists
+	case !exists && flags&sftpFlagCreate == 0:
+		return nil, fs.ErrNotExist
+	}
+	if parent := path.Dir(name); parent != "." {
+		if info, err := s.u.store.stat(parent); err != nil || !info.IsDir {
+			return nil, fs.ErrNotExist
+		}
+	}
+	// The file is only replaced on close, but a client that may not
+	// replace it is better told now than after sending it all.
+	if exists && flags&sftpFlagExcl == 0 {
+		if _, err := s.u.files.replacing(s.client, name); err != nil {
+			return nil, err
+		}
+	}
+
+	// Learn how much the client may write without holding any space yet;
+	// save checks again with the final size.
+	res, err := s.u.quota.reserve(s.client, name, 0)
+	if err != nil {
+		return nil, err
+	}
+	limit := res.limit
+	res.cancel()
+
+	incoming := filepath.Join(stateDir(s.u.uploadDir), "incoming")
+	if err := os.MkdirAll(incoming, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(incoming, "sftp-*")
+	if err != nil {
+		return nil, err
+	}
+	h := &sftpOpenFile{name: name, tmp: tmp, limit: limit, createOnly: flags&sftpFlagExcl != 0}
+	if exists && flags&sftpFlagTrunc == 0 {
+		obj, err := s.u.store.open(name)
+		if err == nil {
+			_, err = io.Copy(tmp, obj)
+			obj.Close()
+		}
+		if err != nil {
+			s.discard(h)
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// closeFile finishes with a handle. For a file being written this is where
+// it is actually stored.
+func (s *sftpServer) closeFile(h *sftpOpenFile) error {
+	if h.obj != nil {
+		return h.obj.Close()
+	}
+	if h.tmp == nil {
+		return nil
+	}
+	defer s.discard(h)
+	if h.failed != nil {
+		s.u.logRejection(s.client, h.name, h.failed)
+		return h.failed
+	}
+	info, err := h.tmp.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := h.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	meta := fileMeta{Uploader: s.user, Via: "sftp", OriginalName: path.Base(h.name)}
+	ev, err := s.u.save(s.client, h.name, h.tmp, info.Size(), saveOptions{types: s.u.types, createOnly: h.createOnly, meta: meta})
+	if err != nil {
+		s.u.logRejection(s.client, h.name, err)
+		return err
+	}
+	s.u.announce(ev)
+	return nil
+}
+
+func (s *sftpServer) discard(h *sftpOpenFile) {
+	h.tmp.Close()
+	os.Remove(h.tmp.Name())
+}
+
+// closeAll drops whatever the client left open. Unfinished writes are
+// discarded rather than stored.
+func (s *sftpServer) closeAll() {
+	for _, h := range s.handles {
+		if h.obj != nil {
+			h.obj.Close()
+		}
+		if h.tmp != nil {
+			s.discard(h)
+		}
+	}
+}
+
+// rename moves a file or directory. Plain SFTP renames refuse to replace an
+// existing name; posix-rename@openssh.com replaces files.
+func (s *sftpServer) rename(id uint32, oldPath, newPath string, replace bool) error {
+	from, err := s.resolve(oldPath)
+	if err != nil {
+		return s.fail(id, err)
+	}
+	to, err := s.resolve(newPath)
+	if err != nil {
+		return s.fail(id, err)
+	}
+	if from == "" || to == "" || strings.HasPrefix(to, from+"/") {
+		return s.status(id, sftpPermissionDenied, "Permission denied")
+	}
+	f, err := s.u.store.stat(from)
+	if err != nil {
+		return s.fail(id, err)
+	}
+	if existing, err := s.u.store.stat(to); err == nil && (!replace || existing.IsDir) {
+		return s.status(id, sftpFailure, "File exists")
+	}
+	if err := s.u.files.move(s.client, f, to, replace); err != nil {
+		return s.fail(id, err)
+	}
+	return s.status(id, sftpOK, "")
+}
+
+// sftpOptions are the command line settings for the embedded SFTP server.
+type sftpOptions struct {
+	addr           string
+	user           string
+	password       string
+	authorizedKeys string
+}
+
+// startSFTP starts the SSH server for SFTP on opts.addr. The host key is
+// kept in the state directory so its fingerprint survives restarts.
+func startSFTP(opts sftpOptions, u *uploader, j *janitor) error {
+	if opts.password == "" && opts.authorizedKeys == "" {
+		return errors.New("--sftp needs --sftp-password or --sftp-authorized-keys")
+	}
+	cfg := &sshConfig{user: opts.user, password: opts.password}
+	if opts.authorizedKeys != "" {
+		keys, err := loadAuthorizedKeys(opts.authorizedKeys)
+		if err != nil {
+			return err
+		}
+		cfg.authorizedKeys = keys
+	}
+	key, err := loadOrCreateHostKey(filepath.Join(stateDir(u.uploadDir), "ssh_host_ed25519_key"))
+	if err != nil {
+		return fmt.Errorf("loading SSH host key: %w", err)
+	}
+	cfg.hostKey = key
+
+	l, err := net.Listen("tcp", opts.addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("SFTP listening on %s (host key %s)", opts.addr, sshFingerprint(sshPublicKeyBlob(key.Public().(ed25519.PublicKey))))
+	go func() {
+		if err := serveSSH(l, cfg, sftpSubsystem(u, j)); err != nil {
+			log.Printf("SFTP server stopped: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultShareTTL = 24 * time.Hour
+
+	// sharePasswordIterations is the PBKDF2 work factor for link passwords.
+	// Every download of a protected link pays it once.
+	sharePasswordIterations = 100_000
+
+	// After sharePasswordTries wrong passwords for one link, a client has
+	// to wait before trying again, twice as long after each further miss.
+	sharePasswordTries    = 5
+	sharePasswordBackoff  = time.Minute
+	sharePasswordMaxDelay = time.Hour
+)
+
+// share is a link that lets someone download a single stored file.
+type share struct {
+	ID           string    `json:"id"`
+	Path         string    `json:"path"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"max_downloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	PasswordSalt string    `json:"password_salt,omitempty"`
+	PasswordHash string    `json:"password_hash,omitempty"`
+	// PasswordIterations is the PBKDF2 work factor of PasswordHash. Links
+	// made before passwords were stretched have none, and a plain HMAC.
+	PasswordIterations int  `json:"password_iterations,omitempty"`
+	Revoked            bool `json:"revoked,omitempty"`
+	// Signed is the path the token was minted for, once the file has been
+	// renamed since, so the link keeps working.
+	Signed string `json:"signed,omitempty"`
+
+	// clients are those a download has been counted for since the server
+	// started, whose ranged requests then continue it rather than count.
+	clients map[string]bool
+}
+
+// shareInfo is what the API reports about a share; it never includes the
+// password hash.
+type shareInfo struct {
+	ID           string    `json:"id"`
+	Path         string    `json:"path"`
+	Token        string    `json:"token"`
+	URL          string    `json:"url"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"max_downloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	Password     bool      `json:"password"`
+}
+
+var (
+	errShareNotFound = errors.New("share link not found")
+	errShareExpired  = errors.New("share link has expired")
+	errShareRevoked  = errors.New("share link has been revoked")
+	errShareUsedUp   = errors.New("share link download limit reached")
+	errSharePassword = errors.New("password required")
+	errShareLocked   = errors.New("too many wrong passwords; try again later")
+)
+
+// shareStore keeps share links and the key used to sign their tokens.
+// Tokens are "<id>.<signature>", where the signature is an HMAC over the id,
+// path and expiry, so a token cannot be altered to point at another file or
+// live longer than it was minted for.
+type shareStore struct {
+	mu       sync.Mutex
+	path     string
+	key      []byte
+	shares   map[string]*share
+	failures map[string]*passwordFailures
+}
+
+// passwordFailures counts one client's wrong passwords for one link.
+type passwordFailures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+func loadShareStore(dir string) (*shareStore, error) {
+	s := &shareStore{
+		path:     filepath.Join(dir, "shares.json"),
+		shares:   make(map[string]*share),
+		failures: make(map[string]*passwordFailures),
+	}
+	key, err := loadOrCreateKey(filepath.Join(dir, "share.key"))
+	if err != nil {
+		return nil, fmt.Errorf("loading share key: %w", err)
+	}
+	s.key = key
+	if err := loadJSON(s.path, &s.shares); err != nil {
+		return nil, fmt.Errorf("loading shares: %w", err)
+	}
+	return s, nil
+}
+
+// loadOrCreateKey reads a 32-byte secret from path, generating and saving a
+// new one the first time.
+func loadOrCreateKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, key, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (s *shareStore) sign(sh *share) string {
+	signed := sh.Path
+	if sh.Signed != "" {
+		signed = sh.Signed
+	}
+	mac := hmac.New(sha256.New, s.key)
+	fmt.Fprintf(mac, "%s\n%s\n%d", sh.ID, signed, sh.Expires.Unix())
+	return sh.ID + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// hashSharePassword stretches a link password with PBKDF2. With no
+// iterations it is the single HMAC older links were made with.
+func hashSharePassword(salt, password string, iterations int) string {
+	if iterations == 0 {
+		mac := hmac.New(sha256.New, []byte(salt))
+		mac.Write([]byte(password))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	return hex.EncodeToString(pbkdf2SHA256([]byte(password), []byte(salt), iterations, sha256.Size))
+}
+
+// pbkdf2SHA256 derives keyLen bytes from password and salt with PBKDF2
+// (RFC 8018) using HMAC-SHA256.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var out, u []byte
+	var counter [4]byte
+	for block := uint32(1); len(out) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], block)
+		prf.Write(counter[:])
+		u = prf.Sum(u[:0])
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:keyLen]
+}
+
+// create mints a new share link for the stored file at path.
+func (s *shareStore) create(path string, ttl time.Duration, maxDownloads int, password string) (*share, error) {
+	sh := &share{
+		ID:           randomID(9),
+		Path:         path,
+		Created:      time.Now().UTC(),
+		Expires:      time.Now().Add(ttl).UTC().Truncate(time.Second),
+		MaxDownloads: maxDownloads,
+	}
+	if password != "" {
+		sh.PasswordSalt = randomID(12)
+		sh.PasswordIterations = sharePasswordIterations
+		sh.PasswordHash = hashSharePassword(sh.PasswordSalt, password, sh.PasswordIterations)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shares[sh.ID] = sh
+	if err := saveJSON(s.path, s.shares); err != nil {
+		delete(s.shares, sh.ID)
+		return nil, err
+	}
+	return sh, nil
+}
+
+// revoke disables a share link for good.
+func (s *shareStore) revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh, ok := s.shares[id]
+	if !ok {
+		return errShareNotFound
+	}
+	sh.Revoked = true
+	return saveJSON(s.path, s.shares)
+}
+
+// move points the links to a file or directory that was renamed at its new
+// name.
+func (s *shareStore) move(from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for _, sh := range s.shares {
+		if dest, ok := movedPath(sh.Path, from, to); ok {
+			if sh.Signed == "" {
+				sh.Signed = sh.Path
+			}
+			sh.Path = dest
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return saveJSON(s.path, s.shares)
+}
+
+// forget revokes the links to a file or directory that was deleted, so
+// they cannot serve whatever is stored under the name next.
+func (s *shareStore) forget(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for _, sh := range s.shares {
+		if _, ok := movedPath(sh.Path, name, name); ok && !sh.Revoked {
+			sh.Revoked = true
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return saveJSON(s.path, s.shares)
+}
+
+// list returns the links that can still be used.
+func (s *shareStore) list(now time.Time) []*share {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*share
+	for _, sh := range s.shares {
+		if !sh.Revoked && now.Before(sh.Expires) && (sh.MaxDownloads == 0 || sh.Downloads < sh.MaxDownloads) {
+			c := *sh
+			out = append(out, &c)
+		}
+	}
+	return out
+}
+
+// redeem checks token and password for a request from client and returns
+// the path of the shared file. A download uses up one of the link's
+// downloads, unless it is a ranged request from a client already counted,
+// which continues the download it was counted for. HEAD requests, where
+// download is false, never count.
+func (s *shareStore) redeem(token, password, client string, download, ranged bool) (string, error) {
+	id := strings.SplitN(token, ".", 2)[0]
+
+	s.mu.Lock()
+	sh, ok := s.shares[id]
+	if !ok || !hmac.Equal([]byte(token), []byte(s.sign(sh))) {
+		s.mu.Unlock()
+		return "", errShareNotFound
+	}
+	if sh.Revoked {
+		s.mu.Unlock()
+		return "", errShareRevoked
+	}
+	if !time.Now().Before(sh.Expires) {
+		s.mu.Unlock()
+		return "", errShareExpired
+	}
+	resuming := ranged && sh.clients[client]
+	if sh.MaxDownloads > 0 && sh.Downloads >= sh.MaxDownloads && !resuming {
+		s.mu.Unlock()
+		return "", errShareUsedUp
+	}
+	salt, want, iterations := sh.PasswordSalt, sh.PasswordHash, sh.PasswordIterations
+	failureKey := id + "\x00" + client
+	if f := s.failures[failureKey]; f != nil && time.Now().Before(f.until) {
+		s.mu.Unlock()
+		return "", errShareLocked
+	}
+	s.mu.Unlock()
+
+	// The password is checked without the lock, as stretching it is slow.
+	if want != "" {
+		got := hashSharePassword(salt, password, iterations)
+		if password == "" || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			if password != "" {
+				s.recordFailure(failureKey)
+			}
+			return "", errSharePassword
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.failures, failureKey)
+	if !download || resuming {
+		return sh.Path, nil
+	}
+	if sh.MaxDownloads > 0 && sh.Downloads >= sh.MaxDownloads {
+		return "", errShareUsedUp
+	}
+	sh.Downloads++
+	if sh.clients == nil {
+		sh.clients = make(map[string]bool)
+	}
+	sh.clients[client] = true
+	if err := saveJSON(s.path, s.shares); err != nil {
+		log.Printf("Failed to record share download: %v", err)
+	}
+	return sh.Path, nil
+}
+
+// recordFailure notes a wrong password and, after sharePasswordTries of
+// them, locks the link for that client for a while.
+func (s *shareStore) recordFailure(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, f := range s.failures {
+		if now.Sub(f.last) > sharePasswordMaxDelay && now.After(f.until) {
+			delete(s.failures, k)
+		}
+	}
+	f := s.failures[key]
+	if f == nil {
+		f = &passwordFailures{}
+		s.failures[key] = f
+	}
+	f.count++
+	f.last = now
+	if f.count >= sharePasswordTries {
+		delay := sharePasswordBackoff << uint(f.count-sharePasswordTries)
+		if delay > sharePasswordMaxDelay || delay <= 0 {
+			delay = sharePasswordMaxDelay
+		}
+		f.until = now.Add(delay)
+	}
+}
+
+func (s *shareStore) info(r *http.Request, sh *share) shareInfo {
+	token := s.sign(sh)
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return shareInfo{
+		ID:           sh.ID,
+		Path:         sh.Path,
+		Token:        token,
+		URL:          scheme + "://" + r.Host + "/s/" + token,
+		Expires:      sh.Expires,
+		MaxDownloads: sh.MaxDownloads,
+		Downloads:    sh.Downloads,
+		Password:     sh.PasswordHash != "",
+	}
+}
+
+// handleShares serves the share management API:
+//
+//	GET    /api/shares       list active links
+//	POST   /api/shares       mint a link: {"path", "expires_in", "max_downloads", "password"}
+//	DELETE /api/shares/{id}  revoke a link
+func handleShares(shares *shareStore, store storage, uploadDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/shares"), "/")
+
+		switch {
+		case r.Method == http.MethodGet && id == "":
+			infos := []shareInfo{}
+			for _, sh := range shares.list(time.Now()) {
+				infos = append(infos, shares.info(r, sh))
+			}
+			writeJSON(w, http.StatusOK, infos)
+
+		case r.Method == http.MethodPost && id == "":
+			var req struct {
+				Path         string `json:"path"`
+				ExpiresIn    string `json:"expires_in"`
+				MaxDownloads int    `json:"max_downloads"`
+				Password     string `json:"password"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			ttl := defaultShareTTL
+			if req.ExpiresIn != "" {
+				var err error
+				if ttl, err = parseTTL(req.ExpiresIn); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if req.MaxDownloads < 0 {
+				http.Error(w, "max_downloads must not be negative", http.StatusBadRequest)
+				return
+			}
+			rel, _, err := resolveUploadPath(uploadDir, req.Path)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, err := store.stat(rel); err != nil {
+				http.Error(w, "File not found", http.StatusNotFound)
+				return
+			}
+			sh, err := shares.create(rel, ttl, req.MaxDownloads, req.Password)
+			if err != nil {
+				http.Error(w, "Failed to create share: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Printf("Shared %s until %s (link %s)", rel, sh.Expires.Format(time.RFC3339), sh.ID)
+			writeJSON(w, http.StatusCreated, shares.info(r, sh))
+
+		case r.Method == http.MethodDelete && id != "":
+			if err := shares.revoke(id); err != nil {
+				if err == errShareNotFound {
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				}
+				http.Error(w, "Failed to revoke share: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Printf("Revoked share link %s", id)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleShareDownload serves /s/{token}. Password-protected links accept the
+// password as a "password" form value and show a prompt when it is missing.
+func handleShareDownload(shares *shareStore, store storage, uploadDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token := strings.TrimPrefix(r.URL.Path, "/s/")
+
+		// Only a fresh download uses up the link. A ranged request counts
+		// too, unless it comes from a client already counted for, so a
+		// file cannot be fetched piecemeal without using up downloads.
+		download := r.Method != http.MethodHead
+		ranged := r.Header.Get("Range") != ""
+
+		rel, err := shares.redeem(token, r.FormValue("password"), clientIP(r), download, ranged)
+		switch err {
+		case nil:
+		case errSharePassword:
+			msg := ""
+			if r.FormValue("password") != "" {
+				msg = "ACCESS DENIED"
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, sharePasswordPage, html.EscapeString(r.URL.Path), msg)
+			return
+		case errShareNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errShareLocked:
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+
+		rel, _, err = resolveUploadPath(uploadDir, rel)
+		if err != nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Share download of %s by %s", rel, clientIP(r))
+		serveDownload(w, r, store, rel)
+	}
+}
+
+const sharePasswordPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<title>NOSTROMO SECURE TRANSFER</title>
+<style>
+body { background: #000; color: #5cdb5c; font-family: 'Share Tech Mono', monospace; padding: 40px; }
+form { border: 1px solid #93e293; background: #001100; padding: 30px; max-width: 500px; margin: 0 auto; }
+input, button { background: rgba(0, 30, 0, 0.6); color: #93e293; border: 1px solid #93e293; font-family: inherit; padding: 8px; margin-top: 10px; }
+</style>
+</head>
+<body>
+<form method="POST" action="%s">
+<p>&gt;_ MU/TH/UR 6000: RESTRICTED DATA</p>
+<p>&gt;_ ENTER ACCESS CODE TO RETRIEVE FILE</p>
+<input type="password" name="password" autofocus>
+<button type="submit">TRANSMIT</button>
+<p style="color:#ff6b6b">%s</p>
+</form>
+</body>
+</html>`
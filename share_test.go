@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestPBKDF2SHA256(t *testing.T) {
+	// RFC 7914, section 11.
+	cases := []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, c := range cases {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(c.password), []byte(c.salt), c.iterations, 64))
+		if got != c.want {
+			t.Errorf("pbkdf2SHA256(%q, %q, %d) = %s, want %s", c.password, c.salt, c.iterations, got, c.want)
+		}
+	}
+}
+
+func newTestShares(t *testing.T) *shareStore {
+	t.Helper()
+	s, err := loadShareStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestShareRangedRequestsUseUpDownloads(t *testing.T) {
+	s := newTestShares(t)
+	sh, err := s.create("report.pdf", time.Hour, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := s.sign(sh)
+
+	// A range that skips the first byte is still a download.
+	if _, err := s.redeem(token, "", "10.0.0.1", true, true); err != nil {
+		t.Fatalf("first ranged request: %v", err)
+	}
+	if sh.Downloads != 1 {
+		t.Fatalf("downloads = %d after a ranged request, want 1", sh.Downloads)
+	}
+
+	// The same client may fetch the rest, but nobody may start again.
+	if _, err := s.redeem(token, "", "10.0.0.1", true, true); err != nil {
+		t.Fatalf("resumed range from the counted client: %v", err)
+	}
+	if _, err := s.redeem(token, "", "10.0.0.1", true, false); err != errShareUsedUp {
+		t.Fatalf("fresh download after the limit: %v", err)
+	}
+	if _, err := s.redeem(token, "", "10.0.0.2", true, true); err != errShareUsedUp {
+		t.Fatalf("ranged request from another client: %v", err)
+	}
+	if sh.Downloads != 1 {
+		t.Fatalf("downloads = %d, want 1", sh.Downloads)
+	}
+}
+
+func TestShareHeadDoesNotCount(t *testing.T) {
+	s := newTestShares(t)
+	sh, err := s.create("report.pdf", time.Hour, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := s.sign(sh)
+	for i := 0; i < 3; i++ {
+		if _, err := s.redeem(token, "", "10.0.0.1", false, false); err != nil {
+			t.Fatalf("HEAD %d: %v", i, err)
+		}
+	}
+	if sh.Downloads != 0 {
+		t.Fatalf("downloads = %d after HEAD requests, want 0", sh.Downloads)
+	}
+}
+
+func TestSharePassword(t *testing.T) {
+	s := newTestShares(t)
+	sh, err := s.create("report.pdf", time.Hour, 0, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sh.PasswordIterations != sharePasswordIterations {
+		t.Fatalf("iterations = %d, want %d", sh.PasswordIterations, sharePasswordIterations)
+	}
+	token := s.sign(sh)
+
+	if _, err := s.redeem(token, "", "10.0.0.1", true, false); err != errSharePassword {
+		t.Fatalf("no password: %v", err)
+	}
+	for i := 0; i < sharePasswordTries; i++ {
+		if _, err := s.redeem(token, "wrong", "10.0.0.1", true, false); err != errSharePassword {
+			t.Fatalf("wrong password %d: %v", i, err)
+		}
+	}
+	// Locked out now, even with the right password; others are not.
+	if _, err := s.redeem(token, "hunter2", "10.0.0.1", true, false); err != errShareLocked {
+		t.Fatalf("right password while locked: %v", err)
+	}
+	if _, err := s.redeem(token, "hunter2", "10.0.0.2", true, false); err != nil {
+		t.Fatalf("right password from another client: %v", err)
+	}
+}
+
+func TestShareLegacyPasswordHash(t *testing.T) {
+	s := newTestShares(t)
+	sh, err := s.create("report.pdf", time.Hour, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As stored before passwords were stretched.
+	sh.PasswordSalt = "salt"
+	sh.PasswordHash = hashSharePassword("salt", "hunter2", 0)
+	if _, err := s.redeem(s.sign(sh), "hunter2", "10.0.0.1", true, false); err != nil {
+		t.Fatalf("legacy hash: %v", err)
+	}
+}
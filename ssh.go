@@ -0,0 +1,1111 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file is a small SSH-2 server (RFC 4251-4254) that does just enough
+// to carry the SFTP subsystem: curve25519 key exchange, an ed25519 host key,
+// AES-CTR with HMAC-SHA2-256, password and public key authentication, and
+// session channels. Shells, exec, port forwarding and agents are refused.
+
+const sshServerVersion = "SSH-2.0-Nostromo_1.0"
+
+// SSH message numbers (RFC 4250).
+const (
+	msgDisconnect          = 1
+	msgIgnore              = 2
+	msgUnimplemented       = 3
+	msgDebug               = 4
+	msgServiceRequest      = 5
+	msgServiceAccept       = 6
+	msgExtInfo             = 7
+	msgKexInit             = 20
+	msgNewKeys             = 21
+	msgKexECDHInit         = 30
+	msgKexECDHReply        = 31
+	msgUserauthRequest     = 50
+	msgUserauthFailure     = 51
+	msgUserauthSuccess     = 52
+	msgUserauthPKOK        = 60
+	msgGlobalRequest       = 80
+	msgRequestFailure      = 82
+	msgChannelOpen         = 90
+	msgChannelOpenConfirm  = 91
+	msgChannelOpenFailure  = 92
+	msgChannelWindowAdjust = 93
+	msgChannelData         = 94
+	msgChannelEOF          = 96
+	msgChannelClose        = 97
+	msgChannelRequest      = 98
+	msgChannelSuccess      = 99
+	msgChannelFailure      = 100
+)
+
+const (
+	sshMaxPacket      = 256 << 10
+	sshChannelWindow  = 2 << 20
+	sshChannelPacket  = 32 << 10
+	sshAuthTimeout    = 2 * time.Minute
+	sshMaxAuthTries   = 10
+	sshKexAlgo        = "curve25519-sha256"
+	sshHostKeyAlgo    = "ssh-ed25519"
+	sshMACAlgo        = "hmac-sha2-256"
+	sshServerSigAlgos = "ssh-ed25519,rsa-sha2-256,rsa-sha2-512,ecdsa-sha2-nistp256,ecdsa-sha2-nistp384,ecdsa-sha2-nistp521"
+)
+
+// sshCiphers maps the supported ciphers to their key lengths.
+var sshCiphers = map[string]int{"aes128-ctr": 16, "aes256-ctr": 32}
+
+var errSSHShortPacket = errors.New("ssh: malformed packet")
+
+// sshPut* append SSH wire encodings (RFC 4251 section 5) to b.
+
+func sshPutUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func sshPutUint64(b []byte, v uint64) []byte {
+	return sshPutUint32(sshPutUint32(b, uint32(v>>32)), uint32(v))
+}
+
+func sshPutString(b []byte, s []byte) []byte {
+	return append(sshPutUint32(b, uint32(len(s))), s...)
+}
+
+func sshPutBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+// sshPutMpint appends an unsigned big-endian integer as an mpint.
+func sshPutMpint(b []byte, v []byte) []byte {
+	for len(v) > 0 && v[0] == 0 {
+		v = v[1:]
+	}
+	if len(v) > 0 && v[0]&0x80 != 0 {
+		v = append([]byte{0}, v...)
+	}
+	return sshPutString(b, v)
+}
+
+// sshReader decodes SSH wire data. The first decoding error sticks, so a
+// message can be read field by field and checked once at the end.
+type sshReader struct {
+	b   []byte
+	err error
+}
+
+func (r *sshReader) take(n int) []byte {
+	if r.err != nil || n < 0 || len(r.b) < n {
+		r.err = errSSHShortPacket
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *sshReader) byte() byte {
+	if v := r.take(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (r *sshReader) uint32() uint32 {
+	v := r.take(4)
+	if v == nil {
+		return 0
+	}
+	return uint32(v[0])<<24 | uint32(v[1])<<16 | uint32(v[2])<<8 | uint32(v[3])
+}
+
+func (r *sshReader) uint64() uint64 {
+	hi := r.uint32()
+	return uint64(hi)<<32 | uint64(r.uint32())
+}
+
+func (r *sshReader) bytes() []byte {
+	n := r.uint32()
+	if n > uint32(len(r.b)) {
+		r.err = errSSHShortPacket
+		return nil
+	}
+	return r.take(int(n))
+}
+
+func (r *sshReader) string() string { return string(r.bytes()) }
+
+func (r *sshReader) bool() bool { return r.byte() != 0 }
+
+// sshDirection is the cipher state for one direction of a connection.
+type sshDirection struct {
+	stream cipher.Stream
+	mac    hash.Hash
+}
+
+// sshConfig describes how the SSH server authenticates clients.
+type sshConfig struct {
+	hostKey        ed25519.PrivateKey
+	user           string
+	password       string
+	authorizedKeys [][]byte
+}
+
+// sshConn is one client connection.
+type sshConn struct {
+	cfg  *sshConfig
+	conn net.Conn
+	br   *bufio.Reader
+
+	clientVersion []byte
+	sessionID     []byte
+	extInfo       bool
+
+	readSeq  uint32
+	writeSeq uint32
+	rd, wr   *sshDirection
+
+	// writeMu serialises packets; key exchange holds it throughout so no
+	// channel data is sent while keys are changing.
+	writeMu sync.Mutex
+
+	user     string
+	channels map[uint32]*sshChannel
+	nextID   uint32
+
+	// subsystem is started for each channel that asks for "sftp".
+	subsystem func(c *sshConn, ch *sshChannel)
+}
+
+// readPacket reads, decrypts and verifies one packet, returning its payload.
+func (c *sshConn) readPacket() ([]byte, error) {
+	blockSize := 8
+	if c.rd != nil {
+		blockSize = aes.BlockSize
+	}
+	first := make([]byte, blockSize)
+	if _, err := io.ReadFull(c.br, first); err != nil {
+		return nil, err
+	}
+	if c.rd != nil {
+		c.rd.stream.XORKeyStream(first, first)
+	}
+	length := uint32(first[0])<<24 | uint32(first[1])<<16 | uint32(first[2])<<8 | uint32(first[3])
+	if length < 5 || length > sshMaxPacket || (length+4)%uint32(blockSize) != 0 {
+		return nil, fmt.Errorf("ssh: invalid packet length %d", length)
+	}
+	packet := make([]byte, length+4)
+	copy(packet, first)
+	if _, err := io.ReadFull(c.br, packet[blockSize:]); err != nil {
+		return nil, err
+	}
+	if c.rd != nil {
+		c.rd.stream.XORKeyStream(packet[blockSize:], packet[blockSize:])
+		c.rd.mac.Reset()
+		c.rd.mac.Write(sshPutUint32(nil, c.readSeq))
+		c.rd.mac.Write(packet)
+		want := c.rd.mac.Sum(nil)
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(c.br, got); err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(want, got) {
+			return nil, errors.New("ssh: MAC mismatch")
+		}
+	}
+	c.readSeq++
+	padding := uint32(packet[4])
+	if padding+1 > length {
+		return nil, errors.New("ssh: invalid padding")
+	}
+	payload := packet[5 : 4+length-padding]
+	if len(payload) == 0 {
+		return nil, errSSHShortPacket
+	}
+	return payload, nil
+}
+
+// writePacket sends one packet. The caller must hold writeMu.
+func (c *sshConn) writePacketLocked(payload []byte) error {
+	blockSize := 8
+	if c.wr != nil {
+		blockSize = aes.BlockSize
+	}
+	padding := blockSize - (5+len(payload))%blockSize
+	if padding < 4 {
+		padding += blockSize
+	}
+	packet := make([]byte, 0, 5+len(payload)+padding+sha256.Size)
+	packet = sshPutUint32(packet, uint32(1+len(payload)+padding))
+	packet = append(packet, byte(padding))
+	packet = append(packet, payload...)
+	pad := make([]byte, padding)
+	rand.Read(pad)
+	packet = append(packet, pad...)
+
+	if c.wr != nil {
+		c.wr.mac.Reset()
+		c.wr.mac.Write(sshPutUint32(nil, c.writeSeq))
+		c.wr.mac.Write(packet)
+		mac := c.wr.mac.Sum(nil)
+		c.wr.stream.XORKeyStream(packet, packet)
+		packet = append(packet, mac...)
+	}
+	c.writeSeq++
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+func (c *sshConn) writePacket(payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.writePacketLocked(payload)
+}
+
+func (c *sshConn) disconnect(reason uint32, msg string) {
+	p := sshPutUint32([]byte{msgDisconnect}, reason)
+	p = sshPutString(p, []byte(msg))
+	p = sshPutString(p, nil)
+	c.writePacket(p)
+}
+
+// kexInit builds our KEXINIT message.
+func sshKexInit() []byte {
+	cookie := make([]byte, 16)
+	rand.Read(cookie)
+	p := append([]byte{msgKexInit}, cookie...)
+	for _, list := range []string{
+		sshKexAlgo + ",curve25519-sha256@libssh.org",
+		sshHostKeyAlgo,
+		"aes128-ctr,aes256-ctr", "aes128-ctr,aes256-ctr",
+		sshMACAlgo, sshMACAlgo,
+		"none", "none",
+		"", "",
+	} {
+		p = sshPutString(p, []byte(list))
+	}
+	p = sshPutBool(p, false)
+	return sshPutUint32(p, 0)
+}
+
+// sshChoose picks the first algorithm in the client's list that we support.
+func sshChoose(client string, supported func(string) bool) (string, error) {
+	for _, a := range strings.Split(client, ",") {
+		if supported(a) {
+			return a, nil
+		}
+	}
+	return "", fmt.Errorf("ssh: no common algorithm in %q", client)
+}
+
+// kex runs a key exchange. clientInit is the client's KEXINIT if it has
+// already been read, as it is when the client asks to rekey.
+func (c *sshConn) kex(clientInit []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	serverInit := sshKexInit()
+	if err := c.writePacketLocked(serverInit); err != nil {
+		return err
+	}
+	for clientInit == nil {
+		p, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+		switch p[0] {
+		case msgKexInit:
+			clientInit = p
+		case msgIgnore, msgDebug:
+		default:
+			return fmt.Errorf("ssh: unexpected message %d before key exchange", p[0])
+		}
+	}
+
+	// The message type is followed by a 16 byte cookie and the name-lists.
+	r := &sshReader{b: clientInit[1:]}
+	r.take(16)
+	kexAlgos := r.string()
+	hostKeyAlgos := r.string()
+	ciphersC2S, ciphersS2C := r.string(), r.string()
+	macsC2S, macsS2C := r.string(), r.string()
+	compC2S, compS2C := r.string(), r.string()
+	r.string()
+	r.string()
+	guessFollows := r.bool()
+	if r.err != nil {
+		return r.err
+	}
+	if c.sessionID == nil {
+		for _, a := range strings.Split(kexAlgos, ",") {
+			if a == "ext-info-c" {
+				c.extInfo = true
+			}
+		}
+	}
+
+	var cipherC2S, cipherS2C string
+	var err error
+	isKex := func(a string) bool { return a == sshKexAlgo || a == "curve25519-sha256@libssh.org" }
+	isCipher := func(a string) bool { return sshCiphers[a] > 0 }
+	isMAC := func(a string) bool { return a == sshMACAlgo }
+	isNone := func(a string) bool { return a == "none" }
+	kexAlgo, err := sshChoose(kexAlgos, isKex)
+	if err == nil {
+		_, err = sshChoose(hostKeyAlgos, func(a string) bool { return a == sshHostKeyAlgo })
+	}
+	if err == nil {
+		cipherC2S, err = sshChoose(ciphersC2S, isCipher)
+	}
+	if err == nil {
+		cipherS2C, err = sshChoose(ciphersS2C, isCipher)
+	}
+	if err == nil {
+		_, err = sshChoose(macsC2S, isMAC)
+	}
+	if err == nil {
+		_, err = sshChoose(macsS2C, isMAC)
+	}
+	if err == nil {
+		_, err = sshChoose(compC2S, isNone)
+	}
+	if err == nil {
+		_, err = sshChoose(compS2C, isNone)
+	}
+	if err != nil {
+		return err
+	}
+	// A client that guessed the wrong algorithm sends a packet we must
+	// ignore.
+	skipGuess := guessFollows && !strings.HasPrefix(kexAlgos, kexAlgo+",") && kexAlgos != kexAlgo
+
+	var qc []byte
+	for qc == nil {
+		p, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+		if skipGuess {
+			skipGuess = false
+			continue
+		}
+		if p[0] != msgKexECDHInit {
+			return fmt.Errorf("ssh: expected KEX_ECDH_INIT, got %d", p[0])
+		}
+		r := &sshReader{b: p[1:]}
+		qc = r.bytes()
+		if r.err != nil {
+			return r.err
+		}
+	}
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	peer, err := ecdh.X25519().NewPublicKey(qc)
+	if err != nil {
+		return err
+	}
+	secret, err := priv.ECDH(peer)
+	if err != nil {
+		return err
+	}
+	qs := priv.PublicKey().Bytes()
+	k := sshPutMpint(nil, secret)
+	hostKeyBlob := sshPublicKeyBlob(c.cfg.hostKey.Public().(ed25519.PublicKey))
+
+	h := sha256.New()
+	for _, v := range [][]byte{c.clientVersion, []byte(sshServerVersion), clientInit, serverInit, hostKeyBlob, qc, qs} {
+		h.Write(sshPutString(nil, v))
+	}
+	h.Write(k)
+	exchangeHash := h.Sum(nil)
+	if c.sessionID == nil {
+		c.sessionID = exchangeHash
+	}
+
+	sig := sshPutString(nil, []byte(sshHostKeyAlgo))
+	sig = sshPutString(sig, ed25519.Sign(c.cfg.hostKey, exchangeHash))
+	reply := sshPutString([]byte{msgKexECDHReply}, hostKeyBlob)
+	reply = sshPutString(reply, qs)
+	reply = sshPutString(reply, sig)
+	if err := c.writePacketLocked(reply); err != nil {
+		return err
+	}
+	if err := c.writePacketLocked([]byte{msgNewKeys}); err != nil {
+		return err
+	}
+
+	derive := func(letter byte, n int) []byte {
+		h := sha256.New()
+		h.Write(k)
+		h.Write(exchangeHash)
+		h.Write([]byte{letter})
+		h.Write(c.sessionID)
+		out := h.Sum(nil)
+		for len(out) < n {
+			h := sha256.New()
+			h.Write(k)
+			h.Write(exchangeHash)
+			h.Write(out)
+			out = h.Sum(out)
+		}
+		return out[:n]
+	}
+	newDirection := func(ivLetter, keyLetter, macLetter byte, cipherName string) (*sshDirection, error) {
+		block, err := aes.NewCipher(derive(keyLetter, sshCiphers[cipherName]))
+		if err != nil {
+			return nil, err
+		}
+		return &sshDirection{
+			stream: cipher.NewCTR(block, derive(ivLetter, aes.BlockSize)),
+			mac:    hmac.New(sha256.New, derive(macLetter, sha256.Size)),
+		}, nil
+	}
+	if c.wr, err = newDirection('B', 'D', 'F', cipherS2C); err != nil {
+		return err
+	}
+	if c.extInfo {
+		c.extInfo = false
+		p := sshPutUint32([]byte{msgExtInfo}, 1)
+		p = sshPutString(p, []byte("server-sig-algs"))
+		p = sshPutString(p, []byte(sshServerSigAlgos))
+		if err := c.writePacketLocked(p); err != nil {
+			return err
+		}
+	}
+
+	for {
+		p, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+		if p[0] == msgIgnore || p[0] == msgDebug {
+			continue
+		}
+		if p[0] != msgNewKeys {
+			return fmt.Errorf("ssh: expected NEWKEYS, got %d", p[0])
+		}
+		break
+	}
+	c.rd, err = newDirection('A', 'C', 'E', cipherC2S)
+	return err
+}
+
+// sshPublicKeyBlob encodes an ed25519 public key in SSH wire format.
+func sshPublicKeyBlob(pub ed25519.PublicKey) []byte {
+	return sshPutString(sshPutString(nil, []byte(sshHostKeyAlgo)), pub)
+}
+
+// sshFingerprint formats a key blob the way ssh-keygen -l does.
+func sshFingerprint(blob []byte) string {
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// verifySSHSignature checks sig, made by the key in blob using algo, over
+// data. ed25519, RSA with SHA-2 and the NIST ECDSA curves are accepted.
+func verifySSHSignature(algo string, blob, data, sig []byte) bool {
+	kr := &sshReader{b: blob}
+	keyType := kr.string()
+	sr := &sshReader{b: sig}
+	sigAlgo := sr.string()
+	sigBytes := sr.bytes()
+	if sr.err != nil || sigAlgo != algo {
+		return false
+	}
+
+	switch algo {
+	case "ssh-ed25519":
+		pub := kr.bytes()
+		return keyType == algo && kr.err == nil && len(pub) == ed25519.PublicKeySize &&
+			ed25519.Verify(ed25519.PublicKey(pub), data, sigBytes)
+
+	case "rsa-sha2-256", "rsa-sha2-512":
+		e := new(big.Int).SetBytes(kr.bytes())
+		n := new(big.Int).SetBytes(kr.bytes())
+		if keyType != "ssh-rsa" || kr.err != nil || !e.IsInt64() || n.BitLen() < 2048 {
+			return false
+		}
+		pub := &rsa.PublicKey{N: n, E: int(e.Int64())}
+		if algo == "rsa-sha2-256" {
+			sum := sha256.Sum256(data)
+			return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sigBytes) == nil
+		}
+		sum := sha512.Sum512(data)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA512, sum[:], sigBytes) == nil
+
+	case "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521":
+		kr.string()
+		point := kr.bytes()
+		if keyType != algo || kr.err != nil {
+			return false
+		}
+		var curve elliptic.Curve
+		var digest []byte
+		switch algo {
+		case "ecdsa-sha2-nistp256":
+			curve = elliptic.P256()
+			sum := sha256.Sum256(data)
+			digest = sum[:]
+		case "ecdsa-sha2-nistp384":
+			curve = elliptic.P384()
+			sum := sha512.Sum384(data)
+			digest = sum[:]
+		default:
+			curve = elliptic.P521()
+			sum := sha512.Sum512(data)
+			digest = sum[:]
+		}
+		x, y := elliptic.Unmarshal(curve, point)
+		if x == nil {
+			return false
+		}
+		rs := &sshReader{b: sigBytes}
+		rInt := new(big.Int).SetBytes(rs.bytes())
+		sInt := new(big.Int).SetBytes(rs.bytes())
+		return rs.err == nil && ecdsa.Verify(&ecdsa.PublicKey{Curve: curve, X: x, Y: y}, digest, rInt, sInt)
+	}
+	return false
+}
+
+// loadAuthorizedKeys reads public keys in OpenSSH authorized_keys format.
+// Key options such as from=, command= and restrict are not supported, so a
+// key that carries any is skipped rather than let in without its limits.
+func loadAuthorizedKeys(path string) ([][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys [][]byte
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if !strings.HasPrefix(fields[i], "ssh-") && !strings.HasPrefix(fields[i], "ecdsa-sha2-") {
+				continue
+			}
+			blob, err := base64.StdEncoding.DecodeString(fields[i+1])
+			if err != nil {
+				continue
+			}
+			r := &sshReader{b: blob}
+			if r.string() != fields[i] || r.err != nil {
+				continue
+			}
+			if i > 0 {
+				log.Printf("Skipping key on line %d of %s: key options (%s) are not supported", n+1, path, strings.Join(fields[:i], " "))
+			} else {
+				keys = append(keys, blob)
+			}
+			break
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no usable keys in %s", path)
+	}
+	return keys, nil
+}
+
+// loadOrCreateHostKey reads the server's ed25519 host key, generating one
+// on first run so clients see the same fingerprint across restarts.
+func loadOrCreateHostKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s is not a PEM file", path)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ed, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an ed25519 key", path)
+		}
+		return ed, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// serveSSH accepts SSH connections on l until it is closed, starting
+// subsystem for each channel that requests SFTP.
+func serveSSH(l net.Listener, cfg *sshConfig, subsystem func(c *sshConn, ch *sshChannel)) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			// A bug in handling one client must not take the server down.
+			defer func() {
+				if v := recover(); v != nil {
+					log.Printf("SSH connection from %s panicked: %v", conn.RemoteAddr(), v)
+					conn.Close()
+				}
+			}()
+			c := &sshConn{
+				cfg:       cfg,
+				conn:      conn,
+				br:        bufio.NewReader(conn),
+				channels:  make(map[uint32]*sshChannel),
+				subsystem: subsystem,
+			}
+			if err := c.serve(); err != nil && err != io.EOF {
+				log.Printf("SSH connection from %s ended: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// clientAddr is the address the connection is accounted against, in the
+// same form clientIP gives for HTTP requests.
+func (c *sshConn) clientAddr() string {
+	host, _, err := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if err != nil {
+		return c.conn.RemoteAddr().String()
+	}
+	return host
+}
+
+func (c *sshConn) serve() error {
+	defer c.conn.Close()
+	defer c.closeChannels()
+
+	// Everything up to a successful login has to happen promptly.
+	c.conn.SetDeadline(time.Now().Add(sshAuthTimeout))
+	if _, err := io.WriteString(c.conn, sshServerVersion+"\r\n"); err != nil {
+		return err
+	}
+	for {
+		line, err := c.br.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if len(line) > 255 {
+			return errors.New("ssh: version line too long")
+		}
+		if strings.HasPrefix(line, "SSH-") {
+			if !strings.HasPrefix(line, "SSH-2.0-") {
+				return fmt.Errorf("ssh: unsupported protocol version %q", strings.TrimSpace(line))
+			}
+			c.clientVersion = []byte(strings.TrimRight(line, "\r\n"))
+			break
+		}
+	}
+	if err := c.kex(nil); err != nil {
+		return err
+	}
+
+	authenticated := false
+	failures := 0
+	for {
+		p, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+		r := &sshReader{b: p[1:]}
+
+		switch p[0] {
+		case msgKexInit:
+			if err := c.kex(p); err != nil {
+				return err
+			}
+		case msgIgnore, msgDebug, msgUnimplemented:
+		case msgDisconnect:
+			return nil
+
+		case msgServiceRequest:
+			service := r.string()
+			if service != "ssh-userauth" || authenticated {
+				c.disconnect(7, "service not available")
+				return fmt.Errorf("ssh: unexpected service request %q", service)
+			}
+			if err := c.writePacket(sshPutString([]byte{msgServiceAccept}, []byte(service))); err != nil {
+				return err
+			}
+
+		case msgUserauthRequest:
+			if authenticated {
+				continue
+			}
+			ok, reply := c.authenticate(r)
+			if ok {
+				authenticated = true
+				c.conn.SetDeadline(time.Time{})
+				log.Printf("SFTP login by %s from %s", c.user, c.clientAddr())
+				if err := c.writePacket([]byte{msgUserauthSuccess}); err != nil {
+					return err
+				}
+				continue
+			}
+			if reply == nil {
+				failures++
+				if failures >= sshMaxAuthTries {
+					c.disconnect(14, "too many authentication failures")
+					return errors.New("ssh: too many authentication failures")
+				}
+				reply = c.authFailure()
+			}
+			if err := c.writePacket(reply); err != nil {
+				return err
+			}
+
+		case msgGlobalRequest:
+			r.string()
+			if r.bool() {
+				c.writePacket([]byte{msgRequestFailure})
+			}
+
+		default:
+			if !authenticated {
+				c.disconnect(2, "not authenticated")
+				return fmt.Errorf("ssh: message %d before authentication", p[0])
+			}
+			if err := c.handleChannelMessage(p); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// authFailure lists the methods a client may try.
+func (c *sshConn) authFailure() []byte {
+	var methods []string
+	if len(c.cfg.authorizedKeys) > 0 {
+		methods = append(methods, "publickey")
+	}
+	if c.cfg.password != "" {
+		methods = append(methods, "password")
+	}
+	p := sshPutString([]byte{msgUserauthFailure}, []byte(strings.Join(methods, ",")))
+	return sshPutBool(p, false)
+}
+
+// authenticate handles one USERAUTH_REQUEST. It reports success, or returns
+// a reply other than a plain failure (a public key acceptance) to send.
+func (c *sshConn) authenticate(r *sshReader) (bool, []byte) {
+	user := r.string()
+	service := r.string()
+	method := r.string()
+	userOK := c.cfg.user == "" || subtle.ConstantTimeCompare([]byte(user), []byte(c.cfg.user)) == 1
+	if r.err != nil || service != "ssh-connection" {
+		return false, nil
+	}
+
+	switch method {
+	case "password":
+		r.bool()
+		password := r.string()
+		if r.err == nil && c.cfg.password != "" && userOK &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(c.cfg.password)) == 1 {
+			c.user = user
+			return true, nil
+		}
+		log.Printf("SFTP password login failed for %q from %s", user, c.clientAddr())
+		time.Sleep(time.Second)
+		return false, nil
+
+	case "publickey":
+		hasSig := r.bool()
+		algo := r.string()
+		blob := r.bytes()
+		if r.err != nil || !userOK {
+			return false, nil
+		}
+		known := false
+		for _, k := range c.cfg.authorizedKeys {
+			if bytes.Equal(k, blob) {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return false, nil
+		}
+		if !hasSig {
+			p := sshPutString([]byte{msgUserauthPKOK}, []byte(algo))
+			return false, sshPutString(p, blob)
+		}
+		sig := r.bytes()
+		if r.err != nil {
+			return false, nil
+		}
+		data := sshPutString(nil, c.sessionID)
+		data = append(data, msgUserauthRequest)
+		data = sshPutString(data, []byte(user))
+		data = sshPutString(data, []byte(service))
+		data = sshPutString(data, []byte("publickey"))
+		data = sshPutBool(data, true)
+		data = sshPutString(data, []byte(algo))
+		data = sshPutString(data, blob)
+		if verifySSHSignature(algo, blob, data, sig) {
+			c.user = user
+			return true, nil
+		}
+		log.Printf("SFTP public key login failed for %q from %s", user, c.clientAddr())
+	}
+	return false, nil
+}
+
+// sshChannel is a session channel. Incoming data is buffered up to the
+// window we advertise, so the connection's read loop never blocks on a slow
+// subsystem; outgoing data waits for the client's window.
+type sshChannel struct {
+	c        *sshConn
+	localID  uint32
+	remoteID uint32
+	maxOut   uint32
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	in        bytes.Buffer
+	consumed  uint32
+	eof       bool
+	closed    bool
+	sentClose bool
+	started   bool
+	outWindow uint32
+}
+
+// Read returns data sent by the client, topping up its window as the
+// buffer drains.
+func (ch *sshChannel) Read(p []byte) (int, error) {
+	ch.mu.Lock()
+	for ch.in.Len() == 0 && !ch.eof && !ch.closed {
+		ch.cond.Wait()
+	}
+	if ch.in.Len() == 0 {
+		ch.mu.Unlock()
+		return 0, io.EOF
+	}
+	n, _ := ch.in.Read(p)
+	ch.consumed += uint32(n)
+	var adjust uint32
+	if ch.consumed >= sshChannelWindow/2 {
+		adjust = ch.consumed
+		ch.consumed = 0
+	}
+	ch.mu.Unlock()
+
+	if adjust > 0 {
+		msg := sshPutUint32([]byte{msgChannelWindowAdjust}, ch.remoteID)
+		ch.c.writePacket(sshPutUint32(msg, adjust))
+	}
+	return n, nil
+}
+
+// Write sends data to the client, waiting for window space as needed.
+func (ch *sshChannel) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		ch.mu.Lock()
+		for ch.outWindow == 0 && !ch.closed {
+			ch.cond.Wait()
+		}
+		if ch.closed {
+			ch.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		n := uint32(len(p))
+		if n > ch.outWindow {
+			n = ch.outWindow
+		}
+		if n > ch.maxOut {
+			n = ch.maxOut
+		}
+		ch.outWindow -= n
+		ch.mu.Unlock()
+
+		msg := sshPutUint32([]byte{msgChannelData}, ch.remoteID)
+		if err := ch.c.writePacket(sshPutString(msg, p[:n])); err != nil {
+			return written, err
+		}
+		written += int(n)
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close sends EOF and CLOSE to the client once the subsystem is finished.
+func (ch *sshChannel) Close() error {
+	ch.mu.Lock()
+	if ch.sentClose {
+		ch.mu.Unlock()
+		return nil
+	}
+	ch.sentClose = true
+	ch.mu.Unlock()
+	ch.c.writePacket(sshPutUint32([]byte{msgChannelEOF}, ch.remoteID))
+	return ch.c.writePacket(sshPutUint32([]byte{msgChannelClose}, ch.remoteID))
+}
+
+func (c *sshConn) closeChannels() {
+	for _, ch := range c.channels {
+		ch.mu.Lock()
+		ch.closed = true
+		ch.cond.Broadcast()
+		ch.mu.Unlock()
+	}
+}
+
+// handleChannelMessage deals with the connection protocol (RFC 4254).
+func (c *sshConn) handleChannelMessage(p []byte) error {
+	if p[0] < msgChannelOpen || p[0] > msgChannelFailure {
+		return c.writePacket(sshPutUint32([]byte{msgUnimplemented}, c.readSeq-1))
+	}
+	r := &sshReader{b: p[1:]}
+
+	if p[0] == msgChannelOpen {
+		kind := r.string()
+		remoteID := r.uint32()
+		window := r.uint32()
+		maxPacket := r.uint32()
+		if r.err != nil {
+			return r.err
+		}
+		if kind != "session" {
+			msg := sshPutUint32([]byte{msgChannelOpenFailure}, remoteID)
+			msg = sshPutUint32(msg, 1)
+			msg = sshPutString(msg, []byte("only session channels are supported"))
+			return c.writePacket(sshPutString(msg, nil))
+		}
+		if maxPacket > sshChannelPacket || maxPacket == 0 {
+			maxPacket = sshChannelPacket
+		}
+		ch := &sshChannel{c: c, localID: c.nextID, remoteID: remoteID, maxOut: maxPacket, outWindow: window}
+		ch.cond = sync.NewCond(&ch.mu)
+		c.channels[ch.localID] = ch
+		c.nextID++
+		msg := sshPutUint32([]byte{msgChannelOpenConfirm}, remoteID)
+		msg = sshPutUint32(msg, ch.localID)
+		msg = sshPutUint32(msg, sshChannelWindow)
+		return c.writePacket(sshPutUint32(msg, sshChannelPacket))
+	}
+
+	ch := c.channels[r.uint32()]
+	if r.err != nil || ch == nil {
+		return fmt.Errorf("ssh: message %d for unknown channel", p[0])
+	}
+
+	switch p[0] {
+	case msgChannelData:
+		data := r.bytes()
+		if r.err != nil {
+			return r.err
+		}
+		ch.mu.Lock()
+		if ch.in.Len()+len(data) > sshChannelWindow {
+			ch.mu.Unlock()
+			return errors.New("ssh: client overran the channel window")
+		}
+		ch.in.Write(data)
+		ch.cond.Broadcast()
+		ch.mu.Unlock()
+
+	case msgChannelWindowAdjust:
+		n := r.uint32()
+		ch.mu.Lock()
+		ch.outWindow += n
+		ch.cond.Broadcast()
+		ch.mu.Unlock()
+
+	case msgChannelEOF:
+		ch.mu.Lock()
+		ch.eof = true
+		ch.cond.Broadcast()
+		ch.mu.Unlock()
+
+	case msgChannelClose:
+		ch.mu.Lock()
+		ch.closed = true
+		ch.cond.Broadcast()
+		ch.mu.Unlock()
+		delete(c.channels, ch.localID)
+		ch.Close()
+
+	case msgChannelRequest:
+		kind := r.string()
+		wantReply := r.bool()
+		ok := false
+		if kind == "subsystem" && r.string() == "sftp" && r.err == nil && !ch.started {
+			ch.started = true
+			ok = true
+			go func() {
+				defer func() {
+					if v := recover(); v != nil {
+						log.Printf("SFTP session from %s panicked: %v", c.conn.RemoteAddr(), v)
+						c.conn.Close()
+					}
+				}()
+				c.subsystem(c, ch)
+				ch.Close()
+			}()
+		}
+		if wantReply {
+			reply := byte(msgChannelFailure)
+			if ok {
+				reply = msgChannelSuccess
+			}
+			return c.writePacket(sshPutUint32([]byte{reply}, ch.remoteID))
+		}
+
+	}
+	return nil
+}
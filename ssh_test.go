@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// bufConn is a connection whose writes are collected in buf.
+type bufConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *bufConn) Write(p []byte) (int, error) { return c.buf.Write(p) }
+
+func TestSSHReaderShortInput(t *testing.T) {
+	r := &sshReader{b: sshPutUint32(nil, 10)}
+	if s := r.bytes(); s != nil || r.err == nil {
+		t.Fatalf("string longer than the packet: %q, %v", s, r.err)
+	}
+	// The first error sticks.
+	r.b = []byte{1, 2, 3, 4, 5}
+	if v := r.uint32(); v != 0 || r.err == nil {
+		t.Fatalf("read after an error: %d, %v", v, r.err)
+	}
+
+	r = &sshReader{b: []byte{0, 0}}
+	r.uint32()
+	if r.err == nil {
+		t.Fatal("short uint32 read without error")
+	}
+}
+
+func TestSSHPacketRoundTrip(t *testing.T) {
+	conn := &bufConn{}
+	c := &sshConn{conn: conn}
+	payloads := [][]byte{{msgIgnore}, append([]byte{msgDebug}, strings.Repeat("x", 1000)...)}
+	for _, p := range payloads {
+		if err := c.writePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wire := append([]byte(nil), conn.buf.Bytes()...)
+
+	c.br = bufio.NewReader(bytes.NewReader(wire))
+	for _, want := range payloads {
+		got, err := c.readPacket()
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("readPacket = %d bytes, %v; want %d bytes", len(got), err, len(want))
+		}
+	}
+
+	for name, mangle := range map[string]func(b []byte){
+		"length too short":  func(b []byte) { copy(b, []byte{0, 0, 0, 1}) },
+		"length too long":   func(b []byte) { copy(b, []byte{0x7f, 0, 0, 4}) },
+		"padding too large": func(b []byte) { b[4] = 200 },
+	} {
+		bad := append([]byte(nil), wire...)
+		mangle(bad)
+		c.br = bufio.NewReader(bytes.NewReader(bad))
+		if _, err := c.readPacket(); err == nil {
+			t.Errorf("%s: packet accepted", name)
+		}
+	}
+}
+
+func TestSSHKexTruncatedInit(t *testing.T) {
+	// Every prefix of a KEXINIT has to be refused, not crash the server.
+	init := sshKexInit()
+	for n := 1; n < len(init); n++ {
+		c := &sshConn{conn: &bufConn{}, br: bufio.NewReader(bytes.NewReader(nil))}
+		if err := c.kex(init[:n]); err == nil {
+			t.Fatalf("KEXINIT cut to %d bytes accepted", n)
+		}
+	}
+}
+
+// sftpWriteStatus sends a WRITE for handle "1" and returns the status code
+// of the reply.
+func sftpWriteStatus(t *testing.T, s *sftpServer, offset uint64, data []byte) uint32 {
+	t.Helper()
+	p := sshPutUint32([]byte{sftpWrite}, 7)
+	p = sshPutString(p, []byte("1"))
+	p = sshPutUint64(p, offset)
+	p = sshPutString(p, data)
+	out := s.rw.(*bytes.Buffer)
+	out.Reset()
+	if err := s.handle(p); err != nil {
+		t.Fatal(err)
+	}
+	r := &sshReader{b: out.Bytes()}
+	reply := &sshReader{b: r.bytes()}
+	kind, id, code := reply.byte(), reply.uint32(), reply.uint32()
+	if r.err != nil || reply.err != nil || kind != sftpStatus || id != 7 {
+		t.Fatalf("bad reply %x", out.Bytes())
+	}
+	return code
+}
+
+func TestSFTPWriteOffsets(t *testing.T) {
+	newHandle := func(limit int64) *sftpServer {
+		tmp, err := os.CreateTemp(t.TempDir(), "sftp-*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { tmp.Close() })
+		return &sftpServer{rw: &bytes.Buffer{}, handles: map[string]*sftpOpenFile{"1": {tmp: tmp, limit: limit}}}
+	}
+
+	s := newHandle(-1)
+	if code := sftpWriteStatus(t, s, 0, []byte("hello")); code != sftpOK {
+		t.Fatalf("plain write: status %d", code)
+	}
+	if code := sftpWriteStatus(t, s, 1<<63, []byte("x")); code != sftpFailure {
+		t.Errorf("negative offset: status %d", code)
+	}
+	if code := sftpWriteStatus(t, s, 1<<63-1, []byte("xy")); code != sftpFailure {
+		t.Errorf("overflowing offset: status %d", code)
+	}
+	if code := sftpWriteStatus(t, s, 5+sftpMaxGap+1, []byte("x")); code != sftpFailure {
+		t.Errorf("write far past the end: status %d", code)
+	}
+	if code := sftpWriteStatus(t, s, 5+sftpMaxGap/2, []byte("x")); code != sftpOK {
+		t.Errorf("pipelined write ahead of the end: status %d", code)
+	}
+
+	s = newHandle(10)
+	if code := sftpWriteStatus(t, s, 8, []byte("abc")); code != sftpFailure {
+		t.Errorf("write past the quota: status %d", code)
+	}
+	if s.handles["1"].failed == nil {
+		t.Error("write past the quota did not fail the file")
+	}
+	info, _ := s.handles["1"].tmp.Stat()
+	if info.Size() != 0 {
+		t.Errorf("refused write left a %d byte file", info.Size())
+	}
+}
+
+func TestAuthorizedKeysWithOptionsAreSkipped(t *testing.T) {
+	key := func(comment string) string {
+		blob := sshPutString(sshPutString(nil, []byte("ssh-ed25519")), []byte(comment))
+		return base64.StdEncoding.EncodeToString(blob)
+	}
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	os.WriteFile(path, []byte(strings.Join([]string{
+		"# laptop",
+		"ssh-ed25519 " + key("plain") + " me@laptop",
+		`from="10.0.0.0/8" ssh-ed25519 ` + key("from") + " backup",
+		`restrict,command="rsync --server" ssh-ed25519 ` + key("command") + " rsync",
+	}, "\n")), 0600)
+
+	keys, err := loadAuthorizedKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !bytes.Contains(keys[0], []byte("plain")) {
+		t.Fatalf("loaded %d keys, want only the one without options", len(keys))
+	}
+
+	os.WriteFile(path, []byte(`restrict ssh-ed25519 `+key("restricted")+"\n"), 0600)
+	if _, err := loadAuthorizedKeys(path); err == nil {
+		t.Error("file holding only keys with options loaded")
+	}
+}
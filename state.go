@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stateDirName is the hidden directory inside the upload directory where the
+// server keeps its bookkeeping (quota usage, share tokens, and so on).
+const stateDirName = ".nostromo"
+
+func stateDir(uploadDir string) string {
+	return filepath.Join(uploadDir, stateDirName)
+}
+
+// isStateDirName reports whether a path element names the state directory.
+// macOS and Windows match names without regard to case, and Windows also
+// drops trailing dots and spaces, so ".NOSTROMO." is the same directory
+// there.
+func isStateDirName(name string) bool {
+	return strings.EqualFold(strings.TrimRight(name, ". "), stateDirName)
+}
+
+// loadJSON decodes the file at path into v. A missing file is not an error
+// and leaves v untouched, so stores start empty on first run.
+func loadJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// saveJSON writes v to path via a temporary file and rename so a crash never
+// leaves a half-written state file behind.
+func saveJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// appendJSONLine appends v to path as a single line of JSON, creating the
+// file if needed. It is used for append-only logs.
+func appendJSONLine(path string, v interface{}) error {
+	var line bytes.Buffer
+	enc := json.NewEncoder(&line)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
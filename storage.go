@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// storage is where uploaded files end up. Names are slash-separated paths
+// relative to the root of the store, as returned by resolveUploadPath.
+// Bookkeeping under the state directory always stays on the local disk.
+type storage interface {
+	// create stores the contents of r under name, replacing any existing
+	// file. The file only becomes visible once it is complete.
+	create(name string, r io.Reader) error
+	// stat describes a file or directory.
+	stat(name string) (storedFile, error)
+	open(name string) (storageObject, error)
+	// list returns every file whose name starts with prefix.
+	list(prefix string) ([]storedFile, error)
+	// readDir returns the files and directories directly inside dir, which
+	// is "" for the root.
+	readDir(dir string) ([]storedFile, error)
+	mkdir(name string) error
+	// remove deletes a file or an empty directory.
+	remove(name string) error
+	// rename moves a file or a whole directory.
+	rename(from, to string) error
+}
+
+// storageObject is an open stored file. It supports seeking so it can be
+// served with http.ServeContent.
+type storageObject interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// storedFile describes a file in storage. Name is relative to the root of
+// the store and always uses forward slashes.
+type storedFile struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// errNotStored is returned for names that do not exist in storage.
+var errNotStored = fs.ErrNotExist
+
+// importer is implemented by backends that can take ownership of a local
+// file more cheaply than copying it, such as by renaming it into place.
+type importer interface {
+	importFile(name, localPath string) error
+}
+
+// storeFile moves the finished upload at localPath into storage under name.
+// sum is its SHA-256, if known. It reports whether a deduplicating backend
+// already held the same content.
+func storeFile(s storage, name, localPath string, sum []byte) (bool, error) {
+	if imp, ok := s.(hashedImporter); ok && sum != nil {
+		return imp.importHashed(name, localPath, sum)
+	}
+	return false, importOrCreate(s, name, localPath)
+}
+
+func importOrCreate(s storage, name, localPath string) error {
+	if imp, ok := s.(importer); ok {
+		return imp.importFile(name, localPath)
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.create(name, f)
+}
+
+// localPather is implemented by backends whose files also exist on the
+// local filesystem, so hooks can be handed a real path.
+type localPather interface {
+	localPath(name string) string
+}
+
+// localStorage keeps files in a directory on disk. It is the default.
+type localStorage struct {
+	root string
+}
+
+func (l *localStorage) localPath(name string) string {
+	return filepath.Join(l.root, filepath.FromSlash(name))
+}
+
+func (l *localStorage) create(name string, r io.Reader) error {
+	incoming := filepath.Join(stateDir(l.root), "incoming")
+	if err := os.MkdirAll(incoming, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(incoming, "create-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return l.importFile(name, tmp.Name())
+}
+
+func (l *localStorage) importFile(name, localPath string) error {
+	dest := l.localPath(name)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return os.Rename(localPath, dest)
+}
+
+func (l *localStorage) stat(name string) (storedFile, error) {
+	info, err := os.Stat(l.localPath(name))
+	if err != nil {
+		return storedFile{}, err
+	}
+	if !info.Mode().IsRegular() && !info.IsDir() {
+		return storedFile{}, errNotStored
+	}
+	return localStoredFile(name, info), nil
+}
+
+func localStoredFile(name string, info fs.FileInfo) storedFile {
+	f := storedFile{Name: name, ModTime: info.ModTime(), IsDir: info.IsDir()}
+	if !f.IsDir {
+		f.Size = info.Size()
+	}
+	return f
+}
+
+func (l *localStorage) open(name string) (storageObject, error) {
+	f, err := os.Open(l.localPath(name))
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		f.Close()
+		return nil, errNotStored
+	}
+	return f, nil
+}
+
+// list walks the upload directory, skipping the state directory.
+func (l *localStorage) list(prefix string) ([]storedFile, error) {
+	var files []storedFile
+	err := filepath.WalkDir(l.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == stateDirName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, storedFile{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return files, err
+}
+
+func (l *localStorage) readDir(dir string) ([]storedFile, error) {
+	entries, err := os.ReadDir(l.localPath(dir))
+	if err != nil {
+		return nil, err
+	}
+	var files []storedFile
+	for _, e := range entries {
+		if dir == "" && e.Name() == stateDirName {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || (!info.Mode().IsRegular() && !info.IsDir()) {
+			continue
+		}
+		files = append(files, localStoredFile(path.Join(dir, e.Name()), info))
+	}
+	return files, nil
+}
+
+func (l *localStorage) mkdir(name string) error {
+	return os.Mkdir(l.localPath(name), 0755)
+}
+
+func (l *localStorage) remove(name string) error {
+	return os.Remove(l.localPath(name))
+}
+
+func (l *localStorage) rename(from, to string) error {
+	dest := l.localPath(to)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return os.Rename(l.localPath(from), dest)
+}
+
+// storageConfig collects the flags that select and configure a backend, so
+// the server and the janitor command can share them.
+type storageConfig struct {
+	backend string
+	dedup   bool
+	s3      s3Config
+
+	encryptKeyFile        string
+	encryptPassphraseFile string
+}
+
+func addStorageFlags(fs *flag.FlagSet) *storageConfig {
+	c := &storageConfig{}
+	fs.StringVar(&c.backend, "storage", "local", "Where to keep uploaded files: local or s3")
+	fs.BoolVar(&c.dedup, "dedup", false, "Store each distinct file content once, with names in --dir hard-linked to it (local storage only)")
+	fs.StringVar(&c.s3.Endpoint, "s3-endpoint", "https://s3.amazonaws.com", "S3-compatible endpoint URL, e.g. http://localhost:9000 for MinIO")
+	fs.StringVar(&c.s3.Region, "s3-region", "us-east-1", "S3 region used for request signing")
+	fs.StringVar(&c.s3.Bucket, "s3-bucket", "", "S3 bucket to store uploads in")
+	fs.StringVar(&c.s3.Prefix, "s3-prefix", "", "Key prefix for stored uploads, e.g. nostromo/")
+	fs.StringVar(&c.s3.AccessKey, "s3-access-key", os.Getenv("AWS_ACCESS_KEY_ID"), "S3 access key (default: $AWS_ACCESS_KEY_ID)")
+	fs.StringVar(&c.s3.SecretKey, "s3-secret-key", os.Getenv("AWS_SECRET_ACCESS_KEY"), "S3 secret key (default: $AWS_SECRET_ACCESS_KEY)")
+	fs.BoolVar(&c.s3.PathStyle, "s3-path-style", true, "Use path-style bucket URLs (needed for MinIO)")
+	fs.StringVar(&c.encryptKeyFile, "encrypt-key-file", "", "Encrypt stored files with the 32-byte key in this file (raw or hex)")
+	fs.StringVar(&c.encryptPassphraseFile, "encrypt-passphrase-file", "", "Encrypt stored files with a key derived from the passphrase in this file")
+	return c
+}
+
+// open returns the configured backend, encrypting files if a key was
+// given. Local storage uses uploadDir itself.
+func (c *storageConfig) open(uploadDir string) (storage, error) {
+	keys, err := loadKeyring(c.encryptKeyFile, c.encryptPassphraseFile)
+	if err != nil {
+		return nil, err
+	}
+	if keys != nil && c.dedup {
+		return nil, fmt.Errorf("--dedup cannot be combined with encryption, as each file is encrypted with its own key")
+	}
+	inner, err := c.openBackend(uploadDir)
+	if err != nil {
+		return nil, err
+	}
+	return newEncryptedStorage(inner, uploadDir, keys)
+}
+
+func (c *storageConfig) openBackend(uploadDir string) (storage, error) {
+	switch c.backend {
+	case "", "local":
+		if c.dedup {
+			return newDedupStorage(uploadDir)
+		}
+		return &localStorage{root: uploadDir}, nil
+	case "s3":
+		if c.dedup {
+			return nil, fmt.Errorf("--dedup needs local storage")
+		}
+		c.s3.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		return newS3Storage(c.s3)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", c.backend)
+}
+
+// movedPath reports whether name is from or lies inside it, and if so where
+// it ends up once from is renamed to to.
+func movedPath(name, from, to string) (string, bool) {
+	if name == from {
+		return to, true
+	}
+	if strings.HasPrefix(name, from+"/") {
+		return to + name[len(from):], true
+	}
+	return "", false
+}
+
+// storageExists reports whether name is present in s.
+func storageExists(s storage, name string) bool {
+	_, err := s.stat(name)
+	return !errors.Is(err, fs.ErrNotExist)
+}
+
+// uniqueName returns name, or "name (n).ext" if a file called name already
+// exists in s.
+func uniqueName(s storage, name string) string {
+	if !storageExists(s, name) {
+		return name
+	}
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if !storageExists(s, candidate) {
+			return candidate
+		}
+	}
+}
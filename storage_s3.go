@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3PartSize is the chunk size for multipart uploads. Files smaller than
+// one part are sent with a single PUT.
+const s3PartSize = 16 << 20
+
+// s3Config holds what is needed to talk to an S3-compatible service.
+type s3Config struct {
+	Endpoint     string
+	Region       string
+	Bucket       string
+	Prefix       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	PathStyle    bool
+}
+
+// s3Storage keeps uploads as objects in an S3-compatible bucket, such as
+// AWS S3 or MinIO. Requests are signed with AWS Signature Version 4.
+type s3Storage struct {
+	cfg      s3Config
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+}
+
+func newS3Storage(cfg s3Config) (*s3Storage, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("--s3-bucket is required for s3 storage")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("s3 storage needs an access key and secret key")
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid --s3-endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Prefix != "" && !strings.HasSuffix(cfg.Prefix, "/") {
+		cfg.Prefix += "/"
+	}
+	return &s3Storage{cfg: cfg, endpoint: u, client: &http.Client{}, now: time.Now}, nil
+}
+
+func (s *s3Storage) key(name string) string {
+	return s.cfg.Prefix + name
+}
+
+// objectURL builds the URL for key (or the bucket itself when key is empty)
+// with the given query.
+func (s *s3Storage) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	if s.cfg.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.cfg.Bucket + "/" + key
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	u.RawPath = ""
+	u.RawQuery = ""
+	if query != nil {
+		u.RawQuery = canonicalQuery(query)
+	}
+	return &u
+}
+
+// do signs and sends a request, turning error responses into errors. A
+// missing object is reported as fs.ErrNotExist.
+func (s *s3Storage) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u := s.objectURL(key, query)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	// Keep the exact path we sign rather than letting net/url re-escape it.
+	req.URL.Opaque = "//" + u.Host + awsURIEncode(u.Path, false)
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 || resp.StatusCode == http.StatusPartialContent {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fs.ErrNotExist
+	}
+	var apiErr struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(data, &apiErr) == nil && apiErr.Code != "" {
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, apiErr.Code, apiErr.Message)
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s", method, key, resp.Status)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header. The payload is
+// sent unsigned so large bodies can be streamed.
+func (s *s3Storage) sign(req *http.Request) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	if s.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.cfg.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	if req.Host != "" {
+		headers["host"] = req.Host
+	}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "content-type" || lk == "content-md5" || strings.HasPrefix(lk, "x-amz-") || lk == "range" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := strings.TrimPrefix(req.URL.Opaque, "//"+req.URL.Host)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	scope := day + "/" + s.cfg.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), day)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.cfg.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsURIEncode percent-encodes s the way SigV4 expects: everything except
+// unreserved characters, and "/" too unless it separates path segments.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes a query string with sorted keys, as SigV4 requires.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// create uploads r, switching to a multipart upload once it is larger than
+// one part.
+func (s *s3Storage) create(name string, r io.Reader) error {
+	buf := make([]byte, s3PartSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		resp, err := s.do(http.MethodPut, s.key(name), nil, nil, bytes.NewReader(buf[:n]), int64(n))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.createMultipart(name, buf, r)
+}
+
+func (s *s3Storage) createMultipart(name string, first []byte, r io.Reader) error {
+	key := s.key(name)
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("s3 multipart upload: %w", err)
+	}
+
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var parts []part
+	abort := func(cause error) error {
+		if resp, err := s.do(http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil, 0); err == nil {
+			resp.Body.Close()
+		}
+		return cause
+	}
+
+	buf := first
+	n := len(first)
+	for number := 1; n > 0; number++ {
+		q := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {initiated.UploadID}}
+		resp, err := s.do(http.MethodPut, key, q, nil, bytes.NewReader(buf[:n]), int64(n))
+		if err != nil {
+			return abort(err)
+		}
+		resp.Body.Close()
+		parts = append(parts, part{number, resp.Header.Get("ETag")})
+
+		n, err = io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return abort(err)
+		}
+	}
+
+	complete, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return abort(err)
+	}
+	resp, err = s.do(http.MethodPost, key, url.Values{"uploadId": {initiated.UploadID}}, nil, bytes.NewReader(complete), int64(len(complete)))
+	if err != nil {
+		return abort(err)
+	}
+	if err := s3ResultError(resp, "complete multipart upload"); err != nil {
+		return abort(err)
+	}
+	return nil
+}
+
+// s3ResultError reads and closes the body of a successful response to a
+// request that S3 can still fail after it has sent the 200 status, such as
+// completing a multipart upload or copying an object. Such failures come
+// as an <Error> document in place of the result.
+func s3ResultError(resp *http.Response, op string) error {
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return fmt.Errorf("s3 %s: %w", op, err)
+	}
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(data, &result) == nil && result.XMLName.Local == "Error" {
+		return fmt.Errorf("s3 %s: %s: %s", op, result.Code, result.Message)
+	}
+	return nil
+}
+
+// stat looks the name up as an object first and then as a directory, which
+// in S3 is either an empty "name/" marker object or a common key prefix.
+func (s *s3Storage) stat(name string) (storedFile, error) {
+	// The root always exists. Without a prefix its key would be the bucket
+	// itself, which a HEAD would report as a file.
+	if name == "" {
+		return storedFile{IsDir: true}, nil
+	}
+	resp, err := s.do(http.MethodHead, s.key(name), nil, nil, nil, 0)
+	if err == nil {
+		resp.Body.Close()
+		mod, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return storedFile{Name: name, Size: resp.ContentLength, ModTime: mod}, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return storedFile{}, err
+	}
+	page, err := s.listPage(name+"/", "/", "", 1)
+	if err != nil {
+		return storedFile{}, err
+	}
+	if len(page.Contents) == 0 && len(page.CommonPrefixes) == 0 {
+		return storedFile{}, fs.ErrNotExist
+	}
+	return storedFile{Name: name, IsDir: true}, nil
+}
+
+func (s *s3Storage) open(name string) (storageObject, error) {
+	info, err := s.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir {
+		return nil, errNotStored
+	}
+	return &s3Object{s: s, key: s.key(name), size: info.Size}, nil
+}
+
+// s3ListPage is one page of a ListObjectsV2 response.
+type s3ListPage struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// listPage lists keys under the store prefix plus prefix. With a delimiter,
+// deeper keys are rolled up into CommonPrefixes.
+func (s *s3Storage) listPage(prefix, delimiter, token string, max int) (*s3ListPage, error) {
+	q := url.Values{"list-type": {"2"}, "prefix": {s.key(prefix)}}
+	if delimiter != "" {
+		q.Set("delimiter", delimiter)
+	}
+	if token != "" {
+		q.Set("continuation-token", token)
+	}
+	if max > 0 {
+		q.Set("max-keys", strconv.Itoa(max))
+	}
+	resp, err := s.do(http.MethodGet, "", q, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var page s3ListPage
+	if err := xml.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("s3 list: %w", err)
+	}
+	return &page, nil
+}
+
+func (s *s3Storage) list(prefix string) ([]storedFile, error) {
+	var files []storedFile
+	token := ""
+	for {
+		page, err := s.listPage(prefix, "", token, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range page.Contents {
+			name := strings.TrimPrefix(c.Key, s.cfg.Prefix)
+			if name == "" || strings.HasSuffix(name, "/") {
+				continue
+			}
+			files = append(files, storedFile{Name: name, Size: c.Size, ModTime: c.LastModified})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return files, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *s3Storage) readDir(dir string) ([]storedFile, error) {
+	prefix := ""
+	if dir != "" {
+		prefix = dir + "/"
+	}
+	var files []storedFile
+	token := ""
+	for {
+		page, err := s.listPage(prefix, "/", token, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range page.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, s.cfg.Prefix), "/")
+			if name == stateDirName {
+				continue
+			}
+			files = append(files, storedFile{Name: name, IsDir: true})
+		}
+		for _, c := range page.Contents {
+			name := strings.TrimPrefix(c.Key, s.cfg.Prefix)
+			if name == prefix || strings.HasSuffix(name, "/") {
+				continue
+			}
+			files = append(files, storedFile{Name: name, Size: c.Size, ModTime: c.LastModified})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return files, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// mkdir creates an empty marker object so the directory shows up before
+// anything is stored in it.
+func (s *s3Storage) mkdir(name string) error {
+	resp, err := s.do(http.MethodPut, s.key(name)+"/", nil, nil, bytes.NewReader(nil), 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// remove deletes the object called name, or the directory marker if name
+// is a directory.
+func (s *s3Storage) remove(name string) error {
+	info, err := s.stat(name)
+	if err != nil {
+		return err
+	}
+	key := s.key(name)
+	if info.IsDir {
+		key += "/"
+	}
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// rename copies objects server-side and deletes the originals, one object
+// at a time for a directory. S3 has no real rename, so a failure part way
+// through a directory leaves it split; a single copy is limited to 5GB.
+func (s *s3Storage) rename(from, to string) error {
+	info, err := s.stat(from)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir {
+		return s.copyObject(s.key(from), s.key(to))
+	}
+	var keys []string
+	token := ""
+	for {
+		page, err := s.listPage(from+"/", "", token, 0)
+		if err != nil {
+			return err
+		}
+		for _, c := range page.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	for _, k := range keys {
+		if err := s.copyObject(k, s.key(to)+strings.TrimPrefix(k, s.key(from))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyObject copies src to dst and deletes src.
+func (s *s3Storage) copyObject(src, dst string) error {
+	h := http.Header{}
+	h.Set("X-Amz-Copy-Source", "/"+s.cfg.Bucket+"/"+awsURIEncode(src, false))
+	resp, err := s.do(http.MethodPut, dst, nil, h, nil, 0)
+	if err != nil {
+		return err
+	}
+	if err := s3ResultError(resp, "copy "+src); err != nil {
+		return err
+	}
+	resp, err = s.do(http.MethodDelete, src, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// s3Object reads an object lazily with ranged GETs, so seeking (as
+// http.ServeContent does for Range requests) costs nothing up front.
+type s3Object struct {
+	s    *s3Storage
+	key  string
+	size int64
+	pos  int64
+	body io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.pos >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		h := http.Header{}
+		h.Set("Range", fmt.Sprintf("bytes=%d-", o.pos))
+		resp, err := o.s.do(http.MethodGet, o.key, nil, h, nil, 0)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.pos += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = o.pos + offset
+	case io.SeekEnd:
+		pos = o.size + offset
+	}
+	if pos < 0 {
+		return 0, errors.New("s3: negative seek position")
+	}
+	if pos != o.pos && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.pos = pos
+	return pos, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
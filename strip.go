@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Kinds of metadata stripFileMetadata removes, as reported to clients and in
+// the audit log.
+const (
+	metaEXIF = "EXIF"
+	metaXMP  = "XMP"
+	metaIPTC = "IPTC"
+	// metaMPF is the index of extra images, such as depth and gain maps,
+	// that phones append to a JPEG after its end. The images go with it,
+	// as each carries metadata of its own.
+	metaMPF = "MPF"
+	// metaText is any other textual PNG chunk: author, comment, software.
+	metaText = "text"
+)
+
+var errStripFormat = errors.New("malformed image")
+
+// stripFileMetadata removes EXIF, XMP and IPTC metadata from the JPEG,
+// PNG or WebP image in the file at name, rewriting it in place. Only the
+// containers are rewritten; pixel data is copied untouched. It returns the
+// kinds of metadata removed, with the new size and SHA-256 of the file.
+// Files that are not images, or carry no metadata, are left alone and
+// removed is empty.
+func stripFileMetadata(name string) (removed []string, size int64, sum []byte, err error) {
+	in, err := os.Open(name)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer in.Close()
+	r := bufio.NewReaderSize(in, 64<<10)
+	head, _ := r.Peek(12)
+
+	var strip func(*bufio.Reader, *os.File) ([]string, error)
+	switch {
+	case bytes.HasPrefix(head, []byte{0xff, 0xd8, 0xff}):
+		strip = stripJPEG
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		strip = stripPNG
+	case len(head) == 12 && string(head[:4]) == "RIFF" && string(head[8:]) == "WEBP":
+		strip = stripWebP
+	default:
+		return nil, 0, nil, nil
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(name), "strip-*")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	removed, err = strip(r, out)
+	if err != nil || len(removed) == 0 {
+		return nil, 0, nil, err
+	}
+
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, nil, err
+	}
+	digest := sha256.New()
+	if size, err = io.Copy(digest, out); err != nil {
+		return nil, 0, nil, err
+	}
+	if err := out.Close(); err != nil {
+		return nil, 0, nil, err
+	}
+	if err := os.Rename(out.Name(), name); err != nil {
+		return nil, 0, nil, err
+	}
+	return removed, size, digest.Sum(nil), nil
+}
+
+// addKind adds kind to removed unless it is already listed.
+func addKind(removed []string, kind string) []string {
+	for _, k := range removed {
+		if k == kind {
+			return removed
+		}
+	}
+	return append(removed, kind)
+}
+
+// stripJPEG copies a JPEG, leaving out APP1 EXIF and XMP segments, APP13
+// Photoshop (IPTC) segments, and the MPF index along with anything after
+// the end of the image. An EXIF orientation other than upright is kept, in
+// a minimal EXIF segment of its own, so photos are not shown sideways.
+func stripJPEG(r *bufio.Reader, out *os.File) ([]string, error) {
+	w := bufio.NewWriterSize(out, 64<<10)
+	var removed []string
+	if _, err := r.Discard(2); err != nil {
+		return nil, err
+	}
+	w.Write([]byte{0xff, 0xd8})
+
+	var marker byte
+	for {
+		if marker == 0 {
+			m, err := nextMarker(r)
+			if err == io.EOF {
+				// Truncated images still display, so they are kept.
+				return removed, w.Flush()
+			}
+			if err != nil {
+				return nil, err
+			}
+			marker = m
+		}
+		m := marker
+		marker = 0
+
+		switch {
+		case m == 0xd9:
+			// End of image: whatever follows is not part of it.
+			w.Write([]byte{0xff, 0xd9})
+			if _, err := r.Peek(1); err == nil {
+				removed = addKind(removed, metaMPF)
+			}
+			return removed, w.Flush()
+		case m >= 0xd0 && m <= 0xd7, m == 0x01, m == 0xd8:
+			w.Write([]byte{0xff, m})
+			continue
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return nil, errStripFormat
+		}
+		n := int(binary.BigEndian.Uint16(length[:]))
+		if n < 2 {
+			return nil, errStripFormat
+		}
+		payload := make([]byte, n-2)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, errStripFormat
+		}
+
+		drop := ""
+		switch {
+		case m == 0xe1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")):
+			drop = metaEXIF
+			if o := exifOrientation(payload[6:]); o != 1 {
+				w.Write(orientationSegment(o))
+			}
+		case m == 0xe1 && (bytes.HasPrefix(payload, []byte("http://ns.adobe.com/xap/1.0/\x00")) ||
+			bytes.HasPrefix(payload, []byte("http://ns.adobe.com/xmp/extension/\x00"))):
+			drop = metaXMP
+		case m == 0xed && bytes.HasPrefix(payload, []byte("Photoshop 3.0\x00")):
+			drop = metaIPTC
+		case m == 0xe2 && bytes.HasPrefix(payload, []byte("MPF\x00")):
+			drop = metaMPF
+		}
+		if drop != "" {
+			removed = addKind(removed, drop)
+			continue
+		}
+		w.Write([]byte{0xff, m})
+		w.Write(length[:])
+		w.Write(payload)
+
+		if m == 0xda {
+			next, err := copyScan(r, w)
+			if err == io.EOF {
+				return removed, w.Flush()
+			}
+			if err != nil {
+				return nil, err
+			}
+			marker = next
+		}
+	}
+}
+
+// nextMarker reads the next JPEG marker, skipping fill bytes.
+func nextMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xff {
+		return 0, errStripFormat
+	}
+	for b == 0xff {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+// copyScan copies entropy-coded scan data up to the next marker, which it
+// returns.
+func copyScan(r *bufio.Reader, w *bufio.Writer) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != 0xff {
+			w.WriteByte(b)
+			continue
+		}
+		m, err := r.ReadByte()
+		for err == nil && m == 0xff {
+			m, err = r.ReadByte()
+		}
+		if err != nil {
+			return 0, err
+		}
+		if m == 0x00 || m >= 0xd0 && m <= 0xd7 {
+			// A stuffed 0xff byte or a restart marker, both part of the scan.
+			w.Write([]byte{0xff, m})
+			continue
+		}
+		return m, nil
+	}
+}
+
+// orientationTIFF builds TIFF data holding just an EXIF orientation tag.
+func orientationTIFF(orientation int) []byte {
+	var b bytes.Buffer
+	b.WriteString("MM\x00\x2a\x00\x00\x00\x08")
+	binary.Write(&b, binary.BigEndian, []uint16{1, 0x0112, 3})
+	binary.Write(&b, binary.BigEndian, uint32(1))
+	binary.Write(&b, binary.BigEndian, []uint16{uint16(orientation), 0})
+	binary.Write(&b, binary.BigEndian, uint32(0))
+	return b.Bytes()
+}
+
+// orientationSegment builds an APP1 segment holding just an EXIF
+// orientation tag.
+func orientationSegment(orientation int) []byte {
+	tiff := orientationTIFF(orientation)
+	seg := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(2+6+len(tiff)))
+	seg = append(seg, "Exif\x00\x00"...)
+	return append(seg, tiff...)
+}
+
+// peekOrientation reads the EXIF orientation from the next n bytes of r,
+// which hold TIFF data, without consuming them. Only what fits in r's
+// buffer is looked at; the tag is in the first IFD, near the start.
+func peekOrientation(r *bufio.Reader, n int64) int {
+	if n > int64(r.Size()) {
+		n = int64(r.Size())
+	}
+	tiff, _ := r.Peek(int(n))
+	// Some writers keep the JPEG "Exif" prefix in PNG and WebP too.
+	return exifOrientation(bytes.TrimPrefix(tiff, []byte("Exif\x00\x00")))
+}
+
+// pngTextKinds classifies text chunks by keyword. ImageMagick stores EXIF
+// and IPTC as hex in "Raw profile" chunks.
+var pngTextKinds = map[string]string{
+	"XML:com.adobe.xmp":     metaXMP,
+	"Raw profile type exif": metaEXIF,
+	"Raw profile type APP1": metaEXIF,
+	"Raw profile type xmp":  metaXMP,
+	"Raw profile type iptc": metaIPTC,
+	"Raw profile type 8bim": metaIPTC,
+}
+
+// stripPNG copies a PNG, leaving out eXIf chunks and every text chunk,
+// which covers XMP, the raw EXIF and IPTC profiles some tools write, and
+// free-form fields like author and comment. Chunks are copied whole, so
+// their checksums stay valid. As with JPEG, an orientation other than
+// upright is kept in a minimal eXIf chunk of its own.
+func stripPNG(r *bufio.Reader, out *os.File) ([]string, error) {
+	w := bufio.NewWriterSize(out, 64<<10)
+	var removed []string
+	var sig [8]byte
+	if _, err := io.ReadFull(r, sig[:]); err != nil {
+		return nil, err
+	}
+	w.Write(sig[:])
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return removed, w.Flush()
+			}
+			return nil, errStripFormat
+		}
+		n := int64(binary.BigEndian.Uint32(hdr[:4])) + 4
+		kind := string(hdr[4:])
+
+		drop := ""
+		switch kind {
+		case "eXIf":
+			drop = metaEXIF
+			if o := peekOrientation(r, n-4); o != 1 {
+				w.Write(pngChunk("eXIf", orientationTIFF(o)))
+			}
+		case "tEXt", "zTXt", "iTXt":
+			drop = metaText
+			keyword, _ := r.Peek(80)
+			if i := bytes.IndexByte(keyword, 0); i >= 0 {
+				if k, ok := pngTextKinds[string(keyword[:i])]; ok {
+					drop = k
+				}
+			}
+		}
+		if drop != "" {
+			if _, err := r.Discard(int(n)); err != nil {
+				return nil, errStripFormat
+			}
+			removed = addKind(removed, drop)
+			continue
+		}
+		w.Write(hdr[:])
+		if _, err := io.CopyN(w, r, n); err != nil {
+			return nil, errStripFormat
+		}
+		if kind == "IEND" {
+			return removed, w.Flush()
+		}
+	}
+}
+
+// pngChunk builds a PNG chunk, with its checksum.
+func pngChunk(kind string, data []byte) []byte {
+	c := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	c = append(c, kind...)
+	c = append(c, data...)
+	return binary.BigEndian.AppendUint32(c, crc32.ChecksumIEEE(c[4:]))
+}
+
+// stripWebP copies a WebP, leaving out its EXIF and XMP chunks and clearing
+// the flags in the extended header that announce them. An orientation
+// other than upright is kept in a minimal EXIF chunk, and its flag with it.
+func stripWebP(r *bufio.Reader, out *os.File) ([]string, error) {
+	w := bufio.NewWriterSize(out, 64<<10)
+	var removed []string
+	// flagsAt is where the extended header's flags are in out, once seen:
+	// written counts from offset 8, and the chunk's own header is 8 bytes.
+	var flagsAt int64
+	var flags byte
+	var hdr [12]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	w.Write(hdr[:])
+	// Anything past the length the RIFF header gives is not part of the
+	// image, and is dropped.
+	total := int64(binary.LittleEndian.Uint32(hdr[4:]))
+	written := int64(4)
+	for read := int64(4); read+8 <= total; {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, errStripFormat
+		}
+		n := int64(binary.LittleEndian.Uint32(chunk[4:]))
+		n += n & 1
+		read += 8 + n
+		switch kind := string(chunk[:4]); kind {
+		case "EXIF", "XMP ":
+			o := 1
+			if kind == "EXIF" && flagsAt > 0 {
+				o = peekOrientation(r, n)
+			}
+			if _, err := r.Discard(int(n)); err != nil {
+				return nil, errStripFormat
+			}
+			removed = addKind(removed, strings.TrimSpace(kind))
+			if o == 1 {
+				continue
+			}
+			tiff := orientationTIFF(o)
+			binary.LittleEndian.PutUint32(chunk[4:], uint32(len(tiff)))
+			w.Write(chunk[:])
+			w.Write(tiff)
+			flags |= 0x08
+			written += 8 + int64(len(tiff))
+			continue
+		case "VP8X":
+			// The extended header is always ten bytes.
+			if n != 10 {
+				return nil, errStripFormat
+			}
+			var data [10]byte
+			if _, err := io.ReadFull(r, data[:]); err != nil {
+				return nil, errStripFormat
+			}
+			data[0] &^= 0x08 | 0x04
+			flags, flagsAt = data[0], written+16
+			w.Write(chunk[:])
+			w.Write(data[:])
+		default:
+			w.Write(chunk[:])
+			if _, err := io.CopyN(w, r, n); err != nil {
+				return nil, errStripFormat
+			}
+		}
+		written += 8 + n
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	if written > 0xffffffff {
+		return nil, fmt.Errorf("%w: too large for RIFF", errStripFormat)
+	}
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(written))
+	if _, err := out.WriteAt(size[:], 4); err != nil {
+		return nil, err
+	}
+	if flagsAt > 0 {
+		if _, err := out.WriteAt([]byte{flags}, flagsAt); err != nil {
+			return nil, err
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// stripBytes runs stripFileMetadata over data and returns what is stored
+// afterwards.
+func stripBytes(t *testing.T, data []byte) ([]byte, []string, error) {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "image")
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	removed, _, _, err := stripFileMetadata(name)
+	stored, rerr := os.ReadFile(name)
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	return stored, removed, err
+}
+
+// testPhoto is a small image with something in every pixel.
+func testPhoto() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 12))
+	for y := 0; y < 12; y++ {
+		for x := 0; x < 16; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 16), uint8(y * 20), 0x80, 0xff})
+		}
+	}
+	return img
+}
+
+// cameraTIFF is EXIF as a camera writes it: an orientation and the make.
+func cameraTIFF(orientation int) []byte {
+	b := []byte("II\x2a\x00\x08\x00\x00\x00")
+	b = binary.LittleEndian.AppendUint16(b, 2)
+	b = binary.LittleEndian.AppendUint16(b, 0x0112)
+	b = binary.LittleEndian.AppendUint16(b, 3)
+	b = binary.LittleEndian.AppendUint32(b, 1)
+	b = binary.LittleEndian.AppendUint32(b, uint32(orientation))
+	b = binary.LittleEndian.AppendUint16(b, 0x010f)
+	b = binary.LittleEndian.AppendUint16(b, 2)
+	b = binary.LittleEndian.AppendUint32(b, 4)
+	b = append(b, "GPS\x00"...)
+	return binary.LittleEndian.AppendUint32(b, 0)
+}
+
+func jpegSegment(marker byte, payload string) []byte {
+	seg := []byte{0xff, marker}
+	seg = binary.BigEndian.AppendUint16(seg, uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+func TestStripJPEG(t *testing.T) {
+	var plain bytes.Buffer
+	if err := jpeg.Encode(&plain, testPhoto(), nil); err != nil {
+		t.Fatal(err)
+	}
+	var photo []byte
+	photo = append(photo, 0xff, 0xd8)
+	photo = append(photo, jpegSegment(0xe1, "Exif\x00\x00"+string(cameraTIFF(6)))...)
+	photo = append(photo, jpegSegment(0xe1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>")...)
+	photo = append(photo, plain.Bytes()[2:]...)
+
+	stored, removed, err := stripBytes(t, photo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 || removed[0] != metaEXIF || removed[1] != metaXMP {
+		t.Errorf("removed %v", removed)
+	}
+	// Everything but the metadata is copied byte for byte.
+	want := append([]byte{0xff, 0xd8}, orientationSegment(6)...)
+	want = append(want, plain.Bytes()[2:]...)
+	if !bytes.Equal(stored, want) {
+		t.Error("stripped JPEG differs from the original image data")
+	}
+	if o := jpegOrientation(stored); o != 6 {
+		t.Errorf("orientation %d after stripping, want 6", o)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(stored)); err != nil {
+		t.Errorf("stripped JPEG does not decode: %v", err)
+	}
+
+	// A photo cut off in its scan data still displays, so it is kept.
+	cut := photo[:len(photo)-20]
+	if _, removed, err := stripBytes(t, cut); err != nil || len(removed) != 2 {
+		t.Errorf("JPEG truncated in its scan: %v, %v", removed, err)
+	}
+	for name, bad := range map[string][]byte{
+		"truncated segment": photo[:30],
+		"bad marker":        {0xff, 0xd8, 0xff, 0xe1, 0x00, 0x10, 'E', 'x', 0x00, 0x42},
+		"short length":      {0xff, 0xd8, 0xff, 0xe1, 0x00, 0x01, 0xff, 0xd9},
+		"garbage":           {0xff, 0xd8, 0xff, 0xd9 - 1, 0x00, 0x02, 0x42},
+	} {
+		stored, _, err := stripBytes(t, bad)
+		if !errors.Is(err, errStripFormat) {
+			t.Errorf("%s: %v, want errStripFormat", name, err)
+		}
+		if !bytes.Equal(stored, bad) {
+			t.Errorf("%s: file changed although stripping failed", name)
+		}
+	}
+}
+
+func TestStripPNG(t *testing.T) {
+	var plain bytes.Buffer
+	if err := png.Encode(&plain, testPhoto()); err != nil {
+		t.Fatal(err)
+	}
+	// Metadata goes after the 8-byte signature and the 25-byte IHDR chunk.
+	head, rest := plain.Bytes()[:33], plain.Bytes()[33:]
+	var photo []byte
+	photo = append(photo, head...)
+	photo = append(photo, pngChunk("tEXt", []byte("Author\x00Ripley"))...)
+	photo = append(photo, pngChunk("eXIf", cameraTIFF(8))...)
+	photo = append(photo, pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>"))...)
+	photo = append(photo, rest...)
+
+	stored, removed, err := stripBytes(t, photo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 3 {
+		t.Errorf("removed %v, want text, EXIF and XMP", removed)
+	}
+	want := append(append(append([]byte{}, head...), pngChunk("eXIf", orientationTIFF(8))...), rest...)
+	if !bytes.Equal(stored, want) {
+		t.Error("stripped PNG differs from the original image data")
+	}
+	if _, err := png.Decode(bytes.NewReader(stored)); err != nil {
+		t.Errorf("stripped PNG does not decode: %v", err)
+	}
+
+	// An upright orientation needs no EXIF at all.
+	upright := append(append(append([]byte{}, head...), pngChunk("eXIf", cameraTIFF(1))...), rest...)
+	if stored, _, err := stripBytes(t, upright); err != nil || !bytes.Equal(stored, plain.Bytes()) {
+		t.Errorf("upright PNG kept EXIF: %v", err)
+	}
+
+	huge := append([]byte{}, head...)
+	huge = append(huge, 0xff, 0xff, 0xff, 0xf0, 'I', 'D', 'A', 'T', 0x42)
+	for name, bad := range map[string][]byte{
+		"truncated chunk":  photo[:len(head)+10],
+		"truncated header": photo[:len(head)+4],
+		"huge chunk":       huge,
+		"no IEND":          photo[:len(photo)-12],
+	} {
+		stored, _, err := stripBytes(t, bad)
+		if name == "no IEND" {
+			// Cut cleanly between chunks, which is still readable.
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			continue
+		}
+		if !errors.Is(err, errStripFormat) {
+			t.Errorf("%s: %v, want errStripFormat", name, err)
+		}
+		if !bytes.Equal(stored, bad) {
+			t.Errorf("%s: file changed although stripping failed", name)
+		}
+	}
+}
+
+func webpChunk(kind string, data []byte) []byte {
+	c := append([]byte(kind), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(c[4:], uint32(len(data)))
+	c = append(c, data...)
+	if len(data)%2 == 1 {
+		c = append(c, 0)
+	}
+	return c
+}
+
+func webpFile(chunks ...[]byte) []byte {
+	body := []byte("WEBP")
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	f := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body)))
+	return append(f, body...)
+}
+
+func TestStripWebP(t *testing.T) {
+	// Alpha, EXIF and XMP flags, then a 16x12 canvas.
+	vp8x := []byte{0x10 | 0x08 | 0x04, 0, 0, 0, 15, 0, 0, 11, 0, 0}
+	pixels := []byte("\x2f\x0f\xc0\x02 lossless bitstream, odd length")
+	photo := webpFile(
+		webpChunk("VP8X", vp8x),
+		webpChunk("VP8L", pixels),
+		webpChunk("EXIF", cameraTIFF(6)),
+		webpChunk("XMP ", []byte("<x:xmpmeta/>")),
+	)
+
+	stored, removed, err := stripBytes(t, photo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 {
+		t.Errorf("removed %v, want EXIF and XMP", removed)
+	}
+	kept := append([]byte{0x10 | 0x08}, vp8x[1:]...)
+	want := webpFile(
+		webpChunk("VP8X", kept),
+		webpChunk("VP8L", pixels),
+		webpChunk("EXIF", orientationTIFF(6)),
+	)
+	if !bytes.Equal(stored, want) {
+		t.Errorf("stripped WebP is\n%q\nwant\n%q", stored, want)
+	}
+
+	// Without an orientation to keep, the EXIF flag goes too.
+	upright := webpFile(webpChunk("VP8X", vp8x), webpChunk("VP8L", pixels), webpChunk("EXIF", cameraTIFF(1)))
+	want = webpFile(webpChunk("VP8X", append([]byte{0x10}, vp8x[1:]...)), webpChunk("VP8L", pixels))
+	if stored, _, err := stripBytes(t, upright); err != nil || !bytes.Equal(stored, want) {
+		t.Errorf("upright WebP: %q, %v", stored, err)
+	}
+
+	for name, bad := range map[string][]byte{
+		// A forged header size must not be allocated.
+		"huge VP8X":      webpFile(webpChunk("VP8X", nil)[:4], []byte{0xf0, 0xff, 0xff, 0xff}, webpChunk("EXIF", nil)),
+		"short VP8X":     webpFile(webpChunk("VP8X", vp8x[:4]), webpChunk("EXIF", cameraTIFF(6))),
+		"truncated VP8L": photo[:len(photo)-len(cameraTIFF(6))-40],
+		"truncated EXIF": photo[:len(photo)-30],
+	} {
+		stored, _, err := stripBytes(t, bad)
+		if !errors.Is(err, errStripFormat) {
+			t.Errorf("%s: %v, want errStripFormat", name, err)
+		}
+		if !bytes.Equal(stored, bad) {
+			t.Errorf("%s: file changed although stripping failed", name)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// thumbSize is the longest side of a thumbnail, in pixels.
+	thumbSize = 160
+	// maxThumbPixels bounds the images that are decoded for a thumbnail, as
+	// a small file can declare enormous dimensions.
+	maxThumbPixels = 40_000_000
+	// maxPassThroughThumb is the largest WebP file sent as its own
+	// thumbnail. WebP is never decoded: the standard library has no
+	// decoder for it, and writing one is out of scope.
+	maxPassThroughThumb = 1 << 20
+)
+
+// thumbBackground is what transparent images are flattened onto, the
+// colour of the file list behind them.
+var thumbBackground = color.RGBA{0x00, 0x11, 0x00, 0xff}
+
+var errNoThumbnail = errors.New("no thumbnail for this type of file")
+
+// thumbEntry records the thumbnail made for a file, and the size and
+// modification time of the file it was made from.
+type thumbEntry struct {
+	File     string    `json:"file"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// thumbCache makes JPEG thumbnails of stored images on first request and
+// keeps them under .nostromo/thumbs, keyed by the path of the image. A
+// thumbnail is made again when the image changes.
+type thumbCache struct {
+	files storage
+	dir   string
+	// busy limits how many images are decoded at once, as each can take
+	// a few hundred megabytes.
+	busy chan struct{}
+
+	mu     sync.Mutex
+	path   string
+	thumbs map[string]thumbEntry
+}
+
+// loadThumbCache opens the thumbnail cache in dir, removing thumbnails
+// whose entries were lost.
+func loadThumbCache(dir string, files storage) (*thumbCache, error) {
+	c := &thumbCache{
+		files:  files,
+		dir:    dir,
+		busy:   make(chan struct{}, 2),
+		path:   filepath.Join(dir, "thumbs.json"),
+		thumbs: map[string]thumbEntry{},
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := loadJSON(c.path, &c.thumbs); err != nil {
+		return nil, fmt.Errorf("loading thumbnail index: %w", err)
+	}
+	known := map[string]bool{"thumbs.json": true}
+	for _, t := range c.thumbs {
+		known[t.File] = true
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !known[e.Name()] {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+	return c, nil
+}
+
+// thumbnailable reports whether a thumbnail can be made of name. WebP is
+// not among them, as there is no decoder for it; see handleThumbs.
+func thumbnailable(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		return true
+	}
+	return false
+}
+
+// get returns the path of an up-to-date thumbnail of the file name, making
+// it if needed.
+func (c *thumbCache) get(name string, info storedFile) (string, error) {
+	if !thumbnailable(name) {
+		return "", errNoThumbnail
+	}
+	c.mu.Lock()
+	t, ok := c.thumbs[name]
+	c.mu.Unlock()
+	if ok && t.Size == info.Size && t.Modified.Equal(info.ModTime) {
+		return filepath.Join(c.dir, t.File), nil
+	}
+
+	c.busy <- struct{}{}
+	data, err := c.render(name)
+	<-c.busy
+	if err != nil {
+		return "", err
+	}
+	t = thumbEntry{File: randomID(12) + ".jpg", Size: info.Size, Modified: info.ModTime}
+	full := filepath.Join(c.dir, t.File)
+	if err := os.WriteFile(full, data, 0644); err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.thumbs[name]; ok {
+		os.Remove(filepath.Join(c.dir, old.File))
+	}
+	c.thumbs[name] = t
+	return full, saveJSON(c.path, c.thumbs)
+}
+
+// render decodes the image name and encodes a thumbnail of it.
+func (c *thumbCache) render(name string) ([]byte, error) {
+	f, err := c.files.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNoThumbnail, err)
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxThumbPixels {
+		return nil, fmt.Errorf("%w: %dx%d is too large to decode", errNoThumbnail, cfg.Width, cfg.Height)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	head := make([]byte, 64<<10)
+	n, _ := io.ReadFull(f, head)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNoThumbnail, err)
+	}
+
+	thumb := orient(shrink(img, thumbSize), jpegOrientation(head[:n]))
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// atLeast returns n, or lo if n is smaller.
+func atLeast(lo, n int) int {
+	if n < lo {
+		return lo
+	}
+	return n
+}
+
+// shrink scales img to fit within size by size pixels, averaging the
+// source pixels behind each thumbnail pixel. Smaller images are only
+// flattened.
+func shrink(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), &image.Uniform{thumbBackground}, image.Point{}, draw.Src)
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Over)
+
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+	tw, th := size, size
+	if w > h {
+		th = atLeast(1, h*size/w)
+	} else {
+		tw = atLeast(1, w*size/h)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for ty := 0; ty < th; ty++ {
+		y0, y1 := ty*h/th, atLeast(ty*h/th+1, (ty+1)*h/th)
+		for tx := 0; tx < tw; tx++ {
+			x0, x1 := tx*w/tw, atLeast(tx*w/tw+1, (tx+1)*w/tw)
+			var r, g, bl, n int
+			for y := y0; y < y1; y++ {
+				row := src.Pix[y*src.Stride:]
+				for x := x0; x < x1; x++ {
+					p := row[x*4:]
+					r += int(p[0])
+					g += int(p[1])
+					bl += int(p[2])
+					n++
+				}
+			}
+			d := dst.Pix[ty*dst.Stride+tx*4:]
+			d[0], d[1], d[2], d[3] = uint8(r/n), uint8(g/n), uint8(bl/n), 0xff
+		}
+	}
+	return dst
+}
+
+// jpegOrientation reads the EXIF orientation tag from the start of a JPEG
+// file. It returns 1, upright, when there is none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return 1
+		}
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xda || length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		seg := data[i+4 : i+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return exifOrientation(seg[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation finds the orientation tag in the first IFD of a TIFF
+// structure.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for k := 0; k < count; k++ {
+		e := ifd + 2 + k*12
+		if e+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[e:]) == 0x0112 {
+			if v := int(order.Uint16(tiff[e+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// orient turns img upright according to an EXIF orientation.
+func orient(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.SetRGBA(dx, dy, img.RGBAAt(x, y))
+		}
+	}
+	return dst
+}
+
+func (c *thumbCache) forget(name string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.thumbs[name]
+	if !ok {
+		return nil
+	}
+	os.Remove(filepath.Join(c.dir, t.File))
+	delete(c.thumbs, name)
+	return saveJSON(c.path, c.thumbs)
+}
+
+// move carries thumbnails over when a file or directory is renamed.
+func (c *thumbCache) move(from, to string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	moved := map[string]thumbEntry{}
+	for name, t := range c.thumbs {
+		if dest, ok := movedPath(name, from, to); ok {
+			moved[dest] = t
+			delete(c.thumbs, name)
+		}
+	}
+	if len(moved) == 0 {
+		return nil
+	}
+	for name, t := range moved {
+		if old, ok := c.thumbs[name]; ok {
+			os.Remove(filepath.Join(c.dir, old.File))
+		}
+		c.thumbs[name] = t
+	}
+	return saveJSON(c.path, c.thumbs)
+}
+
+// handleThumbs serves GET /api/thumbs/{path}, a small JPEG of a stored
+// image for the file list. WebP images are not decoded, so small ones are
+// sent as they are and larger ones get no thumbnail.
+func handleThumbs(c *thumbCache, uploadDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if c == nil {
+			http.Error(w, "Thumbnails are off", http.StatusNotFound)
+			return
+		}
+		name, _, err := resolveUploadPath(uploadDir, strings.TrimPrefix(r.URL.Path, "/api/thumbs/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		info, err := c.files.stat(name)
+		if err != nil || info.IsDir {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		if strings.ToLower(path.Ext(name)) == ".webp" && info.Size <= maxPassThroughThumb {
+			servePreview(w, r, c.files, name)
+			return
+		}
+
+		thumb, err := c.get(name, info)
+		if errors.Is(err, errNoThumbnail) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("Failed to make thumbnail of %s: %v", name, err)
+			}
+			http.Error(w, "Failed to make thumbnail", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+		previewHeaders(w, "image/jpeg")
+		http.ServeFile(w, r, thumb)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// sniffLen is how much of the start of an upload is inspected to work out
+// what it really is.
+const sniffLen = 512
+
+// magicSignature identifies a format that http.DetectContentType does not
+// know about, by the bytes found at a fixed offset.
+type magicSignature struct {
+	offset int
+	magic  []byte
+	mime   string
+}
+
+var extraSignatures = []magicSignature{
+	{0, []byte("\x7fELF"), "application/x-executable"},
+	{0, []byte("\xfe\xed\xfa\xce"), "application/x-mach-binary"},
+	{0, []byte("\xfe\xed\xfa\xcf"), "application/x-mach-binary"},
+	{0, []byte("\xce\xfa\xed\xfe"), "application/x-mach-binary"},
+	{0, []byte("\xcf\xfa\xed\xfe"), "application/x-mach-binary"},
+	{0, []byte("7z\xbc\xaf\x27\x1c"), "application/x-7z-compressed"},
+	{0, []byte("\x28\xb5\x2f\xfd"), "application/zstd"},
+	{0, []byte("\xfd7zXZ\x00"), "application/x-xz"},
+	{0, []byte("BZh"), "application/x-bzip2"},
+	{0, []byte("SQLite format 3\x00"), "application/vnd.sqlite3"},
+	{257, []byte("ustar"), "application/x-tar"},
+}
+
+// sniffContentType works out the MIME type of data from its magic bytes,
+// ignoring whatever the client claimed. Parameters such as charset are
+// dropped.
+func sniffContentType(head []byte) string {
+	// Windows executables start with "MZ" and point at a "PE" header.
+	if len(head) >= 0x40 && head[0] == 'M' && head[1] == 'Z' {
+		off := int(head[0x3c]) | int(head[0x3d])<<8
+		if off+4 <= len(head) && bytes.Equal(head[off:off+4], []byte("PE\x00\x00")) {
+			return "application/vnd.microsoft.portable-executable"
+		}
+	}
+	for _, sig := range extraSignatures {
+		end := sig.offset + len(sig.magic)
+		if len(head) >= end && bytes.Equal(head[sig.offset:end], sig.magic) {
+			return sig.mime
+		}
+	}
+	return baseMediaType(http.DetectContentType(head))
+}
+
+func baseMediaType(t string) string {
+	return strings.TrimSpace(strings.ToLower(strings.SplitN(t, ";", 2)[0]))
+}
+
+// executableExts are the extensions under which executable content is
+// expected, and so not treated as a disguised file.
+var executableExts = map[string]bool{
+	"": true, ".exe": true, ".dll": true, ".sys": true, ".msi": true, ".com": true, ".scr": true,
+	".so": true, ".o": true, ".ko": true, ".elf": true, ".bin": true, ".out": true, ".run": true,
+	".appimage": true, ".dylib": true, ".bundle": true,
+}
+
+// typeFamily groups MIME types that may legitimately stand in for each
+// other. An empty family means the type says too little to judge.
+func typeFamily(t string) string {
+	switch {
+	case strings.HasPrefix(t, "image/"):
+		return "image"
+	case strings.HasPrefix(t, "audio/"), strings.HasPrefix(t, "video/"), t == "application/ogg":
+		return "media"
+	case t == "application/pdf":
+		return "pdf"
+	case t == "application/x-executable", t == "application/vnd.microsoft.portable-executable",
+		t == "application/x-mach-binary", t == "application/x-msdownload":
+		return "executable"
+	case t == "application/zip", t == "application/x-gzip", t == "application/gzip", t == "application/x-tar",
+		t == "application/x-7z-compressed", t == "application/x-rar-compressed", t == "application/zstd",
+		t == "application/x-xz", t == "application/x-bzip2":
+		return "archive"
+	}
+	return ""
+}
+
+// typePolicy decides which files may be stored. Extensions are matched
+// case-insensitively with their leading dot; types are MIME types as sniffed
+// from the content and may use a wildcard subtype such as "image/*".
+type typePolicy struct {
+	AllowExt  []string `json:"allow_ext,omitempty"`
+	DenyExt   []string `json:"deny_ext,omitempty"`
+	AllowType []string `json:"allow_type,omitempty"`
+	DenyType  []string `json:"deny_type,omitempty"`
+
+	// outer holds rules a file has to pass as well, such as the
+	// server-wide ones under a drop box's own, so these can only narrow
+	// them.
+	outer *typePolicy
+}
+
+// splitList turns a comma-separated flag value into its trimmed, lowercased
+// entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func normalizeExt(e string) string {
+	e = strings.ToLower(strings.TrimSpace(e))
+	if e != "" && !strings.HasPrefix(e, ".") {
+		e = "." + e
+	}
+	return e
+}
+
+func matchExt(list []string, ext string) bool {
+	for _, e := range list {
+		if normalizeExt(e) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func matchType(list []string, t string) bool {
+	for _, p := range list {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == t || (strings.HasSuffix(p, "/*") && strings.HasPrefix(t, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// check inspects a file about to be stored under filename whose content
+// starts with head. It rejects content that does not match its extension,
+// such as an ELF binary named photo.jpg, and anything outside the lists.
+func (p typePolicy) check(filename string, head []byte) error {
+	if p.outer != nil {
+		if err := p.outer.check(filename, head); err != nil {
+			return err
+		}
+	}
+	ext := strings.ToLower(path.Ext(filename))
+	sniffed := sniffContentType(head)
+
+	if typeFamily(sniffed) == "executable" && !executableExts[ext] {
+		return &uploadError{http.StatusUnsupportedMediaType, "TYPE_MISMATCH",
+			fmt.Sprintf("%s is named like %s but contains an executable (%s)", filename, ext, sniffed)}
+	}
+	expected := baseMediaType(mime.TypeByExtension(ext))
+	if want, got := typeFamily(expected), typeFamily(sniffed); want != "" && got != "" && want != got {
+		return &uploadError{http.StatusUnsupportedMediaType, "TYPE_MISMATCH",
+			fmt.Sprintf("%s should be %s but its content is %s", filename, expected, sniffed)}
+	}
+
+	if matchExt(p.DenyExt, ext) {
+		return &uploadError{http.StatusUnsupportedMediaType, "TYPE_DENIED",
+			fmt.Sprintf("files ending in %q are not accepted", ext)}
+	}
+	if matchType(p.DenyType, sniffed) {
+		return &uploadError{http.StatusUnsupportedMediaType, "TYPE_DENIED",
+			fmt.Sprintf("%s content is not accepted", sniffed)}
+	}
+	if len(p.AllowExt) > 0 && !matchExt(p.AllowExt, ext) {
+		return &uploadError{http.StatusUnsupportedMediaType, "TYPE_NOT_ALLOWED",
+			fmt.Sprintf("only %s files are accepted", strings.Join(p.AllowExt, ", "))}
+	}
+	if len(p.AllowType) > 0 && !matchType(p.AllowType, sniffed) {
+		return &uploadError{http.StatusUnsupportedMediaType, "TYPE_NOT_ALLOWED",
+			fmt.Sprintf("%s content is not accepted; allowed: %s", sniffed, strings.Join(p.AllowType, ", "))}
+	}
+	return nil
+}
+
+// checkDeclared compares a Content-Type sent by the client with what the
+// content turned out to be. Only clear contradictions are refused, such as an
+// executable declared as an image; generic types like
+// application/octet-stream never conflict.
+func checkDeclared(declared string, head []byte) error {
+	declared = baseMediaType(declared)
+	sniffed := sniffContentType(head)
+	if want, got := typeFamily(declared), typeFamily(sniffed); want != "" && got != "" && want != got {
+		return &uploadError{http.StatusUnsupportedMediaType, "TYPE_MISMATCH",
+			fmt.Sprintf("declared as %s but the content is %s", declared, sniffed)}
+	}
+	return nil
+}
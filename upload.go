@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploader receives files over HTTP and stores them in the upload
+// directory, applying quotas and retention as it goes.
+type uploader struct {
+	uploadDir string
+	store     storage
+	quota     *quotaStore
+	retention *retentionStore
+	meta      *metaStore
+	index     *searchIndex
+	dropBoxes *dropBoxStore
+	types     typePolicy
+	audit     *auditLog
+
+	// scanner, when set, checks every upload before it is moved into place.
+	// Infected files are moved to quarantineDir instead.
+	scanner       scanner
+	quarantineDir string
+
+	hooks   *hookRunner
+	forward *forwarder
+	extract *extractor
+
+	// files decides whether a client may replace an existing file, and
+	// keeps the old version in the trash if there is one.
+	files *fileManager
+
+	// stripMetadata removes EXIF, XMP and IPTC metadata from images before
+	// they are stored.
+	stripMetadata bool
+
+	placeMu sync.Mutex
+}
+
+// sanitizeFilename reduces a client-supplied name to a plain file name, so
+// an upload can never choose its own directory.
+func sanitizeFilename(name string) (string, error) {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	switch name {
+	case "", ".", "..", "/":
+		return "", &uploadError{http.StatusBadRequest, "INVALID_NAME", fmt.Sprintf("%q is not a usable file name", name)}
+	}
+	if isStateDirName(name) {
+		return "", &uploadError{http.StatusBadRequest, "INVALID_NAME", fmt.Sprintf("%q is reserved", name)}
+	}
+	return name, nil
+}
+
+// reject refuses an upload, logging the reason and recording it in the
+// audit log before telling the client.
+func (u *uploader) reject(w http.ResponseWriter, r *http.Request, name string, err error) {
+	u.logRejection(clientIP(r), name, err)
+	writeUploadError(w, err)
+}
+
+// logRejection records a refused upload from client.
+func (u *uploader) logRejection(client, name string, err error) {
+	log.Printf("Rejected upload of %s from %s: %v", name, client, err)
+	u.audit.record(auditEntry{Event: "rejected", Path: name, Client: client, Detail: err.Error()})
+}
+
+// handleUpload serves POST /upload.
+func (u *uploader) handleUpload(w http.ResponseWriter, r *http.Request) {
+	u.receive(w, r, nil)
+}
+
+// handlePut serves PUT /upload/{path}, which takes the request body as the
+// file contents, so "curl -T file http://host/upload/" works. An optional
+// digest header is checked against what arrives, and "If-None-Match: *"
+// refuses to replace an existing file. With "?extract=true" an archive is
+// unpacked into a folder beside name instead.
+func (u *uploader) handlePut(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	raw := strings.TrimPrefix(r.URL.Path, "/upload/")
+	name, _, err := resolveUploadPath(u.uploadDir, raw)
+	if err == nil {
+		_, err = sanitizeFilename(path.Base(name))
+	}
+	if err != nil || name == "" {
+		u.reject(w, r, raw, &uploadError{http.StatusBadRequest, "INVALID_NAME", fmt.Sprintf("%q is not a usable file name", raw)})
+		return
+	}
+
+	opts := saveOptions{types: u.types, createOnly: r.Header.Get("If-None-Match") == "*"}
+	if opts.sha256, err = requestDigest(r.Header); err != nil {
+		u.reject(w, r, name, err)
+		return
+	}
+	opts.meta = requestMeta(r, "http")
+	opts.meta.OriginalName = path.Base(name)
+	if err := annotateFromForm(&opts.meta, r.URL.Query().Get("tags"), r.URL.Query().Get("notes")); err != nil {
+		u.reject(w, r, name, err)
+		return
+	}
+	var ttl time.Duration
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		if ttl, err = parseTTL(v); err != nil {
+			u.reject(w, r, name, &uploadError{http.StatusBadRequest, "INVALID_TTL", err.Error()})
+			return
+		}
+	}
+
+	info, err := u.store.stat(name)
+	existed := err == nil
+	if existed && info.IsDir {
+		u.reject(w, r, name, &uploadError{http.StatusConflict, "INVALID_NAME", name + " is a directory"})
+		return
+	}
+	if existed && opts.createOnly {
+		u.reject(w, r, name, errExists)
+		return
+	}
+
+	// With --dedup, a client that found its content through /api/blobs can
+	// send the digest and an empty body, and the stored copy is used.
+	var body io.Reader = r.Body
+	size := r.ContentLength
+	if d, ok := u.store.(*dedupStorage); ok && size == 0 && opts.sha256 != nil {
+		if f, n, ok := d.openBlob(opts.sha256); ok {
+			defer f.Close()
+			body, size = f, n
+		}
+	}
+
+	// The declared Content-Type is checked against the first bytes here;
+	// save reuses the same buffered reader for its own sniffing.
+	content := bufio.NewReaderSize(body, sniffLen)
+	head, err := content.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		http.Error(w, "Failed to read file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		if err := checkDeclared(ct, head); err != nil {
+			u.reject(w, r, name, err)
+			return
+		}
+	}
+
+	if r.URL.Query().Get("extract") == "true" && isArchive(content) {
+		u.extract.store(w, r, name, content, size, opts.types, opts.meta, nil, ttl)
+		return
+	}
+
+	ev, err := u.save(clientIP(r), name, content, size, opts)
+	if err != nil {
+		u.reject(w, r, name, err)
+		return
+	}
+	if size >= 0 && ev.Size != size {
+		log.Printf("Upload of %s was %d bytes, Content-Length said %d", name, ev.Size, size)
+	}
+	if ttl > 0 {
+		if err := u.retention.setExpiry(name, time.Now().Add(ttl)); err != nil {
+			log.Printf("Failed to record retention for %s: %v", name, err)
+		}
+	}
+	u.finish(w, ev)
+	if existed {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	fmt.Fprintf(w, "File uploaded successfully")
+}
+
+// requestDigest returns the SHA-256 a client declared for its request body,
+// or nil if it sent none. Content-Digest (RFC 9530), the older Digest header
+// (RFC 3230) and X-Nostromo-SHA256 (hex, as this server reports it) are
+// understood; other algorithms are ignored.
+func requestDigest(h http.Header) ([]byte, error) {
+	bad := func(v string) error {
+		return &uploadError{http.StatusBadRequest, "INVALID_DIGEST", fmt.Sprintf("cannot parse sha-256 digest %q", v)}
+	}
+	if v := h.Get("X-Nostromo-SHA256"); v != "" {
+		sum, err := hex.DecodeString(strings.TrimSpace(v))
+		if err != nil || len(sum) != sha256.Size {
+			return nil, bad(v)
+		}
+		return sum, nil
+	}
+	for _, header := range []string{"Content-Digest", "Digest"} {
+		for _, field := range strings.Split(strings.Join(h.Values(header), ","), ",") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 || !strings.EqualFold(kv[0], "sha-256") {
+				continue
+			}
+			// Content-Digest wraps the value in colons as a byte sequence.
+			v := strings.Trim(kv[1], ":")
+			sum, err := base64.StdEncoding.DecodeString(v)
+			if err != nil || len(sum) != sha256.Size {
+				return nil, bad(kv[1])
+			}
+			return sum, nil
+		}
+	}
+	return nil, nil
+}
+
+// multipartOverhead is how much larger than the file a multipart request may
+// be, for the framing and the other form fields.
+const multipartOverhead = 1 << 20
+
+// receive stores the "file" field of a multipart upload. When box is set the
+// file goes into the drop box's directory and its limits apply as well.
+func (u *uploader) receive(w http.ResponseWriter, r *http.Request, box *dropBox) {
+	if r.Method != http.MethodPost {
+
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	stored := false
+	if box != nil {
+		// A box that unpacks archives checks the files in them instead.
+		if !box.Extract {
+			if err := box.checkSize(r.ContentLength - multipartOverhead); err != nil {
+				u.reject(w, r, box.Dir, err)
+				return
+			}
+		}
+		if err := u.dropBoxes.claim(box.Slug); err != nil {
+			u.reject(w, r, box.Dir, err)
+			return
+		}
+		// The slot is only kept once the file has been stored.
+		defer func() {
+			if !stored {
+				u.dropBoxes.unclaim(box.Slug)
+			}
+		}()
+	}
+
+	// Check quotas before reading the body. The declared length includes
+	// the multipart framing, so it is only compared with what is left, with
+	// room for the framing; the file itself is held to the limits by save
+	// once its own size is known.
+	owner := clientIP(r)
+	res, err := u.quota.reserve(owner, "", -1)
+	if err != nil {
+		u.reject(w, r, "", err)
+		return
+	}
+	defer res.cancel()
+	if res.limit >= 0 {
+		if r.ContentLength > res.limit+multipartOverhead {
+			u.reject(w, r, "", &uploadError{http.StatusInsufficientStorage, "QUOTA_EXCEEDED",
+				fmt.Sprintf("%d bytes requested but only %d bytes of quota remain", r.ContentLength, res.limit)})
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, res.limit+multipartOverhead)
+	}
+
+	// Parse multipart form data (32MB max memory)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Get the file from the form data
+	file, header, err := r.FormFile("file")
+	if err != nil {
+
+		http.Error(w, "Failed to get file: "+err.Error(), http.StatusBadRequest)
+		return
+
+	}
+	defer file.Close()
+
+	// An optional TTL asks for this upload to expire sooner than the
+	// global retention policy would remove it.
+	var ttl time.Duration
+	if v := r.FormValue("ttl"); v != "" && box == nil {
+		if ttl, err = parseTTL(v); err != nil {
+			u.reject(w, r, header.Filename, &uploadError{http.StatusBadRequest, "INVALID_TTL", err.Error()})
+			return
+		}
+	}
+
+	// Create a new file in the upload directory
+	filename, err := sanitizeFilename(header.Filename)
+	if err != nil {
+		u.reject(w, r, header.Filename, err)
+		return
+	}
+
+	types := u.types
+	if box != nil {
+		types = box.policy(u.types)
+	}
+	meta := requestMeta(r, "http")
+	meta.OriginalName = header.Filename
+	if box != nil {
+		meta.DropBox = box.Slug
+	}
+	if err := annotateFromForm(&meta, r.FormValue("tags"), r.FormValue("notes")); err != nil {
+		u.reject(w, r, filename, err)
+		return
+	}
+
+	name := filename
+	opts := saveOptions{types: types, meta: meta}
+	if box != nil {
+		// Drop boxes never overwrite: the sender cannot see what is
+		// already there, so a clashing name gets a numbered suffix, even
+		// when another upload of the same name gets there first.
+		name = uniqueName(u.store, path.Join(box.Dir, filename))
+		opts.createOnly, opts.unique = true, true
+	}
+
+	// The reservation for the whole request is replaced by one for the
+	// named file inside save, or for the archive inside extract.
+	res.cancel()
+
+	// Archives are unpacked instead of stored when the sender asks for it,
+	// or always for a drop box set up that way. Anything else is stored as
+	// usual, so a batch can mix archives and plain files.
+	content := bufio.NewReaderSize(file, sniffLen)
+	unpack := r.FormValue("extract") == "true"
+	if box != nil {
+		unpack = box.Extract
+	}
+	if unpack && isArchive(content) {
+		// A drop box counts the files unpacked rather than the archive, so
+		// the archive's slot is handed back here, not by the deferred
+		// unclaim, and extract claims one per file.
+		if box != nil {
+			u.dropBoxes.unclaim(box.Slug)
+			stored = true
+		}
+		u.extract.store(w, r, name, content, header.Size, types, meta, box, ttl)
+		return
+	}
+	if box != nil {
+		if err := box.checkSize(header.Size); err != nil {
+			u.reject(w, r, filename, err)
+			return
+		}
+	}
+
+	// Add a small delay to simulate processing for very small files
+	if header.Size < 10000 { // If less than 10KB
+		time.Sleep(time.Millisecond * 500)
+	}
+
+	ev, err := u.save(clientIP(r), name, content, header.Size, opts)
+	if err != nil {
+		u.reject(w, r, name, err)
+		return
+	}
+	if ttl > 0 {
+		if err := u.retention.setExpiry(ev.Path, time.Now().Add(ttl)); err != nil {
+			log.Printf("Failed to record retention for %s: %v", ev.Path, err)
+		}
+	}
+
+	stored = true
+	if box != nil {
+		ev.DropBox = box.Slug
+	}
+	u.finish(w, ev)
+	fmt.Fprintf(w, "File uploaded successfully")
+}
+
+// saveOptions adjusts how save treats one upload.
+type saveOptions struct {
+	types typePolicy
+	// sha256, when set, is the digest the client says the body has. The
+	// upload is refused if the received bytes do not match it.
+	sha256 []byte
+	// createOnly refuses the upload if name already exists.
+	createOnly bool
+	// unique, with createOnly, stores the upload under the next free
+	// numbered name instead when name is taken by the time it is placed.
+	unique bool
+	// meta describes where the upload came from. save fills in the rest
+	// and records it once the file is stored.
+	meta fileMeta
+}
+
+// save writes body to storage under name on behalf of client, applying the
+// type policy, quota and malware scanning on the way. size may be -1 if it is
+// not known in advance. Nothing is stored under name unless every check
+// passes; a rejection comes back as an *uploadError.
+func (u *uploader) save(client, name string, body io.Reader, size int64, opts saveOptions) (uploadEvent, error) {
+	// Decide what the file really is from its first bytes rather than the
+	// client's Content-Type, before anything is written.
+	content := bufio.NewReaderSize(body, sniffLen)
+	head, err := content.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return uploadEvent{}, &uploadError{http.StatusBadRequest, "READ_FAILED", err.Error()}
+	}
+	if err := opts.types.check(path.Base(name), head); err != nil {
+		return uploadEvent{}, err
+	}
+
+	// Replacing a file loses it as surely as deleting it does, so it needs
+	// the same permission. With a trash the old version is kept there.
+	var keep bool
+	if !opts.createOnly {
+		if keep, err = u.files.replacing(client, name); err != nil {
+			var np *notPermitted
+			if errors.As(err, &np) {
+				return uploadEvent{}, &uploadError{http.StatusForbidden, "NOT_PERMITTED", np.msg}
+			}
+			return uploadEvent{}, err
+		}
+	}
+
+	// Now that the name and size are known, check quota so an overwrite
+	// is credited and unknown-length uploads are held to what is left.
+	owner := client
+	reserve := u.quota.reserve
+	if keep {
+		reserve = u.quota.reserveAlongside
+	}
+	res, err := reserve(owner, name, size)
+	if err != nil {
+		return uploadEvent{}, err
+	}
+	defer res.cancel()
+	var src io.Reader = content
+	if size < 0 {
+		src = res.reader(src)
+	}
+	if res.limit >= 0 {
+		src = io.LimitReader(src, res.limit+1)
+	}
+
+	// Write to a temporary file first, so a failed or rejected upload never
+	// replaces or half-writes the file under its final name.
+	incoming := filepath.Join(stateDir(u.uploadDir), "incoming")
+	if err := os.MkdirAll(incoming, 0755); err != nil {
+		return uploadEvent{}, err
+	}
+	out, err := os.CreateTemp(incoming, "upload-*")
+	if err != nil {
+		return uploadEvent{}, err
+	}
+	tmpName := out.Name()
+	defer os.Remove(tmpName)
+	defer out.Close()
+
+	// Copy the file data, hashing it on the way through
+	digest := sha256.New()
+	written, err := io.Copy(io.MultiWriter(out, digest), src)
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		return uploadEvent{}, err
+	}
+	if res.limit >= 0 && written > res.limit {
+		return uploadEvent{}, &uploadError{http.StatusInsufficientStorage, "QUOTA_EXCEEDED",
+			fmt.Sprintf("upload exceeds the %d bytes of quota remaining", res.limit)}
+	}
+
+	sum := digest.Sum(nil)
+	if opts.sha256 != nil && !bytes.Equal(sum, opts.sha256) {
+		return uploadEvent{}, &uploadError{http.StatusBadRequest, "DIGEST_MISMATCH",
+			fmt.Sprintf("received sha-256 %x but the client sent %x", sum, opts.sha256)}
+	}
+
+	if u.scanner != nil {
+		if err := u.scanFile(client, tmpName, name); err != nil {
+			return uploadEvent{}, err
+		}
+	}
+
+	// Stripping changes the file, so from here on its size and digest are
+	// those of what is stored rather than what the client sent.
+	var stripped []string
+	if u.stripMetadata {
+		removed, size, strippedSum, err := stripFileMetadata(tmpName)
+		if err != nil {
+			return uploadEvent{}, &uploadError{http.StatusUnprocessableEntity, "STRIP_FAILED",
+				"could not remove metadata from the image: " + err.Error()}
+		}
+		if len(removed) > 0 {
+			stripped, written, sum = removed, size, strippedSum
+		}
+	}
+
+	kept := func(bool) {}
+	if keep {
+		if kept, err = u.files.keep(client, name); err != nil {
+			return uploadEvent{}, err
+		}
+	}
+	deduped, err := u.place(name, tmpName, sum, opts.createOnly)
+	for wanted := name; err == errExists && opts.unique; {
+		// Another upload took the name while this one was arriving.
+		name = uniqueName(u.store, wanted)
+		res.rename(name)
+		deduped, err = u.place(name, tmpName, sum, true)
+	}
+	kept(err == nil)
+	if err != nil {
+		return uploadEvent{}, err
+	}
+	if err := res.commit(written); err != nil {
+		log.Printf("Failed to record quota usage for %s: %v", name, err)
+	}
+	if err := u.retention.forget(name); err != nil {
+		log.Printf("Failed to record retention for %s: %v", name, err)
+	}
+	meta := opts.meta
+	meta.ClientIP = client
+	meta.Size = written
+	meta.SHA256 = hex.EncodeToString(sum)
+	meta.Uploaded = time.Now().UTC()
+	if err := u.meta.set(name, meta); err != nil {
+		log.Printf("Failed to record metadata for %s: %v", name, err)
+	}
+
+	return uploadEvent{
+		Event:        "upload",
+		Path:         name,
+		Size:         written,
+		SHA256:       meta.SHA256,
+		Client:       owner,
+		Time:         meta.Uploaded,
+		Deduplicated: deduped,
+		Stripped:     stripped,
+	}, nil
+}
+
+// errExists is returned for a create-only upload whose name is taken.
+var errExists = &uploadError{http.StatusPreconditionFailed, "FILE_EXISTS", "a file with that name already exists"}
+
+// place moves a finished upload into storage. Create-only uploads check and
+// store under a lock, so two of them cannot both claim the same name. It
+// reports whether the content was already held, with --dedup.
+func (u *uploader) place(name, tmpName string, sum []byte, createOnly bool) (bool, error) {
+	if !createOnly {
+		return storeFile(u.store, name, tmpName, sum)
+	}
+	u.placeMu.Lock()
+	defer u.placeMu.Unlock()
+	if storageExists(u.store, name) {
+		return false, errExists
+	}
+	return storeFile(u.store, name, tmpName, sum)
+}
+
+// finish announces a stored upload: it is audited, handed to hooks and the
+// forwarder, and described to the client in response headers.
+func (u *uploader) finish(w http.ResponseWriter, ev uploadEvent) {
+	u.announce(ev)
+	w.Header().Set("X-Nostromo-Stored", ev.Path)
+	w.Header().Set("X-Nostromo-SHA256", ev.SHA256)
+	if ev.Deduplicated {
+		w.Header().Set("X-Nostromo-Deduplicated", "true")
+	}
+	if len(ev.Stripped) > 0 {
+		w.Header().Set("X-Nostromo-Stripped", strings.Join(ev.Stripped, ", "))
+	}
+}
+
+// announce audits a stored upload, hands it to hooks and the forwarder, and
+// adds it to the search index.
+func (u *uploader) announce(ev uploadEvent) {
+	u.audit.record(auditEntry{Event: "upload", Path: ev.Path, Client: ev.Client, Size: ev.Size})
+	if len(ev.Stripped) > 0 {
+		u.audit.record(auditEntry{Event: "stripped", Path: ev.Path, Client: ev.Client, Detail: strings.Join(ev.Stripped, ", ")})
+	}
+	u.hooks.fire(ev)
+	u.forward.enqueue(ev)
+	go u.index.add(ev.Path)
+	log.Printf("Saved file: %s (%d bytes) to %s", ev.Path, ev.Size, u.uploadDir)
+}
+
+// scanFile runs the malware scanner over the temporary file holding an
+// upload. An infected file is moved into quarantine and reported as a
+// rejection; if the scanner cannot be reached the upload is refused too.
+func (u *uploader) scanFile(client, tmpName, name string) error {
+	f, err := os.Open(tmpName)
+	if err != nil {
+		return err
+	}
+	signature, err := u.scanner.scan(f)
+	f.Close()
+	if err != nil {
+		return &uploadError{http.StatusServiceUnavailable, "SCAN_FAILED", err.Error()}
+	}
+	if signature == "" {
+		return nil
+	}
+
+	// The random part keeps two rejected uploads of the same name in the
+	// same second from overwriting each other's evidence.
+	dest := filepath.Join(u.quarantineDir, time.Now().UTC().Format("20060102T150405Z")+"-"+randomID(6)+"-"+path.Base(name))
+	if err := os.MkdirAll(u.quarantineDir, 0700); err != nil {
+		log.Printf("Failed to create quarantine directory: %v", err)
+	} else if err := moveFile(tmpName, dest); err != nil {
+		log.Printf("Failed to quarantine %s: %v", name, err)
+	} else {
+		u.audit.record(auditEntry{Event: "quarantined", Path: name, Client: client, Detail: signature + " -> " + dest})
+		log.Printf("Quarantined %s from %s: %s", name, client, signature)
+	}
+	return &uploadError{http.StatusUnprocessableEntity, "MALWARE_DETECTED", signature}
+}
+
+// moveFile moves the file at src to dst, which need not be on the same
+// filesystem: a quarantine directory usually is not. dst only appears once
+// it holds all of src, synced to disk, and src is only removed after that.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(filepath.Dir(dst), ".moving-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(out.Name(), dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
@@ -4,7 +4,7 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io"
+	"html/template"
 
 	"log"
 	"net"
@@ -222,6 +222,62 @@ const htmlTemplate = `<!DOCTYPE html>
             margin: 20px 0;
         }
         
+        .retention, .unpack, .e2e, .relay {
+            font-size: 14px;
+        }
+        
+        .unpack, .e2e, .relay {
+            display: block;
+            margin-top: 8px;
+        }
+        
+        .unpack input, .e2e input, .relay input {
+            accent-color: var(--accent-color);
+        }
+        
+        .paste-panel {
+            margin-top: 20px;
+            border: 1px solid var(--accent-color);
+            background-color: rgba(0, 15, 0, 0.6);
+            padding: 15px;
+        }
+        
+        .paste-panel textarea {
+            display: block;
+            width: 100%;
+            box-sizing: border-box;
+            min-height: 120px;
+            margin: 10px 0;
+            resize: vertical;
+            white-space: pre;
+        }
+        
+        .paste-actions {
+            display: flex;
+            flex-wrap: wrap;
+            gap: 10px;
+            align-items: center;
+            font-size: 14px;
+        }
+        
+        #pasteResult {
+            margin-top: 10px;
+            font-size: 14px;
+        }
+        
+        #pasteResult a {
+            color: var(--highlight-color);
+            margin-right: 10px;
+        }
+        
+        .retention select, .retention input, .share-panel select, .share-panel input, .info-panel input, .info-panel textarea, .paste-panel select, .paste-panel textarea {
+            background: rgba(0, 30, 0, 0.6);
+            color: var(--accent-color);
+            font-family: 'Share Tech Mono', monospace;
+            border: 1px solid var(--accent-color);
+            padding: 2px 5px;
+        }
+        
         .console-box {
             font-family: 'Share Tech Mono', monospace;
             background-color: rgba(0, 15, 0, 0.6);
@@ -256,9 +312,285 @@ const htmlTemplate = `<!DOCTYPE html>
             box-shadow: 0 0 10px rgba(92, 219, 92, 0.3);
         }
         
+        .btn-small {
+            font-size: 12px;
+            padding: 4px 10px;
+            margin-left: 10px;
+        }
+        
         .file-list {
             margin-top: 20px;
         }
+        
+        .share-panel {
+            margin-top: 10px;
+            padding-top: 10px;
+            border-top: 1px dashed var(--accent-color);
+            font-size: 14px;
+        }
+        
+        .share-panel input {
+            width: 90px;
+        }
+        
+        .info-panel {
+            margin-top: 10px;
+            padding-top: 10px;
+            border-top: 1px dashed var(--accent-color);
+            font-size: 14px;
+        }
+        
+        .info-panel dl {
+            display: grid;
+            grid-template-columns: max-content 1fr;
+            gap: 2px 12px;
+            margin: 0 0 8px;
+        }
+        
+        .info-panel dd {
+            margin: 0;
+            word-break: break-all;
+        }
+        
+        .info-panel input, .info-panel textarea {
+            width: 100%;
+            box-sizing: border-box;
+            margin-bottom: 6px;
+        }
+        
+        .share-result {
+            margin-top: 8px;
+            color: var(--highlight-color);
+            word-break: break-all;
+        }
+
+        .search-bar {
+            margin-top: 20px;
+            display: flex;
+            gap: 10px;
+            align-items: center;
+        }
+        
+        .search-bar input {
+            flex: 1;
+            background: rgba(0, 30, 0, 0.6);
+            color: var(--accent-color);
+            font-family: 'Share Tech Mono', monospace;
+            border: 1px solid var(--accent-color);
+            padding: 6px 8px;
+        }
+        
+        .search-result {
+            padding: 8px 10px;
+            border-bottom: 1px dashed var(--accent-color);
+            font-size: 14px;
+        }
+        
+        .search-result a {
+            color: var(--highlight-color);
+        }
+        
+        .search-excerpt {
+            opacity: 0.8;
+            margin-top: 4px;
+        }
+        
+        .selection-bar {
+            margin-top: 20px;
+            padding: 10px;
+            border: 1px dashed var(--accent-color);
+            display: flex;
+            align-items: center;
+            justify-content: flex-end;
+            font-size: 14px;
+        }
+        
+        .selection-bar[hidden] {
+            display: none;
+        }
+        
+        .file-select {
+            margin-right: 15px;
+            accent-color: var(--text-color);
+        }
+        
+        /* MU/TH/UR override prompt shown before destructive operations */
+        .override {
+            position: fixed;
+            top: 0;
+            left: 0;
+            width: 100%;
+            height: 100%;
+            background: rgba(0, 0, 0, 0.8);
+            display: flex;
+            align-items: center;
+            justify-content: center;
+            z-index: 30;
+        }
+        
+        .override[hidden] {
+            display: none;
+        }
+        
+        .override-box {
+            background: var(--terminal-color);
+            border: 2px solid var(--warning-color);
+            box-shadow: 0 0 20px rgba(255, 107, 107, 0.4);
+            padding: 20px;
+            width: 90%;
+            max-width: 520px;
+        }
+        
+        .override-title {
+            color: var(--warning-color);
+            animation: blink 1s infinite;
+            margin-bottom: 10px;
+        }
+        
+        .override-message {
+            margin-bottom: 15px;
+            word-break: break-all;
+        }
+        
+        .override-input {
+            width: 100%;
+            margin-bottom: 15px;
+            background: rgba(0, 30, 0, 0.6);
+            color: var(--highlight-color);
+            border: 1px solid var(--accent-color);
+            font-family: 'Share Tech Mono', monospace;
+            font-size: 16px;
+            padding: 6px;
+        }
+        
+        .override-actions {
+            text-align: right;
+        }
+        
+        .preview {
+            position: fixed;
+            top: 0;
+            left: 0;
+            width: 100%;
+            height: 100%;
+            background: rgba(0, 0, 0, 0.85);
+            display: flex;
+            align-items: center;
+            justify-content: center;
+            z-index: 20;
+        }
+        
+        .preview[hidden] {
+            display: none;
+        }
+        
+        .preview-box {
+            background: var(--terminal-color);
+            border: 2px solid var(--accent-color);
+            box-shadow: 0 0 20px rgba(147, 226, 147, 0.3);
+            padding: 15px;
+            width: 92%;
+            max-width: 960px;
+            max-height: 90vh;
+            display: flex;
+            flex-direction: column;
+        }
+        
+        .preview-header {
+            display: flex;
+            justify-content: space-between;
+            align-items: center;
+            gap: 10px;
+            margin-bottom: 10px;
+            color: var(--highlight-color);
+            word-break: break-all;
+        }
+        
+        .preview-body {
+            overflow: auto;
+            min-height: 0;
+            text-align: center;
+        }
+        
+        .preview-body img,
+        .preview-body video {
+            max-width: 100%;
+            max-height: 75vh;
+            border: 1px solid var(--accent-color);
+        }
+        
+        .preview-body audio {
+            width: 100%;
+        }
+        
+        .preview-body iframe {
+            width: 100%;
+            height: 75vh;
+            border: 1px solid var(--accent-color);
+            background: #fff;
+        }
+        
+        .preview-body pre {
+            text-align: left;
+            margin: 0;
+            padding: 10px;
+            font-family: 'Share Tech Mono', monospace;
+            font-size: 14px;
+            white-space: pre-wrap;
+            word-break: break-word;
+            background: rgba(0, 20, 0, 0.6);
+            text-shadow: 0 0 4px rgba(92, 219, 92, 0.5);
+        }
+        
+        .tok-comment {
+            opacity: 0.55;
+            font-style: italic;
+        }
+        
+        .tok-string {
+            color: var(--highlight-color);
+        }
+        
+        .tok-number {
+            color: #d4f542;
+        }
+        
+        .tok-keyword {
+            color: #e8ffe8;
+            font-weight: bold;
+        }
+        
+        .sealed-link {
+            margin-top: 8px;
+            display: flex;
+            gap: 8px;
+            align-items: center;
+            font-size: 14px;
+        }
+        
+        .sealed-link input {
+            flex: 1;
+            min-width: 0;
+            background: rgba(0, 30, 0, 0.6);
+            color: var(--highlight-color);
+            font-family: 'Share Tech Mono', monospace;
+            border: 1px solid var(--accent-color);
+            padding: 4px;
+        }
+        
+        .thumb {
+            width: 48px;
+            height: 48px;
+            object-fit: cover;
+            border: 1px solid var(--accent-color);
+            margin-right: 12px;
+            cursor: pointer;
+            filter: sepia(0.4) hue-rotate(60deg) saturate(1.4);
+        }
+        
+        .thumb:hover {
+            filter: none;
+        }
 
         
         .file-item {
@@ -549,6 +881,7 @@ const htmlTemplate = `<!DOCTYPE html>
             
             <div class="system-info">
                 >_ TERMINAL SESSION: USR.RIPLEY.3829<br>
+                <span id="receiverLine">>_ RECEIVER CODE: <span id="receiverCode">------</span><br></span>
                 >_ LOCATION: DECK C - SCIENCE DIVISION<br>
                 >_ DATE: <span id="currentDate">--.--.----</span> | TIME: <span id="currentTime">--:--:--</span><br>
                 >_ WARNING: ALL TRANSFERS LOGGED AND MONITORED<span class="cursor"></span>
@@ -568,12 +901,119 @@ const htmlTemplate = `<!DOCTYPE html>
                     <div class="arrow">↓↓↓</div>
                     <div>SELECT FILES OR DROP HERE</div>
                     <input type="file" id="fileInput" multiple class="file-input" />
+                    <label class="retention">RETENTION:
+                        <select id="ttlSelect">
+                            <option value="">STANDARD</option>
+                            <option value="1h">1 HOUR</option>
+                            <option value="24h">24 HOURS</option>
+                            <option value="7d">7 DAYS</option>
+                        </select>
+                    </label>
+                    <label class="retention">TAGS: <input type="text" id="tagsInput" placeholder="COMMA SEPARATED"></label>
+                    <label class="unpack"><input type="checkbox" id="unpackToggle"> UNPACK ARCHIVES</label>
+                    <label class="e2e" id="e2eLabel"><input type="checkbox" id="e2eToggle"> SEAL END-TO-END (KEY STAYS IN THE LINK)</label>
+                    <label class="relay" id="relayLabel"><input type="checkbox" id="relayToggle"> DIRECT RELAY (NOT STORED)</label>
                 </div>
             </div>
             
+            <div class="paste-panel" id="pastePanel">
+                <div>&gt;_ TEXT TRANSMISSION: PASTE A LOG EXCERPT OR COMMAND</div>
+                <textarea id="pasteText" spellcheck="false" placeholder="CTRL+ENTER TO TRANSMIT"></textarea>
+                <div class="paste-actions">
+                    <label>LANGUAGE:
+                        <select id="pasteLanguage">
+                            <option value="">PLAIN TEXT</option>
+                            <option value="log">LOG</option>
+                            <option value="shell">SHELL</option>
+                            <option value="powershell">POWERSHELL</option>
+                            <option value="python">PYTHON</option>
+                            <option value="go">GO</option>
+                            <option value="javascript">JAVASCRIPT</option>
+                            <option value="typescript">TYPESCRIPT</option>
+                            <option value="json">JSON</option>
+                            <option value="yaml">YAML</option>
+                            <option value="toml">TOML</option>
+                            <option value="sql">SQL</option>
+                            <option value="diff">DIFF</option>
+                            <option value="markdown">MARKDOWN</option>
+                            <option value="c">C</option>
+                            <option value="cpp">C++</option>
+                            <option value="java">JAVA</option>
+                            <option value="rust">RUST</option>
+                            <option value="html">HTML</option>
+                        </select>
+                    </label>
+                    <label>EXPIRES:
+                        <select id="pasteTtl">
+                            <option value="">STANDARD</option>
+                            <option value="1h">1 HOUR</option>
+                            <option value="24h">24 HOURS</option>
+                            <option value="7d">7 DAYS</option>
+                        </select>
+                    </label>
+                    <button class="btn btn-small" id="pasteSubmit">TRANSMIT TEXT</button>
+                </div>
+                <div id="pasteResult"></div>
+            </div>
+            
+            <div class="search-bar" id="searchBar">
+                <span>QUERY DATABASE:</span>
+                <input type="search" id="searchInput" placeholder="NAME, TAG OR NOTE">
+            </div>
+            <div id="searchResults"></div>
+            
+            <div class="search-bar" id="relayBar">
+                <span>RECEIVE RELAY:</span>
+                <input type="text" id="relayCode" placeholder="CODE FROM SENDER" spellcheck="false">
+                <button class="btn btn-small" id="relayReceive">RECEIVE</button>
+            </div>
+            
+            <div class="selection-bar" id="selectionBar" hidden>
+                <span id="selectionCount"></span>
+                <select id="archiveFormat" class="btn-small">
+                    <option value="zip">ZIP</option>
+                    <option value="tar.gz">TAR.GZ</option>
+                    <option value="tar.zst">TAR.ZST</option>
+                </select>
+                <button class="btn btn-small" id="downloadSelection">DOWNLOAD SELECTION</button>
+            </div>
+            
             <div class="file-list" id="fileList">
                 <!-- File items will be added dynamically -->
             </div>
+
+            <div class="override" id="override" hidden>
+                <div class="override-box">
+                    <div class="override-title">!! MU/TH/UR 6000 OVERRIDE REQUIRED !!</div>
+                    <div class="override-message" id="overrideMessage"></div>
+                    <input class="override-input" id="overrideInput" type="text" spellcheck="false">
+                    <div class="override-actions">
+                        <button class="btn btn-small" id="overrideCancel">ABORT</button>
+                        <button class="btn btn-small" id="overrideConfirm">AUTHORIZE</button>
+                    </div>
+                </div>
+            </div>
+            
+            <div class="override" id="incoming" hidden>
+                <div class="override-box">
+                    <div class="override-title">!! INCOMING TRANSMISSION !!</div>
+                    <div class="override-message" id="incomingMessage"></div>
+                    <div class="override-actions">
+                        <button class="btn btn-small" id="incomingDecline">DECLINE</button>
+                        <button class="btn btn-small" id="incomingAccept">ACCEPT</button>
+                    </div>
+                </div>
+            </div>
+            
+            <div class="preview" id="preview" hidden>
+                <div class="preview-box">
+                    <div class="preview-header">
+                        <span id="previewTitle"></span>
+                        <button class="btn btn-small" id="previewClose">CLOSE</button>
+                    </div>
+                    <div class="preview-body" id="previewBody"></div>
+                </div>
+            </div>
         </div>
         
         <div class="footer">
@@ -583,6 +1023,7 @@ const htmlTemplate = `<!DOCTYPE html>
 
     
     <script>
+        const CONFIG = {{.}};
 
         document.addEventListener('DOMContentLoaded', () => {
             const dropZone = document.getElementById('dropZone');
@@ -591,6 +1032,48 @@ const htmlTemplate = `<!DOCTYPE html>
             const consoleBox = document.getElementById('consoleBox');
             const currentDate = document.getElementById('currentDate');
             const currentTime = document.getElementById('currentTime');
+            const ttlSelect = document.getElementById('ttlSelect');
+            const unpackToggle = document.getElementById('unpackToggle');
+            const tagsInput = document.getElementById('tagsInput');
+            const e2eToggle = document.getElementById('e2eToggle');
+            const relayToggle = document.getElementById('relayToggle');
+            
+            // WebCrypto is only offered to pages served over HTTPS or from
+            // localhost
+            if (!window.isSecureContext || !window.crypto || !crypto.subtle) {
+                e2eToggle.disabled = true;
+                document.getElementById('e2eLabel').title = 'SEALING NEEDS AN HTTPS CONNECTION';
+                document.getElementById('e2eLabel').style.opacity = 0.5;
+            }
+
+            // Relays are only offered when the server allows them. A relayed
+            // file is never stored, so it cannot be sealed as well.
+            if (CONFIG.relay) {
+                relayToggle.addEventListener('change', () => {
+                    if (relayToggle.checked) e2eToggle.checked = false;
+                });
+                e2eToggle.addEventListener('change', () => {
+                    if (e2eToggle.checked) relayToggle.checked = false;
+                });
+                document.getElementById('relayReceive').addEventListener('click', receiveRelay);
+                document.getElementById('relayCode').addEventListener('keydown', e => {
+                    if (e.key === 'Enter') receiveRelay();
+                });
+            } else {
+                document.getElementById('relayLabel').remove();
+                document.getElementById('relayBar').remove();
+            }
+            
+            // Drop box pages only accept files: no retention or share controls
+            if (CONFIG.dropBox) {
+                document.querySelectorAll('.retention').forEach(el => el.remove());
+                document.getElementById('searchBar').remove();
+                document.getElementById('pastePanel').remove();
+                document.getElementById('receiverLine').remove();
+                document.querySelector('.unpack').remove();
+                document.querySelector('h1').textContent = 'DROP BOX: ' + CONFIG.dropBox;
+                addConsoleMessage('UPLOAD-ONLY CHANNEL. LISTING DISABLED.');
+            }
 
             
             // Update time and date in futuristic format
@@ -678,13 +1161,169 @@ const htmlTemplate = `<!DOCTYPE html>
                 let files = [...e.target.files];
                 addConsoleMessage(files.length + ' FILE(S) SELECTED FOR TRANSFER');
 
-                files.forEach(uploadFile);
+                files.forEach(CONFIG.relay && relayToggle.checked ? relayFile : uploadFile);
             }
             
-            function uploadFile(file) {
-                addConsoleMessage('UPLOADING: ' + file.name + ' (' + formatBytes(file.size) + ')');
+            // A relayed file goes straight to whoever enters its code, and is
+            // never stored. The upload waits for the receiver, then only moves
+            // as fast as they download.
+            function relayFile(file) {
+                addConsoleMessage('RELAYING: ' + file.name + ' (' + formatBytes(file.size) + ')');
+                const { fileInfo, progressBar, statusElement } = addFileItem(file);
                 
-                // Create file entry in the list
+                function fail(message) {
+                    statusElement.textContent = 'ERROR';
+                    statusElement.className = 'status error';
+                    addConsoleMessage('RELAY FAILURE: ' + file.name + ' - ' + message);
+                }
+                
+                fetch('/api/relay', {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify({ name: file.name, size: file.size })
+                }).then(response => {
+                    if (!response.ok) {
+                        return response.text().then(text => { throw new Error(text.trim() || response.statusText); });
+                    }
+                    return response.json();
+                }).then(relay => {
+                    statusElement.textContent = 'AWAITING RECEIVER';
+                    addLinkRow(fileInfo, 'RELAY CODE ' + relay.code + ':', relay.url, 'RELAY LINK COPIED TO CLIPBOARD');
+                    addConsoleMessage('RELAY ' + relay.code + ' OPEN FOR ' + file.name + ' UNTIL ' + new Date(relay.expires).toLocaleTimeString());
+                    
+                    const xhr = new XMLHttpRequest();
+                    xhr.upload.addEventListener('progress', (e) => {
+                        if (e.lengthComputable && e.loaded > 0) {
+                            const percentComplete = Math.round((e.loaded / e.total) * 100);
+                            progressBar.style.width = percentComplete + '%';
+                            statusElement.textContent = 'RELAYING ' + percentComplete + '%';
+                        }
+                    });
+                    xhr.onload = function() {
+                        if (xhr.status === 200) {
+                            progressBar.style.width = '100%';
+                            statusElement.textContent = 'DELIVERED';
+                            statusElement.className = 'status success';
+                            addConsoleMessage('RELAY COMPLETE: ' + file.name);
+                        } else {
+                            fail(xhr.responseText.trim() || xhr.statusText);
+                        }
+                    };
+                    xhr.onerror = function() {
+                        fail('CONNECTION LOST');
+                    };
+                    xhr.open('PUT', '/api/relay/' + encodeURIComponent(relay.code));
+                    xhr.setRequestHeader('X-Nostromo-Relay-Token', relay.token);
+                    xhr.send(file);
+                }).catch(err => fail(err.message));
+            }
+            
+            // Receiving a relay is an ordinary download, which the browser
+            // streams to disk. The code is looked up first, so a mistyped one
+            // does not leave a failed download behind.
+            function receiveRelay() {
+                const input = document.getElementById('relayCode');
+                const code = input.value.trim().split('/').pop().toUpperCase();
+                if (!code) {
+                    return;
+                }
+                fetch('/api/relay/' + encodeURIComponent(code)).then(response => {
+                    if (!response.ok) {
+                        throw new Error(response.status === 404 ? 'NO RELAY OPEN WITH CODE ' + code : response.statusText);
+                    }
+                    return response.json();
+                }).then(relay => {
+                    const link = document.createElement('a');
+                    link.href = '/r/' + encodeURIComponent(relay.code);
+                    link.download = relay.name;
+                    document.body.appendChild(link);
+                    link.click();
+                    link.remove();
+                    input.value = '';
+                    addConsoleMessage('RECEIVING RELAY: ' + relay.name + ' (' + formatBytes(relay.size) + ')');
+                }).catch(err => {
+                    addConsoleMessage('RELAY UNAVAILABLE: ' + err.message);
+                });
+            }
+            
+            // An image pasted anywhere on the page, such as a screenshot, is
+            // uploaded as a file under a name of its own, since browsers call
+            // every clipboard image "image.png". Text pastes are left alone.
+            const PASTED_IMAGE_TYPES = { 'image/png': 'png', 'image/jpeg': 'jpg', 'image/gif': 'gif', 'image/webp': 'webp' };
+            document.addEventListener('paste', e => {
+                const images = [...e.clipboardData.files].filter(f => PASTED_IMAGE_TYPES[f.type]);
+                if (!images.length) {
+                    return;
+                }
+                e.preventDefault();
+                const stamp = new Date().toISOString().replace(/[-:]/g, '').replace(/\..*$/, '');
+                addConsoleMessage(images.length + ' IMAGE(S) PASTED FOR TRANSFER');
+                images.forEach((image, i) => {
+                    const suffix = images.length > 1 ? '-' + (i + 1) : '';
+                    uploadFile(new File([image], 'pasted-' + stamp + suffix + '.' + PASTED_IMAGE_TYPES[image.type], { type: image.type }));
+                });
+            });
+            
+            // Text in the paste panel is stored as a snippet, which gets a
+            // short link of its own
+            function submitPaste() {
+                const pasteText = document.getElementById('pasteText');
+                const pasteSubmit = document.getElementById('pasteSubmit');
+                const pasteResult = document.getElementById('pasteResult');
+                if (!pasteText.value.trim()) {
+                    addConsoleMessage('NO TEXT TO TRANSMIT');
+                    return;
+                }
+                pasteSubmit.disabled = true;
+                fetch('/api/paste', {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify({
+                        content: pasteText.value,
+                        language: document.getElementById('pasteLanguage').value,
+                        ttl: document.getElementById('pasteTtl').value
+                    })
+                }).then(response => {
+                    if (!response.ok) {
+                        return response.text().then(text => { throw new Error(text.trim() || response.statusText); });
+                    }
+                    return response.json();
+                }).then(snippet => {
+                    pasteResult.textContent = '';
+                    const link = document.createElement('a');
+                    link.href = snippet.url;
+                    link.target = '_blank';
+                    link.textContent = snippet.url;
+                    pasteResult.appendChild(link);
+                    const copy = document.createElement('button');
+                    copy.className = 'btn btn-small';
+                    copy.textContent = 'COPY';
+                    copy.addEventListener('click', () => {
+                        navigator.clipboard.writeText(snippet.url).then(() => addConsoleMessage('LINK COPIED TO CLIPBOARD'), () => {});
+                    });
+                    pasteResult.appendChild(copy);
+                    pasteText.value = '';
+                    addConsoleMessage('TEXT TRANSMITTED: ' + snippet.path + ' (' + formatBytes(snippet.size) + ')' +
+                        (snippet.expires ? ' - EXPIRES ' + snippet.expires : ''));
+                }).catch(err => {
+                    addConsoleMessage('TEXT TRANSMISSION FAILED: ' + err.message);
+                }).finally(() => {
+                    pasteSubmit.disabled = false;
+                });
+            }
+            
+            if (!CONFIG.dropBox) {
+                document.getElementById('pasteSubmit').addEventListener('click', submitPaste);
+                document.getElementById('pasteText').addEventListener('keydown', e => {
+                    if (e.key === 'Enter' && (e.ctrlKey || e.metaKey)) {
+                        e.preventDefault();
+                        submitPaste();
+                    }
+                });
+            }
+            
+            // Create the entry for a file being transferred in the list
+            function addFileItem(file) {
                 const fileItem = document.createElement('div');
                 fileItem.className = 'file-item';
                 
@@ -721,44 +1360,791 @@ const htmlTemplate = `<!DOCTYPE html>
                 fileItem.appendChild(fileInfo);
                 fileItem.appendChild(statusElement);
                 fileList.appendChild(fileItem);
+                return { fileItem, fileInfo, fileName, progressBar, statusElement };
+            }
+            
+            function uploadFile(file) {
+                addConsoleMessage('UPLOADING: ' + file.name + ' (' + formatBytes(file.size) + ')');
                 
-                // Create FormData and upload the file
-                const formData = new FormData();
-                formData.append('file', file);
-                
-                const xhr = new XMLHttpRequest();
+                const { fileItem, fileInfo, fileName, progressBar, statusElement } = addFileItem(file);
                 
-                // Update progress bar
-                xhr.upload.addEventListener('progress', (e) => {
-                    if (e.lengthComputable) {
-                        const percentComplete = (e.loaded / e.total) * 100;
-                        progressBar.style.width = percentComplete + '%';
-                    }
+                // Sealed uploads are encrypted here before anything is sent,
+                // so the server only ever holds ciphertext
+                const sealing = e2eToggle.checked ? e2eEncrypt(file, fraction => {
+                    statusElement.textContent = 'SEALING ' + Math.round(fraction * 100) + '%';
+                }) : Promise.resolve(null);
+                sealing.then(send, err => {
+                    statusElement.textContent = 'ERROR';
+                    statusElement.className = 'status error';
+                    addConsoleMessage('SEALING FAILURE: ' + file.name + ' - ' + err.message);
                 });
                 
-                // Handle response
-                xhr.onload = function() {
-                    if (xhr.status === 200) {
-                        statusElement.textContent = 'COMPLETE';
-                        statusElement.className = 'status success';
-                        addConsoleMessage('TRANSFER COMPLETE: ' + file.name);
+                function send(sealed) {
+                    // Create FormData and upload the file
+                    const formData = new FormData();
+                    if (sealed) {
+                        formData.append('file', sealed.blob, sealed.name);
+                        statusElement.textContent = 'PROCESSING';
                     } else {
+                        formData.append('file', file);
+                    }
+                    if (!CONFIG.dropBox && ttlSelect.value) {
+                        formData.append('ttl', ttlSelect.value);
+                    }
+                    if (!CONFIG.dropBox && unpackToggle.checked) {
+                        formData.append('extract', 'true');
+                    }
+                    if (!CONFIG.dropBox && tagsInput.value.trim()) {
+                        formData.append('tags', tagsInput.value);
+                    }
+                
+                    const xhr = new XMLHttpRequest();
+                
+                    // Update progress bar
+                    xhr.upload.addEventListener('progress', (e) => {
+                        if (e.lengthComputable) {
+                            const percentComplete = (e.loaded / e.total) * 100;
+                            progressBar.style.width = percentComplete + '%';
+                        }
+                    });
+                
+                    // Handle response
+                    xhr.onload = function() {
+                        if (xhr.status === 200 || xhr.status === 201) {
+                            // A 201 carries the manifest of an unpacked archive,
+                            // which is then listed as the folder it went into
+                            const manifest = xhr.status === 201 ? JSON.parse(xhr.responseText) : null;
+                            statusElement.textContent = manifest ? 'UNPACKED' : 'COMPLETE';
+                            statusElement.className = 'status success';
+                            addConsoleMessage('TRANSFER COMPLETE: ' + file.name);
+                            if (xhr.getResponseHeader('X-Nostromo-Deduplicated')) {
+                                addConsoleMessage('CONTENT ALREADY IN DATABASE. LINKED: ' + file.name);
+                            }
+                            if (manifest) {
+                                addConsoleMessage('ARCHIVE UNPACKED: ' + manifest.files.length + ' FILES TO ' + manifest.directory + '/');
+                                (manifest.skipped || []).forEach(entry => {
+                                    addConsoleMessage('SKIPPED ' + entry.name + ': ' + entry.reason.toUpperCase());
+                                });
+                            }
+                            if (sealed) {
+                                addSealedLink(fileInfo, xhr.getResponseHeader('X-Nostromo-Stored') || sealed.name, sealed.key);
+                            }
+                            if (CONFIG.dropBox) {
+                                return;
+                            }
+
+                            let storedName = manifest ? manifest.directory : xhr.getResponseHeader('X-Nostromo-Stored') || file.name;
+                            if (manifest) {
+                                fileName.textContent = manifest.directory + '/';
+                            }
+                            fileItem.dataset.path = storedName;
+                            const selectBox = document.createElement('input');
+                            selectBox.type = 'checkbox';
+                            selectBox.className = 'file-select';
+                            selectBox.title = 'SELECT FOR ARCHIVE DOWNLOAD';
+                            selectBox.addEventListener('change', updateSelection);
+                            fileItem.insertBefore(selectBox, fileInfo);
+                        
+                            if (!manifest && !sealed) {
+                                addThumbnail(fileItem, fileInfo, () => storedName);
+                                const viewButton = document.createElement('button');
+                                viewButton.className = 'btn btn-small';
+                                viewButton.textContent = 'VIEW';
+                                viewButton.addEventListener('click', () => openPreview(storedName));
+                                fileItem.appendChild(viewButton);
+                            
+                                const shareButton = document.createElement('button');
+                                shareButton.className = 'btn btn-small';
+                                shareButton.textContent = 'SHARE';
+                                shareButton.addEventListener('click', () => toggleSharePanel(fileInfo, storedName));
+                                fileItem.appendChild(shareButton);
+                            }
+                            if (CONFIG.fileOps) {
+                                addFileControls(fileItem, fileName, statusElement, () => storedName, name => {
+                                    storedName = name;
+                                    fileItem.dataset.path = name;
+                                });
+                            }
+                            if (!manifest) {
+                                const infoButton = document.createElement('button');
+                                infoButton.className = 'btn btn-small';
+                                infoButton.textContent = 'INFO';
+                                infoButton.addEventListener('click', () => toggleInfoPanel(fileInfo, storedName));
+                                fileItem.insertBefore(infoButton, fileItem.querySelector('.btn'));
+                            }
+                        } else {
+                            statusElement.textContent = xhr.status === 413 || xhr.status === 415 || xhr.status === 422 || xhr.status === 507 ? 'DENIED' : 'ERROR';
+
+                            statusElement.className = 'status error';
+                            addConsoleMessage('ERROR UPLOADING: ' + file.name + ' - ' + (xhr.responseText.trim() || xhr.statusText));
+                        }
+                    };
+                
+                    xhr.onerror = function() {
                         statusElement.textContent = 'ERROR';
 
                         statusElement.className = 'status error';
-                        addConsoleMessage('ERROR UPLOADING: ' + file.name + ' - ' + xhr.statusText);
+                        addConsoleMessage('CONNECTION FAILURE: ' + file.name);
+                    };
+                
+                    xhr.open('POST', CONFIG.uploadUrl, true);
+                    xhr.send(formData);
+                }
+            }
+            
+            // Query the search index as the user types
+            const searchInput = document.getElementById('searchInput');
+            const searchResults = document.getElementById('searchResults');
+            let searchTimer = null;
+            if (searchInput) {
+                searchInput.addEventListener('input', () => {
+                    clearTimeout(searchTimer);
+                    searchTimer = setTimeout(runSearch, 300);
+                });
+            }
+            
+            function runSearch() {
+                const query = searchInput.value.trim();
+                searchResults.textContent = '';
+                if (!query) {
+                    return;
+                }
+                fetch('/api/search?q=' + encodeURIComponent(query)).then(response => {
+                    if (!response.ok) {
+                        return response.text().then(text => { throw new Error(text.trim() || response.statusText); });
+                    }
+                    return response.json();
+                }).then(reply => {
+                    if (searchInput.value.trim() !== query) {
+                        return;
                     }
-                };
+                    if (reply.results.length === 0) {
+                        searchResults.textContent = 'NO RECORDS MATCH "' + query.toUpperCase() + '"';
+                        return;
+                    }
+                    reply.results.forEach(result => {
+                        const row = document.createElement('div');
+                        row.className = 'search-result';
+                        const link = document.createElement('a');
+                        link.href = '/dav/' + result.path.split('/').map(encodeURIComponent).join('/');
+                        link.textContent = result.path;
+                        link.setAttribute('download', '');
+                        row.appendChild(link);
+                        const view = document.createElement('button');
+                        view.className = 'btn btn-small';
+                        view.textContent = 'VIEW';
+                        view.addEventListener('click', () => openPreview(result.path));
+                        row.appendChild(document.createTextNode(' '));
+                        row.appendChild(view);
+                        row.appendChild(document.createTextNode(' [' + formatBytes(result.size) + '] MATCHED: ' + result.matched.join(', ').toUpperCase()));
+                        if (result.tags && result.tags.length) {
+                            row.appendChild(document.createTextNode(' TAGS: ' + result.tags.join(', ')));
+                        }
+                        const detail = result.excerpt || result.notes;
+                        if (detail) {
+                            const text = document.createElement('div');
+                            text.className = 'search-excerpt';
+                            text.textContent = detail;
+                            row.appendChild(text);
+                        }
+                        searchResults.appendChild(row);
+                    });
+                    if (reply.total > reply.results.length) {
+                        searchResults.appendChild(document.createTextNode(reply.total - reply.results.length + ' MORE RECORDS NOT SHOWN'));
+                    }
+                }).catch(err => {
+                    searchResults.textContent = 'QUERY FAILED: ' + err.message;
+                });
+            }
+            
+            // Show the archive download bar while any uploaded files are
+            // selected
+            function updateSelection() {
+                const count = fileList.querySelectorAll('.file-select:checked').length;
+                document.getElementById('selectionBar').hidden = count === 0;
+                document.getElementById('selectionCount').textContent = count + ' FILE(S) SELECTED';
+            }
+            
+            document.getElementById('downloadSelection').addEventListener('click', () => {
+                const params = new URLSearchParams();
+                fileList.querySelectorAll('.file-select:checked').forEach(box => {
+                    params.append('path', box.closest('.file-item').dataset.path);
+                });
+                params.set('format', document.getElementById('archiveFormat').value);
+                addConsoleMessage('PACKAGING ' + params.getAll('path').length + ' FILE(S) FOR RETRIEVAL');
+                window.location.href = '/api/archive?' + params.toString();
+            });
+            
+            // Show the share controls for a stored file, or hide them again
+            function toggleSharePanel(container, path) {
+                const existing = container.querySelector('.share-panel');
+                if (existing) {
+                    existing.remove();
+                    return;
+                }
                 
-                xhr.onerror = function() {
-                    statusElement.textContent = 'ERROR';
-
-                    statusElement.className = 'status error';
-                    addConsoleMessage('CONNECTION FAILURE: ' + file.name);
-                };
+                const panel = document.createElement('div');
+                panel.className = 'share-panel';
+                panel.innerHTML =
+                    'EXPIRES: <select class="share-expiry">' +
+                    '<option value="1h">1 HOUR</option>' +
+                    '<option value="24h" selected>24 HOURS</option>' +
+                    '<option value="7d">7 DAYS</option>' +
+                    '</select> ' +
+                    'MAX DOWNLOADS: <input class="share-max" type="number" min="0" value="0"> ' +
+                    'ACCESS CODE: <input class="share-password" type="password" placeholder="OPTIONAL">';
+                
+                const generate = document.createElement('button');
+                generate.className = 'btn btn-small';
+                generate.textContent = 'GENERATE LINK';
+                panel.appendChild(generate);
+                
+                const result = document.createElement('div');
+                result.className = 'share-result';
+                panel.appendChild(result);
+                container.appendChild(panel);
+                
+                generate.addEventListener('click', () => {
+                    const request = {
+                        path: path,
+                        expires_in: panel.querySelector('.share-expiry').value,
+                        max_downloads: parseInt(panel.querySelector('.share-max').value, 10) || 0,
+                        password: panel.querySelector('.share-password').value
+                    };
+                    fetch('/api/shares', {
+                        method: 'POST',
+                        headers: { 'Content-Type': 'application/json' },
+                        body: JSON.stringify(request)
+                    }).then(response => {
+                        if (!response.ok) {
+                            return response.text().then(text => { throw new Error(text.trim() || response.statusText); });
+                        }
+                        return response.json();
+                    }).then(link => {
+                        result.textContent = link.url + ' ';
+                        const revoke = document.createElement('button');
+                        revoke.className = 'btn btn-small';
+                        revoke.textContent = 'REVOKE';
+                        revoke.addEventListener('click', () => {
+                            fetch('/api/shares/' + encodeURIComponent(link.id), { method: 'DELETE' }).then(response => {
+                                if (response.ok) {
+                                    result.textContent = 'LINK REVOKED';
+                                    addConsoleMessage('SHARE LINK REVOKED: ' + path);
+                                } else {
+                                    addConsoleMessage('REVOKE FAILED: ' + path + ' - ' + response.statusText);
+                                }
+                            });
+                        });
+                        result.appendChild(revoke);
+                        addConsoleMessage('SHARE LINK ISSUED: ' + path + ' - EXPIRES ' + link.expires);
+                        if (navigator.clipboard) {
+                            navigator.clipboard.writeText(link.url).then(() => addConsoleMessage('LINK COPIED TO CLIPBOARD'), () => {});
+                        }
+                    }).catch(err => {
+                        addConsoleMessage('SHARE FAILED: ' + path + ' - ' + err.message);
+                    });
+                });
+            }
+            
+            // Show what the server recorded about an upload, with its tags
+            // and notes editable unless file management is off
+            function toggleInfoPanel(container, path) {
+                const existing = container.querySelector('.info-panel');
+                if (existing) {
+                    existing.remove();
+                    return;
+                }
+                
+                const panel = document.createElement('div');
+                panel.className = 'info-panel';
+                panel.textContent = 'RETRIEVING RECORD...';
+                container.appendChild(panel);
+                
+                fileRequest('GET', path).then(info => {
+                    const meta = info.metadata || {};
+                    const rows = [
+                        ['UPLOADED', meta.uploaded ? new Date(meta.uploaded).toLocaleString() : 'UNKNOWN'],
+                        ['BY', meta.uploader || 'UNIDENTIFIED'],
+                        ['FROM', meta.client_ip || 'UNKNOWN'],
+                        ['VIA', (meta.via || 'unknown').toUpperCase() + (meta.drop_box ? ' (DROP BOX)' : '')],
+                        ['CLIENT', meta.user_agent || '-'],
+                        ['ORIGINAL NAME', meta.original_name || '-'],
+                        ['SIZE', formatBytes(info.size)],
+                        ['SHA-256', meta.sha256 || '-']
+                    ];
+                    panel.textContent = '';
+                    const list = document.createElement('dl');
+                    rows.forEach(([label, value]) => {
+                        const dt = document.createElement('dt');
+                        dt.textContent = label;
+                        const dd = document.createElement('dd');
+                        dd.textContent = value;
+                        list.appendChild(dt);
+                        list.appendChild(dd);
+                    });
+                    panel.appendChild(list);
+                    if (!CONFIG.fileOps) {
+                        return;
+                    }
+                    
+                    const tags = document.createElement('input');
+                    tags.type = 'text';
+                    tags.placeholder = 'TAGS, COMMA SEPARATED';
+                    tags.value = (meta.tags || []).join(', ');
+                    const notes = document.createElement('textarea');
+                    notes.rows = 3;
+                    notes.placeholder = 'NOTES';
+                    notes.value = meta.notes || '';
+                    const save = document.createElement('button');
+                    save.className = 'btn btn-small';
+                    save.textContent = 'UPDATE RECORD';
+                    panel.appendChild(tags);
+                    panel.appendChild(notes);
+                    panel.appendChild(save);
+                    
+                    save.addEventListener('click', () => {
+                        fileRequest('PATCH', path, { tags: tags.value.split(','), notes: notes.value }).then(() => {
+                            addConsoleMessage('RECORD UPDATED: ' + path);
+                        }).catch(err => {
+                            addConsoleMessage('UPDATE FAILED: ' + path + ' - ' + err.message);
+                        });
+                    });
+                }).catch(err => {
+                    panel.textContent = 'RECORD UNAVAILABLE: ' + err.message;
+                });
+            }
+            
+            // Ask for confirmation in the style of a MU/TH/UR override. With a
+            // default value the operator can edit it; resolves to the entered
+            // value, true, or null when aborted.
+            function override(message, value) {
+                const dialog = document.getElementById('override');
+                const input = document.getElementById('overrideInput');
+                const confirm = document.getElementById('overrideConfirm');
+                const cancel = document.getElementById('overrideCancel');
+                document.getElementById('overrideMessage').textContent = message;
+                input.hidden = value === undefined;
+                input.value = value || '';
+                dialog.hidden = false;
+                (input.hidden ? confirm : input).focus();
+                
+                return new Promise(resolve => {
+                    function close(result) {
+                        dialog.hidden = true;
+                        confirm.removeEventListener('click', onConfirm);
+                        cancel.removeEventListener('click', onCancel);
+                        input.removeEventListener('keydown', onKey);
+                        resolve(result);
+                    }
+                    function onConfirm() { close(input.hidden ? true : input.value.trim() || null); }
+                    function onCancel() { close(null); }
+                    function onKey(e) {
+                        if (e.key === 'Enter') onConfirm();
+                        if (e.key === 'Escape') onCancel();
+                    }
+                    confirm.addEventListener('click', onConfirm);
+                    cancel.addEventListener('click', onCancel);
+                    input.addEventListener('keydown', onKey);
+                });
+            }
+            
+            // Each open tab registers for pushed files over an event stream
+            // and shows the code senders address it by. Offers are asked
+            // about one at a time.
+            let receiver = null;
+            const incomingOffers = [];
+            
+            function connectReceiver() {
+                const code = document.getElementById('receiverCode');
+                const events = new EventSource('/api/sessions/events');
+                events.addEventListener('session', e => {
+                    const first = !receiver;
+                    receiver = JSON.parse(e.data);
+                    code.textContent = receiver.code;
+                    if (first) {
+                        addConsoleMessage('RECEIVER CODE ' + receiver.code + ' ACTIVE. FILES CAN BE PUSHED TO THIS TERMINAL.');
+                    }
+                });
+                events.addEventListener('offer', e => {
+                    incomingOffers.push(JSON.parse(e.data));
+                    addConsoleMessage('INCOMING TRANSMISSION: ' + incomingOffers[incomingOffers.length - 1].name);
+                    if (incomingOffers.length === 1) {
+                        showOffer();
+                    }
+                });
+                events.addEventListener('error', () => {
+                    code.textContent = 'OFFLINE';
+                });
+            }
+            
+            function showOffer() {
+                const offer = incomingOffers[0];
+                const dialog = document.getElementById('incoming');
+                const accept = document.getElementById('incomingAccept');
+                const decline = document.getElementById('incomingDecline');
+                document.getElementById('incomingMessage').textContent =
+                    offer.name + ' (' + formatBytes(offer.size) + ') FROM ' + offer.from + '. ACCEPT TRANSFER?';
+                dialog.hidden = false;
+                accept.focus();
+                
+                function answer(accepted) {
+                    dialog.hidden = true;
+                    accept.removeEventListener('click', onAccept);
+                    decline.removeEventListener('click', onDecline);
+                    fetch('/api/sessions/' + encodeURIComponent(receiver.code) + '/offers/' + encodeURIComponent(offer.id), {
+                        method: 'POST',
+                        headers: { 'Content-Type': 'application/json', 'X-Nostromo-Session-Token': receiver.token },
+                        body: JSON.stringify({ accept: accepted })
+                    }).then(response => {
+                        if (!response.ok) {
+                            return response.text().then(text => { throw new Error(text.trim() || response.statusText); });
+                        }
+                        if (accepted) {
+                            const link = document.createElement('a');
+                            link.href = '/dav/' + encodePath(offer.path);
+                            link.download = offer.name;
+                            document.body.appendChild(link);
+                            link.click();
+                            link.remove();
+                        }
+                        addConsoleMessage((accepted ? 'TRANSMISSION ACCEPTED: ' : 'TRANSMISSION DECLINED: ') + offer.name);
+                    }).catch(err => {
+                        addConsoleMessage('TRANSMISSION FAILED: ' + offer.name + ' - ' + err.message);
+                    });
+                    incomingOffers.shift();
+                    if (incomingOffers.length) {
+                        showOffer();
+                    }
+                }
+                function onAccept() { answer(true); }
+                function onDecline() { answer(false); }
+                accept.addEventListener('click', onAccept);
+                decline.addEventListener('click', onDecline);
+            }
+            
+            if (!CONFIG.dropBox && window.EventSource) {
+                connectReceiver();
+            }
+            
+            // How each kind of file is shown in the preview window, by
+            // extension. Anything else is fetched and shown as text, if
+            // the server finds it is text.
+            const PREVIEW_KINDS = {
+                image: ['jpg', 'jpeg', 'png', 'gif', 'webp'],
+                audio: ['mp3', 'ogg', 'oga', 'opus', 'wav', 'flac', 'm4a'],
+                video: ['mp4', 'm4v', 'webm', 'ogv', 'mov'],
+                pdf: ['pdf']
+            };
+            const PREVIEW_TEXT_LIMIT = 256 * 1024;
+            
+            function fileExtension(path) {
+                const base = path.split('/').pop();
+                const dot = base.lastIndexOf('.');
+                return dot > 0 ? base.slice(dot + 1).toLowerCase() : '';
+            }
+            
+            function previewKind(path) {
+                const ext = fileExtension(path);
+                return Object.keys(PREVIEW_KINDS).find(kind => PREVIEW_KINDS[kind].includes(ext)) || 'text';
+            }
+            
+            function encodePath(path) {
+                return path.split('/').map(encodeURIComponent).join('/');
+            }
+            
+            // Sealed uploads use the format described in e2e.go: a header,
+            // the file's name, type and size sealed with AES-256-GCM, then
+            // the content in 64 KB chunks, each sealed under a nonce made
+            // of its index and a flag marking the last one
+            const E2E_CHUNK_LOG2 = 16;
+            const E2E_CHUNK = 1 << E2E_CHUNK_LOG2;
+            
+            function e2eNonce(index, final) {
+                const nonce = new Uint8Array(12);
+                new DataView(nonce.buffer).setBigUint64(3, BigInt(index));
+                nonce[11] = final ? 1 : 0;
+                return nonce;
+            }
+            
+            function base64url(bytes) {
+                return btoa(String.fromCharCode(...bytes)).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+            }
+            
+            // Encrypt a file under a new random key. The result is uploaded
+            // under a random name, so the server learns neither the name
+            // nor the content.
+            async function e2eEncrypt(file, onProgress) {
+                const rawKey = crypto.getRandomValues(new Uint8Array(32));
+                const key = await crypto.subtle.importKey('raw', rawKey, 'AES-GCM', false, ['encrypt']);
+                const header = new Uint8Array(14);
+                header.set(new TextEncoder().encode('NSTRME2E'));
+                header[8] = 1;
+                header[9] = E2E_CHUNK_LOG2;
+                const meta = new TextEncoder().encode(JSON.stringify({ name: file.name, type: file.type, size: file.size }));
+                const metaNonce = new Uint8Array(12);
+                metaNonce[0] = 1;
+                const sealedMeta = await crypto.subtle.encrypt({ name: 'AES-GCM', iv: metaNonce, additionalData: header.subarray(0, 10) }, key, meta);
+                new DataView(header.buffer).setUint32(10, sealedMeta.byteLength);
+                
+                const parts = [header, sealedMeta];
+                const chunks = Math.max(1, Math.ceil(file.size / E2E_CHUNK));
+                for (let i = 0; i < chunks; i++) {
+                    const plain = await file.slice(i * E2E_CHUNK, (i + 1) * E2E_CHUNK).arrayBuffer();
+                    parts.push(await crypto.subtle.encrypt({ name: 'AES-GCM', iv: e2eNonce(i, i === chunks - 1) }, key, plain));
+                    onProgress((i + 1) / chunks);
+                }
+                const id = Array.from(crypto.getRandomValues(new Uint8Array(8)), b => b.toString(16).padStart(2, '0')).join('');
+                return { blob: new Blob(parts, { type: 'application/octet-stream' }), name: id + '.nenc', key: base64url(rawKey) };
+            }
+            
+            // Show the download link of a sealed upload. The key is in the
+            // fragment, which the browser never sends to the server.
+            function addSealedLink(container, path, key) {
+                const link = location.origin + '/e2e#file=' + encodeURIComponent(path) + '&key=' + key;
+                addLinkRow(container, 'SEALED LINK:', link, 'SEALED LINK COPIED. ANYONE WITH IT CAN DECRYPT.');
+                addConsoleMessage('TRANSMISSION SEALED. KEY NOT HELD BY MU/TH/UR.');
+            }
+            
+            // Show a link to hand on, with a button to copy it
+            function addLinkRow(container, label, link, copiedMessage) {
+                const row = document.createElement('div');
+                row.className = 'sealed-link';
+                row.appendChild(document.createTextNode(label));
+                const input = document.createElement('input');
+                input.readOnly = true;
+                input.value = link;
+                input.addEventListener('focus', () => input.select());
+                row.appendChild(input);
+                const copy = document.createElement('button');
+                copy.className = 'btn btn-small';
+                copy.textContent = 'COPY';
+                copy.addEventListener('click', () => {
+                    navigator.clipboard.writeText(link).then(() => addConsoleMessage(copiedMessage));
+                });
+                row.appendChild(copy);
+                container.appendChild(row);
+                return row;
+            }
+            
+            // Add a thumbnail of an uploaded image to its file entry. Files
+            // the server cannot make a thumbnail of simply get none.
+            function addThumbnail(fileItem, before, getName) {
+                if (previewKind(getName()) !== 'image') {
+                    return;
+                }
+                const thumb = document.createElement('img');
+                thumb.className = 'thumb';
+                thumb.alt = '';
+                thumb.title = 'VIEW';
+                thumb.addEventListener('error', () => thumb.remove());
+                thumb.addEventListener('click', () => openPreview(getName()));
+                thumb.src = '/api/thumbs/' + encodePath(getName());
+                fileItem.insertBefore(thumb, before);
+            }
+            
+            const previewWindow = document.getElementById('preview');
+            const previewBody = document.getElementById('previewBody');
+            
+            // Show a stored file in the preview window. Everything is
+            // loaded from /api/preview, which serves files so that they
+            // cannot run script in this page.
+            function openPreview(path) {
+                const url = '/api/preview/' + encodePath(path);
+                document.getElementById('previewTitle').textContent = 'VIEWING: ' + path;
+                previewBody.textContent = '';
+                previewWindow.hidden = false;
+                addConsoleMessage('ACCESSING RECORD: ' + path);
                 
-                xhr.open('POST', '/upload', true);
-                xhr.send(formData);
+                const kind = previewKind(path);
+                if (kind === 'image') {
+                    const img = document.createElement('img');
+                    img.src = url;
+                    img.alt = path;
+                    previewBody.appendChild(img);
+                } else if (kind === 'audio' || kind === 'video') {
+                    const media = document.createElement(kind);
+                    media.controls = true;
+                    media.src = url;
+                    media.addEventListener('error', () => {
+                        previewBody.textContent = 'SIGNAL CANNOT BE DECODED BY THIS TERMINAL';
+                    });
+                    previewBody.appendChild(media);
+                } else if (kind === 'pdf') {
+                    const frame = document.createElement('iframe');
+                    frame.src = url;
+                    frame.title = path;
+                    previewBody.appendChild(frame);
+                } else {
+                    previewText(url, path);
+                }
+            }
+            
+            function previewText(url, path) {
+                previewBody.textContent = 'RETRIEVING...';
+                fetch(url, { headers: { Range: 'bytes=0-' + (PREVIEW_TEXT_LIMIT - 1) } }).then(response => {
+                    if (response.status === 415) {
+                        throw new Error('NO PREVIEW AVAILABLE FOR THIS FILE TYPE');
+                    }
+                    if (!response.ok) {
+                        return response.text().then(text => { throw new Error(text.trim() || response.statusText); });
+                    }
+                    const range = response.headers.get('Content-Range');
+                    const total = range ? parseInt(range.split('/')[1], 10) : 0;
+                    return response.text().then(text => ({ text: text, truncated: total > PREVIEW_TEXT_LIMIT, total: total }));
+                }).then(result => {
+                    if (previewWindow.hidden) {
+                        return;
+                    }
+                    previewBody.textContent = '';
+                    const pre = document.createElement('pre');
+                    highlight(pre, result.text, fileExtension(path));
+                    previewBody.appendChild(pre);
+                    if (result.truncated) {
+                        previewBody.appendChild(document.createTextNode('SHOWING FIRST ' + formatBytes(PREVIEW_TEXT_LIMIT) + ' OF ' + formatBytes(result.total)));
+                    }
+                }).catch(err => {
+                    previewBody.textContent = err.message.toUpperCase();
+                });
+            }
+            
+            function closePreview() {
+                // Emptying the window also stops any audio or video
+                previewWindow.hidden = true;
+                previewBody.textContent = '';
+            }
+            
+            document.getElementById('previewClose').addEventListener('click', closePreview);
+            previewWindow.addEventListener('click', e => {
+                if (e.target === previewWindow) closePreview();
+            });
+            document.addEventListener('keydown', e => {
+                if (e.key === 'Escape' && !previewWindow.hidden) closePreview();
+            });
+            
+            // Languages whose comments start with # rather than //
+            const HASH_COMMENTS = ['py', 'sh', 'bash', 'zsh', 'rb', 'pl', 'r', 'yml', 'yaml', 'toml', 'conf', 'ini', 'cfg', 'mk', 'dockerfile', 'tf'];
+            const CODE_EXTENSIONS = HASH_COMMENTS.concat(['go', 'js', 'mjs', 'ts', 'tsx', 'jsx', 'json', 'c', 'h', 'cc', 'cpp', 'hpp', 'cs', 'java', 'kt', 'swift', 'rs', 'php', 'css', 'scss', 'html', 'htm', 'xml', 'svg', 'sql', 'lua', 'dart', 'scala', 'proto']);
+            const KEYWORDS = new Set(('as async await break case catch class const continue def default defer del do elif else enum export extends ' +
+                'false final finally fn for from func function go if impl import in interface is lambda let loop match mod mut new nil None ' +
+                'not null package pass private protected pub public raise return select self static struct super switch this throw ' +
+                'true True False try type typeof use var void while with yield').split(' '));
+            
+            // Colour comments, strings, numbers and keywords in source code.
+            // This is a rough lexer that knows no particular language, which
+            // is enough to make code readable at a glance.
+            function highlight(pre, text, ext) {
+                if (!CODE_EXTENSIONS.includes(ext)) {
+                    pre.textContent = text;
+                    return;
+                }
+                const comment = HASH_COMMENTS.includes(ext) ? '#[^\\n]*' : '\\/\\*[\\s\\S]*?\\*\\/|\\/\\/[^\\n]*|<!--[\\s\\S]*?-->';
+                const lexer = new RegExp('(' + comment + ')' +
+                    '|("(?:[^"\\\\\\n]|\\\\.)*"|\'(?:[^\'\\\\\\n]|\\\\.)*\'|\\x60(?:[^\\x60\\\\]|\\\\.)*\\x60)' +
+                    '|(\\b(?:0x[0-9a-fA-F]+|\\d[\\d_]*(?:\\.\\d+)?(?:[eE][+-]?\\d+)?)\\b)' +
+                    '|([A-Za-z_]\\w*)', 'g');
+                const classes = ['tok-comment', 'tok-string', 'tok-number', 'tok-keyword'];
+                let last = 0;
+                let match;
+                while ((match = lexer.exec(text)) !== null) {
+                    const group = match.slice(1).findIndex(part => part !== undefined);
+                    if (group === 3 && !KEYWORDS.has(match[0])) {
+                        continue;
+                    }
+                    pre.appendChild(document.createTextNode(text.slice(last, match.index)));
+                    const span = document.createElement('span');
+                    span.className = classes[group];
+                    span.textContent = match[0];
+                    pre.appendChild(span);
+                    last = lexer.lastIndex;
+                }
+                pre.appendChild(document.createTextNode(text.slice(last)));
+            }
+            
+            // Send a request to /api/files and return the parsed reply,
+            // throwing the server's message when it is refused
+            function fileRequest(method, path, body) {
+                const options = { method: method };
+                if (body) {
+                    options.headers = { 'Content-Type': 'application/json' };
+                    options.body = JSON.stringify(body);
+                }
+                return fetch('/api/files/' + path.split('/').map(encodeURIComponent).join('/'), options).then(response => {
+                    if (!response.ok) {
+                        return response.text().then(text => { throw new Error(text.trim() || response.statusText); });
+                    }
+                    return response.json();
+                });
+            }
+            
+            // Add rename and delete controls to an uploaded file. getName and
+            // setName track where the file currently lives on the server.
+            function addFileControls(fileItem, fileName, statusElement, getName, setName) {
+                const renameButton = document.createElement('button');
+                renameButton.className = 'btn btn-small';
+                renameButton.textContent = 'RENAME';
+                fileItem.appendChild(renameButton);
+                
+                const deleteButton = document.createElement('button');
+                deleteButton.className = 'btn btn-small';
+                deleteButton.textContent = 'DELETE';
+                fileItem.appendChild(deleteButton);
+                
+                renameButton.addEventListener('click', () => {
+                    const from = getName();
+                    override('ENTER NEW DESIGNATION FOR ' + from + ':', from).then(to => {
+                        if (!to || to === from) {
+                            return;
+                        }
+                        return fileRequest('PATCH', from, { to: to }).then(result => {
+                            setName(result.path);
+                            fileName.textContent = result.path;
+                            addConsoleMessage('FILE REDESIGNATED: ' + from + ' -> ' + result.path);
+                        });
+                    }).catch(err => addConsoleMessage('RENAME FAILED: ' + from + ' - ' + err.message));
+                });
+                
+                deleteButton.addEventListener('click', () => {
+                    const name = getName();
+                    const message = CONFIG.trash ?
+                        'CONFIRM TRANSFER OF ' + name + ' TO TRASH.' :
+                        'CONFIRM PERMANENT PURGE OF ' + name + '. THIS CANNOT BE UNDONE.';
+                    override(message).then(confirmed => {
+                        if (!confirmed) {
+                            return;
+                        }
+                        return fileRequest('DELETE', name).then(result => {
+                            const buttons = [...fileItem.querySelectorAll('button, .file-select')];
+                            buttons.forEach(button => { button.hidden = true; });
+                            fileItem.querySelector('.file-select').checked = false;
+                            updateSelection();
+                            const panel = fileItem.querySelector('.share-panel');
+                            if (panel) {
+                                panel.remove();
+                            }
+                            statusElement.className = 'status error';
+                            if (!result.trash) {
+                                statusElement.textContent = 'PURGED';
+                                addConsoleMessage('FILE PURGED: ' + name);
+                                return;
+                            }
+                            statusElement.textContent = 'TRASHED';
+                            addConsoleMessage('FILE MOVED TO TRASH: ' + name);
+                            const restoreButton = document.createElement('button');
+                            restoreButton.className = 'btn btn-small';
+                            restoreButton.textContent = 'RESTORE';
+                            restoreButton.addEventListener('click', () => {
+                                fileRequest('PATCH', result.trash, { to: name }).then(() => {
+                                    restoreButton.remove();
+                                    statusElement.textContent = 'RESTORED';
+                                    statusElement.className = 'status success';
+                                    addConsoleMessage('FILE RESTORED: ' + name);
+                                    buttons.forEach(button => { button.hidden = false; });
+                                }).catch(err => addConsoleMessage('RESTORE FAILED: ' + name + ' - ' + err.message));
+                            });
+                            fileItem.appendChild(restoreButton);
+                        });
+                    }).catch(err => addConsoleMessage('DELETE FAILED: ' + name + ' - ' + err.message));
+                });
             }
             
             function formatBytes(bytes) {
@@ -794,81 +2180,276 @@ const htmlTemplate = `<!DOCTYPE html>
 </body>
 </html>`
 
+var uiTemplate = template.Must(template.New("ui").Parse(htmlTemplate))
+
+// uiConfig tells the page script where to send files and which features to
+// offer. Drop box pages get a restricted view with no sharing, retention or
+// file management controls.
+type uiConfig struct {
+	UploadURL string `json:"uploadUrl"`
+	DropBox   string `json:"dropBox,omitempty"`
+	FileOps   bool   `json:"fileOps,omitempty"`
+	Trash     bool   `json:"trash,omitempty"`
+	Relay     bool   `json:"relay,omitempty"`
+}
+
+func renderUI(w http.ResponseWriter, cfg uiConfig) {
+	w.Header().Set("Content-Type", "text/html")
+	if err := uiTemplate.Execute(w, cfg); err != nil {
+		log.Printf("Failed to render page: %v", err)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "janitor" {
+		runJanitorCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "decrypt" {
+		runDecryptCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "push" {
+		runPushCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "relay" {
+		runRelayCommand(os.Args[2:])
+		return
+	}
+
 	// Parse command line flags
 	port := flag.Int("port", 8080, "Port to run the server on")
 	uploadDir := flag.String("dir", ".", "Directory to save uploaded files")
+	var quotaTotal, quotaPerIP, maxFileSize byteSize
+	flag.Var(&quotaTotal, "quota-total", "Maximum total bytes stored across all uploads, e.g. 10GB (0 = unlimited)")
+	flag.Var(&quotaPerIP, "quota-per-ip", "Maximum bytes stored per client IP (0 = unlimited)")
+	flag.Var(&maxFileSize, "max-file-size", "Maximum size of a single uploaded file (0 = unlimited)")
+	maxFiles := flag.Int("max-files", 0, "Maximum number of stored files (0 = unlimited)")
+	maxFilesPerIP := flag.Int("max-files-per-ip", 0, "Maximum number of stored files per client IP (0 = unlimited)")
+	maxAge := flag.Duration("max-age", 0, "Delete uploads older than this, e.g. 72h (0 = keep forever)")
+	var maxTotal byteSize
+	flag.Var(&maxTotal, "max-total", "Evict the oldest uploads once the directory exceeds this size (0 = unlimited)")
+	janitorInterval := flag.Duration("janitor-interval", time.Minute, "How often to check for expired uploads")
+	allowExt := flag.String("allow-ext", "", "Comma-separated file extensions to accept, e.g. .pdf,.png (default: any)")
+	denyExt := flag.String("deny-ext", "", "Comma-separated file extensions to refuse")
+	allowType := flag.String("allow-type", "", "Comma-separated MIME types to accept, judged from file content, e.g. image/*,application/pdf")
+	denyType := flag.String("deny-type", "", "Comma-separated MIME types to refuse, judged from file content")
+	clamdAddr := flag.String("clamd", "", "Scan uploads with clamd at this address, e.g. tcp://127.0.0.1:3310 or unix:///run/clamav/clamd.ctl")
+	clamdTimeout := flag.Duration("clamd-timeout", 2*time.Minute, "Timeout for a single clamd scan")
+	quarantineDir := flag.String("quarantine-dir", "", "Directory for infected uploads (default: .nostromo/quarantine in the upload directory)")
+	onUpload := flag.String("on-upload", "", "Shell command to run after each upload; the file is described in NOSTROMO_* environment variables")
+	hookTimeout := flag.Duration("on-upload-timeout", time.Minute, "Timeout for the --on-upload command")
+	webhookURL := flag.String("webhook", "", "URL to POST a signed JSON event to after each upload")
+	webhookSecret := flag.String("webhook-secret", os.Getenv("NOSTROMO_WEBHOOK_SECRET"), "Secret for the webhook's HMAC-SHA256 signature (default: $NOSTROMO_WEBHOOK_SECRET)")
+	webhookRetries := flag.Int("webhook-retries", 5, "How many times to retry a failed webhook before dead-lettering it")
+	forwardTo := flag.String("forward-to", "", "Relay each upload to another Nostromo instance or drop box URL, e.g. http://10.0.0.5:8080")
+	forwardDelete := flag.Bool("forward-delete", false, "Delete the local copy once --forward-to has confirmed the transfer")
+	var sftp sftpOptions
+	flag.StringVar(&sftp.addr, "sftp", "", "Also serve the upload directory over SFTP on this address, e.g. :2022")
+	flag.StringVar(&sftp.user, "sftp-user", "nostromo", "User name for SFTP logins")
+	flag.StringVar(&sftp.password, "sftp-password", os.Getenv("NOSTROMO_SFTP_PASSWORD"), "Password for SFTP logins (default: $NOSTROMO_SFTP_PASSWORD)")
+	flag.StringVar(&sftp.authorizedKeys, "sftp-authorized-keys", "", "authorized_keys file with public keys allowed to log in over SFTP")
+	fileOps := flag.String("file-ops", fileOpsOwner, "Who may delete, rename, replace and create folders, over /api/files, WebDAV, SFTP or by uploading: owner (the client that uploaded a file), any, or off")
+	trash := flag.String("trash", "", "Move deleted files into this folder in the upload directory instead of removing them, e.g. .trash")
+	extractMaxSize := byteSize(1 << 30)
+	flag.Var(&extractMaxSize, "extract-max-size", "Most bytes one archive may unpack to when extraction is requested (0 = unlimited)")
+	extractMaxFiles := flag.Int("extract-max-files", 10000, "Most entries one archive may hold when extraction is requested (0 = unlimited)")
+	indexContent := flag.Bool("index-content", false, "Also index the text of .txt, .md and .pdf files and pasted snippets for search")
+	stripMetadata := flag.Bool("strip-metadata", false, "Remove EXIF, XMP and IPTC metadata (GPS position, camera serials) from JPEG, PNG and WebP uploads")
+	relay := flag.Bool("relay", false, "Allow files to be relayed from one client straight to another without being stored, scanned or checked")
+	relayTimeout := flag.Duration("relay-timeout", 10*time.Minute, "How long a relay waits for its sender and receiver to both arrive")
+	storageCfg := addStorageFlags(flag.CommandLine)
 	flag.Parse()
 
+	switch *fileOps {
+	case fileOpsOwner, fileOpsAny, fileOpsOff:
+	default:
+		log.Fatalf("Invalid --file-ops %q: must be owner, any or off", *fileOps)
+	}
+
 	// Ensure upload directory exists
 	if err := os.MkdirAll(*uploadDir, 0755); err != nil {
 		log.Fatalf("Failed to create upload directory: %v", err)
 	}
 
-	// Define handlers
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != "/" {
-			http.NotFound(w, r)
-			return
-		}
-		w.Header().Set("Content-Type", "text/html")
-		fmt.Fprint(w, htmlTemplate)
+	store, err := storageCfg.open(*uploadDir)
+	if err != nil {
+		log.Fatalf("Failed to set up storage: %v", err)
+	}
+	trashDir, _, err := resolveUploadPath(*uploadDir, *trash)
+	if err != nil {
+		log.Fatalf("Invalid --trash: %v", err)
+	}
+
+	quota, err := loadQuotaStore(filepath.Join(stateDir(*uploadDir), "quota.json"), quotaLimits{
+		TotalBytes:     int64(quotaTotal),
+		PerClientBytes: int64(quotaPerIP),
+		MaxFileSize:    int64(maxFileSize),
+		MaxFiles:       *maxFiles,
+		PerClientFiles: *maxFilesPerIP,
 	})
+	if err != nil {
+		log.Fatalf("Failed to load quota usage: %v", err)
+	}
 
-	http.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
+	retention, err := loadRetentionStore(filepath.Join(stateDir(*uploadDir), "retention.json"))
+	if err != nil {
+		log.Fatalf("Failed to load retention data: %v", err)
+	}
+	meta, err := loadMetaStore(filepath.Join(stateDir(*uploadDir), "metadata.json"))
+	if err != nil {
+		log.Fatalf("Failed to load file metadata: %v", err)
+	}
+	// Thumbnails and indexed text would be readable copies of encrypted
+	// files, so neither is kept when encryption is on.
+	encrypted := storageEncrypted(store)
+	if encrypted && *indexContent {
+		log.Printf("Ignoring --index-content: the search index cannot hold file contents when files are encrypted")
+		*indexContent = false
+	}
+	index, err := loadSearchIndex(filepath.Join(stateDir(*uploadDir), "search.json"), store, meta, *indexContent)
+	if err != nil {
+		log.Fatalf("Failed to load search index: %v", err)
+	}
+	var thumbs *thumbCache
+	if encrypted {
+		os.RemoveAll(filepath.Join(stateDir(*uploadDir), "thumbs"))
+	} else if thumbs, err = loadThumbCache(filepath.Join(stateDir(*uploadDir), "thumbs"), store); err != nil {
+		log.Fatalf("Failed to load thumbnails: %v", err)
+	}
+	shares, err := loadShareStore(stateDir(*uploadDir))
+	if err != nil {
+		log.Fatalf("Failed to load share links: %v", err)
+	}
+	j := &janitor{
+		files:  store,
+		policy: retentionPolicy{MaxAge: *maxAge, MaxTotal: int64(maxTotal)},
+		store:  retention,
+		quota:  quota,
+		meta:   meta,
+		index:  index,
+		thumbs: thumbs,
+		shares: shares,
+	}
+	go j.run(*janitorInterval)
 
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	dropBoxes, err := loadDropBoxStore(filepath.Join(stateDir(*uploadDir), "dropboxes.json"))
+	if err != nil {
+		log.Fatalf("Failed to load drop boxes: %v", err)
+	}
 
-			return
-		}
+	audit, err := newAuditLog(filepath.Join(stateDir(*uploadDir), "audit.log"))
+	if err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
 
-		// Parse multipart form data (32MB max memory)
-		if err := r.ParseMultipartForm(32 << 20); err != nil {
-			http.Error(w, "Failed to parse form: "+err.Error(), http.StatusBadRequest)
-			return
+	u := &uploader{
+		uploadDir: *uploadDir,
+		store:     store,
+		quota:     quota,
+		retention: retention,
+		meta:      meta,
+		index:     index,
+		dropBoxes: dropBoxes,
+		types: typePolicy{
+			AllowExt:  splitList(*allowExt),
+			DenyExt:   splitList(*denyExt),
+			AllowType: splitList(*allowType),
+			DenyType:  splitList(*denyType),
+		},
+		audit:         audit,
+		quarantineDir: *quarantineDir,
+		stripMetadata: *stripMetadata,
+	}
+	u.extract = &extractor{u: u, j: j, limits: extractLimits{MaxBytes: int64(extractMaxSize), MaxFiles: *extractMaxFiles}}
+	u.files = &fileManager{u: u, j: j, mode: *fileOps, trash: trashDir}
+	if u.quarantineDir == "" {
+		u.quarantineDir = filepath.Join(stateDir(*uploadDir), "quarantine")
+	}
+	if *onUpload != "" || *webhookURL != "" {
+		if *webhookURL != "" && *webhookSecret == "" {
+			log.Fatal("--webhook requires --webhook-secret or $NOSTROMO_WEBHOOK_SECRET")
 		}
-
-		// Get the file from the form data
-		file, header, err := r.FormFile("file")
-		if err != nil {
-
-			http.Error(w, "Failed to get file: "+err.Error(), http.StatusBadRequest)
-			return
-
+		u.hooks = &hookRunner{
+			uploadDir:      *uploadDir,
+			store:          store,
+			audit:          audit,
+			command:        *onUpload,
+			commandTimeout: *hookTimeout,
+			webhookURL:     *webhookURL,
+			webhookSecret:  []byte(*webhookSecret),
+			webhookRetries: *webhookRetries,
+			deadLetterPath: filepath.Join(stateDir(*uploadDir), "webhook-deadletter.jsonl"),
+			client:         &http.Client{Timeout: 30 * time.Second},
 		}
-		defer file.Close()
-
-		// Create a new file in the upload directory
-		filename := header.Filename
-
-		out, err := os.Create(filepath.Join(*uploadDir, filename))
-
+	}
+	if *forwardTo != "" {
+		fwd, err := newForwarder(*forwardTo, *uploadDir, store)
 		if err != nil {
-			http.Error(w, "Failed to create file: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer out.Close()
-
-		// Add a small delay to simulate processing for very small files
-		if header.Size < 10000 { // If less than 10KB
-			time.Sleep(time.Millisecond * 500)
+			log.Fatalf("Failed to set up forwarding: %v", err)
 		}
-
-
-		// Copy the file data
-		_, err = io.Copy(out, file)
+		fwd.audit = audit
+		fwd.deleteAfter = *forwardDelete
+		fwd.forget = j.forget
+		u.forward = fwd
+		go fwd.run()
+	}
+	if *clamdAddr != "" {
+		clamd, err := newClamdScanner(*clamdAddr, *clamdTimeout)
 		if err != nil {
+			log.Fatalf("Invalid --clamd: %v", err)
+		}
+		u.scanner = clamd
+	}
 
-			http.Error(w, "Failed to save file: "+err.Error(), http.StatusInternalServerError)
+	// Define handlers
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
 			return
 		}
-
-		log.Printf("Saved file: %s (%d bytes) to %s", filename, header.Size, *uploadDir)
-		fmt.Fprintf(w, "File uploaded successfully")
-
+		renderUI(w, uiConfig{UploadURL: "/upload", FileOps: *fileOps != fileOpsOff, Trash: trashDir != "", Relay: *relay})
 	})
 
+	http.HandleFunc("/upload", u.handleUpload)
+	http.HandleFunc("/upload/", u.handlePut)
+	http.HandleFunc("/api/paste", u.handlePaste)
+	http.HandleFunc("/p/", u.handlePasteView)
+
+	http.HandleFunc("/api/shares", handleShares(shares, store, *uploadDir))
+	http.HandleFunc("/api/shares/", handleShares(shares, store, *uploadDir))
+	http.HandleFunc("/s/", handleShareDownload(shares, store, *uploadDir))
+	http.HandleFunc("/api/dropboxes", handleDropBoxes(dropBoxes, *uploadDir))
+	http.HandleFunc("/api/dropboxes/", handleDropBoxes(dropBoxes, *uploadDir))
+	http.HandleFunc("/drop/", handleDropBox(dropBoxes, u))
+	http.HandleFunc("/api/archive", handleArchive(store, *uploadDir))
+	http.HandleFunc("/api/search", handleSearch(index))
+	sessions := newSessionRegistry(store, audit)
+	http.HandleFunc("/api/sessions", sessions.handleSessions(*uploadDir))
+	http.HandleFunc("/api/sessions/", sessions.handleSessions(*uploadDir))
+	if *relay {
+		relays := newRelayHub(*relayTimeout)
+		http.HandleFunc("/api/relay", relays.handleRelay)
+		http.HandleFunc("/api/relay/", relays.handleRelay)
+		http.HandleFunc("/r/", relays.handleRelayReceive)
+	}
+	http.HandleFunc("/api/preview/", handlePreview(store, *uploadDir))
+	http.HandleFunc("/api/thumbs/", handleThumbs(thumbs, *uploadDir))
+	http.HandleFunc("/e2e", handleE2EPage)
+	if d, ok := store.(*dedupStorage); ok {
+		http.HandleFunc("/api/blobs/", handleBlobs(d))
+	}
+	http.HandleFunc("/api/files/", handleFiles(u.files))
+	if sftp.addr != "" {
+		if err := startSFTP(sftp, u, j); err != nil {
+			log.Fatalf("Failed to start SFTP server: %v", err)
+		}
+	}
+
+	dav := handleDAV(u, j)
+	http.HandleFunc("/dav", dav)
+	http.HandleFunc("/dav/", dav)
 
 	// Print server information
 	printServerInfo(*port, *uploadDir)
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	for _, name := range []string{"", ".", "..", "/", ".nostromo", ".NOSTROMO", "x/.Nostromo", `a\.NoStRoMo`, ".nostromo."} {
+		if got, err := sanitizeFilename(name); err == nil {
+			t.Errorf("sanitizeFilename(%q) = %q", name, got)
+		}
+	}
+	for name, want := range map[string]string{
+		"report.pdf":         "report.pdf",
+		"../../etc/passwd":   "passwd",
+		`C:\Users\a\b.txt`:   "b.txt",
+		".nostromo-notes.md": ".nostromo-notes.md",
+	} {
+		if got, err := sanitizeFilename(name); err != nil || got != want {
+			t.Errorf("sanitizeFilename(%q) = %q, %v", name, got, err)
+		}
+	}
+}
+
+func TestUniqueSaveNeverOverwrites(t *testing.T) {
+	m := newTestFileManager(t, fileOpsAny, "")
+	// Both uploads picked the free name before either was stored, as two
+	// drop box uploads of the same file arriving together do.
+	var stored []string
+	for _, content := range []string{"first", "second"} {
+		ev, err := m.u.save("10.0.0.1", "box/a.txt", strings.NewReader(content), int64(len(content)), saveOptions{createOnly: true, unique: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored = append(stored, ev.Path)
+	}
+	if stored[0] != "box/a.txt" || stored[1] != "box/a (1).txt" {
+		t.Fatalf("stored as %v", stored)
+	}
+	if got := readStored(t, m, "box/a.txt"); got != "first" {
+		t.Errorf("box/a.txt = %q", got)
+	}
+	if owner, ok := m.u.quota.owner("box/a (1).txt"); !ok || owner != "10.0.0.1" {
+		t.Errorf("quota not recorded under the new name: %q, %v", owner, ok)
+	}
+
+	// Without unique, create-only still refuses.
+	if _, err := m.u.save("10.0.0.1", "box/a.txt", strings.NewReader("third"), 5, saveOptions{createOnly: true}); err != errExists {
+		t.Errorf("create-only over an existing file: %v", err)
+	}
+}
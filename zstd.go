@@ -0,0 +1,965 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// zstdWriter writes a Zstandard frame (RFC 8878) made of raw blocks. There
+// is no zstd encoder in the standard library, so the data is stored rather
+// than compressed, but the output is a valid .zst stream that any zstd
+// decoder accepts and checks against the frame's content checksum.
+type zstdWriter struct {
+	w       io.Writer
+	buf     []byte
+	sum     xxhash64
+	started bool
+	err     error
+}
+
+const zstdBlockSize = 128 << 10
+
+func newZstdWriter(w io.Writer) *zstdWriter {
+	return &zstdWriter{w: w, buf: make([]byte, 0, zstdBlockSize), sum: newXXHash64()}
+}
+
+func (z *zstdWriter) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		if len(z.buf) == zstdBlockSize {
+			if err := z.flushBlock(false); err != nil {
+				return 0, err
+			}
+		}
+		c := copy(z.buf[len(z.buf):zstdBlockSize], p)
+		z.buf = z.buf[:len(z.buf)+c]
+		p = p[c:]
+	}
+	return n, nil
+}
+
+// flushBlock writes the buffered data as one raw block, preceded by the
+// frame header if this is the first.
+func (z *zstdWriter) flushBlock(last bool) error {
+	var out []byte
+	if !z.started {
+		// Magic number, a descriptor with only the checksum flag set, and
+		// a 128KB window so every raw block fits.
+		out = append(out, 0x28, 0xb5, 0x2f, 0xfd, 0x04, 0x38)
+		z.started = true
+	}
+	header := uint32(len(z.buf)) << 3
+	if last {
+		header |= 1
+	}
+	out = append(out, byte(header), byte(header>>8), byte(header>>16))
+	if _, err := z.w.Write(out); err != nil {
+		z.err = err
+		return err
+	}
+	if _, err := z.w.Write(z.buf); err != nil {
+		z.err = err
+		return err
+	}
+	z.sum.Write(z.buf)
+	z.buf = z.buf[:0]
+	return nil
+}
+
+// Close ends the frame with the last block and the content checksum. It
+// does not close the underlying writer.
+func (z *zstdWriter) Close() error {
+	if z.err != nil {
+		return z.err
+	}
+	if err := z.flushBlock(true); err != nil {
+		return err
+	}
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], uint32(z.sum.Sum64()))
+	_, z.err = z.w.Write(sum[:])
+	return z.err
+}
+
+// xxhash64 is the XXH64 hash with a zero seed, which zstd uses for its
+// content checksum.
+type xxhash64 struct {
+	v     [4]uint64
+	total uint64
+	mem   [32]byte
+	n     int
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func newXXHash64() xxhash64 {
+	// The lanes start at xxPrime1+xxPrime2, xxPrime2, 0 and -xxPrime1,
+	// wrapped to 64 bits.
+	return xxhash64{v: [4]uint64{6983438078262162902, xxPrime2, 0, 7046029288634856825}}
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	return bits.RotateLeft64(acc, 31) * xxPrime1
+}
+
+func xxMerge(acc, v uint64) uint64 {
+	acc ^= xxRound(0, v)
+	return acc*xxPrime1 + xxPrime4
+}
+
+func (x *xxhash64) Write(p []byte) {
+	x.total += uint64(len(p))
+	if x.n > 0 {
+		c := copy(x.mem[x.n:], p)
+		x.n += c
+		p = p[c:]
+		if x.n < 32 {
+			return
+		}
+		x.stripe(x.mem[:])
+		x.n = 0
+	}
+	for len(p) >= 32 {
+		x.stripe(p[:32])
+		p = p[32:]
+	}
+	x.n = copy(x.mem[:], p)
+}
+
+func (x *xxhash64) stripe(b []byte) {
+	for i := range x.v {
+		x.v[i] = xxRound(x.v[i], binary.LittleEndian.Uint64(b[i*8:]))
+	}
+}
+
+func (x *xxhash64) Sum64() uint64 {
+	var h uint64
+	if x.total >= 32 {
+		h = bits.RotateLeft64(x.v[0], 1) + bits.RotateLeft64(x.v[1], 7) +
+			bits.RotateLeft64(x.v[2], 12) + bits.RotateLeft64(x.v[3], 18)
+		for _, v := range x.v {
+			h = xxMerge(h, v)
+		}
+	} else {
+		h = xxPrime5
+	}
+	h += x.total
+
+	b := x.mem[:x.n]
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+// zstdReader decompresses a Zstandard stream of one or more frames.
+// Dictionaries are not supported, and windows larger than zstdMaxWindow are
+// refused so a hostile stream cannot make it hold unbounded history.
+type zstdReader struct {
+	r   *bufio.Reader
+	err error
+
+	// hist holds the frame's decoded output: the window that matches may
+	// refer back into, followed by bytes Read has not returned yet.
+	hist []byte
+	pos  int
+
+	inFrame  bool
+	window   int
+	checksum bool
+	sum      xxhash64
+
+	// State carried between the blocks of a frame.
+	huff                      *huffTable
+	llTable, ofTable, mlTable *fseTable
+	rep                       [3]int
+}
+
+const zstdMaxWindow = 1 << 27
+
+var errZstdCorrupt = errors.New("zstd: corrupt stream")
+
+func newZstdReader(r io.Reader) *zstdReader {
+	return &zstdReader{r: bufio.NewReader(r)}
+}
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	for z.pos == len(z.hist) {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.err = z.next()
+	}
+	n := copy(p, z.hist[z.pos:])
+	z.pos += n
+	return n, nil
+}
+
+// next decodes the next block, starting a new frame if needed.
+func (z *zstdReader) next() error {
+	if !z.inFrame {
+		if err := z.frameHeader(); err != nil {
+			return err
+		}
+	} else if len(z.hist) > 2*z.window+zstdBlockSize {
+		// Everything has been read; keep only the window.
+		z.hist = append(z.hist[:0], z.hist[len(z.hist)-z.window:]...)
+		z.pos = len(z.hist)
+	}
+
+	var hdr [3]byte
+	if _, err := io.ReadFull(z.r, hdr[:]); err != nil {
+		return zstdEOF(err)
+	}
+	bh := uint32(hdr[0]) | uint32(hdr[1])<<8 | uint32(hdr[2])<<16
+	last, typ, size := bh&1 == 1, (bh>>1)&3, int(bh>>3)
+	start := len(z.hist)
+
+	switch typ {
+	case 0: // raw
+		if size > zstdBlockSize {
+			return errZstdCorrupt
+		}
+		z.hist = append(z.hist, make([]byte, size)...)
+		if _, err := io.ReadFull(z.r, z.hist[start:]); err != nil {
+			return zstdEOF(err)
+		}
+	case 1: // RLE
+		if size > zstdBlockSize {
+			return errZstdCorrupt
+		}
+		b, err := z.r.ReadByte()
+		if err != nil {
+			return zstdEOF(err)
+		}
+		for i := 0; i < size; i++ {
+			z.hist = append(z.hist, b)
+		}
+	case 2: // compressed
+		if size > zstdBlockSize || size > z.window {
+			return errZstdCorrupt
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(z.r, data); err != nil {
+			return zstdEOF(err)
+		}
+		if err := z.compressedBlock(data); err != nil {
+			return err
+		}
+	default:
+		return errZstdCorrupt
+	}
+	if len(z.hist)-start > zstdBlockSize {
+		return errZstdCorrupt
+	}
+	if z.checksum {
+		z.sum.Write(z.hist[start:])
+	}
+
+	if last {
+		z.inFrame = false
+		if z.checksum {
+			var sum [4]byte
+			if _, err := io.ReadFull(z.r, sum[:]); err != nil {
+				return zstdEOF(err)
+			}
+			if binary.LittleEndian.Uint32(sum[:]) != uint32(z.sum.Sum64()) {
+				return errors.New("zstd: checksum mismatch")
+			}
+		}
+	}
+	return nil
+}
+
+func zstdEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// frameHeader reads the header of the next frame, skipping skippable
+// frames. It returns io.EOF at a clean end of the stream.
+func (z *zstdReader) frameHeader() error {
+	for {
+		var magic [4]byte
+		if _, err := io.ReadFull(z.r, magic[:]); err != nil {
+			return err
+		}
+		m := binary.LittleEndian.Uint32(magic[:])
+		if m&0xfffffff0 == 0x184d2a50 {
+			if _, err := io.ReadFull(z.r, magic[:]); err != nil {
+				return zstdEOF(err)
+			}
+			if _, err := io.CopyN(io.Discard, z.r, int64(binary.LittleEndian.Uint32(magic[:]))); err != nil {
+				return zstdEOF(err)
+			}
+			continue
+		}
+		if m != 0xfd2fb528 {
+			return errors.New("zstd: not a zstd stream")
+		}
+		break
+	}
+
+	fhd, err := z.r.ReadByte()
+	if err != nil {
+		return zstdEOF(err)
+	}
+	if fhd&0x08 != 0 {
+		return errZstdCorrupt
+	}
+	single := fhd&0x20 != 0
+	window := uint64(0)
+	if !single {
+		wd, err := z.r.ReadByte()
+		if err != nil {
+			return zstdEOF(err)
+		}
+		base := uint64(1) << (10 + wd>>3)
+		window = base + base/8*uint64(wd&7)
+	}
+	if dictLen := []int{0, 1, 2, 4}[fhd&3]; dictLen > 0 {
+		dict := make([]byte, dictLen)
+		if _, err := io.ReadFull(z.r, dict); err != nil {
+			return zstdEOF(err)
+		}
+		for _, b := range dict {
+			if b != 0 {
+				return errors.New("zstd: dictionaries are not supported")
+			}
+		}
+	}
+	fcsLen := []int{0, 2, 4, 8}[fhd>>6]
+	if fcsLen == 0 && single {
+		fcsLen = 1
+	}
+	if fcsLen > 0 {
+		var b [8]byte
+		if _, err := io.ReadFull(z.r, b[:fcsLen]); err != nil {
+			return zstdEOF(err)
+		}
+		fcs := binary.LittleEndian.Uint64(b[:])
+		if fcsLen == 2 {
+			fcs += 256
+		}
+		if single {
+			window = fcs
+		}
+	}
+	if window > zstdMaxWindow {
+		return fmt.Errorf("zstd: window of %d bytes is larger than the %d allowed", window, zstdMaxWindow)
+	}
+	z.window = int(window)
+	if z.window < 1<<10 {
+		z.window = 1 << 10
+	}
+
+	z.inFrame = true
+	z.checksum = fhd&0x04 != 0
+	z.sum = newXXHash64()
+	z.hist = z.hist[:0]
+	z.pos = 0
+	z.huff = nil
+	z.llTable, z.ofTable, z.mlTable = nil, nil, nil
+	z.rep = [3]int{1, 4, 8}
+	return nil
+}
+
+// compressedBlock decodes a block of literals and sequences onto hist.
+func (z *zstdReader) compressedBlock(data []byte) error {
+	start := len(z.hist)
+	lits, n, err := z.literals(data)
+	if err != nil {
+		return err
+	}
+	data = data[n:]
+
+	if len(data) < 1 {
+		return errZstdCorrupt
+	}
+	nbSeq := int(data[0])
+	switch {
+	case nbSeq == 0:
+		z.hist = append(z.hist, lits...)
+		return nil
+	case nbSeq < 128:
+		data = data[1:]
+	case nbSeq < 255:
+		if len(data) < 2 {
+			return errZstdCorrupt
+		}
+		nbSeq = (nbSeq-128)<<8 + int(data[1])
+		data = data[2:]
+	default:
+		if len(data) < 3 {
+			return errZstdCorrupt
+		}
+		nbSeq = int(data[1]) + int(data[2])<<8 + 0x7f00
+		data = data[3:]
+	}
+
+	if len(data) < 1 || data[0]&3 != 0 {
+		return errZstdCorrupt
+	}
+	modes := data[0]
+	data = data[1:]
+	for _, t := range []struct {
+		table  **fseTable
+		mode   byte
+		def    *fseTable
+		maxSym int
+		maxLog uint
+	}{
+		{&z.llTable, modes >> 6, zstdDefaultLL, 35, 9},
+		{&z.ofTable, modes >> 4 & 3, zstdDefaultOF, 31, 8},
+		{&z.mlTable, modes >> 2 & 3, zstdDefaultML, 52, 9},
+	} {
+		switch t.mode {
+		case 0:
+			*t.table = t.def
+		case 1:
+			if len(data) < 1 || int(data[0]) > t.maxSym {
+				return errZstdCorrupt
+			}
+			*t.table = &fseTable{entries: []fseEntry{{sym: data[0]}}}
+			data = data[1:]
+		case 2:
+			table, n, err := readFSETable(data, t.maxSym, t.maxLog)
+			if err != nil {
+				return err
+			}
+			*t.table = table
+			data = data[n:]
+		case 3:
+			if *t.table == nil {
+				return errZstdCorrupt
+			}
+		}
+	}
+
+	br, err := newReverseBits(data)
+	if err != nil {
+		return err
+	}
+	ll, of, ml := z.llTable, z.ofTable, z.mlTable
+	llState := br.read(ll.log)
+	ofState := br.read(of.log)
+	mlState := br.read(ml.log)
+	for i := 0; i < nbSeq; i++ {
+		llCode := ll.entries[llState].sym
+		ofCode := of.entries[ofState].sym
+		mlCode := ml.entries[mlState].sym
+
+		ofValue := 1<<ofCode + int(br.read(uint(ofCode)))
+		matchLen := zstdMLBase[mlCode] + int(br.read(uint(zstdMLBits[mlCode])))
+		litLen := zstdLLBase[llCode] + int(br.read(uint(zstdLLBits[llCode])))
+
+		var offset int
+		if ofValue > 3 {
+			offset = ofValue - 3
+			z.rep = [3]int{offset, z.rep[0], z.rep[1]}
+		} else {
+			if litLen == 0 {
+				ofValue++
+			}
+			switch ofValue {
+			case 1:
+				offset = z.rep[0]
+			case 2:
+				offset = z.rep[1]
+				z.rep = [3]int{offset, z.rep[0], z.rep[2]}
+			case 3:
+				offset = z.rep[2]
+				z.rep = [3]int{offset, z.rep[0], z.rep[1]}
+			case 4:
+				offset = z.rep[0] - 1
+				z.rep = [3]int{offset, z.rep[0], z.rep[1]}
+			}
+		}
+
+		if litLen > len(lits) {
+			return errZstdCorrupt
+		}
+		z.hist = append(z.hist, lits[:litLen]...)
+		lits = lits[litLen:]
+		if offset <= 0 || offset > len(z.hist) || offset > z.window || len(z.hist)+matchLen-start > zstdBlockSize {
+			return errZstdCorrupt
+		}
+		from := len(z.hist) - offset
+		if offset >= matchLen {
+			z.hist = append(z.hist, z.hist[from:from+matchLen]...)
+		} else {
+			for k := 0; k < matchLen; k++ {
+				z.hist = append(z.hist, z.hist[from+k])
+			}
+		}
+
+		if i < nbSeq-1 {
+			e := ll.entries[llState]
+			llState = uint64(e.base) + br.read(uint(e.nb))
+			e = ml.entries[mlState]
+			mlState = uint64(e.base) + br.read(uint(e.nb))
+			e = of.entries[ofState]
+			ofState = uint64(e.base) + br.read(uint(e.nb))
+		}
+	}
+	if br.p != 0 {
+		return errZstdCorrupt
+	}
+	z.hist = append(z.hist, lits...)
+	return nil
+}
+
+// literals decodes the literals section at the start of a compressed
+// block, returning the literals and the length of the section.
+func (z *zstdReader) literals(data []byte) ([]byte, int, error) {
+	if len(data) < 1 {
+		return nil, 0, errZstdCorrupt
+	}
+	// Headers are up to five bytes; read them from a padded copy and check
+	// the sizes they give against the real data.
+	h := data
+	if len(h) < 5 {
+		h = append(make([]byte, 0, 5), data...)
+		h = h[:5]
+	}
+	typ, format := h[0]&3, h[0]>>2&3
+
+	if typ < 2 {
+		var size, hl int
+		switch format {
+		case 0, 2:
+			size, hl = int(h[0]>>3), 1
+		case 1:
+			size, hl = int(h[0]>>4)+int(h[1])<<4, 2
+		case 3:
+			size, hl = int(h[0]>>4)+int(h[1])<<4+int(h[2])<<12, 3
+		}
+		if size > zstdBlockSize {
+			return nil, 0, errZstdCorrupt
+		}
+		if typ == 0 {
+			if hl+size > len(data) {
+				return nil, 0, errZstdCorrupt
+			}
+			return data[hl : hl+size], hl + size, nil
+		}
+		if hl >= len(data) {
+			return nil, 0, errZstdCorrupt
+		}
+		lits := make([]byte, size)
+		for i := range lits {
+			lits[i] = data[hl]
+		}
+		return lits, hl + 1, nil
+	}
+
+	var size, compressed, hl int
+	streams := 4
+	switch format {
+	case 0, 1:
+		v := int(h[0]) | int(h[1])<<8 | int(h[2])<<16
+		size, compressed, hl = v>>4&0x3ff, v>>14&0x3ff, 3
+		if format == 0 {
+			streams = 1
+		}
+	case 2:
+		v := int(binary.LittleEndian.Uint32(h))
+		size, compressed, hl = v>>4&0x3fff, v>>18&0x3fff, 4
+	case 3:
+		v := int(binary.LittleEndian.Uint32(h)) | int(h[4])<<32
+		size, compressed, hl = v>>4&0x3ffff, v>>22&0x3ffff, 5
+	}
+	if size > zstdBlockSize || hl+compressed > len(data) {
+		return nil, 0, errZstdCorrupt
+	}
+	body := data[hl : hl+compressed]
+	if typ == 2 {
+		table, n, err := readHuffTable(body)
+		if err != nil {
+			return nil, 0, err
+		}
+		z.huff = table
+		body = body[n:]
+	} else if z.huff == nil {
+		return nil, 0, errZstdCorrupt
+	}
+
+	lits := make([]byte, 0, size)
+	if streams == 1 {
+		out, err := z.huff.decode(lits, body, size)
+		return out, hl + compressed, err
+	}
+	if len(body) < 6 {
+		return nil, 0, errZstdCorrupt
+	}
+	sizes := [4]int{int(binary.LittleEndian.Uint16(body)), int(binary.LittleEndian.Uint16(body[2:])), int(binary.LittleEndian.Uint16(body[4:]))}
+	sizes[3] = len(body) - 6 - sizes[0] - sizes[1] - sizes[2]
+	segment := (size + 3) / 4
+	if sizes[3] < 0 || size-3*segment < 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	body = body[6:]
+	for i, n := range sizes {
+		count := segment
+		if i == 3 {
+			count = size - 3*segment
+		}
+		var err error
+		if lits, err = z.huff.decode(lits, body[:n], count); err != nil {
+			return nil, 0, err
+		}
+		body = body[n:]
+	}
+	return lits, hl + compressed, nil
+}
+
+// huffTable decodes Huffman-coded literals by looking up the next maxBits
+// bits of the stream.
+type huffTable struct {
+	maxBits uint
+	entries []huffEntry
+}
+
+type huffEntry struct {
+	sym byte
+	nb  uint8
+}
+
+// readHuffTable reads a Huffman tree description, returning the table and
+// the number of bytes it took.
+func readHuffTable(data []byte) (*huffTable, int, error) {
+	if len(data) < 1 {
+		return nil, 0, errZstdCorrupt
+	}
+	var weights []byte
+	n := 1
+	if hdr := int(data[0]); hdr < 128 {
+		// Weights compressed with FSE, decoded with two interleaved states.
+		if 1+hdr > len(data) {
+			return nil, 0, errZstdCorrupt
+		}
+		src := data[1 : 1+hdr]
+		table, used, err := readFSETable(src, 255, 6)
+		if err != nil {
+			return nil, 0, err
+		}
+		br, err := newReverseBits(src[used:])
+		if err != nil {
+			return nil, 0, err
+		}
+		s1, s2 := br.read(table.log), br.read(table.log)
+		for len(weights) < 255 {
+			weights = append(weights, table.entries[s1].sym)
+			s1 = table.next(s1, br)
+			if br.p < 0 {
+				weights = append(weights, table.entries[s2].sym)
+				break
+			}
+			weights = append(weights, table.entries[s2].sym)
+			s2 = table.next(s2, br)
+			if br.p < 0 {
+				weights = append(weights, table.entries[s1].sym)
+				break
+			}
+		}
+		if br.p >= 0 || len(weights) > 255 {
+			return nil, 0, errZstdCorrupt
+		}
+		n += hdr
+	} else {
+		count := hdr - 127
+		n += (count + 1) / 2
+		if n > len(data) {
+			return nil, 0, errZstdCorrupt
+		}
+		for i := 0; i < count; i++ {
+			b := data[1+i/2]
+			if i%2 == 0 {
+				b >>= 4
+			}
+			weights = append(weights, b&15)
+		}
+	}
+
+	// The last symbol's weight is implied: it brings the total up to the
+	// next power of two.
+	total := 0
+	for _, w := range weights {
+		if w > 11 {
+			return nil, 0, errZstdCorrupt
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	maxBits := uint(bits.Len(uint(total)))
+	rest := 1<<maxBits - total
+	if maxBits > 11 || rest&(rest-1) != 0 {
+		return nil, 0, errZstdCorrupt
+	}
+	weights = append(weights, byte(bits.Len(uint(rest))))
+
+	t := &huffTable{maxBits: maxBits, entries: make([]huffEntry, 0, 1<<maxBits)}
+	for w := byte(1); w <= byte(maxBits); w++ {
+		for sym, sw := range weights {
+			if sw != w {
+				continue
+			}
+			e := huffEntry{sym: byte(sym), nb: uint8(maxBits + 1 - uint(w))}
+			for i := 0; i < 1<<(w-1); i++ {
+				t.entries = append(t.entries, e)
+			}
+		}
+	}
+	return t, n, nil
+}
+
+// decode appends count literals decoded from one Huffman stream.
+func (t *huffTable) decode(out, data []byte, count int) ([]byte, error) {
+	br, err := newReverseBits(data)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < count; i++ {
+		e := t.entries[br.peek(t.maxBits)]
+		out = append(out, e.sym)
+		br.p -= int(e.nb)
+	}
+	if br.p != 0 {
+		return nil, errZstdCorrupt
+	}
+	return out, nil
+}
+
+// fseTable is a finite state entropy decoding table.
+type fseTable struct {
+	log     uint
+	entries []fseEntry
+}
+
+type fseEntry struct {
+	sym  uint8
+	nb   uint8
+	base uint16
+}
+
+func (t *fseTable) next(state uint64, br *reverseBits) uint64 {
+	e := t.entries[state]
+	return uint64(e.base) + br.read(uint(e.nb))
+}
+
+// readFSETable reads an FSE table description, returning the table and
+// the number of bytes it took.
+func readFSETable(data []byte, maxSym int, maxLog uint) (*fseTable, int, error) {
+	pos := 0
+	read := func(n int) int {
+		v := int(loadLE64(data, pos>>3) >> (pos & 7) & (1<<n - 1))
+		pos += n
+		return v
+	}
+	log := uint(read(4)) + 5
+	if log > maxLog {
+		return nil, 0, errZstdCorrupt
+	}
+	var norm []int16
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	nbBits := int(log) + 1
+	for remaining > 1 && len(norm) <= maxSym {
+		max := 2*threshold - 1 - remaining
+		var count int
+		if v := int(loadLE64(data, pos>>3) >> (pos & 7)); v&(threshold-1) < max {
+			count = v & (threshold - 1)
+			pos += nbBits - 1
+		} else {
+			count = v & (2*threshold - 1)
+			if count >= threshold {
+				count -= max
+			}
+			pos += nbBits
+		}
+		count--
+		if count < 0 {
+			remaining--
+		} else {
+			remaining -= count
+		}
+		norm = append(norm, int16(count))
+		if count == 0 {
+			for {
+				repeat := read(2)
+				for i := 0; i < repeat; i++ {
+					norm = append(norm, 0)
+				}
+				if repeat != 3 {
+					break
+				}
+			}
+		}
+		for remaining < threshold && threshold > 1 {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	used := (pos + 7) / 8
+	if remaining != 1 || len(norm) > maxSym+1 || used > len(data) {
+		return nil, 0, errZstdCorrupt
+	}
+	t, err := buildFSETable(norm, log)
+	return t, used, err
+}
+
+// buildFSETable spreads symbols over the table according to their
+// normalized counts, as RFC 8878 section 4.1.1 describes.
+func buildFSETable(norm []int16, log uint) (*fseTable, error) {
+	size := 1 << log
+	t := &fseTable{log: log, entries: make([]fseEntry, size)}
+	next := make([]int, len(norm))
+	high := size - 1
+	for s, c := range norm {
+		if c == -1 {
+			t.entries[high].sym = uint8(s)
+			high--
+			next[s] = 1
+		} else {
+			next[s] = int(c)
+		}
+	}
+	step := size>>1 + size>>3 + 3
+	pos := 0
+	for s, c := range norm {
+		for i := 0; i < int(c); i++ {
+			t.entries[pos].sym = uint8(s)
+			for pos = (pos + step) & (size - 1); pos > high; pos = (pos + step) & (size - 1) {
+			}
+		}
+	}
+	if pos != 0 {
+		return nil, errZstdCorrupt
+	}
+	for i := range t.entries {
+		e := &t.entries[i]
+		state := next[e.sym]
+		next[e.sym]++
+		nb := int(log) + 1 - bits.Len(uint(state))
+		e.nb = uint8(nb)
+		e.base = uint16(state<<nb - size)
+	}
+	return t, nil
+}
+
+// Predefined distributions and code tables from RFC 8878 section 3.1.1.3.2.
+var (
+	zstdDefaultLL = mustFSETable([]int16{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1}, 6)
+	zstdDefaultML = mustFSETable([]int16{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, -1, -1, -1, -1, -1, -1, -1}, 6)
+	zstdDefaultOF = mustFSETable([]int16{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}, 5)
+
+	zstdLLBase = [36]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536}
+	zstdLLBits = [36]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	zstdMLBase = [53]int{3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539}
+	zstdMLBits = [53]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+)
+
+func mustFSETable(norm []int16, log uint) *fseTable {
+	t, err := buildFSETable(norm, log)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// reverseBits reads a zstd backward bitstream: it starts at the highest set
+// bit of the last byte and is consumed towards the first byte. p is the
+// number of bits left; it goes negative if a reader runs past the start.
+type reverseBits struct {
+	data []byte
+	p    int
+}
+
+func newReverseBits(data []byte) (*reverseBits, error) {
+	if len(data) == 0 || data[len(data)-1] == 0 {
+		return nil, errZstdCorrupt
+	}
+	return &reverseBits{data: data, p: (len(data)-1)*8 + bits.Len8(data[len(data)-1]) - 1}, nil
+}
+
+// peek returns the next n bits without consuming them, padding with zeros
+// past the start of the stream.
+func (b *reverseBits) peek(n uint) uint64 {
+	if n == 0 {
+		return 0
+	}
+	start := b.p - int(n)
+	if b.p <= 0 {
+		return 0
+	}
+	if start < 0 {
+		return (loadLE64(b.data, 0) & (1<<(n-uint(-start)) - 1)) << uint(-start)
+	}
+	return loadLE64(b.data, start>>3) >> (start & 7) & (1<<n - 1)
+}
+
+func (b *reverseBits) read(n uint) uint64 {
+	v := b.peek(n)
+	b.p -= int(n)
+	return v
+}
+
+// loadLE64 reads eight little-endian bytes at i, as zeros past the end.
+func loadLE64(data []byte, i int) uint64 {
+	if i+8 <= len(data) {
+		return binary.LittleEndian.Uint64(data[i:])
+	}
+	var b [8]byte
+	if i < len(data) {
+		copy(b[:], data[i:])
+	}
+	return binary.LittleEndian.Uint64(b[:])
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// zstdVector is zstdVectorText compressed by the zstd tool at level 19
+// with a checksum, so it has Huffman-coded literals and FSE sequences.
+const zstdVector = "KLUv/WQgDM0EAIKHGBhwqw4ACkwkRr5L09yD8Ldt2+6DV/qvIAIRPtfYUgmtCJ9rbKmEVITPNbZUQinC5xpbKgHCbH6VPe3CPOFfy82ROtOWxwOlaVm8Ofm87fBxaheksnJmuJvLxgeETrn+mU0EKagRgFv/s2bgdwMROAQO4f//M34GAAEAAAZ4ABAAADiADwABAIAD+AAQAADgBLsCRWBVAd/qSoU="
+
+func zstdVectorText() string {
+	var b strings.Builder
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&b, "Crew log %02d: Nostromo holding course for Earth, cargo 20000000 tons of mineral ore.\n", i)
+	}
+	return b.String()
+}
+
+func TestXXHash64(t *testing.T) {
+	for s, want := range map[string]uint64{
+		"":    0xef46db3751d8e999,
+		"abc": 0x44bc2cf5ad770999,
+	} {
+		x := newXXHash64()
+		x.Write([]byte(s))
+		if got := x.Sum64(); got != want {
+			t.Errorf("XXH64(%q) = %x, want %x", s, got, want)
+		}
+	}
+
+	// Writing in pieces gives the same sum as writing at once.
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	whole := newXXHash64()
+	whole.Write(data)
+	pieces := newXXHash64()
+	for _, n := range []int{1, 31, 32, 33, 100, 803} {
+		pieces.Write(data[:n])
+		data = data[n:]
+	}
+	if whole.Sum64() != pieces.Sum64() {
+		t.Error("sum depends on how the input is split")
+	}
+}
+
+func TestZstdDecodeVector(t *testing.T) {
+	frame, err := base64.StdEncoding.DecodeString(zstdVector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(newZstdReader(bytes.NewReader(frame)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != zstdVectorText() {
+		t.Fatalf("decoded %d bytes that differ from the original", len(got))
+	}
+
+	// A damaged checksum and a cut-off frame are both errors.
+	bad := append([]byte(nil), frame...)
+	bad[len(bad)-1] ^= 1
+	if _, err := io.ReadAll(newZstdReader(bytes.NewReader(bad))); err == nil {
+		t.Error("checksum mismatch not detected")
+	}
+	if _, err := io.ReadAll(newZstdReader(bytes.NewReader(frame[:len(frame)-10]))); err == nil {
+		t.Error("truncated frame decoded")
+	}
+}
+
+func TestZstdRoundTrip(t *testing.T) {
+	random := make([]byte, 3*zstdBlockSize+17)
+	rand.New(rand.NewSource(1)).Read(random)
+	for _, n := range []int{0, 1, zstdBlockSize, zstdBlockSize + 1, len(random)} {
+		var buf bytes.Buffer
+		w := newZstdWriter(&buf)
+		// Uneven writes, so blocks are filled across several calls.
+		for p := random[:n]; len(p) > 0; {
+			c := len(p)
+			if c > 50000 {
+				c = 50000
+			}
+			if _, err := w.Write(p[:c]); err != nil {
+				t.Fatal(err)
+			}
+			p = p[c:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(newZstdReader(&buf))
+		if err != nil || !bytes.Equal(got, random[:n]) {
+			t.Errorf("%d bytes: got %d bytes back, %v", n, len(got), err)
+		}
+	}
+
+	// Concatenated frames decode as one stream.
+	var buf bytes.Buffer
+	for _, s := range []string{"first ", "second"} {
+		w := newZstdWriter(&buf)
+		io.WriteString(w, s)
+		w.Close()
+	}
+	got, err := io.ReadAll(newZstdReader(&buf))
+	if err != nil || string(got) != "first second" {
+		t.Errorf("concatenated frames: %q, %v", got, err)
+	}
+}